@@ -0,0 +1,374 @@
+// Package client talks to the HTTP API of package server. Client has the
+// methods of wallet.Service that the API serves and returns the same records
+// and errors, so code written against Wallet works with an embedded service
+// and a remote one alike.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/server"
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/Tursunkhuja/wallet/pkg/wallet"
+)
+
+// Wallet is implemented by *wallet.Service and *Client
+type Wallet interface {
+	RegisterAccount(phone types.Phone) (*types.Account, error)
+	RegisterAccountInCurrency(phone types.Phone, currency types.Currency) (*types.Account, error)
+	FindAccountByID(accountID int64) (*types.Account, error)
+	Deposit(accountID int64, amount types.Money) error
+	DepositIdempotent(key string, accountID int64, amount types.Money) error
+	Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error)
+	PayIdempotent(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error)
+	Transfer(fromID int64, toID int64, amount types.Money) (*types.Payment, error)
+	TransferIdempotent(key string, fromID int64, toID int64, amount types.Money) (*types.Payment, error)
+	FindPaymentByID(paymentID string) (*types.Payment, error)
+	Reject(paymentID string) error
+	Repeat(paymentID string) (*types.Payment, error)
+	Refund(paymentID string, amount types.Money) (*types.Payment, error)
+	RefundIdempotent(key string, paymentID string, amount types.Money) (*types.Payment, error)
+	Refunds(paymentID string) ([]types.Payment, error)
+	Authorize(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Hold, error)
+	Capture(holdID string, amount types.Money) (*types.Payment, error)
+	Void(holdID string) error
+	FindHoldByID(holdID string) (*types.Hold, error)
+	FindHoldsByAccountID(accountID int64) ([]types.Hold, error)
+	AccountBalance(accountID int64) (*types.AccountBalance, error)
+	FavoritePayment(paymentID string, name string) (*types.Favorite, error)
+	FindFavoriteByID(favoriteID string) (*types.Favorite, error)
+	FindFavoritesByAccountID(accountID int64) ([]types.Favorite, error)
+	PayFromFavorite(favoriteID string) (*types.Payment, error)
+	PayFromFavoriteIdempotent(key string, favoriteID string) (*types.Payment, error)
+	ExportAccountHistory(accountID int64) ([]types.Payment, error)
+}
+
+var (
+	_ Wallet = (*wallet.Service)(nil)
+	_ Wallet = (*Client)(nil)
+)
+
+// DefaultTimeout limits a request of a client made without WithHTTPClient
+const DefaultTimeout = 30 * time.Second
+
+// ResponseError is a failed request whose error is not one of the wallet
+// package, e.g. a bad request or an internal error of the server
+type ResponseError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("wallet server: %v %v: %v", e.StatusCode, e.Code, e.Message)
+}
+
+// Client is a wallet on the other side of the HTTP API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// Option configures a Client created by New.
+type Option func(c *Client)
+
+// WithHTTPClient replaces the http.Client of the requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// New creates a client of the server at baseURL, e.g. http://localhost:8080
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: DefaultTimeout},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// do sends the request and decodes the response into result, if it's not nil.
+// An error response is turned back into the error of the wallet package.
+func (c *Client) do(method string, path string, key string, request interface{}, result interface{}) error {
+	var body io.Reader
+	if request != nil {
+		content, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(content)
+	}
+
+	httpRequest, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+	if key != "" {
+		httpRequest.Header.Set(server.IdempotencyKeyHeader, key)
+	}
+
+	response, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return responseError(response)
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.NewDecoder(response.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("wallet server: bad response: %w", err)
+	}
+	return nil
+}
+
+func responseError(response *http.Response) error {
+	body := server.ErrorResponse{}
+	err := json.NewDecoder(response.Body).Decode(&body)
+	if err != nil {
+		return &ResponseError{StatusCode: response.StatusCode, Message: response.Status}
+	}
+	known := server.ErrorFromCode(body.Code)
+	if known != nil {
+		return known
+	}
+	return &ResponseError{StatusCode: response.StatusCode, Code: body.Code, Message: body.Error}
+}
+
+func accountPath(accountID int64, rest string) string {
+	return "/accounts/" + strconv.FormatInt(accountID, 10) + rest
+}
+
+func paymentPath(paymentID string, rest string) string {
+	return "/payments/" + url.PathEscape(paymentID) + rest
+}
+
+func favoritePath(favoriteID string, rest string) string {
+	return "/favorites/" + url.PathEscape(favoriteID) + rest
+}
+
+func holdPath(holdID string, rest string) string {
+	return "/holds/" + url.PathEscape(holdID) + rest
+}
+
+func (c *Client) RegisterAccount(phone types.Phone) (*types.Account, error) {
+	return c.RegisterAccountInCurrency(phone, types.DefaultCurrency)
+}
+
+func (c *Client) RegisterAccountInCurrency(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	account := &types.Account{}
+	err := c.do(http.MethodPost, "/accounts", "", server.AccountRequest{Phone: phone, Currency: currency}, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (c *Client) FindAccountByID(accountID int64) (*types.Account, error) {
+	account := &types.Account{}
+	err := c.do(http.MethodGet, accountPath(accountID, ""), "", nil, account)
+	if err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+func (c *Client) Deposit(accountID int64, amount types.Money) error {
+	return c.DepositIdempotent("", accountID, amount)
+}
+
+// DepositIdempotent is Deposit that the server does only once for the key
+func (c *Client) DepositIdempotent(key string, accountID int64, amount types.Money) error {
+	return c.do(http.MethodPost, accountPath(accountID, "/deposits"), key, server.DepositRequest{Amount: amount}, nil)
+}
+
+func (c *Client) Pay(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	return c.PayIdempotent("", accountID, amount, category)
+}
+
+// PayIdempotent is Pay that the server does only once for the key
+func (c *Client) PayIdempotent(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodPost, accountPath(accountID, "/payments"), key, server.PaymentRequest{Amount: amount, Category: category}, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) Transfer(fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	return c.TransferIdempotent("", fromID, toID, amount)
+}
+
+// TransferIdempotent is Transfer that the server does only once for the key
+func (c *Client) TransferIdempotent(key string, fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodPost, accountPath(fromID, "/transfers"), key, server.TransferRequest{ToAccountID: toID, Amount: amount}, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) FindPaymentByID(paymentID string) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodGet, paymentPath(paymentID, ""), "", nil, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) Reject(paymentID string) error {
+	return c.do(http.MethodPost, paymentPath(paymentID, "/reject"), "", nil, nil)
+}
+
+func (c *Client) Repeat(paymentID string) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodPost, paymentPath(paymentID, "/repeat"), "", nil, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) Refund(paymentID string, amount types.Money) (*types.Payment, error) {
+	return c.RefundIdempotent("", paymentID, amount)
+}
+
+// RefundIdempotent is Refund that the server does only once for the key
+func (c *Client) RefundIdempotent(key string, paymentID string, amount types.Money) (*types.Payment, error) {
+	refund := &types.Payment{}
+	err := c.do(http.MethodPost, paymentPath(paymentID, "/refunds"), key, server.RefundRequest{Amount: amount}, refund)
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+func (c *Client) Refunds(paymentID string) ([]types.Payment, error) {
+	refunds := []types.Payment{}
+	err := c.do(http.MethodGet, paymentPath(paymentID, "/refunds"), "", nil, &refunds)
+	if err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+func (c *Client) Authorize(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Hold, error) {
+	hold := &types.Hold{}
+	err := c.do(http.MethodPost, accountPath(accountID, "/holds"), "", server.HoldRequest{Amount: amount, Category: category}, hold)
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (c *Client) Capture(holdID string, amount types.Money) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodPost, holdPath(holdID, "/capture"), "", server.CaptureRequest{Amount: amount}, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) Void(holdID string) error {
+	return c.do(http.MethodPost, holdPath(holdID, "/void"), "", nil, nil)
+}
+
+func (c *Client) FindHoldByID(holdID string) (*types.Hold, error) {
+	hold := &types.Hold{}
+	err := c.do(http.MethodGet, holdPath(holdID, ""), "", nil, hold)
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+func (c *Client) FindHoldsByAccountID(accountID int64) ([]types.Hold, error) {
+	holds := []types.Hold{}
+	err := c.do(http.MethodGet, accountPath(accountID, "/holds"), "", nil, &holds)
+	if err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+func (c *Client) AccountBalance(accountID int64) (*types.AccountBalance, error) {
+	balance := &types.AccountBalance{}
+	err := c.do(http.MethodGet, accountPath(accountID, "/balance"), "", nil, balance)
+	if err != nil {
+		return nil, err
+	}
+	return balance, nil
+}
+
+func (c *Client) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
+	favorite := &types.Favorite{}
+	err := c.do(http.MethodPost, paymentPath(paymentID, "/favorites"), "", server.FavoriteRequest{Name: name}, favorite)
+	if err != nil {
+		return nil, err
+	}
+	return favorite, nil
+}
+
+func (c *Client) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
+	favorite := &types.Favorite{}
+	err := c.do(http.MethodGet, favoritePath(favoriteID, ""), "", nil, favorite)
+	if err != nil {
+		return nil, err
+	}
+	return favorite, nil
+}
+
+func (c *Client) FindFavoritesByAccountID(accountID int64) ([]types.Favorite, error) {
+	favorites := []types.Favorite{}
+	err := c.do(http.MethodGet, accountPath(accountID, "/favorites"), "", nil, &favorites)
+	if err != nil {
+		return nil, err
+	}
+	return favorites, nil
+}
+
+func (c *Client) PayFromFavorite(favoriteID string) (*types.Payment, error) {
+	return c.PayFromFavoriteIdempotent("", favoriteID)
+}
+
+// PayFromFavoriteIdempotent is PayFromFavorite that the server does only once for the key
+func (c *Client) PayFromFavoriteIdempotent(key string, favoriteID string) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := c.do(http.MethodPost, favoritePath(favoriteID, "/payments"), key, nil, payment)
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func (c *Client) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
+	payments := []types.Payment{}
+	err := c.do(http.MethodGet, accountPath(accountID, "/payments"), "", nil, &payments)
+	if err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
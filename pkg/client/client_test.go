@@ -0,0 +1,282 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/server"
+	"github.com/Tursunkhuja/wallet/pkg/wallet"
+)
+
+func newTestService(t *testing.T) *wallet.Service {
+	service, err := wallet.NewService(wallet.NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+// newTestClient starts a server with a new service
+func newTestClient(t *testing.T) *Client {
+	s := httptest.NewServer(server.New(newTestService(t)))
+	t.Cleanup(s.Close)
+	return New(s.URL, WithHTTPClient(s.Client()))
+}
+
+// session works with a wallet and returns what it saw, it must be the same
+// for the embedded and the remote wallets
+func session(w Wallet) ([]interface{}, error) {
+	seen := []interface{}{}
+
+	first, err := w.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, err
+	}
+	second, err := w.RegisterAccount("+992000000002")
+	if err != nil {
+		return nil, err
+	}
+	err = w.Deposit(first.ID, 1_000)
+	if err != nil {
+		return nil, err
+	}
+
+	payment, err := w.Pay(first.ID, 300, "auto")
+	if err != nil {
+		return nil, err
+	}
+	favorite, err := w.FavoritePayment(payment.ID, "car")
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.PayFromFavorite(favorite.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Refund(payment.ID, 50)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Repeat(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Reject(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Transfer(first.ID, second.ID, 100)
+	if err != nil {
+		return nil, err
+	}
+	hold, err := w.Authorize(first.ID, 200, "food")
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Capture(hold.ID, 150)
+	if err != nil {
+		return nil, err
+	}
+	voided, err := w.Authorize(first.ID, 10, "food")
+	if err != nil {
+		return nil, err
+	}
+	err = w.Void(voided.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range []int64{first.ID, second.ID} {
+		account, err := w.FindAccountByID(id)
+		if err != nil {
+			return nil, err
+		}
+		history, err := w.ExportAccountHistory(id)
+		if err != nil {
+			return nil, err
+		}
+		seen = append(seen, account.Phone, account.Balance, len(history))
+	}
+
+	rejected, err := w.FindPaymentByID(payment.ID)
+	if err != nil {
+		return nil, err
+	}
+	favorites, err := w.FindFavoritesByAccountID(first.ID)
+	if err != nil {
+		return nil, err
+	}
+	found, err := w.FindFavoriteByID(favorite.ID)
+	if err != nil {
+		return nil, err
+	}
+	seen = append(seen, rejected.Status, len(favorites), found.Name, found.Amount)
+
+	captured, err := w.FindHoldByID(hold.ID)
+	if err != nil {
+		return nil, err
+	}
+	holds, err := w.FindHoldsByAccountID(first.ID)
+	if err != nil {
+		return nil, err
+	}
+	balance, err := w.AccountBalance(first.ID)
+	if err != nil {
+		return nil, err
+	}
+	seen = append(seen, captured.Status, captured.Captured, len(holds), *balance)
+
+	// the errors are the sentinels of the wallet package
+	_, err = w.FindAccountByID(3)
+	seen = append(seen, err)
+	_, err = w.Pay(second.ID, 1_000, "auto")
+	seen = append(seen, err)
+	err = w.Reject("no-such-payment")
+	seen = append(seen, err)
+	_, err = w.PayFromFavorite("no-such-favorite")
+	seen = append(seen, err)
+	_, err = w.RegisterAccount("+992000000001")
+	seen = append(seen, err)
+	err = w.Deposit(first.ID, 0)
+	seen = append(seen, err)
+	_, err = w.Transfer(first.ID, first.ID, 1)
+	seen = append(seen, err)
+	err = w.Void(hold.ID)
+	seen = append(seen, errors.Is(err, wallet.ErrHoldNotActive))
+	_, err = w.Capture("no-such-hold", 1)
+	seen = append(seen, err)
+	return seen, nil
+}
+
+func TestClient_sameAsService(t *testing.T) {
+	expected, err := session(newTestService(t))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := session(newTestClient(t))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("client:\n%v\nservice:\n%v", got, expected)
+	}
+}
+
+func TestClient_records(t *testing.T) {
+	service := newTestService(t)
+	s := httptest.NewServer(server.New(service))
+	defer s.Close()
+	c := New(s.URL + "/")
+
+	account, err := c.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = c.Deposit(account.ID, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := c.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the client gets the records of the service as they are
+	expected, err := service.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(payment, expected) {
+		t.Errorf("Pay(): client got %v, service has %v", payment, expected)
+	}
+}
+
+func TestClient_idempotent(t *testing.T) {
+	c := newTestClient(t)
+	account, err := c.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i := 0; i < 2; i++ {
+		err = c.DepositIdempotent("deposit-1", account.ID, 100)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	first, err := c.PayIdempotent("pay-1", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := c.PayIdempotent("pay-1", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first.ID != second.ID {
+		t.Errorf("PayIdempotent(): payments %v and %v for the same key", first.ID, second.ID)
+	}
+
+	_, err = c.PayIdempotent("pay-1", account.ID, 20, "auto")
+	if err != wallet.ErrIdempotencyKeyReused {
+		t.Errorf("PayIdempotent(): must return ErrIdempotencyKeyReused, returned = %v", err)
+	}
+
+	got, err := c.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 90 {
+		t.Errorf("FindAccountByID(): balance expected:%v, actual:%v", 90, got.Balance)
+	}
+}
+
+func TestClient_responseError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/accounts/1" {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error":"internal error","code":"internal"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("<html>bad gateway</html>"))
+	}))
+	defer s.Close()
+	c := New(s.URL)
+
+	_, err := c.FindAccountByID(1)
+	var re *ResponseError
+	if !errors.As(err, &re) || re.StatusCode != http.StatusInternalServerError || re.Code != server.CodeInternal {
+		t.Errorf("FindAccountByID(): must return ResponseError, returned = %v", err)
+	}
+
+	_, err = c.FindPaymentByID("p1")
+	if !errors.As(err, &re) || re.StatusCode != http.StatusBadGateway {
+		t.Errorf("FindPaymentByID(): must return ResponseError, returned = %v", err)
+	}
+}
+
+func TestClient_escapedID(t *testing.T) {
+	c := newTestClient(t)
+	_, err := c.FindPaymentByID("a/b?c")
+	if err != wallet.ErrPaymentNotFound {
+		t.Errorf("FindPaymentByID(): must return ErrPaymentNotFound, returned = %v", err)
+	}
+	_, err = c.FindFavoriteByID("")
+	if err == nil {
+		t.Errorf("FindFavoriteByID(): must return an error for an empty ID")
+	}
+}
@@ -1,5 +1,888 @@
+// Command wallet works with a wallet kept in a data directory in the
+// format of Service.Export. Every command restores the directory, runs and,
+// if it changed something, writes it back. The serve command runs the HTTP
+// API of package server on the directory.
+//
+//	wallet [-data dir] [-rates file] [-actor name] [-json] <command> [arguments]
+//
+// The calls that change the wallet are recorded in audit.log of the data
+// directory under the actor, the user running the command by default.
+//
+// Run it without arguments for the list of commands. The exit code tells
+// what went wrong, see exitCodes.
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/server"
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/Tursunkhuja/wallet/pkg/wallet"
+)
+
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitNotEnoughBalance
+	exitInvalidArgument
+	exitConflict
+	exitInvalidData
+)
+
+// exitCodes maps the errors of the wallet package to exit codes, the first
+// match wins and any other error exits with exitError
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{wallet.ErrAccountNotFound, exitNotFound},
+	{wallet.ErrPaymentNotFound, exitNotFound},
+	{wallet.ErrFavoriteNotFound, exitNotFound},
+	{wallet.ErrHoldNotFound, exitNotFound},
+	{wallet.ErrNotEnoughBalance, exitNotEnoughBalance},
+	{wallet.ErrAmountMustBePositive, exitInvalidArgument},
+	{wallet.ErrTransferToSameAccount, exitInvalidArgument},
+	{wallet.ErrUnknownCurrency, exitInvalidArgument},
+	{wallet.ErrUnknownRounding, exitInvalidArgument},
+	{wallet.ErrCurrencyMismatch, exitInvalidArgument},
+	{wallet.ErrNoRate, exitInvalidArgument},
+	{wallet.ErrAmountTooLarge, exitInvalidArgument},
+	{wallet.ErrRefundTooLarge, exitInvalidArgument},
+	{wallet.ErrRefundPayment, exitInvalidArgument},
+	{wallet.ErrCaptureTooLarge, exitInvalidArgument},
+	{types.ErrOverflow, exitInvalidArgument},
+	{wallet.ErrPhoneRegistered, exitConflict},
+	{wallet.ErrIllegalTransition, exitConflict},
+	{wallet.ErrNotRefundable, exitConflict},
+	{wallet.ErrHoldNotActive, exitConflict},
+	{wallet.ErrImportConflict, exitConflict},
+	{wallet.ErrInvalidImport, exitInvalidData},
+	{wallet.ErrCorruptedDump, exitInvalidData},
+	{wallet.ErrLedgerUnbalanced, exitInvalidData},
+	{wallet.ErrBalanceMismatch, exitInvalidData},
+	{wallet.ErrAuditTampered, exitInvalidData},
+}
+
+func exitCode(err error) int {
+	for _, v := range exitCodes {
+		if errors.Is(err, v.err) {
+			return v.code
+		}
+	}
+	return exitError
+}
+
+// usageError is a wrong command line
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+const usage = `usage: wallet [-data dir] [-rates file] [-actor name] [-json] <command> [arguments]
+
+commands:
+  register <phone> [currency]
+  deposit <account> <amount>
+  pay <account> <amount> <category> [currency]
+  transfer <from account> <to account> <amount>
+  reject <payment>
+  repeat <payment>
+  refund <payment> <amount>
+  hold <account> <amount> <category>
+  capture <hold> <amount>
+  void <hold>
+  holds <account>
+  balance <account>
+  expire
+  favorite add <payment> <name>
+  favorite pay <favorite>
+  favorite list <account>
+  history <account>
+  export <dir>
+  import [-policy overwrite|keep|fail|newest] <dir>
+  check
+  reconcile [-adjust]
+  audit verify
+  audit account <account>
+  audit payment <payment>
+  serve [-addr :8080] [-snapshot 1000]
+
+amounts are in the main units of the account currency, e.g. 12.50 TJS is
+12.50, the -json output keeps them in the smallest units, e.g. dirams;
+accounts are opened in TJS unless the currency is given;
+a payment in another currency is converted at the rate from the rates file,
+whose lines are from;to;rate like USD;TJS;10.95
+`
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("wallet", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	data := flags.String("data", "wallet-data", "data directory")
+	rates := flags.String("rates", "", "exchange rates file")
+	actor := flags.String("actor", os.Getenv("USER"), "who the audit log records")
+	asJSON := flags.Bool("json", false, "print the result as JSON")
+
+	err := flags.Parse(args)
+	if err == flag.ErrHelp {
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+	if err == nil && flags.NArg() == 0 {
+		err = usageError("no command")
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "wallet: %v\n\n%v", err, usage)
+		return exitUsage
+	}
+
+	c := &command{data: *data, rates: *rates, actor: *actor}
+	result, err := c.run(flags.Args())
+	// the reports of check and reconcile are printed with the problems they found
+	if _, ok := result.(interface{ Err() error }); err == nil || ok {
+		if *asJSON {
+			printJSON(stdout, result)
+		} else {
+			printText(stdout, result)
+		}
+	}
+	if err != nil {
+		code := exitCode(err)
+		if _, ok := err.(usageError); ok {
+			code = exitUsage
+		}
+		if *asJSON {
+			printJSON(stderr, map[string]interface{}{"error": err.Error(), "code": code})
+		} else {
+			fmt.Fprintf(stderr, "wallet: %v\n", err)
+		}
+		return code
+	}
+	return exitOK
+}
+
+func printJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func printText(w io.Writer, v interface{}) {
+	switch v := v.(type) {
+	case *types.Account:
+		fmt.Fprintf(w, "account %v: phone %v, balance %v\n", v.ID, v.Phone, formatAmount(v.Balance, v.Currency))
+	case *types.Payment:
+		printPayment(w, *v)
+	case []types.Payment:
+		for _, payment := range v {
+			printPayment(w, payment)
+		}
+	case *types.Favorite:
+		printFavorite(w, *v)
+	case []types.Favorite:
+		for _, favorite := range v {
+			printFavorite(w, favorite)
+		}
+	case *types.Hold:
+		printHold(w, *v)
+	case []types.Hold:
+		for _, hold := range v {
+			printHold(w, hold)
+		}
+	case *types.AccountBalance:
+		fmt.Fprintf(w, "account %v: balance %v, held %v, available %v\n", v.AccountID,
+			formatAmount(v.Balance, v.Currency), formatAmount(v.Held, v.Currency), formatAmount(v.Available, v.Currency))
+	case *wallet.ImportSummary:
+		fmt.Fprintf(w, "accounts: %v inserted, %v updated, %v skipped\n", v.Accounts.Inserted, v.Accounts.Updated, v.Accounts.Skipped)
+		fmt.Fprintf(w, "payments: %v inserted, %v updated, %v skipped\n", v.Payments.Inserted, v.Payments.Updated, v.Payments.Skipped)
+		fmt.Fprintf(w, "favorites: %v inserted, %v updated, %v skipped\n", v.Favorites.Inserted, v.Favorites.Updated, v.Favorites.Skipped)
+		fmt.Fprintf(w, "holds: %v inserted, %v updated, %v skipped\n", v.Holds.Inserted, v.Holds.Updated, v.Holds.Skipped)
+		fmt.Fprintf(w, "ledger postings: %v inserted, %v skipped\n", v.Postings.Inserted, v.Postings.Skipped)
+	case *wallet.LedgerReport:
+		if len(v.Problems) == 0 {
+			fmt.Fprintf(w, "ledger: %v entries, %v postings, balanced\n", v.Entries, v.Postings)
+			return
+		}
+		fmt.Fprintf(w, "ledger: %v entries, %v postings, %v problems\n", v.Entries, v.Postings, len(v.Problems))
+		for _, problem := range v.Problems {
+			fmt.Fprintf(w, "  %v\n", problem)
+		}
+	case *wallet.Reconciliation:
+		printReconciliation(w, v)
+	case auditRecords:
+		for _, record := range v.records {
+			printAuditRecord(w, record, v.currencies)
+		}
+	case string:
+		fmt.Fprintln(w, v)
+	}
+}
+
+func printPayment(w io.Writer, v types.Payment) {
+	amount := formatAmount(v.Amount, v.Currency)
+	if v.RefundOf != "" {
+		fmt.Fprintf(w, "refund %v: %v to account %v for payment %v\n", v.ID, amount, v.AccountID, v.RefundOf)
+		return
+	}
+	if v.Refunded != 0 {
+		fmt.Fprintf(w, "payment %v: %v from account %v for %v, %v refunded, %v\n", v.ID, amount, v.AccountID, v.Category,
+			formatAmount(v.Refunded, v.Currency), v.Status)
+		return
+	}
+	if v.ToAccountID != 0 {
+		fmt.Fprintf(w, "payment %v: %v from account %v to account %v, %v\n", v.ID, amount, v.AccountID, v.ToAccountID, v.Status)
+		return
+	}
+	if v.OriginalCurrency != "" {
+		fmt.Fprintf(w, "payment %v: %v from account %v for %v, %v at %v, %v\n", v.ID, amount, v.AccountID, v.Category,
+			v.OriginalAmount.Format(v.OriginalCurrency), v.Rate, v.Status)
+		return
+	}
+	fmt.Fprintf(w, "payment %v: %v from account %v for %v, %v\n", v.ID, amount, v.AccountID, v.Category, v.Status)
+}
+
+func printHold(w io.Writer, v types.Hold) {
+	if v.Status == types.HoldStatusCaptured {
+		fmt.Fprintf(w, "hold %v: %v on account %v for %v, %v captured by payment %v\n", v.ID,
+			formatAmount(v.Amount, v.Currency), v.AccountID, v.Category, formatAmount(v.Captured, v.Currency), v.PaymentID)
+		return
+	}
+	fmt.Fprintf(w, "hold %v: %v on account %v for %v, %v, expires %v\n", v.ID, formatAmount(v.Amount, v.Currency),
+		v.AccountID, v.Category, v.Status, v.ExpiresAt.Format(time.RFC3339))
+}
+
+func printReconciliation(w io.Writer, v *wallet.Reconciliation) {
+	fmt.Fprintf(w, "reconciled %v accounts, %v mismatches\n", v.Accounts, len(v.Mismatches))
+	for _, account := range v.Mismatches {
+		fmt.Fprintf(w, "account %v: balance %v, expected %v\n", account.AccountID,
+			formatAmount(account.Balance, account.Currency), formatAmount(account.Expected, account.Currency))
+		for _, posting := range account.Postings {
+			fmt.Fprintf(w, "  %v %v %v %v\n", posting.CreatedAt.Format(time.RFC3339), posting.Operation,
+				formatAmount(posting.Amount, posting.Currency), posting.PaymentID)
+		}
+		for _, problem := range account.Problems {
+			fmt.Fprintf(w, "  problem: %v\n", problem)
+		}
+		if account.AdjustmentID != "" {
+			fmt.Fprintf(w, "  adjusted by %v in entry %v\n", formatAmount(account.Difference(), account.Currency),
+				account.AdjustmentID)
+		}
+	}
+}
+
+// auditRecords carry the currencies of the accounts they change, so that the
+// balances are printed in main units; the JSON has the records only
+type auditRecords struct {
+	records    []types.AuditRecord
+	currencies map[int64]types.Currency
+}
+
+func (v auditRecords) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.records)
+}
+
+func printAuditRecord(w io.Writer, v types.AuditRecord, currencies map[int64]types.Currency) {
+	fmt.Fprintf(w, "%v %v %v by %q", v.Seq, v.Time.Format(time.RFC3339), v.Operation, v.Actor)
+	if v.Source != "" {
+		fmt.Fprintf(w, " from %v", v.Source)
+	}
+	if v.Error != "" {
+		fmt.Fprintf(w, ", failed: %v", v.Error)
+	}
+	fmt.Fprintln(w)
+	for _, balance := range v.Balances {
+		currency := currencies[balance.AccountID]
+		fmt.Fprintf(w, "  account %v: %v -> %v\n", balance.AccountID, formatAmount(balance.Before, currency),
+			formatAmount(balance.After, currency))
+	}
+	for _, id := range v.Payments {
+		fmt.Fprintf(w, "  payment %v\n", id)
+	}
+}
+
+func printFavorite(w io.Writer, v types.Favorite) {
+	fmt.Fprintf(w, "favorite %v %q: %v from account %v for %v\n", v.ID, v.Name, formatAmount(v.Amount, v.Currency),
+		v.AccountID, v.Category)
+}
+
+type command struct {
+	data    string
+	rates   string // exchange rates file, none if empty
+	actor   string
+	service *wallet.Service
+	changed bool // the data directory has to be written back
+}
+
+// open restores the service from the data directory, with the log of the
+// changes that a server stopped before writing a snapshot
+func (c *command) open(snapshotEvery int) error {
+	err := os.MkdirAll(c.data, 0777)
+	if err != nil {
+		return err
+	}
+	options := []wallet.Option{wallet.WithLog(c.data, snapshotEvery), wallet.WithAudit(c.data + "/audit.log")}
+	if c.rates != "" {
+		rates, err := wallet.NewFileRates(c.rates)
+		if err != nil {
+			return err
+		}
+		options = append(options, wallet.WithRates(rates))
+	}
+	s, err := wallet.NewService(wallet.NewMemoryStorage(), options...)
+	if err != nil {
+		return err
+	}
+	c.service = s.As(c.actor)
+	return nil
+}
+
+func (c *command) run(args []string) (result interface{}, err error) {
+	if args[0] == "serve" {
+		return c.serve(args[1:])
+	}
+
+	err = c.open(0)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		closeErr := c.service.Close()
+		if err == nil && closeErr != nil {
+			result, err = nil, closeErr
+		}
+	}()
+
+	result, err = c.dispatch(args[0], args[1:])
+	if err != nil {
+		return result, err
+	}
+
+	if c.changed {
+		err = c.service.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// serve runs the HTTP API until an interrupt, the changes go to the log of
+// the data directory and a snapshot is written every snapshotEvery of them
+func (c *command) serve(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	addr := flags.String("addr", ":8080", "")
+	snapshotEvery := flags.Int("snapshot", 1000, "")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, usageError("serve: " + err.Error())
+	}
+	err = expectArgs("serve", flags.Args())
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.open(*snapshotEvery)
+	if err != nil {
+		return nil, err
+	}
+	defer c.service.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = server.ListenAndServe(ctx, *addr, server.New(c.service))
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.service.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return "stopped", nil
+}
+
+func (c *command) dispatch(name string, args []string) (interface{}, error) {
+	s := c.service
+	switch name {
+	case "register":
+		currency := types.DefaultCurrency
+		if len(args) == 2 {
+			currency, args = types.Currency(args[1]), args[:1]
+		}
+		err := expectArgs(name, args, "<phone>")
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.RegisterAccountInCurrency(types.Phone(args[0]), currency)
+
+	case "deposit":
+		err := expectArgs(name, args, "<account>", "<amount>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := c.accountAmount(accountID, args[1])
+		if err != nil {
+			return nil, err
+		}
+		err = s.Deposit(accountID, amount)
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.FindAccountByID(accountID)
+
+	case "pay":
+		currency := types.Currency("")
+		if len(args) == 4 {
+			currency, args = types.Currency(args[3]), args[:3]
+		}
+		err := expectArgs(name, args, "<account>", "<amount>", "<category>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		if currency != "" {
+			amount, err := parseAmount(args[1], currency)
+			if err != nil {
+				return nil, err
+			}
+			c.changed = true
+			return s.PayConverted(accountID, amount, currency, types.PaymentCategory(args[2]), wallet.DefaultRounding)
+		}
+		amount, err := c.accountAmount(accountID, args[1])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Pay(accountID, amount, types.PaymentCategory(args[2]))
+
+	case "transfer":
+		err := expectArgs(name, args, "<from account>", "<to account>", "<amount>")
+		if err != nil {
+			return nil, err
+		}
+		fromID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		toID, err := parseID(args[1])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := c.accountAmount(fromID, args[2])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Transfer(fromID, toID, amount)
+
+	case "reject":
+		err := expectArgs(name, args, "<payment>")
+		if err != nil {
+			return nil, err
+		}
+		err = s.Reject(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.FindPaymentByID(args[0])
+
+	case "repeat":
+		err := expectArgs(name, args, "<payment>")
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Repeat(args[0])
+
+	case "refund":
+		err := expectArgs(name, args, "<payment>", "<amount>")
+		if err != nil {
+			return nil, err
+		}
+		amount, err := c.paymentAmount(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Refund(args[0], amount)
+
+	case "hold":
+		err := expectArgs(name, args, "<account>", "<amount>", "<category>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		amount, err := c.accountAmount(accountID, args[1])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Authorize(accountID, amount, types.PaymentCategory(args[2]))
+
+	case "capture":
+		err := expectArgs(name, args, "<hold>", "<amount>")
+		if err != nil {
+			return nil, err
+		}
+		amount, err := c.holdAmount(args[0], args[1])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.Capture(args[0], amount)
+
+	case "void":
+		err := expectArgs(name, args, "<hold>")
+		if err != nil {
+			return nil, err
+		}
+		err = s.Void(args[0])
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.FindHoldByID(args[0])
+
+	case "holds":
+		err := expectArgs(name, args, "<account>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.FindHoldsByAccountID(accountID)
+
+	case "balance":
+		err := expectArgs(name, args, "<account>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.AccountBalance(accountID)
+
+	case "expire":
+		err := expectArgs(name, args)
+		if err != nil {
+			return nil, err
+		}
+		expired, err := s.ExpireHolds()
+		if err != nil {
+			return nil, err
+		}
+		c.changed = expired > 0
+		return fmt.Sprintf("expired %v holds", expired), nil
+
+	case "favorite":
+		if len(args) == 0 {
+			return nil, usageError("favorite: expected add, pay or list")
+		}
+		return c.favorite(args[0], args[1:])
+
+	case "history":
+		err := expectArgs(name, args, "<account>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.ExportAccountHistory(accountID)
+
+	case "export":
+		err := expectArgs(name, args, "<dir>")
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(args[0], 0777)
+		if err != nil {
+			return nil, err
+		}
+		err = s.Export(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return "exported to " + args[0], nil
+
+	case "import":
+		return c.importDir(args)
+
+	case "reconcile":
+		return c.reconcile(args)
+
+	case "audit":
+		if len(args) == 0 {
+			return nil, usageError("audit: expected verify, account or payment")
+		}
+		return c.audit(args[0], args[1:])
+
+	case "check":
+		err := expectArgs(name, args)
+		if err != nil {
+			return nil, err
+		}
+		report, err := s.CheckLedger()
+		if err != nil {
+			return nil, err
+		}
+		return report, report.Err()
+	}
+	return nil, usageError(fmt.Sprintf("unknown command %q", name))
+}
+
+func (c *command) favorite(name string, args []string) (interface{}, error) {
+	s := c.service
+	switch name {
+	case "add":
+		err := expectArgs("favorite add", args, "<payment>", "<name>")
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.FavoritePayment(args[0], args[1])
+
+	case "pay":
+		err := expectArgs("favorite pay", args, "<favorite>")
+		if err != nil {
+			return nil, err
+		}
+		c.changed = true
+		return s.PayFromFavorite(args[0])
+
+	case "list":
+		err := expectArgs("favorite list", args, "<account>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return s.FindFavoritesByAccountID(accountID)
+	}
+	return nil, usageError(fmt.Sprintf("unknown command \"favorite %v\"", name))
+}
+
+func (c *command) audit(name string, args []string) (interface{}, error) {
+	s := c.service
+	switch name {
+	case "verify":
+		err := expectArgs("audit verify", args)
+		if err != nil {
+			return nil, err
+		}
+		count, err := s.VerifyAudit()
+		if err != nil {
+			return nil, err
+		}
+		return fmt.Sprintf("audit log: %v records, intact", count), nil
+
+	case "account":
+		err := expectArgs("audit account", args, "<account>")
+		if err != nil {
+			return nil, err
+		}
+		accountID, err := parseID(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return c.auditRecords(s.AuditByAccount(accountID))
+
+	case "payment":
+		err := expectArgs("audit payment", args, "<payment>")
+		if err != nil {
+			return nil, err
+		}
+		return c.auditRecords(s.AuditByPayment(args[0]))
+	}
+	return nil, usageError(fmt.Sprintf("unknown command \"audit %v\"", name))
+}
+
+// auditRecords looks up the currencies of the accounts the records change,
+// an account that is not there any more gets the default one
+func (c *command) auditRecords(records []types.AuditRecord, err error) (interface{}, error) {
+	if err != nil {
+		return nil, err
+	}
+	currencies := map[int64]types.Currency{}
+	for _, record := range records {
+		for _, balance := range record.Balances {
+			account, err := c.service.FindAccountByID(balance.AccountID)
+			if err == nil {
+				currencies[balance.AccountID] = account.Currency
+			}
+		}
+	}
+	return auditRecords{records: records, currencies: currencies}, nil
+}
+
+var policies = map[string]wallet.ConflictPolicy{
+	wallet.ConflictOverwrite.String(): wallet.ConflictOverwrite,
+	wallet.ConflictKeep.String():      wallet.ConflictKeep,
+	wallet.ConflictFail.String():      wallet.ConflictFail,
+	wallet.ConflictNewest.String():    wallet.ConflictNewest,
+}
+
+func (c *command) importDir(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	policyName := flags.String("policy", wallet.ConflictOverwrite.String(), "")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, usageError("import: " + err.Error())
+	}
+
+	policy, ok := policies[*policyName]
+	if !ok {
+		return nil, usageError(fmt.Sprintf("import: unknown policy %q", *policyName))
+	}
+	err = expectArgs("import", flags.Args(), "<dir>")
+	if err != nil {
+		return nil, err
+	}
+
+	summary, err := c.service.ImportWithPolicy(flags.Arg(0), policy)
+	if err != nil {
+		return nil, err
+	}
+	c.changed = true
+	return summary, nil
+}
+
+func (c *command) reconcile(args []string) (interface{}, error) {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	adjust := flags.Bool("adjust", false, "")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, usageError("reconcile: " + err.Error())
+	}
+	err = expectArgs("reconcile", flags.Args())
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := c.service.Reconcile(*adjust)
+	if err != nil {
+		return nil, err
+	}
+	c.changed = *adjust
+	return result, result.Err()
+}
+
+func expectArgs(name string, args []string, expected ...string) error {
+	if len(args) != len(expected) {
+		return usageError(fmt.Sprintf("%v: expected %v arguments %v, got %v", name, len(expected), expected, len(args)))
+	}
+	return nil
+}
+
+func parseID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, usageError(fmt.Sprintf("bad account %q", s))
+	}
+	return id, nil
+}
+
+// parseAmount parses the amount in the main units of the currency
+func parseAmount(s string, currency types.Currency) (types.Money, error) {
+	currency = currencyOrDefault(currency)
+	if _, ok := currency.Exponent(); !ok {
+		return 0, wallet.ErrUnknownCurrency
+	}
+	amount, err := types.ParseMoney(s, currency)
+	if err != nil {
+		return 0, usageError(fmt.Sprintf("bad amount %q: %v", s, err))
+	}
+	return amount, nil
+}
+
+// accountAmount parses the amount in the currency of the account, or in the
+// default one if there's no such account: the call reports it then
+func (c *command) accountAmount(accountID int64, s string) (types.Money, error) {
+	account, err := c.service.FindAccountByID(accountID)
+	if errors.Is(err, wallet.ErrAccountNotFound) {
+		return parseAmount(s, types.DefaultCurrency)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseAmount(s, account.Currency)
+}
+
+// paymentAmount parses the amount in the currency of the payment, or in the
+// default one if there's no such payment
+func (c *command) paymentAmount(paymentID string, s string) (types.Money, error) {
+	payment, err := c.service.FindPaymentByID(paymentID)
+	if errors.Is(err, wallet.ErrPaymentNotFound) {
+		return parseAmount(s, types.DefaultCurrency)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseAmount(s, payment.Currency)
+}
+
+// holdAmount parses the amount in the currency of the hold, or in the
+// default one if there's no such hold
+func (c *command) holdAmount(holdID string, s string) (types.Money, error) {
+	hold, err := c.service.FindHoldByID(holdID)
+	if errors.Is(err, wallet.ErrHoldNotFound) {
+		return parseAmount(s, types.DefaultCurrency)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return parseAmount(s, hold.Currency)
+}
+
+// formatAmount writes the amount in the main units of the currency
+func formatAmount(amount types.Money, currency types.Currency) string {
+	return amount.Format(currencyOrDefault(currency))
+}
 
+// currencyOrDefault returns the currency, or the default one for the records
+// of old dumps that have none
+func currencyOrDefault(currency types.Currency) types.Currency {
+	if currency == "" {
+		return types.DefaultCurrency
+	}
+	return currency
 }
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// runWallet runs the command line against the data directory
+func runWallet(data string, args ...string) (int, string, string) {
+	stdout, stderr := bytes.Buffer{}, bytes.Buffer{}
+	code := run(append([]string{"-data", data}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun_session(t *testing.T) {
+	data := t.TempDir()
+
+	code, out, _ := runWallet(data, "register", "+992000000001")
+	if code != exitOK || out != "account 1: phone +992000000001, balance 0.00 TJS\n" {
+		t.Errorf("register: code %v, output %q", code, out)
+	}
+
+	code, out, _ = runWallet(data, "deposit", "1", "10")
+	if code != exitOK || out != "account 1: phone +992000000001, balance 10.00 TJS\n" {
+		t.Errorf("deposit: code %v, output %q", code, out)
+	}
+
+	code, out, _ = runWallet(data, "-json", "pay", "1", "3", "auto")
+	if code != exitOK {
+		t.Errorf("pay: code %v, output %q", code, out)
+		return
+	}
+	payment := types.Payment{}
+	err := json.Unmarshal([]byte(out), &payment)
+	if err != nil {
+		t.Errorf("pay: bad JSON %q: %v", out, err)
+		return
+	}
+	if payment.Amount != 300 || payment.Status != types.PaymentStatusInProgress {
+		t.Errorf("pay: wrong payment %v", payment)
+	}
+
+	code, out, _ = runWallet(data, "-json", "favorite", "add", payment.ID, "car")
+	if code != exitOK {
+		t.Errorf("favorite add: code %v, output %q", code, out)
+		return
+	}
+	favorite := types.Favorite{}
+	err = json.Unmarshal([]byte(out), &favorite)
+	if err != nil {
+		t.Errorf("favorite add: bad JSON %q: %v", out, err)
+		return
+	}
+
+	code, _, _ = runWallet(data, "favorite", "pay", favorite.ID)
+	if code != exitOK {
+		t.Errorf("favorite pay: code %v", code)
+	}
+
+	code, out, _ = runWallet(data, "favorite", "list", "1")
+	if code != exitOK || !strings.Contains(out, `"car"`) {
+		t.Errorf("favorite list: code %v, output %q", code, out)
+	}
+
+	code, out, _ = runWallet(data, "reject", payment.ID)
+	if code != exitOK || !strings.Contains(out, "FAIL") {
+		t.Errorf("reject: code %v, output %q", code, out)
+	}
+
+	code, out, _ = runWallet(data, "-json", "history", "1")
+	if code != exitOK {
+		t.Errorf("history: code %v, output %q", code, out)
+		return
+	}
+	history := []types.Payment{}
+	err = json.Unmarshal([]byte(out), &history)
+	if err != nil {
+		t.Errorf("history: bad JSON %q: %v", out, err)
+		return
+	}
+	if len(history) != 2 {
+		t.Errorf("history: payments expected:%v, actual:%v", 2, len(history))
+	}
+
+	// the balance survives between the runs: 10 - 3 - 3 + 3
+	code, out, _ = runWallet(data, "deposit", "1", "0.01")
+	if code != exitOK || !strings.Contains(out, "balance 7.01 TJS") {
+		t.Errorf("deposit: code %v, output %q", code, out)
+	}
+}
+
+func TestRun_favoriteSeparators(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "10")
+	_, out, _ := runWallet(data, "-json", "pay", "1", "3", "snacks;tea")
+	payment := types.Payment{}
+	err := json.Unmarshal([]byte(out), &payment)
+	if err != nil {
+		t.Errorf("pay: bad JSON %q: %v", out, err)
+		return
+	}
+
+	code, out, _ := runWallet(data, "favorite", "add", payment.ID, "lunch;with friends\nand more")
+	if code != exitOK {
+		t.Errorf("favorite add: code %v, output %q", code, out)
+		return
+	}
+
+	// the next run loads what the last one saved
+	code, out, stderr := runWallet(data, "favorite", "list", "1")
+	if code != exitOK || !strings.Contains(out, `"lunch;with friends\nand more"`) ||
+		!strings.Contains(out, "for snacks;tea") {
+		t.Errorf("favorite list: code %v, output %q, stderr %q", code, out, stderr)
+	}
+}
+
+func TestRun_refund(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "10")
+	_, out, _ := runWallet(data, "-json", "pay", "1", "3", "auto")
+	payment := types.Payment{}
+	err := json.Unmarshal([]byte(out), &payment)
+	if err != nil {
+		t.Errorf("pay: bad JSON %q: %v", out, err)
+		return
+	}
+
+	code, out, _ := runWallet(data, "refund", payment.ID, "1")
+	if code != exitOK || !strings.Contains(out, "1.00 TJS to account 1 for payment "+payment.ID) {
+		t.Errorf("refund: code %v, output %q", code, out)
+	}
+	code, _, _ = runWallet(data, "refund", payment.ID, "2.01")
+	if code != exitInvalidArgument {
+		t.Errorf("refund: code expected:%v, actual:%v", exitInvalidArgument, code)
+	}
+
+	code, out, _ = runWallet(data, "history", "1")
+	if code != exitOK || !strings.Contains(out, "3.00 TJS from account 1 for auto, 1.00 TJS refunded") {
+		t.Errorf("history: code %v, output %q", code, out)
+	}
+}
+
+func TestRun_holds(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "10")
+	_, out, _ := runWallet(data, "-json", "hold", "1", "3", "auto")
+	hold := types.Hold{}
+	err := json.Unmarshal([]byte(out), &hold)
+	if err != nil {
+		t.Errorf("hold: bad JSON %q: %v", out, err)
+		return
+	}
+
+	code, out, _ := runWallet(data, "balance", "1")
+	if code != exitOK || !strings.Contains(out, "balance 10.00 TJS, held 3.00 TJS, available 7.00 TJS") {
+		t.Errorf("balance: code %v, output %q", code, out)
+	}
+	code, _, _ = runWallet(data, "pay", "1", "7.01", "auto")
+	if code != exitNotEnoughBalance {
+		t.Errorf("pay: code expected:%v, actual:%v", exitNotEnoughBalance, code)
+	}
+	code, _, _ = runWallet(data, "capture", hold.ID, "3.01")
+	if code != exitInvalidArgument {
+		t.Errorf("capture: code expected:%v, actual:%v", exitInvalidArgument, code)
+	}
+	code, out, _ = runWallet(data, "capture", hold.ID, "2")
+	if code != exitOK || !strings.Contains(out, "2.00 TJS from account 1 for auto") {
+		t.Errorf("capture: code %v, output %q", code, out)
+	}
+	code, _, _ = runWallet(data, "void", hold.ID)
+	if code != exitConflict {
+		t.Errorf("void: code expected:%v, actual:%v", exitConflict, code)
+	}
+	code, _, _ = runWallet(data, "void", "unknown")
+	if code != exitNotFound {
+		t.Errorf("void: code expected:%v, actual:%v", exitNotFound, code)
+	}
+
+	code, out, _ = runWallet(data, "holds", "1")
+	if code != exitOK || !strings.Contains(out, "3.00 TJS on account 1 for auto, 2.00 TJS captured by payment") {
+		t.Errorf("holds: code %v, output %q", code, out)
+	}
+	code, out, _ = runWallet(data, "expire")
+	if code != exitOK || out != "expired 0 holds\n" {
+		t.Errorf("expire: code %v, output %q", code, out)
+	}
+}
+
+func TestRun_exportImport(t *testing.T) {
+	data := t.TempDir()
+	code, _, _ := runWallet(data, "register", "+992000000001")
+	if code != exitOK {
+		t.Errorf("register: code %v", code)
+		return
+	}
+
+	dir := t.TempDir() + "/backup"
+	code, _, _ = runWallet(data, "export", dir)
+	if code != exitOK {
+		t.Errorf("export: code %v", code)
+		return
+	}
+
+	other := t.TempDir()
+	code, out, _ := runWallet(other, "import", "-policy", "fail", dir)
+	if code != exitOK || !strings.Contains(out, "accounts: 1 inserted") {
+		t.Errorf("import: code %v, output %q", code, out)
+	}
+
+	code, _, _ = runWallet(other, "register", "+992000000001")
+	if code != exitConflict {
+		t.Errorf("register: imported phone must be registered, code %v", code)
+	}
+}
+
+func TestRun_exitCodes(t *testing.T) {
+	data := t.TempDir()
+	code, _, _ := runWallet(data, "register", "+992000000001")
+	if code != exitOK {
+		t.Errorf("register: code %v", code)
+		return
+	}
+
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{}, exitUsage},
+		{[]string{"fly"}, exitUsage},
+		{[]string{"deposit", "1"}, exitUsage},
+		{[]string{"deposit", "one", "10"}, exitUsage},
+		{[]string{"deposit", "1", "0.001"}, exitUsage},
+		{[]string{"import", "-policy", "merge", data}, exitUsage},
+		{[]string{"deposit", "2", "10"}, exitNotFound},
+		{[]string{"reject", "no-such-payment"}, exitNotFound},
+		{[]string{"pay", "1", "10", "auto"}, exitNotEnoughBalance},
+		{[]string{"deposit", "1", "-10"}, exitInvalidArgument},
+		{[]string{"transfer", "1", "1", "10"}, exitInvalidArgument},
+		{[]string{"pay", "1", "10", "auto", "XYZ"}, exitInvalidArgument},
+		{[]string{"register", "+992000000002", "XYZ"}, exitInvalidArgument},
+		{[]string{"register", "+992000000001"}, exitConflict},
+	}
+	for _, tt := range tests {
+		code, _, stderr := runWallet(data, tt.args...)
+		if code != tt.code {
+			t.Errorf("%v: exit code expected:%v, actual:%v, stderr %q", tt.args, tt.code, code, stderr)
+		}
+	}
+
+	code, _, stderr := runWallet(data, "-json", "deposit", "2", "10")
+	result := struct {
+		Error string
+		Code  int
+	}{}
+	err := json.Unmarshal([]byte(stderr), &result)
+	if err != nil || result.Code != exitNotFound || result.Error != "account not found" {
+		t.Errorf("-json: error output %q, code %v", stderr, code)
+	}
+}
+
+func TestRun_rates(t *testing.T) {
+	data := t.TempDir()
+	rates := t.TempDir() + "/rates.txt"
+	err := os.WriteFile(rates, []byte("USD;TJS;10.95\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "1000")
+
+	code, out, _ := runWallet(data, "-rates", rates, "pay", "1", "10", "shop", "USD")
+	if code != exitOK || !strings.Contains(out, "109.50 TJS from account 1 for shop, 10.00 USD at 10.95") {
+		t.Errorf("pay: code %v, output %q", code, out)
+	}
+
+	code, _, _ = runWallet(data, "-rates", rates, "pay", "1", "10", "shop", "JPY")
+	if code != exitInvalidArgument {
+		t.Errorf("pay: no rate, code %v", code)
+	}
+	code, _, _ = runWallet(data, "pay", "1", "10", "shop", "USD")
+	if code != exitInvalidArgument {
+		t.Errorf("pay: no rates file, code %v", code)
+	}
+	code, _, _ = runWallet(data, "-rates", data+"/missing.txt", "deposit", "1", "1")
+	if code != exitError {
+		t.Errorf("deposit: missing rates file, code %v", code)
+	}
+}
+
+func TestRun_check(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "10")
+	runWallet(data, "pay", "1", "3", "auto")
+
+	code, out, _ := runWallet(data, "check")
+	if code != exitOK || out != "ledger: 2 entries, 4 postings, balanced\n" {
+		t.Errorf("check: code %v, output %q", code, out)
+	}
+
+	// a balance changed behind the ledger's back
+	account := "1;+992000000001;5000;2024-01-01T00:00:00Z;2024-01-01T00:00:00Z;TJS\n"
+	err := os.WriteFile(data+"/accounts.dump", []byte(account), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	code, _, stderr := runWallet(data, "check")
+	if code != exitInvalidData || !strings.Contains(stderr, "account 1 has 50.00 TJS, its ledger account 7.00 TJS") {
+		t.Errorf("check: code %v, stderr %q", code, stderr)
+	}
+}
+
+func TestRun_reconcile(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "register", "+992000000001")
+	runWallet(data, "deposit", "1", "10")
+
+	code, out, _ := runWallet(data, "reconcile")
+	if code != exitOK || out != "reconciled 1 accounts, 0 mismatches\n" {
+		t.Errorf("reconcile: code %v, output %q", code, out)
+	}
+
+	account := "1;+992000000001;5000;2024-01-01T00:00:00Z;2024-01-01T00:00:00Z;TJS\n"
+	err := os.WriteFile(data+"/accounts.dump", []byte(account), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	code, out, stderr := runWallet(data, "reconcile")
+	if code != exitInvalidData || !strings.Contains(out, "account 1: balance 50.00 TJS, expected 10.00 TJS") ||
+		!strings.Contains(out, " deposit 10.00 TJS") || !strings.Contains(stderr, "account 1 has 50.00 TJS, expected 10.00 TJS") {
+		t.Errorf("reconcile: code %v, output %q, stderr %q", code, out, stderr)
+	}
+
+	code, out, _ = runWallet(data, "reconcile", "-adjust")
+	if code != exitOK || !strings.Contains(out, "adjusted by 40.00 TJS") {
+		t.Errorf("reconcile -adjust: code %v, output %q", code, out)
+	}
+	code, _, _ = runWallet(data, "check")
+	if code != exitOK {
+		t.Errorf("check: code %v after the adjustment", code)
+	}
+}
+
+func TestRun_audit(t *testing.T) {
+	data := t.TempDir()
+	runWallet(data, "-actor", "support", "register", "+992000000001")
+	runWallet(data, "-actor", "support", "deposit", "1", "10")
+	runWallet(data, "deposit", "2", "10")
+
+	code, out, _ := runWallet(data, "audit", "verify")
+	if code != exitOK || out != "audit log: 3 records, intact\n" {
+		t.Errorf("audit verify: code %v, output %q", code, out)
+	}
+
+	code, out, _ = runWallet(data, "audit", "account", "1")
+	if code != exitOK || !strings.Contains(out, `Deposit by "support"`) ||
+		!strings.Contains(out, "account 1: 0.00 TJS -> 10.00 TJS") {
+		t.Errorf("audit account: code %v, output %q", code, out)
+	}
+	code, out, _ = runWallet(data, "audit", "account", "2")
+	if code != exitOK || !strings.Contains(out, "failed: account not found") {
+		t.Errorf("audit account: code %v, output %q", code, out)
+	}
+
+	content, err := os.ReadFile(data + "/audit.log")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	content = bytes.Replace(content, []byte(`"amount":"1000"`), []byte(`"amount":"100"`), 1)
+	err = os.WriteFile(data+"/audit.log", content, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	code, _, stderr := runWallet(data, "audit", "verify")
+	if code != exitInvalidData || !strings.Contains(stderr, "line 2: record 2 was changed") {
+		t.Errorf("audit verify: code %v, stderr %q", code, stderr)
+	}
+}
@@ -0,0 +1,608 @@
+// Package server exposes a wallet.Service over HTTP. Requests and responses
+// are JSON, the records are the structs of the types package.
+//
+//	POST /accounts                   AccountRequest   201 account
+//	GET  /accounts/{id}                                   account
+//	POST /accounts/{id}/deposits     DepositRequest       account
+//	POST /accounts/{id}/payments     PaymentRequest   201 payment
+//	POST /accounts/{id}/transfers    TransferRequest  201 payment
+//	GET  /accounts/{id}/payments                          history of the account
+//	GET  /accounts/{id}/favorites                         favorites of the account
+//	POST /accounts/{id}/holds        HoldRequest      201 hold
+//	GET  /accounts/{id}/holds                             holds of the account
+//	GET  /accounts/{id}/balance                           balance and available balance
+//	GET  /payments/{id}                                   payment
+//	POST /payments/{id}/reject                            payment
+//	POST /payments/{id}/repeat                        201 payment
+//	POST /payments/{id}/favorites    FavoriteRequest  201 favorite
+//	POST /payments/{id}/refunds      RefundRequest    201 refund
+//	GET  /payments/{id}/refunds                           refunds of the payment
+//	GET  /favorites/{id}                                  favorite
+//	POST /favorites/{id}/payments                     201 payment
+//	GET  /holds/{id}                                      hold
+//	POST /holds/{id}/capture         CaptureRequest   201 payment
+//	POST /holds/{id}/void                                 hold
+//
+// Deposits, payments, transfers, refunds and payments from a favorite with an
+// Idempotency-Key header are done once per key. A failed request gets an
+// ErrorResponse with the status and the code from errorCodes. The audit log
+// of the service records a request under its X-Actor header, or under the
+// address of the client without one. The header isn't authenticated, so the
+// record keeps the address of the client as its source either way.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/Tursunkhuja/wallet/pkg/wallet"
+)
+
+// IdempotencyKeyHeader carries the idempotency key of a request
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ActorHeader names who makes a request for the audit log
+const ActorHeader = "X-Actor"
+
+// ShutdownTimeout is how long Serve waits for the requests in flight
+const ShutdownTimeout = 10 * time.Second
+
+// maxBodySize limits the request bodies, they are a few fields each
+const maxBodySize = 1 << 20
+
+// AccountRequest registers an account, in types.DefaultCurrency if the
+// currency is empty
+type AccountRequest struct {
+	Phone    types.Phone    `json:"phone"`
+	Currency types.Currency `json:"currency,omitempty"`
+}
+
+// DepositRequest puts money into an account
+type DepositRequest struct {
+	Amount types.Money `json:"amount"`
+}
+
+// PaymentRequest pays from an account
+type PaymentRequest struct {
+	Amount   types.Money           `json:"amount"`
+	Category types.PaymentCategory `json:"category"`
+}
+
+// TransferRequest moves money to another account
+type TransferRequest struct {
+	ToAccountID int64       `json:"to_account_id"`
+	Amount      types.Money `json:"amount"`
+}
+
+// FavoriteRequest adds a payment to the favorites
+type FavoriteRequest struct {
+	Name string `json:"name"`
+}
+
+// RefundRequest gives a part of a payment back
+type RefundRequest struct {
+	Amount types.Money `json:"amount"`
+}
+
+// HoldRequest holds money of an account for a later payment
+type HoldRequest struct {
+	Amount   types.Money           `json:"amount"`
+	Category types.PaymentCategory `json:"category"`
+}
+
+// CaptureRequest pays a hold, all of it or a part
+type CaptureRequest struct {
+	Amount types.Money `json:"amount"`
+}
+
+// ErrorResponse is the body of a failed request
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// Codes of the errors that are not from the wallet package
+const (
+	CodeBadRequest       = "bad_request"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInternal         = "internal"
+)
+
+// errorCodes maps the errors of the wallet package to the statuses and the
+// codes of the responses, any other error is a 500 with CodeInternal
+var errorCodes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{wallet.ErrAccountNotFound, http.StatusNotFound, "account_not_found"},
+	{wallet.ErrPaymentNotFound, http.StatusNotFound, "payment_not_found"},
+	{wallet.ErrFavoriteNotFound, http.StatusNotFound, "favorite_not_found"},
+	{wallet.ErrHoldNotFound, http.StatusNotFound, "hold_not_found"},
+	{wallet.ErrPhoneRegistered, http.StatusConflict, "phone_registered"},
+	{wallet.ErrIllegalTransition, http.StatusConflict, "illegal_transition"},
+	{wallet.ErrNotRefundable, http.StatusConflict, "not_refundable"},
+	{wallet.ErrHoldNotActive, http.StatusConflict, "hold_not_active"},
+	{wallet.ErrNotEnoughBalance, http.StatusUnprocessableEntity, "not_enough_balance"},
+	{wallet.ErrAmountMustBePositive, http.StatusUnprocessableEntity, "amount_must_be_positive"},
+	{wallet.ErrTransferToSameAccount, http.StatusUnprocessableEntity, "transfer_to_same_account"},
+	{wallet.ErrIdempotencyKeyReused, http.StatusUnprocessableEntity, "idempotency_key_reused"},
+	{wallet.ErrUnknownCurrency, http.StatusUnprocessableEntity, "unknown_currency"},
+	{wallet.ErrCurrencyMismatch, http.StatusUnprocessableEntity, "currency_mismatch"},
+	{wallet.ErrNoRate, http.StatusUnprocessableEntity, "no_rate"},
+	{wallet.ErrAmountTooLarge, http.StatusUnprocessableEntity, "amount_too_large"},
+	{wallet.ErrRefundTooLarge, http.StatusUnprocessableEntity, "refund_too_large"},
+	{wallet.ErrRefundPayment, http.StatusUnprocessableEntity, "refund_payment"},
+	{wallet.ErrCaptureTooLarge, http.StatusUnprocessableEntity, "capture_too_large"},
+	{types.ErrOverflow, http.StatusUnprocessableEntity, "amount_overflow"},
+}
+
+// ErrorFromCode returns the error of the wallet package for the code of an
+// ErrorResponse, or nil if the code is not one of them
+func ErrorFromCode(code string) error {
+	for _, v := range errorCodes {
+		if v.code == code {
+			return v.err
+		}
+	}
+	return nil
+}
+
+// requestError is a request the server can't make sense of
+type requestError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{http.StatusBadRequest, CodeBadRequest, fmt.Errorf(format, args...)}
+}
+
+func errorResponse(err error) (int, ErrorResponse) {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.status, ErrorResponse{re.Error(), re.code}
+	}
+	for _, v := range errorCodes {
+		if errors.Is(err, v.err) {
+			return v.status, ErrorResponse{v.err.Error(), v.code}
+		}
+	}
+	// the details stay in the log
+	log.Println(err)
+	return http.StatusInternalServerError, ErrorResponse{"internal error", CodeInternal}
+}
+
+// Server is the http.Handler of the API
+type Server struct {
+	service *wallet.Service
+}
+
+// New creates the handler of the API for the service
+func New(service *wallet.Service) *Server {
+	return &Server{service: service}
+}
+
+// handler serves a matched route, id is the {id} of the path. It returns the
+// status and the body of a successful response.
+type handler func(s *Server, r *http.Request, id string) (int, interface{}, error)
+
+type route struct {
+	method  string
+	pattern []string
+	handle  handler
+}
+
+var routes = []route{
+	{http.MethodPost, []string{"accounts"}, (*Server).registerAccount},
+	{http.MethodGet, []string{"accounts", "{id}"}, (*Server).account},
+	{http.MethodPost, []string{"accounts", "{id}", "deposits"}, (*Server).deposit},
+	{http.MethodPost, []string{"accounts", "{id}", "payments"}, (*Server).pay},
+	{http.MethodPost, []string{"accounts", "{id}", "transfers"}, (*Server).transfer},
+	{http.MethodGet, []string{"accounts", "{id}", "payments"}, (*Server).history},
+	{http.MethodGet, []string{"accounts", "{id}", "favorites"}, (*Server).favorites},
+	{http.MethodPost, []string{"accounts", "{id}", "holds"}, (*Server).authorize},
+	{http.MethodGet, []string{"accounts", "{id}", "holds"}, (*Server).holds},
+	{http.MethodGet, []string{"accounts", "{id}", "balance"}, (*Server).balance},
+	{http.MethodGet, []string{"payments", "{id}"}, (*Server).payment},
+	{http.MethodPost, []string{"payments", "{id}", "reject"}, (*Server).reject},
+	{http.MethodPost, []string{"payments", "{id}", "repeat"}, (*Server).repeat},
+	{http.MethodPost, []string{"payments", "{id}", "favorites"}, (*Server).favoritePayment},
+	{http.MethodPost, []string{"payments", "{id}", "refunds"}, (*Server).refund},
+	{http.MethodGet, []string{"payments", "{id}", "refunds"}, (*Server).refunds},
+	{http.MethodGet, []string{"favorites", "{id}"}, (*Server).favorite},
+	{http.MethodPost, []string{"favorites", "{id}", "payments"}, (*Server).payFromFavorite},
+	{http.MethodGet, []string{"holds", "{id}"}, (*Server).hold},
+	{http.MethodPost, []string{"holds", "{id}", "capture"}, (*Server).capture},
+	{http.MethodPost, []string{"holds", "{id}", "void"}, (*Server).void},
+}
+
+// match returns the unescaped {id} segment if the escaped path fits the
+// pattern, so an ID may have a slash in it
+func match(pattern []string, path []string) (string, bool) {
+	if len(pattern) != len(path) {
+		return "", false
+	}
+	id := ""
+	for i, segment := range pattern {
+		switch {
+		case segment == "{id}" && path[i] != "":
+			var err error
+			id, err = url.PathUnescape(path[i])
+			if err != nil {
+				return "", false
+			}
+		case segment != path[i]:
+			return "", false
+		}
+	}
+	return id, true
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	allowed := []string{}
+	for _, route := range routes {
+		id, ok := match(route.pattern, path)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+
+		status, body, err := route.handle(s.as(r), r, id)
+		if err != nil {
+			status, body = errorResponse(err)
+		}
+		writeJSON(w, status, body)
+		return
+	}
+
+	if len(allowed) != 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{"method not allowed", CodeMethodNotAllowed})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, ErrorResponse{"not found", CodeNotFound})
+}
+
+// as returns the server that calls the service as the actor of the request
+func (s *Server) as(r *http.Request) *Server {
+	actor := r.Header.Get(ActorHeader)
+	if actor == "" {
+		actor = r.RemoteAddr
+	}
+	return &Server{service: s.service.As(actor).From(r.RemoteAddr)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// readJSON decodes the body of the request into v, unknown fields are an
+// error so that a typo doesn't go unnoticed
+func readJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return badRequest("bad request body: %v", err)
+	}
+	return nil
+}
+
+func parseAccountID(id string) (int64, error) {
+	accountID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, badRequest("bad account ID %q", id)
+	}
+	return accountID, nil
+}
+
+func (s *Server) registerAccount(r *http.Request, _ string) (int, interface{}, error) {
+	request := AccountRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	if request.Currency == "" {
+		request.Currency = types.DefaultCurrency
+	}
+	account, err := s.service.RegisterAccountInCurrency(request.Phone, request.Currency)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, account, nil
+}
+
+func (s *Server) account(_ *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	account, err := s.service.FindAccountByID(accountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, account, nil
+}
+
+func (s *Server) deposit(r *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	request := DepositRequest{}
+	err = readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	err = s.service.DepositIdempotent(r.Header.Get(IdempotencyKeyHeader), accountID, request.Amount)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.account(r, id)
+}
+
+func (s *Server) pay(r *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	request := PaymentRequest{}
+	err = readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	payment, err := s.service.PayIdempotent(r.Header.Get(IdempotencyKeyHeader), accountID, request.Amount, request.Category)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, payment, nil
+}
+
+func (s *Server) transfer(r *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	request := TransferRequest{}
+	err = readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	payment, err := s.service.TransferIdempotent(r.Header.Get(IdempotencyKeyHeader), accountID, request.ToAccountID, request.Amount)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, payment, nil
+}
+
+func (s *Server) history(_ *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	payments, err := s.service.ExportAccountHistory(accountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, payments, nil
+}
+
+func (s *Server) favorites(_ *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	favorites, err := s.service.FindFavoritesByAccountID(accountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, favorites, nil
+}
+
+func (s *Server) authorize(r *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	request := HoldRequest{}
+	err = readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	hold, err := s.service.Authorize(accountID, request.Amount, request.Category)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, hold, nil
+}
+
+func (s *Server) holds(_ *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	holds, err := s.service.FindHoldsByAccountID(accountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, holds, nil
+}
+
+func (s *Server) balance(_ *http.Request, id string) (int, interface{}, error) {
+	accountID, err := parseAccountID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	balance, err := s.service.AccountBalance(accountID)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, balance, nil
+}
+
+func (s *Server) payment(_ *http.Request, id string) (int, interface{}, error) {
+	payment, err := s.service.FindPaymentByID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, payment, nil
+}
+
+func (s *Server) reject(r *http.Request, id string) (int, interface{}, error) {
+	err := s.service.Reject(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.payment(r, id)
+}
+
+func (s *Server) repeat(_ *http.Request, id string) (int, interface{}, error) {
+	payment, err := s.service.Repeat(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, payment, nil
+}
+
+func (s *Server) favoritePayment(r *http.Request, id string) (int, interface{}, error) {
+	request := FavoriteRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	favorite, err := s.service.FavoritePayment(id, request.Name)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, favorite, nil
+}
+
+func (s *Server) refund(r *http.Request, id string) (int, interface{}, error) {
+	request := RefundRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	refund, err := s.service.RefundIdempotent(r.Header.Get(IdempotencyKeyHeader), id, request.Amount)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, refund, nil
+}
+
+func (s *Server) refunds(_ *http.Request, id string) (int, interface{}, error) {
+	refunds, err := s.service.Refunds(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, refunds, nil
+}
+
+func (s *Server) favorite(_ *http.Request, id string) (int, interface{}, error) {
+	favorite, err := s.service.FindFavoriteByID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, favorite, nil
+}
+
+func (s *Server) payFromFavorite(r *http.Request, id string) (int, interface{}, error) {
+	payment, err := s.service.PayFromFavoriteIdempotent(r.Header.Get(IdempotencyKeyHeader), id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, payment, nil
+}
+
+func (s *Server) hold(_ *http.Request, id string) (int, interface{}, error) {
+	hold, err := s.service.FindHoldByID(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusOK, hold, nil
+}
+
+func (s *Server) capture(r *http.Request, id string) (int, interface{}, error) {
+	request := CaptureRequest{}
+	err := readJSON(r, &request)
+	if err != nil {
+		return 0, nil, err
+	}
+	payment, err := s.service.Capture(id, request.Amount)
+	if err != nil {
+		return 0, nil, err
+	}
+	return http.StatusCreated, payment, nil
+}
+
+func (s *Server) void(r *http.Request, id string) (int, interface{}, error) {
+	err := s.service.Void(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return s.hold(r, id)
+}
+
+// Serve serves the handler on the listener until ctx is done, then stops
+// accepting connections and waits up to ShutdownTimeout for the requests in
+// flight to finish
+func Serve(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	// Serve returns http.ErrServerClosed as soon as Shutdown starts
+	<-errs
+	return err
+}
+
+// ListenAndServe listens on the TCP address and serves the handler like Serve
+func ListenAndServe(ctx context.Context, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, listener, handler)
+}
@@ -0,0 +1,384 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/Tursunkhuja/wallet/pkg/wallet"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	service, err := wallet.NewService(wallet.NewMemoryStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(service))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// call sends the request and decodes the response into result,
+// it returns the status of the response
+func call(t *testing.T, server *httptest.Server, method string, path string, body interface{}, result interface{}) int {
+	var content []byte
+	if body != nil {
+		var err error
+		content, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	request, err := http.NewRequest(method, server.URL+path, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if result != nil {
+		err = json.NewDecoder(response.Body).Decode(result)
+		if err != nil {
+			t.Fatalf("%v %v: bad response body: %v", method, path, err)
+		}
+	}
+	return response.StatusCode
+}
+
+func TestServer_session(t *testing.T) {
+	server := newTestServer(t)
+
+	account := types.Account{}
+	status := call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, &account)
+	if status != http.StatusCreated || account.ID != 1 || account.Phone != "+992000000001" {
+		t.Errorf("POST /accounts: status %v, account %v", status, account)
+		return
+	}
+
+	status = call(t, server, http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: 1_000}, &account)
+	if status != http.StatusOK || account.Balance != 1_000 {
+		t.Errorf("POST /accounts/1/deposits: status %v, account %v", status, account)
+		return
+	}
+
+	payment := types.Payment{}
+	status = call(t, server, http.MethodPost, "/accounts/1/payments", PaymentRequest{Amount: 300, Category: "auto"}, &payment)
+	if status != http.StatusCreated || payment.Amount != 300 || payment.Category != "auto" {
+		t.Errorf("POST /accounts/1/payments: status %v, payment %v", status, payment)
+		return
+	}
+
+	favorite := types.Favorite{}
+	status = call(t, server, http.MethodPost, "/payments/"+payment.ID+"/favorites", FavoriteRequest{Name: "car"}, &favorite)
+	if status != http.StatusCreated || favorite.Name != "car" || favorite.Amount != 300 {
+		t.Errorf("POST /payments/{id}/favorites: status %v, favorite %v", status, favorite)
+		return
+	}
+
+	fromFavorite := types.Payment{}
+	status = call(t, server, http.MethodPost, "/favorites/"+favorite.ID+"/payments", nil, &fromFavorite)
+	if status != http.StatusCreated || fromFavorite.Amount != 300 {
+		t.Errorf("POST /favorites/{id}/payments: status %v, payment %v", status, fromFavorite)
+		return
+	}
+
+	repeated := types.Payment{}
+	status = call(t, server, http.MethodPost, "/payments/"+payment.ID+"/repeat", nil, &repeated)
+	if status != http.StatusCreated || repeated.ID == payment.ID {
+		t.Errorf("POST /payments/{id}/repeat: status %v, payment %v", status, repeated)
+		return
+	}
+
+	rejected := types.Payment{}
+	status = call(t, server, http.MethodPost, "/payments/"+payment.ID+"/reject", nil, &rejected)
+	if status != http.StatusOK || rejected.Status != types.PaymentStatusFail {
+		t.Errorf("POST /payments/{id}/reject: status %v, payment %v", status, rejected)
+		return
+	}
+
+	history := []types.Payment{}
+	status = call(t, server, http.MethodGet, "/accounts/1/payments", nil, &history)
+	if status != http.StatusOK || len(history) != 3 {
+		t.Errorf("GET /accounts/1/payments: status %v, payments %v", status, history)
+	}
+
+	favorites := []types.Favorite{}
+	status = call(t, server, http.MethodGet, "/accounts/1/favorites", nil, &favorites)
+	if status != http.StatusOK || len(favorites) != 1 || favorites[0].ID != favorite.ID {
+		t.Errorf("GET /accounts/1/favorites: status %v, favorites %v", status, favorites)
+	}
+
+	// 1000 - 300 - 300 - 300 + 300
+	status = call(t, server, http.MethodGet, "/accounts/1", nil, &account)
+	if status != http.StatusOK || account.Balance != 400 {
+		t.Errorf("GET /accounts/1: status %v, account %v", status, account)
+	}
+}
+
+func TestServer_transfer(t *testing.T) {
+	server := newTestServer(t)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000002"}, nil)
+	call(t, server, http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: 100}, nil)
+
+	payment := types.Payment{}
+	status := call(t, server, http.MethodPost, "/accounts/1/transfers", TransferRequest{ToAccountID: 2, Amount: 40}, &payment)
+	if status != http.StatusCreated || payment.ToAccountID != 2 || payment.Amount != 40 {
+		t.Errorf("POST /accounts/1/transfers: status %v, payment %v", status, payment)
+		return
+	}
+
+	got := types.Payment{}
+	status = call(t, server, http.MethodGet, "/payments/"+payment.ID, nil, &got)
+	if status != http.StatusOK || got.ID != payment.ID {
+		t.Errorf("GET /payments/{id}: status %v, payment %v", status, got)
+	}
+
+	account := types.Account{}
+	call(t, server, http.MethodGet, "/accounts/2", nil, &account)
+	if account.Balance != 40 {
+		t.Errorf("GET /accounts/2: balance expected:%v, actual:%v", 40, account.Balance)
+	}
+}
+
+func TestServer_refund(t *testing.T) {
+	server := newTestServer(t)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+	call(t, server, http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: 100}, nil)
+	payment := types.Payment{}
+	call(t, server, http.MethodPost, "/accounts/1/payments", PaymentRequest{Amount: 50, Category: "auto"}, &payment)
+
+	refund := types.Payment{}
+	status := call(t, server, http.MethodPost, "/payments/"+payment.ID+"/refunds", RefundRequest{Amount: 20}, &refund)
+	if status != http.StatusCreated || refund.RefundOf != payment.ID || refund.Amount != 20 {
+		t.Errorf("POST /payments/{id}/refunds: status %v, refund %v", status, refund)
+		return
+	}
+
+	response := ErrorResponse{}
+	status = call(t, server, http.MethodPost, "/payments/"+payment.ID+"/refunds", RefundRequest{Amount: 31}, &response)
+	if status != http.StatusUnprocessableEntity || response.Code != "refund_too_large" {
+		t.Errorf("POST /payments/{id}/refunds: status %v, response %v", status, response)
+	}
+
+	refunds := []types.Payment{}
+	status = call(t, server, http.MethodGet, "/payments/"+payment.ID+"/refunds", nil, &refunds)
+	if status != http.StatusOK || len(refunds) != 1 || refunds[0].ID != refund.ID {
+		t.Errorf("GET /payments/{id}/refunds: status %v, refunds %v", status, refunds)
+	}
+}
+
+func TestServer_holds(t *testing.T) {
+	server := newTestServer(t)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+	call(t, server, http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: 100}, nil)
+
+	hold := types.Hold{}
+	status := call(t, server, http.MethodPost, "/accounts/1/holds", HoldRequest{Amount: 60, Category: "auto"}, &hold)
+	if status != http.StatusCreated || hold.Amount != 60 || hold.Status != types.HoldStatusActive {
+		t.Errorf("POST /accounts/1/holds: status %v, hold %v", status, hold)
+		return
+	}
+	other := types.Hold{}
+	call(t, server, http.MethodPost, "/accounts/1/holds", HoldRequest{Amount: 10, Category: "food"}, &other)
+
+	balance := types.AccountBalance{}
+	status = call(t, server, http.MethodGet, "/accounts/1/balance", nil, &balance)
+	if status != http.StatusOK || balance.Balance != 100 || balance.Available != 30 {
+		t.Errorf("GET /accounts/1/balance: status %v, balance %v", status, balance)
+	}
+
+	response := ErrorResponse{}
+	status = call(t, server, http.MethodPost, "/holds/"+hold.ID+"/capture", CaptureRequest{Amount: 61}, &response)
+	if status != http.StatusUnprocessableEntity || response.Code != "capture_too_large" {
+		t.Errorf("POST /holds/{id}/capture: status %v, response %v", status, response)
+	}
+	payment := types.Payment{}
+	status = call(t, server, http.MethodPost, "/holds/"+hold.ID+"/capture", CaptureRequest{Amount: 40}, &payment)
+	if status != http.StatusCreated || payment.Amount != 40 {
+		t.Errorf("POST /holds/{id}/capture: status %v, payment %v", status, payment)
+	}
+
+	status = call(t, server, http.MethodPost, "/holds/"+other.ID+"/void", nil, &other)
+	if status != http.StatusOK || other.Status != types.HoldStatusVoided {
+		t.Errorf("POST /holds/{id}/void: status %v, hold %v", status, other)
+	}
+	status = call(t, server, http.MethodPost, "/holds/"+other.ID+"/void", nil, &response)
+	if status != http.StatusConflict || response.Code != "hold_not_active" {
+		t.Errorf("POST /holds/{id}/void: status %v, response %v", status, response)
+	}
+	status = call(t, server, http.MethodGet, "/holds/unknown", nil, &response)
+	if status != http.StatusNotFound || response.Code != "hold_not_found" {
+		t.Errorf("GET /holds/{id}: status %v, response %v", status, response)
+	}
+
+	holds := []types.Hold{}
+	status = call(t, server, http.MethodGet, "/accounts/1/holds", nil, &holds)
+	if status != http.StatusOK || len(holds) != 2 || holds[0].Status != types.HoldStatusCaptured || holds[0].PaymentID != payment.ID {
+		t.Errorf("GET /accounts/1/holds: status %v, holds %v", status, holds)
+	}
+}
+
+func TestServer_idempotencyKey(t *testing.T) {
+	server := newTestServer(t)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+	call(t, server, http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: 100}, nil)
+
+	pay := func(amount types.Money) (int, types.Payment) {
+		content, _ := json.Marshal(PaymentRequest{Amount: amount, Category: "auto"})
+		request, _ := http.NewRequest(http.MethodPost, server.URL+"/accounts/1/payments", bytes.NewReader(content))
+		request.Header.Set(IdempotencyKeyHeader, "key-1")
+		response, err := server.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		payment := types.Payment{}
+		_ = json.NewDecoder(response.Body).Decode(&payment)
+		return response.StatusCode, payment
+	}
+
+	_, first := pay(10)
+	status, second := pay(10)
+	if status != http.StatusCreated || first.ID != second.ID {
+		t.Errorf("repeated request: status %v, payments %v and %v", status, first.ID, second.ID)
+	}
+
+	status, _ = pay(20)
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("reused key: status expected:%v, actual:%v", http.StatusUnprocessableEntity, status)
+	}
+}
+
+func TestServer_actor(t *testing.T) {
+	service, err := wallet.NewService(wallet.NewMemoryStorage(), wallet.WithAudit(t.TempDir()+"/audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	server := httptest.NewServer(New(service))
+	defer server.Close()
+
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+	content, _ := json.Marshal(DepositRequest{Amount: 100})
+	request, _ := http.NewRequest(http.MethodPost, server.URL+"/accounts/1/deposits", bytes.NewReader(content))
+	request.Header.Set(ActorHeader, "support")
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	records, err := service.AuditByAccount(1)
+	if err != nil || len(records) != 2 {
+		t.Errorf("AuditByAccount(): records %v, error %v", records, err)
+		return
+	}
+	if _, _, err := net.SplitHostPort(records[0].Actor); err != nil || records[1].Actor != "support" {
+		t.Errorf("AuditByAccount(): actors %q and %q", records[0].Actor, records[1].Actor)
+	}
+	if records[0].Source != records[0].Actor || records[1].Source != records[0].Actor {
+		t.Errorf("AuditByAccount(): sources %q and %q, want %q", records[0].Source, records[1].Source, records[0].Actor)
+	}
+}
+
+func TestServer_errors(t *testing.T) {
+	server := newTestServer(t)
+	call(t, server, http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, nil)
+
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/accounts/2", nil, http.StatusNotFound, "account_not_found"},
+		{http.MethodGet, "/accounts/one", nil, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/payments/p1", nil, http.StatusNotFound, "payment_not_found"},
+		{http.MethodPost, "/payments/p1/reject", nil, http.StatusNotFound, "payment_not_found"},
+		{http.MethodPost, "/favorites/f1/payments", nil, http.StatusNotFound, "favorite_not_found"},
+		{http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000001"}, http.StatusConflict, "phone_registered"},
+		{http.MethodPost, "/accounts", AccountRequest{Phone: "+992000000002", Currency: "XYZ"}, http.StatusUnprocessableEntity, "unknown_currency"},
+		{http.MethodPost, "/accounts/1/payments", PaymentRequest{Amount: 10, Category: "auto"}, http.StatusUnprocessableEntity, "not_enough_balance"},
+		{http.MethodPost, "/accounts/1/deposits", DepositRequest{Amount: -10}, http.StatusUnprocessableEntity, "amount_must_be_positive"},
+		{http.MethodPost, "/accounts/1/transfers", TransferRequest{ToAccountID: 1, Amount: 10}, http.StatusUnprocessableEntity, "transfer_to_same_account"},
+		{http.MethodPost, "/accounts/1/deposits", map[string]int{"amunt": 10}, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodPost, "/accounts/1/deposits", nil, http.StatusBadRequest, CodeBadRequest},
+		{http.MethodGet, "/balances", nil, http.StatusNotFound, CodeNotFound},
+		{http.MethodDelete, "/accounts/1", nil, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		result := ErrorResponse{}
+		status := call(t, server, tt.method, tt.path, tt.body, &result)
+		if status != tt.status || result.Code != tt.code || result.Error == "" {
+			t.Errorf("%v %v: expected %v %v, actual %v %v", tt.method, tt.path, tt.status, tt.code, status, result)
+		}
+	}
+}
+
+func TestErrorFromCode(t *testing.T) {
+	for _, v := range errorCodes {
+		if ErrorFromCode(v.code) != v.err {
+			t.Errorf("ErrorFromCode(%v): expected %v", v.code, v.err)
+		}
+	}
+	if ErrorFromCode(CodeInternal) != nil {
+		t.Errorf("ErrorFromCode(%v): must be nil", CodeInternal)
+	}
+}
+
+func TestServe_shutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, listener, handler)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- 0
+			return
+		}
+		response.Body.Close()
+		responses <- response.StatusCode
+	}()
+
+	// the request in flight is finished after the shutdown starts
+	<-started
+	cancel()
+	if status := <-responses; status != http.StatusNoContent {
+		t.Errorf("Serve(): request in flight got status %v", status)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve(): error = %v", err)
+	}
+
+	_, err = http.Get("http://" + listener.Addr().String())
+	if err == nil {
+		t.Errorf("Serve(): must not accept connections after shutdown")
+	}
+}
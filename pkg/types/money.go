@@ -0,0 +1,194 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrOverflow — результат операции над суммами не помещается в Money.
+var ErrOverflow = errors.New("amount overflow")
+
+// ErrInvalidAmount — строку нельзя разобрать как сумму.
+var ErrInvalidAmount = errors.New("invalid amount")
+
+// Add возвращает m + other или ErrOverflow, если сумма не помещается в Money.
+func (m Money) Add(other Money) (Money, error) {
+	sum := m + other
+	if other > 0 && sum < m || other < 0 && sum > m {
+		return 0, ErrOverflow
+	}
+	return sum, nil
+}
+
+// Sub возвращает m - other или ErrOverflow, если разность не помещается в Money.
+func (m Money) Sub(other Money) (Money, error) {
+	difference := m - other
+	if other > 0 && difference > m || other < 0 && difference < m {
+		return 0, ErrOverflow
+	}
+	return difference, nil
+}
+
+// Locale задаёт разделители, с которыми суммы записываются для людей.
+type Locale struct {
+	Decimal  rune // разделитель дробной части
+	Grouping rune // разделитель групп разрядов, 0 — без групп
+}
+
+// Предопределённые локали: LocalePlain используют Format и ParseMoney.
+var (
+	LocalePlain = Locale{Decimal: '.'}                // 1234.56
+	LocaleEN    = Locale{Decimal: '.', Grouping: ','} // 1,234.56
+	LocaleRU    = Locale{Decimal: ',', Grouping: ' '} // 1 234,56, так же пишут в Таджикистане
+)
+
+// Format записывает сумму в основных единицах валюты с её кодом, например «12.34 TJS».
+// Сумма в неизвестной валюте записывается в минимальных единицах.
+func (m Money) Format(currency Currency) string {
+	return m.FormatLocale(currency, LocalePlain)
+}
+
+// FormatLocale — Format с разделителями локали, например «1 234,56 TJS» для LocaleRU.
+func (m Money) FormatLocale(currency Currency, locale Locale) string {
+	exponent, _ := currency.Exponent()
+
+	// модуль MinInt64 не помещается в int64
+	magnitude := uint64(m)
+	if m < 0 {
+		magnitude = uint64(-(m + 1)) + 1
+	}
+	digits := strconv.FormatUint(magnitude, 10)
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-exponent], digits[len(digits)-exponent:]
+
+	b := strings.Builder{}
+	if m < 0 {
+		b.WriteByte('-')
+	}
+	for i, digit := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 && locale.Grouping != 0 {
+			b.WriteRune(locale.Grouping)
+		}
+		b.WriteRune(digit)
+	}
+	if exponent > 0 {
+		b.WriteRune(locale.Decimal)
+		b.WriteString(fraction)
+	}
+	b.WriteByte(' ')
+	b.WriteString(string(currency))
+	return b.String()
+}
+
+// ParseMoney разбирает введённую человеком сумму в основных единицах валюты, например «12.34»
+// или «12.34 TJS», и возвращает её в минимальных единицах. Знаков после точки не больше,
+// чем у валюты: сумма не округляется.
+func ParseMoney(s string, currency Currency) (Money, error) {
+	return ParseMoneyLocale(s, currency, LocalePlain)
+}
+
+// ParseMoneyLocale — ParseMoney с разделителями локали. Группы разрядов, если они есть,
+// должны быть по три цифры: «1,234» в LocaleEN — это 1234, а «12,34» — ошибка.
+// Для локали с пробелом между группами подходят и неразрывные пробелы.
+func ParseMoneyLocale(s string, currency Currency, locale Locale) (Money, error) {
+	exponent, ok := currency.Exponent()
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown currency %q", ErrInvalidAmount, currency)
+	}
+	bad := func(reason string) error {
+		return fmt.Errorf("%w %q: %v", ErrInvalidAmount, s, reason)
+	}
+
+	text := strings.TrimSpace(s)
+	text = strings.TrimSpace(strings.TrimSuffix(text, string(currency)))
+	negative := false
+	if strings.HasPrefix(text, "-") || strings.HasPrefix(text, "+") {
+		negative = text[0] == '-'
+		text = text[1:]
+	}
+
+	whole, fraction := text, ""
+	if i := strings.IndexRune(text, locale.Decimal); i >= 0 {
+		whole, fraction = text[:i], text[i+utf8.RuneLen(locale.Decimal):]
+		if fraction == "" {
+			return 0, bad("no digits after the decimal separator")
+		}
+	}
+	whole, err := ungroup(whole, locale.Grouping)
+	if err != nil {
+		return 0, bad(err.Error())
+	}
+	if !isDigits(fraction) {
+		return 0, bad("not a number")
+	}
+	if len(fraction) > exponent {
+		return 0, bad(fmt.Sprintf("more than %v decimals in %v", exponent, currency))
+	}
+	digits := whole + fraction + strings.Repeat("0", exponent-len(fraction))
+
+	// MinInt64 по модулю на единицу больше MaxInt64
+	limit := uint64(math.MaxInt64)
+	if negative {
+		limit++
+	}
+	magnitude := uint64(0)
+	for _, digit := range digits {
+		d := uint64(digit - '0')
+		if magnitude > (limit-d)/10 {
+			return 0, ErrOverflow
+		}
+		magnitude = magnitude*10 + d
+	}
+	if negative {
+		return Money(-int64(magnitude)), nil
+	}
+	return Money(magnitude), nil
+}
+
+// ungroup убирает разделители групп разрядов из целой части и проверяет группы
+func ungroup(whole string, grouping rune) (string, error) {
+	groups := []string{whole}
+	if grouping != 0 {
+		groups = splitGroups(whole, grouping)
+	}
+	for i, group := range groups {
+		if group == "" || !isDigits(group) {
+			return "", errors.New("not a number")
+		}
+		if len(groups) > 1 && (i == 0 && len(group) > 3 || i > 0 && len(group) != 3) {
+			return "", errors.New("digit groups must be of three")
+		}
+	}
+	return strings.Join(groups, ""), nil
+}
+
+func splitGroups(s string, grouping rune) []string {
+	groups := []string{}
+	start := 0
+	for i, r := range s {
+		if r == grouping || isSpace(grouping) && isSpace(r) {
+			groups = append(groups, s[start:i])
+			start = i + utf8.RuneLen(r)
+		}
+	}
+	return append(groups, s[start:])
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\u00a0' || r == '\u202f'
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
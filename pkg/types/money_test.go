@@ -0,0 +1,209 @@
+package types
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func TestMoney_Add(t *testing.T) {
+	tests := []struct {
+		a, b     Money
+		expected Money
+		err      error
+	}{
+		{1, 2, 3, nil},
+		{-1, -2, -3, nil},
+		{math.MaxInt64, 0, math.MaxInt64, nil},
+		{math.MaxInt64, 1, 0, ErrOverflow},
+		{math.MinInt64, -1, 0, ErrOverflow},
+		{math.MaxInt64, math.MinInt64, -1, nil},
+	}
+	for _, tt := range tests {
+		sum, err := tt.a.Add(tt.b)
+		if sum != tt.expected || err != tt.err {
+			t.Errorf("%v.Add(%v): expected %v %v, actual %v %v", tt.a, tt.b, tt.expected, tt.err, sum, err)
+		}
+	}
+}
+
+func TestMoney_Sub(t *testing.T) {
+	tests := []struct {
+		a, b     Money
+		expected Money
+		err      error
+	}{
+		{3, 2, 1, nil},
+		{0, math.MaxInt64, -math.MaxInt64, nil},
+		{-2, math.MaxInt64, 0, ErrOverflow},
+		{0, math.MinInt64, 0, ErrOverflow},
+		{math.MaxInt64, -1, 0, ErrOverflow},
+		{-1, math.MinInt64, math.MaxInt64, nil},
+	}
+	for _, tt := range tests {
+		difference, err := tt.a.Sub(tt.b)
+		if difference != tt.expected || err != tt.err {
+			t.Errorf("%v.Sub(%v): expected %v %v, actual %v %v", tt.a, tt.b, tt.expected, tt.err, difference, err)
+		}
+	}
+}
+
+func TestMoney_Format(t *testing.T) {
+	tests := []struct {
+		amount   Money
+		currency Currency
+		locale   Locale
+		expected string
+	}{
+		{1234, "TJS", LocalePlain, "12.34 TJS"},
+		{5, "TJS", LocalePlain, "0.05 TJS"},
+		{0, "USD", LocalePlain, "0.00 USD"},
+		{-150, "USD", LocalePlain, "-1.50 USD"},
+		{1234, "JPY", LocalePlain, "1234 JPY"},
+		{1234, "KWD", LocalePlain, "1.234 KWD"},
+		{1234, "XYZ", LocalePlain, "1234 XYZ"},
+		{123456789, "TJS", LocaleEN, "1,234,567.89 TJS"},
+		{123456789, "TJS", LocaleRU, "1 234 567,89 TJS"},
+		{12345, "TJS", LocaleRU, "123,45 TJS"},
+		{-100000, "JPY", LocaleEN, "-100,000 JPY"},
+		{math.MinInt64, "TJS", LocalePlain, "-92233720368547758.08 TJS"},
+	}
+	for _, tt := range tests {
+		formatted := tt.amount.FormatLocale(tt.currency, tt.locale)
+		if formatted != tt.expected {
+			t.Errorf("%v.FormatLocale(%v, %q): expected %q, actual %q", int64(tt.amount), tt.currency, tt.locale, tt.expected, formatted)
+		}
+	}
+	if formatted := Money(1234).Format("TJS"); formatted != "12.34 TJS" {
+		t.Errorf("Format(): expected %q, actual %q", "12.34 TJS", formatted)
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency Currency
+		locale   Locale
+		expected Money
+	}{
+		{"12.34", "TJS", LocalePlain, 1234},
+		{" 12.34 TJS ", "TJS", LocalePlain, 1234},
+		{"12", "TJS", LocalePlain, 1200},
+		{"12.3", "TJS", LocalePlain, 1230},
+		{"0.05", "TJS", LocalePlain, 5},
+		{"-1.50", "USD", LocalePlain, -150},
+		{"+1", "USD", LocalePlain, 100},
+		{"1234", "JPY", LocalePlain, 1234},
+		{"1.234", "KWD", LocalePlain, 1234},
+		{"1,234,567.89", "TJS", LocaleEN, 123456789},
+		{"1,234", "TJS", LocaleEN, 123400},
+		{"1 234 567,89", "TJS", LocaleRU, 123456789},
+		{"1 234,5", "TJS", LocaleRU, 123450},
+		{"1234,5", "TJS", LocaleRU, 123450},
+		{"92233720368547758.07", "TJS", LocalePlain, math.MaxInt64},
+		{"-92233720368547758.08", "TJS", LocalePlain, math.MinInt64},
+	}
+	for _, tt := range tests {
+		amount, err := ParseMoneyLocale(tt.s, tt.currency, tt.locale)
+		if err != nil || amount != tt.expected {
+			t.Errorf("ParseMoneyLocale(%q, %v): expected %v, actual %v, error %v", tt.s, tt.currency, tt.expected, amount, err)
+		}
+	}
+}
+
+func TestParseMoney_fail(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency Currency
+		locale   Locale
+		err      error
+	}{
+		{"", "TJS", LocalePlain, ErrInvalidAmount},
+		{"-", "TJS", LocalePlain, ErrInvalidAmount},
+		{"12.345", "TJS", LocalePlain, ErrInvalidAmount},
+		{"1.5", "JPY", LocalePlain, ErrInvalidAmount},
+		{"12.", "TJS", LocalePlain, ErrInvalidAmount},
+		{".5", "TJS", LocalePlain, ErrInvalidAmount},
+		{"1.2.3", "TJS", LocalePlain, ErrInvalidAmount},
+		{"12,34", "TJS", LocalePlain, ErrInvalidAmount},
+		{"12 USD", "TJS", LocalePlain, ErrInvalidAmount},
+		{"1e3", "TJS", LocalePlain, ErrInvalidAmount},
+		{"12", "XYZ", LocalePlain, ErrInvalidAmount},
+		{"12,34", "TJS", LocaleEN, ErrInvalidAmount},
+		{"1,,234", "TJS", LocaleEN, ErrInvalidAmount},
+		{",123", "TJS", LocaleEN, ErrInvalidAmount},
+		{"1234,567", "TJS", LocaleEN, ErrInvalidAmount},
+		{"92233720368547758.08", "TJS", LocalePlain, ErrOverflow},
+		{"-92233720368547758.09", "TJS", LocalePlain, ErrOverflow},
+		{"99999999999999999999", "JPY", LocalePlain, ErrOverflow},
+	}
+	for _, tt := range tests {
+		_, err := ParseMoneyLocale(tt.s, tt.currency, tt.locale)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("ParseMoneyLocale(%q, %v): must return %v, returned = %v", tt.s, tt.currency, tt.err, err)
+		}
+	}
+}
+
+var fuzzLocales = []Locale{LocalePlain, LocaleEN, LocaleRU}
+
+func FuzzMoney_Add(f *testing.F) {
+	f.Add(int64(1), int64(2))
+	f.Add(int64(math.MaxInt64), int64(1))
+	f.Add(int64(math.MinInt64), int64(-1))
+	f.Fuzz(func(t *testing.T, a int64, b int64) {
+		exact := new(big.Int).Add(big.NewInt(a), big.NewInt(b))
+		sum, err := Money(a).Add(Money(b))
+		if exact.IsInt64() != (err == nil) || err == nil && int64(sum) != exact.Int64() {
+			t.Errorf("%v.Add(%v): %v %v, exact %v", a, b, sum, err, exact)
+		}
+
+		exact = new(big.Int).Sub(big.NewInt(a), big.NewInt(b))
+		difference, err := Money(a).Sub(Money(b))
+		if exact.IsInt64() != (err == nil) || err == nil && int64(difference) != exact.Int64() {
+			t.Errorf("%v.Sub(%v): %v %v, exact %v", a, b, difference, err, exact)
+		}
+	})
+}
+
+// FuzzMoney_Format checks that every formatted amount is parsed back
+func FuzzMoney_Format(f *testing.F) {
+	f.Add(int64(1234), "TJS", uint8(0))
+	f.Add(int64(-5), "KWD", uint8(1))
+	f.Add(int64(math.MinInt64), "JPY", uint8(2))
+	f.Fuzz(func(t *testing.T, amount int64, currency string, locale uint8) {
+		if _, ok := Currency(currency).Exponent(); !ok {
+			return
+		}
+		l := fuzzLocales[int(locale)%len(fuzzLocales)]
+		formatted := Money(amount).FormatLocale(Currency(currency), l)
+		parsed, err := ParseMoneyLocale(formatted, Currency(currency), l)
+		if err != nil || int64(parsed) != amount {
+			t.Errorf("ParseMoneyLocale(%q): expected %v, actual %v, error %v", formatted, amount, parsed, err)
+		}
+	})
+}
+
+// FuzzParseMoney checks that the parser doesn't panic and that whatever it
+// accepts is formatted and parsed again to the same amount
+func FuzzParseMoney(f *testing.F) {
+	for _, s := range []string{"12.34", "1,234.56", "1 234,56 TJS", "-0.05", "+7", "", "1.2.3", "99999999999999999999"} {
+		f.Add(s, uint8(0))
+	}
+	f.Fuzz(func(t *testing.T, s string, locale uint8) {
+		l := fuzzLocales[int(locale)%len(fuzzLocales)]
+		amount, err := ParseMoneyLocale(s, DefaultCurrency, l)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidAmount) && !errors.Is(err, ErrOverflow) {
+				t.Errorf("ParseMoneyLocale(%q): unexpected error %v", s, err)
+			}
+			return
+		}
+		formatted := amount.FormatLocale(DefaultCurrency, l)
+		again, err := ParseMoneyLocale(formatted, DefaultCurrency, l)
+		if err != nil || again != amount {
+			t.Errorf("ParseMoneyLocale(%q) = %v, formatted %q parsed to %v, error %v", s, amount, formatted, again, err)
+		}
+	})
+}
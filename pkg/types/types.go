@@ -1,11 +1,50 @@
 package types
 
+import "time"
+
 // Money представляет собой денежную сумму в минимальных единицах (центы, копейки, дирамы и т.д.).
+// Валюта суммы — валюта записи, в которой она хранится (счёта, платежа, избранного).
 type Money int64
 
+// Currency представляет собой код валюты по ISO 4217 (TJS, USD, EUR и т.д.).
+type Currency string
+
+// DefaultCurrency — валюта счетов, открытых без указания валюты, и записей без валюты из старых дампов.
+const DefaultCurrency Currency = "TJS"
+
+// currencyExponents — число знаков минимальных единиц по ISO 4217: 1 TJS = 100 дирамов, у JPY дробных единиц нет.
+var currencyExponents = map[Currency]int{
+	"TJS": 2,
+	"USD": 2,
+	"EUR": 2,
+	"RUB": 2,
+	"UZS": 2,
+	"KZT": 2,
+	"KGS": 2,
+	"CNY": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"TRY": 2,
+	"AED": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+	"BHD": 3,
+	"OMR": 3,
+}
+
+// Exponent возвращает число знаков минимальных единиц валюты, ok равно false для неизвестной валюты.
+func (c Currency) Exponent() (exponent int, ok bool) {
+	exponent, ok = currencyExponents[c]
+	return exponent, ok
+}
+
 // PaymentCategory представляет собой категорию, в которой был совершён платёж (авто, аптеки, рестораны и т.д.).
 type PaymentCategory string
 
+// PaymentCategoryTransfer — категория переводов между счетами.
+const PaymentCategoryTransfer PaymentCategory = "transfer"
+
 // PaymentStatus представляет собой статус платежа.
 type PaymentStatus string
 
@@ -14,31 +53,145 @@ const (
 	PaymentStatusOk         PaymentStatus = "OK"
 	PaymentStatusFail       PaymentStatus = "FAIL"
 	PaymentStatusInProgress PaymentStatus = "INPROGRESS"
+	PaymentStatusConfirmed  PaymentStatus = "CONFIRMED"
 )
 
 // Payment представляет информацию о платеже.
+// Для перевода между счетами ToAccountID — счёт получателя, для обычных платежей он равен 0.
+// Currency — валюта счёта, с которого сделан платёж.
+// Если платёж сделан в другой валюте, OriginalAmount и OriginalCurrency — сумма и валюта платежа,
+// Rate — применённый курс (единиц валюты счёта за единицу OriginalCurrency), а Amount — списанная со счёта сумма.
+// Refunded — сумма частичных возвратов платежа, не больше Amount.
+// Возврат — отдельный платёж на счёт плательщика со статусом OK: RefundOf — ID возвращённого платежа,
+// Amount — возвращённая сумма в валюте счёта.
+// CreatedAt — время создания, UpdatedAt — время последней смены статуса или возврата.
 type Payment struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Category  PaymentCategory
-	Status    PaymentStatus
+	ID          string          `json:"id"`
+	AccountID   int64           `json:"account_id"`
+	Amount      Money           `json:"amount"`
+	Category    PaymentCategory `json:"category"`
+	Status      PaymentStatus   `json:"status"`
+	Currency    Currency        `json:"currency"`
+	ToAccountID int64           `json:"to_account_id,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+
+	OriginalAmount   Money    `json:"original_amount,omitempty"`
+	OriginalCurrency Currency `json:"original_currency,omitempty"`
+	Rate             string   `json:"rate,omitempty"`
+
+	Refunded Money  `json:"refunded,omitempty"`
+	RefundOf string `json:"refund_of,omitempty"`
 }
 
 type Phone string
 
 // Account представляет информацию о счёте пользователя.
+// Currency — валюта, в которой открыт счёт, она не меняется.
+// UpdatedAt — время последнего изменения баланса.
 type Account struct {
-	ID      int64
-	Phone   Phone
-	Balance Money
+	ID        int64     `json:"id"`
+	Phone     Phone     `json:"phone"`
+	Balance   Money     `json:"balance"`
+	Currency  Currency  `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // Favorite представляет информацию об элементе "Избранное".
 type Favorite struct {
-	ID        string
-	AccountID int64
-	Amount    Money
-	Name      string
-	Category  PaymentCategory
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Name      string          `json:"name"`
+	Category  PaymentCategory `json:"category"`
+	Currency  Currency        `json:"currency"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// HoldStatus представляет собой статус блокировки средств.
+type HoldStatus string
+
+// Статусы блокировок: активная блокировка ждёт списания или отмены, остальные статусы конечные.
+const (
+	HoldStatusActive   HoldStatus = "ACTIVE"
+	HoldStatusCaptured HoldStatus = "CAPTURED"
+	HoldStatusVoided   HoldStatus = "VOIDED"
+	HoldStatusExpired  HoldStatus = "EXPIRED"
+)
+
+// Hold представляет блокировку средств на счёте: авторизацию платежа, который спишут позже.
+// Активная блокировка уменьшает доступный баланс счёта, но не меняет ни баланс, ни главную книгу.
+// Captured — списанная сумма, не больше Amount, PaymentID — платёж, которым её списали.
+// После ExpiresAt несписанная и неотменённая блокировка истекает.
+type Hold struct {
+	ID        string          `json:"id"`
+	AccountID int64           `json:"account_id"`
+	Amount    Money           `json:"amount"`
+	Category  PaymentCategory `json:"category"`
+	Currency  Currency        `json:"currency"`
+	Status    HoldStatus      `json:"status"`
+	Captured  Money           `json:"captured,omitempty"`
+	PaymentID string          `json:"payment_id,omitempty"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// AccountBalance представляет балансы счёта: Balance — текущий баланс, Held — сумма активных
+// блокировок, Available — доступная для платежей часть баланса.
+type AccountBalance struct {
+	AccountID int64    `json:"account_id"`
+	Currency  Currency `json:"currency"`
+	Balance   Money    `json:"balance"`
+	Held      Money    `json:"held"`
+	Available Money    `json:"available"`
+}
+
+// LedgerAccount представляет счёт главной книги: счёт пользователя, источник пополнений,
+// счёт продавцов категории и т.д.
+type LedgerAccount string
+
+// Posting представляет проводку главной книги: изменение баланса одного её счёта.
+// Проводки одной операции имеют общий EntryID, их сумма в каждой валюте равна нулю.
+// Положительная сумма увеличивает баланс счёта книги (кредит), отрицательная уменьшает (дебет).
+// Operation — вид операции (пополнение, платёж, отмена и т.д.), PaymentID — её платёж, если он есть.
+type Posting struct {
+	EntryID   string        `json:"entry_id"`
+	Operation string        `json:"operation"`
+	Account   LedgerAccount `json:"account"`
+	Amount    Money         `json:"amount"`
+	Currency  Currency      `json:"currency"`
+	PaymentID string        `json:"payment_id,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+// AuditBalance представляет баланс счёта до и после операции журнала аудита.
+type AuditBalance struct {
+	AccountID int64 `json:"account_id"`
+	Before    Money `json:"before"`
+	After     Money `json:"after"`
+}
+
+// AuditRecord представляет запись журнала аудита: кто, когда и с какими параметрами
+// вызвал операцию, какие счета, платежи, избранное и блокировки она затронула и чем закончилась.
+// Записи связаны в цепочку: Hash — хеш записи вместе с PrevHash, хешем предыдущей.
+// Source — откуда пришёл вызов, например адрес клиента: Actor он называет сам.
+// Error пуст, если операция прошла успешно.
+type AuditRecord struct {
+	Seq       int64             `json:"seq"`
+	Time      time.Time         `json:"time"`
+	Actor     string            `json:"actor"`
+	Source    string            `json:"source,omitempty"`
+	Operation string            `json:"operation"`
+	Params    map[string]string `json:"params,omitempty"`
+	Accounts  []int64           `json:"accounts,omitempty"`
+	Payments  []string          `json:"payments,omitempty"`
+	Favorites []string          `json:"favorites,omitempty"`
+	Holds     []string          `json:"holds,omitempty"`
+	Balances  []AuditBalance    `json:"balances,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
 }
@@ -0,0 +1,478 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrAuditTampered = errors.New("audit log tampered with")
+var ErrNoAuditLog = errors.New("no audit log")
+var ErrAuditFailed = errors.New("audit log can't be written")
+
+// The audit log has a record of every call that changes the service, one
+// JSON object per line. A record has the hash of the record before it and a
+// hash of itself over that, so changing, removing or reordering records
+// breaks the chain from there on; VerifyAuditLog finds where. The log is only
+// ever appended to.
+
+type auditLog struct {
+	mu   sync.Mutex // serializes appends and reads
+	path string
+	file *os.File
+	seq  int64  // of the last record
+	hash string // of the last record
+	err  error  // of the first failed append, the log takes no more records
+}
+
+// WithAudit writes the audit log to the file, a new one or one written by
+// WithAudit before. The restore of WithLog is not audited.
+func WithAudit(path string) Option {
+	return func(s *Service) {
+		s.audit = &auditLog{path: path}
+	}
+}
+
+// As returns the service for the actor, the records of its calls in the
+// audit log name it
+func (s *Service) As(actor string) *Service {
+	s.ready()
+	return &Service{state: s.state, actor: actor, source: s.source}
+}
+
+// From returns the service for calls that come from the source, such as the
+// address of a client, the records of its calls in the audit log keep it next
+// to the actor
+func (s *Service) From(source string) *Service {
+	s.ready()
+	return &Service{state: s.state, actor: s.actor, source: source}
+}
+
+// open checks the chain of the existing records and goes on after the last one
+func (l *auditLog) open() error {
+	last, err := verifyAuditFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.seq, l.hash = last.Seq, last.Hash
+	return nil
+}
+
+// append chains the record to the last one and waits until it is on disk
+func (l *auditLog) append(record types.AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+	err := l.write(record)
+	if err != nil {
+		l.err = fmt.Errorf("%w: %v", ErrAuditFailed, err)
+		return l.err
+	}
+	return nil
+}
+
+// failed returns the error of the failed append, if there was one
+func (l *auditLog) failed() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+func (l *auditLog) write(record types.AuditRecord) error {
+	record.Seq = l.seq + 1
+	record.PrevHash = l.hash
+	record.Hash = hashAuditRecord(record)
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	err = l.file.Sync()
+	if err != nil {
+		return err
+	}
+	l.seq, l.hash = record.Seq, record.Hash
+	return nil
+}
+
+func (l *auditLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
+
+// hashAuditRecord hashes the record without its own hash
+func hashAuditRecord(record types.AuditRecord) string {
+	record.Hash = ""
+	line, err := json.Marshal(record)
+	if err != nil {
+		panic(err) // the record has nothing json can't encode
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// readAuditFile calls read with every record in the order of the file,
+// a missing file has no records
+func readAuditFile(path string, read func(number int, record types.AuditRecord) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeFile(file)
+
+	reader := bufio.NewReader(file)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err == io.EOF {
+			return fmt.Errorf("%w: line %v is incomplete", ErrAuditTampered, number)
+		}
+		if err != nil {
+			return err
+		}
+
+		record := types.AuditRecord{}
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&record)
+		if err != nil {
+			return fmt.Errorf("%w: line %v: %v", ErrAuditTampered, number, err)
+		}
+		err = read(number, record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// verifyAuditFile returns the last record of the file, zero if it is empty
+func verifyAuditFile(path string) (types.AuditRecord, error) {
+	last := types.AuditRecord{}
+	err := readAuditFile(path, func(number int, record types.AuditRecord) error {
+		switch {
+		case record.Seq != last.Seq+1:
+			return fmt.Errorf("%w: line %v: record %v follows record %v", ErrAuditTampered, number, record.Seq, last.Seq)
+		case record.PrevHash != last.Hash:
+			return fmt.Errorf("%w: line %v: record %v doesn't follow the one before it", ErrAuditTampered, number, record.Seq)
+		case record.Hash != hashAuditRecord(record):
+			return fmt.Errorf("%w: line %v: record %v was changed", ErrAuditTampered, number, record.Seq)
+		}
+		last = record
+		return nil
+	})
+	return last, err
+}
+
+// VerifyAuditLog checks the chain of the audit log and returns the number of
+// records, the error wraps ErrAuditTampered and tells the first broken line.
+// Records cut off the end leave an intact chain, so keep the count or the
+// last hash somewhere else to notice that.
+func VerifyAuditLog(path string) (int64, error) {
+	last, err := verifyAuditFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return last.Seq, nil
+}
+
+// VerifyAudit is VerifyAuditLog of the audit log of the service
+func (s *Service) VerifyAudit() (int64, error) {
+	s.ready()
+	if s.audit == nil {
+		return 0, ErrNoAuditLog
+	}
+
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+
+	last, err := verifyAuditFile(s.audit.path)
+	if err != nil {
+		return 0, err
+	}
+	if last.Hash != s.audit.hash {
+		return 0, fmt.Errorf("%w: the last record is not the last one written", ErrAuditTampered)
+	}
+	return last.Seq, nil
+}
+
+// AuditByAccount returns the records of the calls that named or changed the
+// account, oldest first
+func (s *Service) AuditByAccount(accountID int64) ([]types.AuditRecord, error) {
+	s.ready()
+	return s.findAudit(func(record *types.AuditRecord) bool {
+		for _, id := range record.Accounts {
+			if id == accountID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AuditByPayment returns the records of the calls that named or made the
+// payment, oldest first
+func (s *Service) AuditByPayment(paymentID string) ([]types.AuditRecord, error) {
+	s.ready()
+	return s.findAudit(func(record *types.AuditRecord) bool {
+		for _, id := range record.Payments {
+			if id == paymentID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (s *Service) findAudit(match func(record *types.AuditRecord) bool) ([]types.AuditRecord, error) {
+	if s.audit == nil {
+		return nil, ErrNoAuditLog
+	}
+
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+
+	records := []types.AuditRecord{}
+	err := readAuditFile(s.audit.path, func(_ int, record types.AuditRecord) error {
+		if match(&record) {
+			records = append(records, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// auditCall collects the record of a call while it runs
+type auditCall struct {
+	mu       sync.Mutex
+	record   types.AuditRecord
+	balances map[int64]int // account ID -> index in record.Balances
+}
+
+// audited runs the call with a service that collects what it changes and
+// writes the record once it is done. The calls it makes itself, like the Pay
+// of a PayFromFavorite, are a part of its record.
+//
+// A call whose record can't be written fails with ErrAuditFailed, even if
+// its changes are saved, and the calls after it fail before they change
+// anything: the service doesn't work without its audit log.
+func (s *Service) audited(operation string, params map[string]string, run func(s *Service) error) error {
+	if s.audit == nil || s.call != nil {
+		return run(s)
+	}
+	err := s.audit.failed()
+	if err != nil {
+		return err
+	}
+
+	call := &auditCall{
+		record: types.AuditRecord{
+			Time:      s.now(),
+			Actor:     s.actor,
+			Source:    s.source,
+			Operation: operation,
+			Params:    params,
+		},
+		balances: map[int64]int{},
+	}
+	err = run(&Service{state: s.state, actor: s.actor, source: s.source, call: call, key: s.key})
+	if err != nil {
+		call.record.Error = err.Error()
+	}
+
+	auditErr := s.audit.append(call.record)
+	if auditErr != nil && err == nil {
+		return auditErr
+	}
+	if auditErr != nil {
+		return fmt.Errorf("%w, %v", err, auditErr)
+	}
+	return err
+}
+
+// auditParams makes the parameters of a record out of names and values
+func auditParams(pairs ...interface{}) map[string]string {
+	params := map[string]string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		params[fmt.Sprint(pairs[i])] = fmt.Sprint(pairs[i+1])
+	}
+	return params
+}
+
+// account, payment, favorite and hold add the IDs a call names to its record, they
+// do nothing outside of an audited call
+func (c *auditCall) account(id int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addAccount(id)
+}
+
+func (c *auditCall) payment(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record.Payments = addID(c.record.Payments, id)
+}
+
+func (c *auditCall) favorite(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record.Favorites = addID(c.record.Favorites, id)
+}
+
+func (c *auditCall) hold(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record.Holds = addID(c.record.Holds, id)
+}
+
+// param adds what the call found out while running to its parameters,
+// like the rate of a conversion
+func (c *auditCall) param(name string, value interface{}) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.record.Params == nil {
+		c.record.Params = map[string]string{}
+	}
+	c.record.Params[name] = fmt.Sprint(value)
+}
+
+// addAccount must be called with c.mu held
+func (c *auditCall) addAccount(id int64) {
+	for _, v := range c.record.Accounts {
+		if v == id {
+			return
+		}
+	}
+	c.record.Accounts = append(c.record.Accounts, id)
+}
+
+func addID(ids []string, id string) []string {
+	for _, v := range ids {
+		if v == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+// saving takes the balances of the accounts before the batch changes them,
+// it is called by save with the accounts locked
+func (c *auditCall) saving(accounts AccountRepository, b batch) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, account := range b.accounts {
+		c.addAccount(account.ID)
+		if _, ok := c.balances[account.ID]; ok {
+			continue
+		}
+
+		before := types.Money(0) // a new account
+		existing, err := accounts.FindByID(account.ID)
+		if err != nil && err != ErrAccountNotFound {
+			return err
+		}
+		if err == nil {
+			before = existing.Balance
+		}
+		c.balances[account.ID] = len(c.record.Balances)
+		c.record.Balances = append(c.record.Balances, types.AuditBalance{AccountID: account.ID, Before: before, After: before})
+	}
+	return nil
+}
+
+// saved takes the balances and IDs of the batch once it is saved
+func (c *auditCall) saved(b batch) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, account := range b.accounts {
+		c.record.Balances[c.balances[account.ID]].After = account.Balance
+	}
+	for _, payment := range b.payments {
+		c.record.Payments = addID(c.record.Payments, payment.ID)
+		c.addAccount(payment.AccountID)
+		if payment.ToAccountID != 0 {
+			c.addAccount(payment.ToAccountID)
+		}
+	}
+	for _, favorite := range b.favorites {
+		c.record.Favorites = addID(c.record.Favorites, favorite.ID)
+	}
+	for _, hold := range b.holds {
+		c.record.Holds = addID(c.record.Holds, hold.ID)
+		c.addAccount(hold.AccountID)
+	}
+}
+
+// auditedPayment is audited for the calls that make a payment
+func (s *Service) auditedPayment(operation string, params map[string]string, run func(s *Service) (*types.Payment, error)) (*types.Payment, error) {
+	var payment *types.Payment
+	err := s.audited(operation, params, func(s *Service) error {
+		var err error
+		payment, err = run(s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
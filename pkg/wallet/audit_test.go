@@ -0,0 +1,247 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func newAuditTestService(path string, options ...Option) (*Service, error) {
+	s, err := NewService(NewMemoryStorage(), append(options, WithAudit(path))...)
+	if err != nil {
+		return nil, err
+	}
+	return s.As("alice").From("10.0.0.1"), nil
+}
+
+func auditOperations(records []types.AuditRecord) []string {
+	operations := []string{}
+	for _, record := range records {
+		operations = append(operations, record.Operation)
+	}
+	return operations
+}
+
+func TestService_audit(t *testing.T) {
+	path := t.TempDir() + "/audit.log"
+	s, err := newAuditTestService(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	err = fillLoggedService(s)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(99, 10)
+	if err != ErrAccountNotFound {
+		t.Errorf("Deposit(): must return ErrAccountNotFound, returned = %v", err)
+	}
+
+	count, err := s.VerifyAudit()
+	if err != nil || count != 9 {
+		t.Errorf("VerifyAudit(): records %v, error %v", count, err)
+	}
+
+	records, err := s.AuditByAccount(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []string{"RegisterAccountInCurrency", "Transfer"}
+	if !reflect.DeepEqual(auditOperations(records), expected) {
+		t.Errorf("AuditByAccount(): operations %v, expected %v", auditOperations(records), expected)
+		return
+	}
+	transfer := records[1]
+	balances := []types.AuditBalance{
+		{AccountID: 1, Before: 9_000_00, After: 8_999_00},
+		{AccountID: 2, Before: 0, After: 100},
+	}
+	if transfer.Actor != "alice" || transfer.Source != "10.0.0.1" || transfer.Params["amount"] != "100" || len(transfer.Payments) != 1 ||
+		!reflect.DeepEqual(transfer.Balances, balances) {
+		t.Errorf("AuditByAccount(): wrong transfer record %+v", transfer)
+	}
+
+	history, err := s.ExportAccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	records, err = s.AuditByPayment(history[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected = []string{"Pay", "FavoritePayment", "Reject"}
+	if !reflect.DeepEqual(auditOperations(records), expected) {
+		t.Errorf("AuditByPayment(): operations %v, expected %v", auditOperations(records), expected)
+	}
+
+	records, err = s.AuditByAccount(99)
+	if err != nil || len(records) != 1 || records[0].Error != ErrAccountNotFound.Error() || records[0].Balances != nil {
+		t.Errorf("AuditByAccount(): failed call must be recorded, records %+v, error %v", records, err)
+	}
+}
+
+func TestService_audit_nested(t *testing.T) {
+	path := t.TempDir() + "/audit.log"
+	s, err := newAuditTestService(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+
+	ts := &testService{Service: s}
+	_, payments, err := ts.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	repeated, err := s.Repeat(payments[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the PayIn of Repeat is a part of its record
+	records, err := s.AuditByPayment(repeated.ID)
+	if err != nil || len(records) != 1 || records[0].Operation != "Repeat" {
+		t.Errorf("AuditByPayment(): records %+v, error %v", records, err)
+		return
+	}
+	if !reflect.DeepEqual(records[0].Payments, []string{payments[0].ID, repeated.ID}) {
+		t.Errorf("AuditByPayment(): payments %v", records[0].Payments)
+	}
+}
+
+func TestService_audit_reopen(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/audit.log"
+	s1, err := newAuditTestService(path, WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s1.Close()
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the restore from the log is not a call, the chain goes on
+	s2, err := newAuditTestService(path, WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s2.Close()
+	err = s2.Deposit(1, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	count, err := VerifyAuditLog(path)
+	if err != nil || count != 2 {
+		t.Errorf("VerifyAuditLog(): records %v, error %v", count, err)
+	}
+}
+
+func TestService_audit_failed(t *testing.T) {
+	s, err := newAuditTestService(t.TempDir() + "/audit.log")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the file goes away under the log
+	err = s.audit.file.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(account.ID, 100)
+	if !errors.Is(err, ErrAuditFailed) {
+		t.Errorf("Deposit(): must return ErrAuditFailed, returned = %v", err)
+	}
+
+	// the calls after it change nothing
+	_, err = s.Pay(account.ID, 10, "auto")
+	if !errors.Is(err, ErrAuditFailed) {
+		t.Errorf("Pay(): must return ErrAuditFailed, returned = %v", err)
+	}
+	found, err := s.FindAccountByID(account.ID)
+	if err != nil || found.Balance != 100 {
+		t.Errorf("FindAccountByID(): account %+v, error %v", found, err)
+	}
+}
+
+func TestVerifyAuditLog_tampered(t *testing.T) {
+	path := t.TempDir() + "/audit.log"
+	s, err := newAuditTestService(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ts := &testService{Service: s}
+	_, _, err = ts.addAccount(defultTestAccount)
+	if err == nil {
+		err = s.Close()
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	lines = lines[:len(lines)-1] // after the last newline
+
+	tests := []struct {
+		name    string
+		content string
+		message string
+	}{
+		{"changed", lines[0] + strings.Replace(lines[1], `"amount":"1000000"`, `"amount":"10"`, 1) + lines[2],
+			"line 2: record 2 was changed"},
+		{"removed", lines[0] + lines[2], "line 2: record 3 follows record 1"},
+		{"reordered", lines[1] + lines[0] + lines[2], "line 1: record 2 follows record 0"},
+		{"torn", lines[0] + lines[1] + lines[2][:10], "line 3 is incomplete"},
+	}
+	for _, tt := range tests {
+		err = os.WriteFile(path, []byte(tt.content), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = VerifyAuditLog(path)
+		if !errors.Is(err, ErrAuditTampered) || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("VerifyAuditLog(): %v: error %v, expected %q", tt.name, err, tt.message)
+		}
+		_, err = NewService(NewMemoryStorage(), WithAudit(path))
+		if !errors.Is(err, ErrAuditTampered) {
+			t.Errorf("NewService(): %v: must return ErrAuditTampered, returned = %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package wallet
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// CSV files start with a header row, the columns are named like the JSON
+// fields. On import the columns are found by the header, so their order
+// doesn't matter and the optional ones may be missing.
+
+var accountColumns = []string{"id", "phone", "balance", "currency", "created_at", "updated_at"}
+
+var paymentColumns = []string{"id", "account_id", "amount", "category", "status", "currency", "to_account_id", "created_at", "updated_at",
+	"original_amount", "original_currency", "rate", "refunded", "refund_of"}
+
+var favoriteColumns = []string{"id", "account_id", "amount", "name", "category", "currency", "created_at", "updated_at"}
+
+// CSVOption configures the CSV export and import
+type CSVOption func(c *csvConfig)
+
+type csvConfig struct {
+	delimiter rune
+	columns   map[string]string // column -> header in the file
+}
+
+func newCSVConfig(options []CSVOption) csvConfig {
+	c := csvConfig{delimiter: ','}
+	for _, option := range options {
+		option(&c)
+	}
+	return c
+}
+
+// header returns the name of the column in the file
+func (c csvConfig) header(column string) string {
+	if name, ok := c.columns[column]; ok {
+		return name
+	}
+	return column
+}
+
+// WithDelimiter sets the field delimiter, ',' by default
+func WithDelimiter(delimiter rune) CSVOption {
+	return func(c *csvConfig) {
+		c.delimiter = delimiter
+	}
+}
+
+// WithColumns renames the columns: the keys are the column names used by
+// the wallet, the values are the headers in the file. For example
+// WithColumns(map[string]string{"amount": "Sum"}) reads a bank statement
+// whose amount column is called Sum.
+func WithColumns(columns map[string]string) CSVOption {
+	return func(c *csvConfig) {
+		c.columns = columns
+	}
+}
+
+// writeCSV replaces the file with the header and the rows
+func writeCSV(path string, columns []string, rows [][]string, options []CSVOption) error {
+	c := newCSVConfig(options)
+
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = c.header(column)
+	}
+
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		writer := csv.NewWriter(w)
+		writer.Comma = c.delimiter
+		writer.UseCRLF = true // as RFC 4180 says
+
+		err := writer.Write(header)
+		if err != nil {
+			return err
+		}
+		err = writer.WriteAll(rows)
+		if err != nil {
+			return err
+		}
+		return writer.Error()
+	})
+}
+
+// csvRow gives the fields of one row by column name, a missing column is empty
+type csvRow struct {
+	line    int // of the file, where the row starts
+	fields  []string
+	indexes map[string]int
+}
+
+func (r csvRow) get(column string) string {
+	i, ok := r.indexes[column]
+	if !ok {
+		return ""
+	}
+	return r.fields[i]
+}
+
+func (r csvRow) int(column string) (int64, error) {
+	value := r.get(column)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// readCSV calls fn for every row after the header, the required columns
+// must be in the header
+func readCSV(path string, columns []string, required []string, options []CSVOption, fn func(row csvRow) error) error {
+	c := newCSVConfig(options)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer closeFile(file)
+
+	reader := csv.NewReader(file)
+	reader.Comma = c.delimiter
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+
+	byHeader := map[string]int{}
+	for i, name := range header {
+		byHeader[name] = i
+	}
+	row := csvRow{indexes: map[string]int{}}
+	for _, column := range columns {
+		if i, ok := byHeader[c.header(column)]; ok {
+			row.indexes[column] = i
+		}
+	}
+	for _, column := range required {
+		if _, ok := row.indexes[column]; !ok {
+			return fmt.Errorf("%v: no %q column", path, c.header(column))
+		}
+	}
+
+	for {
+		row.fields, err = reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+
+		row.line, _ = reader.FieldPos(0)
+		err = fn(row)
+		if err != nil {
+			return fmt.Errorf("%v: line %v: %w", path, row.line, err)
+		}
+	}
+}
+
+func accountRow(v types.Account) []string {
+	return []string{
+		strconv.FormatInt(v.ID, 10),
+		string(v.Phone),
+		strconv.FormatInt(int64(v.Balance), 10),
+		string(currencyOrDefault(v.Currency)),
+		formatTime(v.CreatedAt),
+		formatTime(v.UpdatedAt),
+	}
+}
+
+func paymentRow(v types.Payment) []string {
+	return []string{
+		v.ID,
+		strconv.FormatInt(v.AccountID, 10),
+		strconv.FormatInt(int64(v.Amount), 10),
+		string(v.Category),
+		string(v.Status),
+		string(currencyOrDefault(v.Currency)),
+		strconv.FormatInt(v.ToAccountID, 10),
+		formatTime(v.CreatedAt),
+		formatTime(v.UpdatedAt),
+		originalAmount(v),
+		string(v.OriginalCurrency),
+		v.Rate,
+		strconv.FormatInt(int64(v.Refunded), 10),
+		v.RefundOf,
+	}
+}
+
+// originalAmount is empty for a payment that was not converted
+func originalAmount(v types.Payment) string {
+	if v.OriginalCurrency == "" {
+		return ""
+	}
+	return strconv.FormatInt(int64(v.OriginalAmount), 10)
+}
+
+func favoriteRow(v types.Favorite) []string {
+	return []string{
+		v.ID,
+		strconv.FormatInt(v.AccountID, 10),
+		strconv.FormatInt(int64(v.Amount), 10),
+		v.Name,
+		string(v.Category),
+		string(currencyOrDefault(v.Currency)),
+		formatTime(v.CreatedAt),
+		formatTime(v.UpdatedAt),
+	}
+}
+
+func parseAccountRow(row csvRow) (types.Account, error) {
+	id, err := row.int("id")
+	if err != nil {
+		return types.Account{}, err
+	}
+	balance, err := row.int("balance")
+	if err != nil {
+		return types.Account{}, err
+	}
+	created, err := parseTime(row.get("created_at"))
+	if err != nil {
+		return types.Account{}, err
+	}
+	updated, err := parseTime(row.get("updated_at"))
+	if err != nil {
+		return types.Account{}, err
+	}
+	return types.Account{
+		ID:        id,
+		Phone:     types.Phone(row.get("phone")),
+		Balance:   types.Money(balance),
+		Currency:  currencyOrDefault(types.Currency(row.get("currency"))),
+		CreatedAt: created,
+		UpdatedAt: updated,
+	}, nil
+}
+
+// parsePaymentRow treats a payment without a status as a completed one,
+// bank statements list only those
+func parsePaymentRow(row csvRow) (types.Payment, error) {
+	accountID, err := row.int("account_id")
+	if err != nil {
+		return types.Payment{}, err
+	}
+	amount, err := row.int("amount")
+	if err != nil {
+		return types.Payment{}, err
+	}
+	toAccountID, err := row.int("to_account_id")
+	if err != nil {
+		return types.Payment{}, err
+	}
+	created, err := parseTime(row.get("created_at"))
+	if err != nil {
+		return types.Payment{}, err
+	}
+	updated, err := parseTime(row.get("updated_at"))
+	if err != nil {
+		return types.Payment{}, err
+	}
+	originalAmount, err := row.int("original_amount")
+	if err != nil {
+		return types.Payment{}, err
+	}
+	refunded, err := row.int("refunded")
+	if err != nil {
+		return types.Payment{}, err
+	}
+
+	status := types.PaymentStatus(row.get("status"))
+	if status == "" {
+		status = types.PaymentStatusOk
+	}
+	return types.Payment{
+		ID:          row.get("id"),
+		AccountID:   accountID,
+		Amount:      types.Money(amount),
+		Category:    types.PaymentCategory(row.get("category")),
+		Status:      status,
+		Currency:    currencyOrDefault(types.Currency(row.get("currency"))),
+		ToAccountID: toAccountID,
+		CreatedAt:   created,
+		UpdatedAt:   updated,
+
+		OriginalAmount:   types.Money(originalAmount),
+		OriginalCurrency: types.Currency(row.get("original_currency")),
+		Rate:             row.get("rate"),
+
+		Refunded: types.Money(refunded),
+		RefundOf: row.get("refund_of"),
+	}, nil
+}
+
+func parseFavoriteRow(row csvRow) (types.Favorite, error) {
+	accountID, err := row.int("account_id")
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	amount, err := row.int("amount")
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	created, err := parseTime(row.get("created_at"))
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	updated, err := parseTime(row.get("updated_at"))
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	return types.Favorite{
+		ID:        row.get("id"),
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Name:      row.get("name"),
+		Category:  types.PaymentCategory(row.get("category")),
+		Currency:  currencyOrDefault(types.Currency(row.get("currency"))),
+		CreatedAt: created,
+		UpdatedAt: updated,
+	}, nil
+}
+
+func (s *Service) ExportAccountsCSV(path string, options ...CSVOption) error {
+	s.ready()
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, len(accounts))
+	for i, v := range accounts {
+		rows[i] = accountRow(v)
+	}
+	return writeCSV(path, accountColumns, rows, options)
+}
+
+func (s *Service) ExportPaymentsCSV(path string, options ...CSVOption) error {
+	s.ready()
+	payments, err := s.payments.All()
+	if err != nil {
+		return err
+	}
+	return writePaymentsCSV(path, payments, options)
+}
+
+// ExportAccountHistoryCSV writes the payments of ExportAccountHistory
+func (s *Service) ExportAccountHistoryCSV(accountID int64, path string, options ...CSVOption) error {
+	s.ready()
+	payments, err := s.ExportAccountHistory(accountID)
+	if err != nil {
+		return err
+	}
+	return writePaymentsCSV(path, payments, options)
+}
+
+func writePaymentsCSV(path string, payments []types.Payment, options []CSVOption) error {
+	rows := make([][]string, len(payments))
+	for i, v := range payments {
+		rows[i] = paymentRow(v)
+	}
+	return writeCSV(path, paymentColumns, rows, options)
+}
+
+func (s *Service) ExportFavoritesCSV(path string, options ...CSVOption) error {
+	s.ready()
+	favorites, err := s.favorites.All()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, len(favorites))
+	for i, v := range favorites {
+		rows[i] = favoriteRow(v)
+	}
+	return writeCSV(path, favoriteColumns, rows, options)
+}
+
+// ImportAccountsCSV needs the id, phone and balance columns,
+// accounts with a known ID are replaced like in ImportAccounts. The rows
+// are checked like the lines of accounts.dump and a bad one rejects the
+// file before anything is imported.
+func (s *Service) ImportAccountsCSV(path string, options ...CSVOption) error {
+	s.ready()
+	return s.audited("ImportAccountsCSV", auditParams("path", path), func(s *Service) error {
+		v := s.newImportValidator(ConflictOverwrite)
+		accounts := []types.Account{}
+		err := readCSV(path, accountColumns, []string{"id", "phone", "balance"}, options, func(row csvRow) error {
+			account, err := parseAccountRow(row)
+			if err != nil {
+				return err
+			}
+			v.checkAccountRecord("", row.line, account)
+			accounts = append(accounts, account)
+			return v.report.Err()
+		})
+		if err != nil {
+			return err
+		}
+		// a phone of another account is known only once all rows are read
+		v.checkPhonesOfService("")
+		err = v.report.Err()
+		if err != nil {
+			return err
+		}
+
+		im := s.newImporter(ConflictOverwrite)
+		for _, account := range accounts {
+			err = im.account(account)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportPaymentsCSV needs the id, account_id and amount columns,
+// payments with a known ID are replaced like in ImportPayments. The rows
+// are checked like the lines of payments.dump and the first bad one rejects
+// the file before anything is imported.
+func (s *Service) ImportPaymentsCSV(path string, options ...CSVOption) error {
+	s.ready()
+	return s.audited("ImportPaymentsCSV", auditParams("path", path), func(s *Service) error {
+		v := s.newImportValidator(ConflictOverwrite)
+		payments := []types.Payment{}
+		err := readCSV(path, paymentColumns, []string{"id", "account_id", "amount"}, options, func(row csvRow) error {
+			payment, err := parsePaymentRow(row)
+			if err != nil {
+				return err
+			}
+			v.checkPaymentRecord("", row.line, payment)
+			payments = append(payments, payment)
+			return v.report.Err()
+		})
+		if err != nil {
+			return err
+		}
+
+		im := s.newImporter(ConflictOverwrite)
+		for _, payment := range payments {
+			err = im.payment(payment)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportFavoritesCSV needs the id, account_id and amount columns,
+// favorites with a known ID are replaced like in ImportFavorites. The rows
+// are checked like the lines of favorites.dump and the first bad one
+// rejects the file before anything is imported.
+func (s *Service) ImportFavoritesCSV(path string, options ...CSVOption) error {
+	s.ready()
+	return s.audited("ImportFavoritesCSV", auditParams("path", path), func(s *Service) error {
+		v := s.newImportValidator(ConflictOverwrite)
+		favorites := []types.Favorite{}
+		err := readCSV(path, favoriteColumns, []string{"id", "account_id", "amount"}, options, func(row csvRow) error {
+			favorite, err := parseFavoriteRow(row)
+			if err != nil {
+				return err
+			}
+			v.checkFavoriteRecord("", row.line, favorite)
+			favorites = append(favorites, favorite)
+			return v.report.Err()
+		})
+		if err != nil {
+			return err
+		}
+
+		im := s.newImporter(ConflictOverwrite)
+		for _, favorite := range favorites {
+			err = im.favorite(favorite)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
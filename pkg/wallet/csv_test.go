@@ -0,0 +1,299 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func exportImportCSV(s1 *Service, dir string, options ...CSVOption) (*Service, error) {
+	err := s1.ExportAccountsCSV(dir+"/accounts.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+	err = s1.ExportPaymentsCSV(dir+"/payments.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+	err = s1.ExportFavoritesCSV(dir+"/favorites.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+
+	s2, err := NewService(NewMemoryStorage())
+	if err != nil {
+		return nil, err
+	}
+	err = s2.ImportAccountsCSV(dir+"/accounts.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+	err = s2.ImportPaymentsCSV(dir+"/payments.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+	err = s2.ImportFavoritesCSV(dir+"/favorites.csv", options...)
+	if err != nil {
+		return nil, err
+	}
+	return s2, nil
+}
+
+func TestService_ExportImportCSV(t *testing.T) {
+	s1, err := newSeparatorsTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := exportImportCSV(s1, t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2)
+}
+
+func TestService_ExportImportCSV_options(t *testing.T) {
+	s1, err := newSeparatorsTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	options := []CSVOption{WithDelimiter(';'), WithColumns(map[string]string{"name": "Название", "amount": "Sum"})}
+	s2, err := exportImportCSV(s1, dir, options...)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2)
+
+	content, err := os.ReadFile(dir + "/favorites.csv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	header := "id;account_id;Sum;Название;category;currency;created_at;updated_at\r\n"
+	if !strings.HasPrefix(string(content), header) {
+		t.Errorf("ExportFavoritesCSV(): header expected:%q, content:%q", header, content)
+	}
+	if !strings.Contains(string(content), `"lunch;`+"\r\n"+`with ""friends"""`) {
+		t.Errorf("ExportFavoritesCSV(): name must be quoted, content:%q", content)
+	}
+}
+
+func TestService_ImportPaymentsCSV_bankStatement(t *testing.T) {
+	s := newTestService()
+	_, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/statement.csv"
+	content := "Date,Amount,Description,Account,Reference\n" +
+		"2021-03-01T10:00:00Z,250,\"Coffee, large\",1,bank-1\n" +
+		"2021-03-02T10:00:00Z,100,Taxi,1,bank-2\n"
+	err = os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.ImportPaymentsCSV(path, WithColumns(map[string]string{
+		"id":         "Reference",
+		"account_id": "Account",
+		"amount":     "Amount",
+		"category":   "Description",
+		"created_at": "Date",
+	}))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.FindPaymentByID("bank-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Amount != 250 || got.Category != "Coffee, large" || got.AccountID != 1 || got.Status != types.PaymentStatusOk {
+		t.Errorf("ImportPaymentsCSV(): wrong payment %v", got)
+	}
+	if got.CreatedAt.Format("2006-01-02") != "2021-03-01" {
+		t.Errorf("ImportPaymentsCSV(): CreatedAt expected:2021-03-01, actual:%v", got.CreatedAt)
+	}
+}
+
+func TestService_ImportPaymentsCSV_errors(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.WriteFile(dir+"/no-amount.csv", []byte("id,account_id\nx,1\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportPaymentsCSV(dir + "/no-amount.csv")
+	if err == nil || !strings.Contains(err.Error(), `"amount"`) {
+		t.Errorf("ImportPaymentsCSV(): must report the missing column, error = %v", err)
+	}
+
+	err = os.WriteFile(dir+"/bad-amount.csv", []byte("id,account_id,amount\nx,1,10\ny,1,ten\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportPaymentsCSV(dir + "/bad-amount.csv")
+	if err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("ImportPaymentsCSV(): must report the line, error = %v", err)
+	}
+}
+
+func TestService_ImportPaymentsCSV_invalid(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		rows    string
+		err     error
+		message string
+	}{
+		{"unknown account", "x,2,10,OK", ErrAccountNotFound, "unknown account 2"},
+		{"no ID", ",1,10,OK", ErrInvalidImport, "payment without ID"},
+		{"duplicate", "x,1,10,OK\nx,1,20,OK", ErrInvalidImport, "line 4: invalid import: 1 problems: duplicate payment ID x, first on line 3"},
+		{"not positive", "x,1,0,OK", ErrAmountMustBePositive, "amount 0 must be positive"},
+		{"unknown status", "x,1,10,PAID", ErrInvalidImport, `unknown status "PAID"`},
+	}
+	for _, tt := range tests {
+		path := dir + "/payments.csv"
+		// a good row first, the file is rejected as a whole
+		err = os.WriteFile(path, []byte("id,account_id,amount,status\ngood,1,5,OK\n"+tt.rows+"\n"), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = s.ImportPaymentsCSV(path)
+		if !errors.Is(err, tt.err) || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("ImportPaymentsCSV(): %v: error = %v", tt.name, err)
+		}
+		payments, _ := s.payments.All()
+		if len(payments) != 0 {
+			t.Errorf("ImportPaymentsCSV(): %v: imported %v", tt.name, payments)
+		}
+	}
+
+	err = os.WriteFile(dir+"/favorites.csv", []byte("id,account_id,amount\nf,2,10\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportFavoritesCSV(dir + "/favorites.csv")
+	if !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("ImportFavoritesCSV(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_ImportAccountsCSV_invalid(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		rows    string
+		err     error
+		message string
+	}{
+		{"negative balance", "2,+992000000002,-10,TJS", ErrInvalidImport, "negative balance -10"},
+		{"unknown currency", "2,+992000000002,10,XYZ", ErrUnknownCurrency, `unknown currency "XYZ"`},
+		{"registered phone", "2,+992000000001,10,TJS", ErrPhoneRegistered, "phone +992000000001 is already used by account 1"},
+	}
+	for _, tt := range tests {
+		path := dir + "/accounts.csv"
+		// a good row first, the file is rejected as a whole
+		err = os.WriteFile(path, []byte("id,phone,balance,currency\n3,+992000000003,5,TJS\n"+tt.rows+"\n"), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = s.ImportAccountsCSV(path)
+		if !errors.Is(err, tt.err) || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("ImportAccountsCSV(): %v: error = %v", tt.name, err)
+		}
+		accounts, _ := s.accounts.All()
+		if len(accounts) != 1 {
+			t.Errorf("ImportAccountsCSV(): %v: imported %v", tt.name, accounts)
+		}
+	}
+}
+
+func TestService_ExportAccountHistoryCSV(t *testing.T) {
+	s := newTestService()
+	account, payments, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the payments of other accounts are not in the history
+	_, _, err = s.addAccount(testAccount{
+		phone:   "+992000000001",
+		balance: 10,
+		payments: []struct {
+			amount   types.Money
+			category types.PaymentCategory
+		}{{amount: 5, category: "auto"}},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/history.csv"
+	err = s.ExportAccountHistoryCSV(account.ID, path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	_, err = s2.RegisterAccount(defultTestAccount.phone)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.ImportPaymentsCSV(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, _ := s2.payments.All()
+	if len(got) != len(payments) {
+		t.Errorf("ExportAccountHistoryCSV(): payments expected:%v, actual:%v", len(payments), len(got))
+	}
+
+	err = s.ExportAccountHistoryCSV(100, path)
+	if err != ErrAccountNotFound {
+		t.Errorf("ExportAccountHistoryCSV(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrUnknownCurrency = errors.New("unknown currency")
+var ErrCurrencyMismatch = errors.New("currencies don't match")
+
+// Every account has a currency and the amounts of its payments are in the
+// minor units of that currency. Money never moves between accounts in
+// different currencies; a payment or a deposit in another currency is
+// converted, see PayConverted. A favorite is in the currency of the payment.
+
+// currencyOrDefault gives the records written before currencies the default one
+func currencyOrDefault(currency types.Currency) types.Currency {
+	if currency == "" {
+		return types.DefaultCurrency
+	}
+	return currency
+}
+
+func checkCurrency(currency types.Currency) error {
+	if _, ok := currency.Exponent(); !ok {
+		return ErrUnknownCurrency
+	}
+	return nil
+}
+
+// Totals are sums of money by currency
+type Totals map[types.Currency]types.Money
+
+func (t Totals) add(currency types.Currency, amount types.Money) error {
+	currency = currencyOrDefault(currency)
+	sum, err := t[currency].Add(amount)
+	if err != nil {
+		return fmt.Errorf("%w: sum in %v", err, currency)
+	}
+	t[currency] = sum
+	return nil
+}
+
+func (t Totals) merge(other Totals) error {
+	for currency, amount := range other {
+		err := t.add(currency, amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterAccountInCurrency opens an account in the currency,
+// RegisterAccount opens it in types.DefaultCurrency
+func (s *Service) RegisterAccountInCurrency(phone types.Phone, currency types.Currency) (account *types.Account, err error) {
+	s.ready()
+	err = s.audited("RegisterAccountInCurrency", auditParams("phone", phone, "currency", currency), func(s *Service) error {
+		account, err = s.registerAccount(phone, currency)
+		return err
+	})
+	return account, err
+}
+
+func (s *Service) registerAccount(phone types.Phone, currency types.Currency) (*types.Account, error) {
+	err := checkCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.accounts.FindByPhone(phone)
+	if err == nil {
+		return nil, ErrPhoneRegistered // if there is such a phone, then just leave
+	}
+	if err != ErrAccountNotFound {
+		return nil, err
+	}
+
+	now := s.now()
+	account := &types.Account{
+		ID:        s.nextAccountID + 1,
+		Phone:     phone,
+		Balance:   0,
+		Currency:  currency,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = s.save(batch{accounts: []*types.Account{account}})
+	if err != nil {
+		return nil, err
+	}
+	s.nextAccountID++
+
+	return account, nil
+}
+
+// PayIn is Pay with the currency of the amount, which must be the currency
+// of the account; PayConverted converts the amount instead
+func (s *Service) PayIn(accountID int64, amount types.Money, currency types.Currency, category types.PaymentCategory) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("PayIn", auditParams("account", accountID, "amount", amount, "currency", currency, "category", category), func(s *Service) (*types.Payment, error) {
+		s.call.account(accountID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
+
+		unlock := s.lockAccount(accountID)
+		defer unlock()
+
+		account, err := s.accounts.FindByID(accountID)
+		if err != nil {
+			return nil, err
+		}
+
+		if currencyOrDefault(currency) != currencyOrDefault(account.Currency) {
+			return nil, ErrCurrencyMismatch
+		}
+		return s.pay(account, amount, category, nil, nil)
+	})
+}
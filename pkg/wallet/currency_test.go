@@ -0,0 +1,288 @@
+package wallet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func TestCurrency_Exponent(t *testing.T) {
+	tests := []struct {
+		currency types.Currency
+		exponent int
+		ok       bool
+	}{
+		{"TJS", 2, true},
+		{"USD", 2, true},
+		{"JPY", 0, true},
+		{"KWD", 3, true},
+		{"XYZ", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		exponent, ok := tt.currency.Exponent()
+		if exponent != tt.exponent || ok != tt.ok {
+			t.Errorf("Exponent(%q): expected %v %v, actual %v %v", tt.currency, tt.exponent, tt.ok, exponent, ok)
+		}
+	}
+}
+
+// newCurrencyTestService has a TJS account 1 and a USD account 2 with 1000 each
+func newCurrencyTestService() (*testService, error) {
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.RegisterAccountInCurrency("+992000000002", "USD")
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range []int64{1, 2} {
+		err = s.Deposit(id, 1_000)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func TestService_RegisterAccountInCurrency(t *testing.T) {
+	s, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.FindAccountByID(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Currency != "USD" {
+		t.Errorf("RegisterAccountInCurrency(): currency expected:%v, actual:%v", "USD", account.Currency)
+	}
+
+	_, err = s.RegisterAccountInCurrency("+992000000003", "XYZ")
+	if err != ErrUnknownCurrency {
+		t.Errorf("RegisterAccountInCurrency(): must return ErrUnknownCurrency, returned = %v", err)
+	}
+}
+
+func TestService_PayIn(t *testing.T) {
+	s, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(2, 100, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if payment.Currency != "USD" {
+		t.Errorf("Pay(): currency expected:%v, actual:%v", "USD", payment.Currency)
+	}
+
+	_, err = s.PayIn(2, 100, "TJS", "auto")
+	if err != ErrCurrencyMismatch {
+		t.Errorf("PayIn(): must return ErrCurrencyMismatch, returned = %v", err)
+	}
+	_, err = s.PayIn(2, 100, "USD", "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the favorite and the repeated payment keep the currency
+	favorite, err := s.FavoritePayment(payment.ID, "fuel")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromFavorite, err := s.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	repeated, err := s.Repeat(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if favorite.Currency != "USD" || fromFavorite.Currency != "USD" || repeated.Currency != "USD" {
+		t.Errorf("wrong currencies %v %v %v", favorite.Currency, fromFavorite.Currency, repeated.Currency)
+	}
+}
+
+func TestService_Transfer_currencyMismatch(t *testing.T) {
+	s, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Transfer(1, 2, 100)
+	if err != ErrCurrencyMismatch {
+		t.Errorf("Transfer(): must return ErrCurrencyMismatch, returned = %v", err)
+	}
+
+	for _, id := range []int64{1, 2} {
+		account, err := s.FindAccountByID(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if account.Balance != 1_000 {
+			t.Errorf("Transfer(): balance of account %v changed to %v", id, account.Balance)
+		}
+	}
+}
+
+func TestService_SumPayments_byCurrency(t *testing.T) {
+	s, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payments := []struct {
+		accountID int64
+		amount    types.Money
+	}{{1, 10}, {2, 20}, {1, 30}, {2, 40}, {2, 50}}
+	for _, v := range payments {
+		_, err = s.Pay(v.accountID, v.amount, "auto")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	expected := Totals{"TJS": 40, "USD": 110}
+	if sum, err := s.SumPayments(3); err != nil || !reflect.DeepEqual(sum, expected) {
+		t.Errorf("SumPayments(): expected:%v, actual:%v, error %v", expected, sum, err)
+	}
+	if sum, err := s.SumPaymentsRegular(); err != nil || !reflect.DeepEqual(sum, expected) {
+		t.Errorf("SumPaymentsRegular(): expected:%v, actual:%v, error %v", expected, sum, err)
+	}
+
+	sum := Totals{}
+	for progress := range s.SumPaymentsWithProgress() {
+		if progress.Err != nil {
+			t.Error(progress.Err)
+			continue
+		}
+		_ = sum.merge(progress.Result)
+	}
+	if !reflect.DeepEqual(sum, expected) {
+		t.Errorf("SumPaymentsWithProgress(): expected:%v, actual:%v", expected, sum)
+	}
+}
+
+func TestService_Export_currency(t *testing.T) {
+	s1, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s1.Pay(2, 100, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.FavoritePayment(payment.ID, "fuel")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1.Service, s2.Service)
+}
+
+func TestService_Import_legacyCurrency(t *testing.T) {
+	dir := t.TempDir()
+	err := writeDumps(dir, map[string]string{
+		"accounts.dump":  "1;+992000000001;100",
+		"payments.dump":  "p1;1;10;auto;OK",
+		"favorites.dump": "f1;1;lunch;10;food",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, _ := s.FindAccountByID(1)
+	payment, _ := s.FindPaymentByID("p1")
+	favorite, _ := s.FindFavoriteByID("f1")
+	if account == nil || payment == nil || favorite == nil {
+		t.Errorf("Import(): records are missing")
+		return
+	}
+	if account.Currency != types.DefaultCurrency || payment.Currency != types.DefaultCurrency || favorite.Currency != types.DefaultCurrency {
+		t.Errorf("Import(): records without a currency must be in %v: %v %v %v",
+			types.DefaultCurrency, account.Currency, payment.Currency, favorite.Currency)
+	}
+}
+
+func TestService_ValidateImport_currency(t *testing.T) {
+	s, err := newCurrencyTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = writeDumps(dir, map[string]string{
+		"accounts.dump": "2;+992000000002;1000;;;EUR\n" +
+			"3;+992000000003;0;;;XYZ",
+		"payments.dump": "p1;1;10;auto;OK;0;;;USD\n" +
+			"p2;1;10;transfer;OK;2;;;TJS",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report, err := s.ValidateImport(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accounts, payments := dir+"/accounts.dump", dir+"/payments.dump"
+	expected := []string{
+		accounts + ":1: account 2 is in USD, not EUR",
+		accounts + ":2: unknown currency \"XYZ\"",
+		payments + ":1: payment in USD from account 1 in TJS",
+		payments + ":2: transfer in TJS to account 2 in EUR",
+	}
+	got := make([]string, len(report.Problems))
+	for i, problem := range report.Problems {
+		got[i] = problem.String()
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ValidateImport(): problems\n%v\nexpected\n%v", got, expected)
+	}
+	if !errors.Is(report.Err(), ErrCurrencyMismatch) || !errors.Is(report.Err(), ErrUnknownCurrency) {
+		t.Errorf("ValidateImport(): wrong causes %v", report.Err())
+	}
+}
@@ -0,0 +1,529 @@
+package wallet
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// the .dump files keep one record per line with fields separated by ';',
+// a dump is read with the columns of the schema in its header, so that older
+// dumps can still be read
+
+// formatTime writes timestamps in UTC, zero time as an empty field
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseTimes reads created and updated times from rec[from:], if the columns are there
+func parseTimes(rec []string, from int) (time.Time, time.Time, error) {
+	if len(rec) < from+2 {
+		return time.Time{}, time.Time{}, nil
+	}
+	created, err := parseTime(rec[from])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	updated, err := parseTime(rec[from+1])
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return created, updated, nil
+}
+
+// parseCurrency reads the currency from rec[at], records written before
+// currencies have no such column and are in types.DefaultCurrency
+func parseCurrency(rec []string, at int) types.Currency {
+	if len(rec) <= at {
+		return types.DefaultCurrency
+	}
+	return currencyOrDefault(types.Currency(rec[at]))
+}
+
+// escapeField keeps ';' and line breaks of a text field out of the record
+func escapeField(v interface{}) string {
+	return url.QueryEscape(fmt.Sprint(v))
+}
+
+// splitRecord splits the line into its fields. Text fields are escaped since
+// schemaEscaped; numbers and timestamps never have '%' or '+', so every field
+// is unescaped.
+func splitRecord(line string, schema int) ([]string, error) {
+	rec := strings.Split(line, ";")
+	if schema < schemaEscaped {
+		return rec, nil
+	}
+	for i, field := range rec {
+		v, err := url.QueryUnescape(field)
+		if err != nil {
+			return nil, err
+		}
+		rec[i] = v
+	}
+	return rec, nil
+}
+
+// checkFields returns an error unless the record has one of the numbers of
+// fields its schema allows
+func checkFields(record string, schema int, rec []string, allowed ...int) error {
+	for _, n := range allowed {
+		if len(rec) == n {
+			return nil
+		}
+	}
+	counts := strconv.Itoa(allowed[0])
+	for i, n := range allowed[1:] {
+		if i == len(allowed)-2 {
+			counts += " or " + strconv.Itoa(n)
+		} else {
+			counts += ", " + strconv.Itoa(n)
+		}
+	}
+	return fmt.Errorf("%v: expected %v fields in schema %v, got %v", record, counts, schema, len(rec))
+}
+
+func formatAccount(v types.Account) string {
+	return fmt.Sprintf("%v;%v;%v;%v;%v;%v", v.ID, escapeField(v.Phone), v.Balance, formatTime(v.CreatedAt),
+		formatTime(v.UpdatedAt), escapeField(currencyOrDefault(v.Currency)))
+}
+
+// accountFields are the numbers of fields of an account in the schema, a
+// dump without a header may have any of them
+func accountFields(schema int) []int {
+	switch {
+	case schema >= schemaCurrencies:
+		return []int{6}
+	case schema >= schemaHeader:
+		return []int{5}
+	}
+	return []int{3, 5, 6}
+}
+
+func parseAccount(line string, schema int) (types.Account, error) {
+	rec, err := splitRecord(line, schema)
+	if err != nil {
+		return types.Account{}, err
+	}
+	err = checkFields("account", schema, rec, accountFields(schema)...)
+	if err != nil {
+		return types.Account{}, err
+	}
+	id, err := strconv.ParseInt(rec[0], 10, 64)
+	if err != nil {
+		return types.Account{}, err
+	}
+	phone := rec[1]
+	balance, err := strconv.ParseInt(rec[2], 10, 64)
+	if err != nil {
+		return types.Account{}, err
+	}
+	created, updated, err := parseTimes(rec, 3)
+	if err != nil {
+		return types.Account{}, err
+	}
+	return types.Account{
+		ID:        id,
+		Phone:     types.Phone(phone),
+		Balance:   types.Money(balance),
+		Currency:  parseCurrency(rec, 5),
+		CreatedAt: created,
+		UpdatedAt: updated,
+	}, nil
+}
+
+// formatPayment adds the original amount, currency and rate only to a
+// converted payment and the refunded amount and the refunded payment only
+// to a refunded payment or a refund, with empty conversion columns before
+// them if the payment was not converted
+func formatPayment(v types.Payment) string {
+	line := fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v;%v", escapeField(v.ID), v.AccountID, v.Amount, escapeField(v.Category),
+		escapeField(v.Status), v.ToAccountID, formatTime(v.CreatedAt), formatTime(v.UpdatedAt),
+		escapeField(currencyOrDefault(v.Currency)))
+	refund := v.Refunded != 0 || v.RefundOf != ""
+	if v.OriginalCurrency != "" {
+		line += fmt.Sprintf(";%v;%v;%v", v.OriginalAmount, escapeField(v.OriginalCurrency), escapeField(v.Rate))
+	} else if refund {
+		line += ";;;"
+	}
+	if refund {
+		line += fmt.Sprintf(";%v;%v", v.Refunded, escapeField(v.RefundOf))
+	}
+	return line
+}
+
+// paymentFields are the numbers of fields of a payment in the schema, the
+// conversion and the refund columns are there only when the payment has them
+func paymentFields(schema int) []int {
+	switch {
+	case schema >= schemaRefunds:
+		return []int{9, 12, 14}
+	case schema >= schemaConversions:
+		return []int{9, 12}
+	case schema >= schemaCurrencies:
+		return []int{9}
+	case schema >= schemaHeader:
+		return []int{8}
+	}
+	return []int{5, 6, 8, 9, 12, 14}
+}
+
+func parsePayment(line string, schema int) (types.Payment, error) {
+	rec, err := splitRecord(line, schema)
+	if err != nil {
+		return types.Payment{}, err
+	}
+	err = checkFields("payment", schema, rec, paymentFields(schema)...)
+	if err != nil {
+		return types.Payment{}, err
+	}
+	id := rec[0]
+
+	accid, err := strconv.ParseInt(rec[1], 10, 64)
+	if err != nil {
+		return types.Payment{}, err
+	}
+
+	amount, err := strconv.ParseInt(rec[2], 10, 64)
+	if err != nil {
+		return types.Payment{}, err
+	}
+
+	category := rec[3]
+	status := rec[4]
+
+	// older dumps have no recipient column
+	toAccid := int64(0)
+	if len(rec) > 5 {
+		toAccid, err = strconv.ParseInt(rec[5], 10, 64)
+		if err != nil {
+			return types.Payment{}, err
+		}
+	}
+
+	created, updated, err := parseTimes(rec, 6)
+	if err != nil {
+		return types.Payment{}, err
+	}
+
+	payment := types.Payment{
+		ID:          id,
+		AccountID:   accid,
+		Amount:      types.Money(amount),
+		Category:    types.PaymentCategory(category),
+		Status:      types.PaymentStatus(status),
+		Currency:    parseCurrency(rec, 8),
+		ToAccountID: toAccid,
+		CreatedAt:   created,
+		UpdatedAt:   updated,
+	}
+
+	// a converted payment, a refund that was not converted has them empty
+	if len(rec) >= 12 && rec[10] != "" {
+		original, err := strconv.ParseInt(rec[9], 10, 64)
+		if err != nil {
+			return types.Payment{}, err
+		}
+		payment.OriginalAmount = types.Money(original)
+		payment.OriginalCurrency = types.Currency(rec[10])
+		payment.Rate = rec[11]
+	}
+
+	// a refunded payment or a refund
+	if len(rec) == 14 {
+		refunded, err := strconv.ParseInt(rec[12], 10, 64)
+		if err != nil {
+			return types.Payment{}, err
+		}
+		payment.Refunded = types.Money(refunded)
+		payment.RefundOf = rec[13]
+	}
+	return payment, nil
+}
+
+func formatFavorite(v types.Favorite) string {
+	return fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v", escapeField(v.ID), v.AccountID, escapeField(v.Name), v.Amount,
+		escapeField(v.Category), formatTime(v.CreatedAt), formatTime(v.UpdatedAt), escapeField(currencyOrDefault(v.Currency)))
+}
+
+// favoriteFields are the numbers of fields of a favorite in the schema
+func favoriteFields(schema int) []int {
+	switch {
+	case schema >= schemaCurrencies:
+		return []int{8}
+	case schema >= schemaHeader:
+		return []int{7}
+	}
+	return []int{5, 7, 8}
+}
+
+func parseFavorite(line string, schema int) (types.Favorite, error) {
+	rec, err := splitRecord(line, schema)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	err = checkFields("favorite", schema, rec, favoriteFields(schema)...)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+	id := rec[0]
+	accid, err := strconv.ParseInt(rec[1], 10, 64)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+
+	name := rec[2]
+
+	amount, err := strconv.ParseInt(rec[3], 10, 64)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+
+	category := rec[4]
+
+	created, updated, err := parseTimes(rec, 5)
+	if err != nil {
+		return types.Favorite{}, err
+	}
+
+	return types.Favorite{
+		ID:        id,
+		AccountID: accid,
+		Name:      name,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(category),
+		Currency:  parseCurrency(rec, 7),
+		CreatedAt: created,
+		UpdatedAt: updated,
+	}, nil
+}
+
+// the versions of the dump columns, every change of the columns makes a new one
+const (
+	schemaLegacy      = 1 // dumps written before the header
+	schemaHeader      = 2 // the header
+	schemaCurrencies  = 3 // the currencies of accounts, payments and favorites
+	schemaConversions = 4 // the original amount, currency and rate of converted payments
+	schemaRefunds     = 5 // the refunded amount and the refunded payment of payments
+	schemaEscaped     = 6 // text fields escaped like URL query values
+)
+
+// dumpSchema is the version of the columns written by this code
+const dumpSchema = schemaEscaped
+
+const dumpHeaderPrefix = "#wallet-dump"
+
+var ErrCorruptedDump = errors.New("corrupted dump")
+
+func corruptedDump(path string, format string, args ...interface{}) error {
+	return fmt.Errorf("%v: %w: %v", path, ErrCorruptedDump, fmt.Sprintf(format, args...))
+}
+
+// a dump starts with a header that describes the records after it
+//
+//	#wallet-dump schema=6 records=3 sha256=<hex of the records joined with '\n'>
+//
+// dumps written before the header existed are read as schemaLegacy, with the
+// columns each record has
+
+// readDump returns the records of a dump file and their schema, a missing or
+// empty file has none. A file with a header must match it, otherwise
+// ErrCorruptedDump is returned and nothing is read.
+func readDump(path string) ([]string, int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, dumpSchema, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer closeFile(file)
+
+	lines, schema := []string{}, dumpSchema
+	err = scanDump(path, file, func(recordSchema int, _ int, line string) error {
+		lines, schema = append(lines, line), recordSchema
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return lines, schema, nil
+}
+
+// scanDump reads a dump line by line and calls fn for every record with the
+// schema of the dump and its line number in the file, a nil fn only checks
+// the dump. Errors of fn are returned with the name and the line number. The
+// header can be checked only at the end, so when ErrCorruptedDump is returned
+// fn has already seen records that can't be trusted; check the dump first if
+// that matters.
+func scanDump(name string, r io.Reader, fn func(schema int, number int, line string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxDumpLine)
+	scanner.Split(scanDumpLines)
+
+	header := false
+	schema, records, checksum := schemaLegacy, 0, ""
+	hash := sha256.New()
+	n := 0 // records
+	for number := 1; scanner.Scan(); number++ {
+		line := scanner.Bytes()
+
+		if number == 1 && bytes.HasPrefix(line, []byte(dumpHeaderPrefix)) {
+			_, err := fmt.Sscanf(string(line), dumpHeaderPrefix+" schema=%d records=%d sha256=%s", &schema, &records, &checksum)
+			if err != nil {
+				return corruptedDump(name, "bad header %q", line)
+			}
+			if schema < schemaHeader {
+				return corruptedDump(name, "bad schema %v", schema)
+			}
+			if schema > dumpSchema {
+				return fmt.Errorf("%v: schema %v is newer than the supported %v", name, schema, dumpSchema)
+			}
+			header = true
+			continue
+		}
+
+		if n > 0 {
+			hash.Write([]byte{'\n'})
+		}
+		hash.Write(line)
+		n++
+
+		if fn != nil {
+			err := fn(schema, number, string(line))
+			if err != nil {
+				return fmt.Errorf("%v: line %v: %w", name, number, err)
+			}
+		}
+	}
+	if scanner.Err() != nil {
+		return fmt.Errorf("%v: %w", name, scanner.Err())
+	}
+
+	if !header {
+		return nil // legacy dump
+	}
+	if n != records {
+		return corruptedDump(name, "header says %v records, file has %v", records, n)
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != checksum {
+		return corruptedDump(name, "checksum mismatch")
+	}
+	return nil
+}
+
+// maxDumpLine limits the memory taken by one record
+const maxDumpLine = 1 << 20
+
+// scanDumpLines splits at '\n' only, unlike bufio.ScanLines a '\r' at the
+// end of a record is part of it
+func scanDumpLines(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// writeDump replaces the file atomically with the header and the records
+func writeDump(path string, lines []string) error {
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		return writeDumpTo(w, len(lines), func(i int) string {
+			return lines[i]
+		})
+	})
+}
+
+// writeDumpTo writes the header and n records given by line. The header
+// needs the checksum, so every record is formatted twice instead of being
+// kept in memory.
+func writeDumpTo(w io.Writer, n int, line func(i int) string) error {
+	hash := sha256.New()
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			io.WriteString(hash, "\n")
+		}
+		io.WriteString(hash, line(i))
+	}
+
+	_, err := fmt.Fprintf(w, "%v schema=%v records=%v sha256=%v", dumpHeaderPrefix, dumpSchema, n, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		_, err = io.WriteString(w, "\n"+line(i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomicFunc writes to a temporary file and renames it over the
+// target, so readers see either the old or the new content. The directory is
+// synced after the rename, otherwise a crash may lose the new name.
+func writeFileAtomicFunc(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(file)
+	err = write(buf)
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of the directory to disk
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
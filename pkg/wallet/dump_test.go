@@ -0,0 +1,233 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteDump_readDump(t *testing.T) {
+	path := t.TempDir() + "/payments.dump"
+	lines := []string{"a;1", "b;2", "c;3"}
+
+	err := writeDump(path, lines)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(content), "#wallet-dump schema=6 records=3 sha256=") {
+		t.Errorf("writeDump(): wrong header, content = %q", content)
+	}
+
+	got, schema, err := readDump(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(got, lines) || schema != dumpSchema {
+		t.Errorf("readDump(): got %v want %v", got, lines)
+	}
+
+	_, err = os.Stat(path + ".tmp")
+	if !os.IsNotExist(err) {
+		t.Errorf("writeDump(): temporary file is left, stat error = %v", err)
+	}
+}
+
+func TestWriteDump_readDump_empty(t *testing.T) {
+	path := t.TempDir() + "/payments.dump"
+
+	err := writeDump(path, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, _, err := readDump(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 0 {
+		t.Errorf("readDump(): got %v want no records", got)
+	}
+}
+
+func TestReadDump_corrupted(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/payments.dump"
+
+	err := writeDump(path, []string{"a;1", "b;2", "c;3"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{"truncated", strings.TrimSuffix(string(content), "\nc;3"), "header says 3 records, file has 2"},
+		{"changed", strings.Replace(string(content), "b;2", "b;7", 1), "checksum mismatch"},
+		{"bad header", "#wallet-dump schema=two\na;1", "bad header"},
+		{"bad schema", "#wallet-dump schema=1 records=0 sha256=x", "bad schema 1"},
+	}
+	for _, tt := range tests {
+		err = os.WriteFile(path, []byte(tt.content), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, _, err = readDump(path)
+		if !errors.Is(err, ErrCorruptedDump) {
+			t.Errorf("readDump(): %v: must return ErrCorruptedDump, returned = %v", tt.name, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.reason) || !strings.Contains(err.Error(), path) {
+			t.Errorf("readDump(): %v: error must name the file and the reason, error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestReadDump_newerSchema(t *testing.T) {
+	path := t.TempDir() + "/payments.dump"
+
+	err := os.WriteFile(path, []byte("#wallet-dump schema=7 records=0 sha256=x"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, _, err = readDump(path)
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("readDump(): must refuse a newer schema, returned = %v", err)
+	}
+}
+
+func TestParse_schema(t *testing.T) {
+	tests := []struct {
+		name   string
+		parse  func(line string, schema int) error
+		line   string
+		schema int
+		ok     bool
+	}{
+		{"account before currencies", parseAccountErr, "1;+992000000001;100;;", schemaHeader, true},
+		{"account without timestamps", parseAccountErr, "1;+992000000001;100", schemaHeader, false},
+		{"legacy account", parseAccountErr, "1;+992000000001;100", schemaLegacy, true},
+		{"account without currency", parseAccountErr, "1;+992000000001;100;;", schemaCurrencies, false},
+		{"account with currency", parseAccountErr, "1;+992000000001;100;;;USD", schemaCurrencies, true},
+		{"account with currency before currencies", parseAccountErr, "1;+992000000001;100;;;USD", schemaHeader, false},
+		{"payment before conversions", parsePaymentErr, "p;1;100;auto;INPROGRESS;0;;;TJS;100;USD;10", schemaCurrencies, false},
+		{"converted payment", parsePaymentErr, "p;1;100;auto;INPROGRESS;0;;;TJS;100;USD;10", schemaConversions, true},
+		{"refund before refunds", parsePaymentErr, "p;1;100;auto;OK;0;;;TJS;;;;0;q", schemaConversions, false},
+		{"refund", parsePaymentErr, "p;1;100;auto;OK;0;;;TJS;;;;0;q", schemaRefunds, true},
+		{"torn conversion", parsePaymentErr, "p;1;100;auto;OK;0;;;TJS;100", schemaRefunds, false},
+		{"favorite without currency", parseFavoriteErr, "f;1;car;100;auto;;", schemaCurrencies, false},
+	}
+	for _, tt := range tests {
+		err := tt.parse(tt.line, tt.schema)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: schema %v, error %v", tt.name, tt.schema, err)
+		}
+	}
+
+	account, err := parseAccount("1;+992000000001;100;;", schemaHeader)
+	if err != nil || account.Currency != "TJS" {
+		t.Errorf("parseAccount(): account %v, error %v", account, err)
+	}
+}
+
+func parseAccountErr(line string, schema int) error {
+	_, err := parseAccount(line, schema)
+	return err
+}
+
+func parsePaymentErr(line string, schema int) error {
+	_, err := parsePayment(line, schema)
+	return err
+}
+
+func parseFavoriteErr(line string, schema int) error {
+	_, err := parseFavorite(line, schema)
+	return err
+}
+
+func TestService_Import_legacyAccounts(t *testing.T) {
+	dir := t.TempDir()
+
+	// balances used to be parsed with bitSize 34
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+992000000001;100000000000\n2;+992000000002;0"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 100_000_000_000 {
+		t.Errorf("Import(): balance expected:%v, actual:%v", 100_000_000_000, got.Balance)
+	}
+}
+
+func TestService_Import_refusesCorrupted(t *testing.T) {
+	s1, err := generateTestData(10)
+	if err != nil {
+		t.Errorf("Error generate TEST data: %v", err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := os.ReadFile(dir + "/payments.dump")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = os.WriteFile(dir+"/payments.dump", content[:len(content)-10], 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if !errors.Is(err, ErrCorruptedDump) {
+		t.Errorf("Import(): must return ErrCorruptedDump, returned = %v", err)
+	}
+
+	payments, _ := s2.payments.All()
+	if len(payments) != 0 {
+		t.Errorf("Import(): payments of a corrupted file must not be imported, got %v", len(payments))
+	}
+}
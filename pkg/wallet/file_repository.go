@@ -0,0 +1,423 @@
+package wallet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// NewFileStorage returns a storage that keeps everything in memory and
+// rewrites accounts.dump, payments.dump, favorites.dump, holds.dump,
+// ledger.dump and idempotency.dump in dir after every change, in the same
+// format as Export. Existing files are loaded.
+func NewFileStorage(dir string) (Storage, error) {
+	accounts, err := NewFileAccountRepository(dir + "/accounts.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	payments, err := NewFilePaymentRepository(dir + "/payments.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	favorites, err := NewFileFavoriteRepository(dir + "/favorites.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	holds, err := NewFileHoldRepository(dir + "/holds.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	postings, err := NewFilePostingRepository(dir + "/ledger.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	keys, err := newFileKeyRepository(dir + "/idempotency.dump")
+	if err != nil {
+		return Storage{}, err
+	}
+
+	return Storage{
+		Accounts:  accounts,
+		Payments:  payments,
+		Favorites: favorites,
+		Holds:     holds,
+		Postings:  postings,
+		keys:      keys,
+	}, nil
+}
+
+type FileAccountRepository struct {
+	mu     sync.Mutex // serializes writes to the file
+	path   string
+	memory MemoryAccountRepository
+}
+
+func NewFileAccountRepository(path string) (*FileAccountRepository, error) {
+	r := &FileAccountRepository{path: path}
+
+	lines, schema, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		account, err := parseAccount(line, schema)
+		if err != nil {
+			return nil, err
+		}
+		err = r.memory.Save(&account)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *FileAccountRepository) FindByID(id int64) (*types.Account, error) {
+	return r.memory.FindByID(id)
+}
+
+func (r *FileAccountRepository) FindByPhone(phone types.Phone) (*types.Account, error) {
+	return r.memory.FindByPhone(phone)
+}
+
+func (r *FileAccountRepository) Save(account *types.Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	accounts, err := r.memory.All()
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(accounts)+1)
+	saved := false
+	for _, v := range accounts {
+		if v.ID == account.ID {
+			v = *account
+			saved = true
+		}
+		lines = append(lines, formatAccount(v))
+	}
+	if !saved {
+		lines = append(lines, formatAccount(*account))
+	}
+
+	// the file goes first, so that a failed write leaves the memory as
+	// it is on disk
+	err = writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	return r.memory.Save(account)
+}
+
+func (r *FileAccountRepository) All() ([]types.Account, error) {
+	return r.memory.All()
+}
+
+type FilePaymentRepository struct {
+	mu     sync.Mutex // serializes writes to the file
+	path   string
+	memory MemoryPaymentRepository
+}
+
+func NewFilePaymentRepository(path string) (*FilePaymentRepository, error) {
+	r := &FilePaymentRepository{path: path}
+
+	lines, schema, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		payment, err := parsePayment(line, schema)
+		if err != nil {
+			return nil, err
+		}
+		err = r.memory.Save(&payment)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *FilePaymentRepository) FindByID(id string) (*types.Payment, error) {
+	return r.memory.FindByID(id)
+}
+
+func (r *FilePaymentRepository) FindByAccountID(accountID int64) ([]types.Payment, error) {
+	return r.memory.FindByAccountID(accountID)
+}
+
+func (r *FilePaymentRepository) Save(payment *types.Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payments, err := r.memory.All()
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(payments)+1)
+	saved := false
+	for _, v := range payments {
+		if v.ID == payment.ID {
+			v = *payment
+			saved = true
+		}
+		lines = append(lines, formatPayment(v))
+	}
+	if !saved {
+		lines = append(lines, formatPayment(*payment))
+	}
+
+	err = writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	return r.memory.Save(payment)
+}
+
+func (r *FilePaymentRepository) All() ([]types.Payment, error) {
+	return r.memory.All()
+}
+
+type FileFavoriteRepository struct {
+	mu     sync.Mutex // serializes writes to the file
+	path   string
+	memory MemoryFavoriteRepository
+}
+
+func NewFileFavoriteRepository(path string) (*FileFavoriteRepository, error) {
+	r := &FileFavoriteRepository{path: path}
+
+	lines, schema, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		favorite, err := parseFavorite(line, schema)
+		if err != nil {
+			return nil, err
+		}
+		err = r.memory.Save(&favorite)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *FileFavoriteRepository) FindByID(id string) (*types.Favorite, error) {
+	return r.memory.FindByID(id)
+}
+
+func (r *FileFavoriteRepository) Save(favorite *types.Favorite) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	favorites, err := r.memory.All()
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(favorites)+1)
+	saved := false
+	for _, v := range favorites {
+		if v.ID == favorite.ID {
+			v = *favorite
+			saved = true
+		}
+		lines = append(lines, formatFavorite(v))
+	}
+	if !saved {
+		lines = append(lines, formatFavorite(*favorite))
+	}
+
+	err = writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	return r.memory.Save(favorite)
+}
+
+func (r *FileFavoriteRepository) All() ([]types.Favorite, error) {
+	return r.memory.All()
+}
+
+type FileHoldRepository struct {
+	mu     sync.Mutex // serializes writes to the file
+	path   string
+	memory holdTable
+}
+
+func NewFileHoldRepository(path string) (*FileHoldRepository, error) {
+	r := &FileHoldRepository{path: path}
+
+	lines, schema, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	holds := make([]*types.Hold, len(lines))
+	for i, line := range lines {
+		hold, err := parseHold(line, schema)
+		if err != nil {
+			return nil, err
+		}
+		holds[i] = &hold
+	}
+	r.memory.add(holds)
+	return r, nil
+}
+
+func (r *FileHoldRepository) Save(hold *types.Hold) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	holds := r.memory.all()
+	lines := make([]string, 0, len(holds)+1)
+	saved := false
+	for _, v := range holds {
+		if v.ID == hold.ID {
+			v = *hold
+			saved = true
+		}
+		lines = append(lines, formatHold(v))
+	}
+	if !saved {
+		lines = append(lines, formatHold(*hold))
+	}
+
+	err := writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	r.memory.add([]*types.Hold{hold})
+	return nil
+}
+
+func (r *FileHoldRepository) All() ([]types.Hold, error) {
+	return r.memory.all(), nil
+}
+
+type FilePostingRepository struct {
+	mu     sync.Mutex // serializes writes to the file
+	path   string
+	memory ledger
+}
+
+func NewFilePostingRepository(path string) (*FilePostingRepository, error) {
+	r := &FilePostingRepository{path: path}
+
+	lines, schema, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	postings := make([]types.Posting, len(lines))
+	for i, line := range lines {
+		postings[i], err = parsePosting(line, schema)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.memory.add(postings)
+	return r, nil
+}
+
+func (r *FilePostingRepository) Add(postings []types.Posting) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added := []types.Posting{}
+	for _, posting := range postings {
+		if !r.memory.has(posting.EntryID) {
+			added = append(added, posting)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	all := append(r.memory.all(), added...)
+	lines := make([]string, len(all))
+	for i, v := range all {
+		lines[i] = formatPosting(v)
+	}
+	err := writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	r.memory.add(added)
+	return nil
+}
+
+func (r *FilePostingRepository) All() ([]types.Posting, error) {
+	return r.memory.all(), nil
+}
+
+type fileKeyRepository struct {
+	mu      sync.Mutex // serializes writes to the file
+	path    string
+	entries []idempotencyEntry // oldest first
+}
+
+func newFileKeyRepository(path string) (*fileKeyRepository, error) {
+	r := &fileKeyRepository{path: path}
+
+	lines, _, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		entry, err := parseIdempotencyEntry(line)
+		if err != nil {
+			return nil, err
+		}
+		r.entries = append(r.entries, *entry)
+	}
+	return r, nil
+}
+
+func (r *fileKeyRepository) Save(entries []*idempotencyEntry, deadline time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	kept := []idempotencyEntry{}
+	known := map[string]bool{}
+	for _, entry := range r.entries {
+		if !entry.createdAt.Before(deadline) {
+			kept = append(kept, entry)
+			known[entry.key] = true
+		}
+	}
+	for _, entry := range entries {
+		if !known[entry.key] {
+			kept = append(kept, idempotencyEntry{key: entry.key, request: entry.request,
+				paymentID: entry.paymentID, err: entry.err, createdAt: entry.createdAt})
+			known[entry.key] = true
+		}
+	}
+
+	lines := make([]string, len(kept))
+	for i, v := range kept {
+		lines[i] = formatIdempotencyEntry(v)
+	}
+	err := writeDump(r.path, lines)
+	if err != nil {
+		return err
+	}
+	r.entries = kept
+	return nil
+}
+
+func (r *fileKeyRepository) All() ([]idempotencyEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]idempotencyEntry, len(r.entries))
+	copy(entries, r.entries)
+	return entries, nil
+}
@@ -0,0 +1,463 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/google/uuid"
+)
+
+var ErrHoldNotFound = errors.New("hold not found")
+var ErrHoldNotActive = errors.New("hold is not active")
+var ErrCaptureTooLarge = errors.New("capture is more than the hold")
+
+// A hold reserves money of an account for a payment that is made later, like
+// the authorization of a card payment. An active hold takes its amount off
+// the available balance, the balance and the ledger don't change until the
+// hold is captured: then the captured amount is paid like with Pay and the
+// rest is released. A hold that is neither captured nor voided before it
+// expires releases its amount by itself.
+
+// DefaultHoldExpiry is how long a hold lasts unless WithHoldExpiry says otherwise
+const DefaultHoldExpiry = 7 * 24 * time.Hour
+
+// WithHoldExpiry sets how long the holds made by Authorize last, NewService
+// fails with ErrInvalidOption if it is not positive
+func WithHoldExpiry(expiry time.Duration) Option {
+	return func(s *Service) {
+		if expiry <= 0 {
+			s.invalidOption("hold expiry %v must be positive", expiry)
+			return
+		}
+		s.holdExpiry = expiry
+	}
+}
+
+// holdTable keeps the holds in the order they were made
+type holdTable struct {
+	mu        sync.RWMutex
+	holds     []*types.Hold
+	byID      map[string]int  // index in holds
+	byAccount map[int64][]int // indexes in holds
+}
+
+// add inserts the holds or replaces the ones with the same IDs
+func (t *holdTable) add(holds []*types.Hold) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.byID == nil {
+		t.byID = make(map[string]int)
+		t.byAccount = make(map[int64][]int)
+	}
+
+	for _, hold := range holds {
+		copied := *hold
+		if i, ok := t.byID[hold.ID]; ok {
+			t.holds[i] = &copied
+			continue
+		}
+		t.byID[hold.ID] = len(t.holds)
+		t.byAccount[hold.AccountID] = append(t.byAccount[hold.AccountID], len(t.holds))
+		t.holds = append(t.holds, &copied)
+	}
+}
+
+func (t *holdTable) find(id string) (*types.Hold, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	i, ok := t.byID[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *t.holds[i]
+	return &copied, true
+}
+
+func (t *holdTable) all() []types.Hold {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	holds := make([]types.Hold, len(t.holds))
+	for i, hold := range t.holds {
+		holds[i] = *hold
+	}
+	return holds
+}
+
+func (t *holdTable) findByAccount(accountID int64) []types.Hold {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	holds := make([]types.Hold, len(t.byAccount[accountID]))
+	for i, index := range t.byAccount[accountID] {
+		holds[i] = *t.holds[index]
+	}
+	return holds
+}
+
+// held sums the holds of the account that are active at now, except the one
+// with the ID
+func (t *holdTable) held(accountID int64, now time.Time, except string) (types.Money, error) {
+	sum := types.Money(0)
+	for _, hold := range t.findByAccount(accountID) {
+		if hold.ID == except || holdStatus(hold, now) != types.HoldStatusActive {
+			continue
+		}
+		var err error
+		sum, err = sum.Add(hold.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("holds of account %v: %w", accountID, err)
+		}
+	}
+	return sum, nil
+}
+
+// holdStatus is the status of the hold at now, an active hold past its
+// expiry is expired even if that was not saved yet
+func holdStatus(hold types.Hold, now time.Time) types.HoldStatus {
+	if pastExpiry(hold, now) {
+		return types.HoldStatusExpired
+	}
+	return hold.Status
+}
+
+// pastExpiry says whether the hold is still active but past its expiry
+func pastExpiry(hold types.Hold, now time.Time) bool {
+	return hold.Status == types.HoldStatusActive && !now.Before(hold.ExpiresAt)
+}
+
+// validHoldStatus reports whether the status is one of the known ones
+func validHoldStatus(status types.HoldStatus) bool {
+	switch status {
+	case types.HoldStatusActive, types.HoldStatusCaptured, types.HoldStatusVoided, types.HoldStatusExpired:
+		return true
+	}
+	return false
+}
+
+// available is the balance of the account less its active holds, except the
+// one with the ID; it must be called with the account locked
+func (s *Service) available(account *types.Account, except string) (types.Money, error) {
+	held, err := s.holds.held(account.ID, s.now(), except)
+	if err != nil {
+		return 0, err
+	}
+	return availableOf(account.Balance, held)
+}
+
+// availableOf is what is left of the balance after the holds, nothing if
+// they are more than the balance, e.g. after an import lowered it
+func availableOf(balance types.Money, held types.Money) (types.Money, error) {
+	available, err := balance.Sub(held)
+	if err != nil {
+		return 0, err
+	}
+	if available < 0 {
+		return 0, nil
+	}
+	return available, nil
+}
+
+// Authorize holds the amount on the account for a payment of the category,
+// the hold expires after the time set by WithHoldExpiry
+func (s *Service) Authorize(accountID int64, amount types.Money, category types.PaymentCategory) (hold *types.Hold, err error) {
+	s.ready()
+	err = s.audited("Authorize", auditParams("account", accountID, "amount", amount, "category", category), func(s *Service) error {
+		s.call.account(accountID)
+		hold, err = s.authorize(accountID, amount, category)
+		return err
+	})
+	return hold, err
+}
+
+func (s *Service) authorize(accountID int64, amount types.Money, category types.PaymentCategory) (*types.Hold, error) {
+	if amount <= 0 {
+		return nil, ErrAmountMustBePositive
+	}
+
+	unlock := s.lockAccount(accountID)
+	defer unlock()
+
+	account, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	available, err := s.available(account, "")
+	if err != nil {
+		return nil, err
+	}
+	if available < amount {
+		return nil, ErrNotEnoughBalance
+	}
+
+	now := s.now()
+	hold := &types.Hold{
+		ID:        uuid.New().String(),
+		AccountID: accountID,
+		Amount:    amount,
+		Category:  category,
+		Currency:  account.Currency,
+		Status:    types.HoldStatusActive,
+		ExpiresAt: now.Add(s.holdExpiry),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = s.save(batch{holds: []*types.Hold{hold}})
+	if err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Capture pays the amount of the hold, all of it or a part, and releases
+// the rest. The payment is like one made by Pay.
+func (s *Service) Capture(holdID string, amount types.Money) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("Capture", auditParams("hold", holdID, "amount", amount), func(s *Service) (*types.Payment, error) {
+		s.call.hold(holdID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
+
+		hold, unlock, err := s.lockActiveHold(holdID)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		if amount > hold.Amount {
+			return nil, ErrCaptureTooLarge
+		}
+		account, err := s.accounts.FindByID(hold.AccountID)
+		if err != nil {
+			return nil, err
+		}
+
+		hold.Status = types.HoldStatusCaptured
+		hold.Captured = amount
+		return s.pay(account, amount, hold.Category, nil, hold)
+	})
+}
+
+// Void releases the hold without a payment
+func (s *Service) Void(holdID string) error {
+	s.ready()
+	return s.audited("Void", auditParams("hold", holdID), func(s *Service) error {
+		s.call.hold(holdID)
+
+		hold, unlock, err := s.lockActiveHold(holdID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+
+		hold.Status = types.HoldStatusVoided
+		hold.UpdatedAt = s.now()
+		return s.save(batch{holds: []*types.Hold{hold}})
+	})
+}
+
+// lockActiveHold locks the account of the hold and returns the hold if it
+// is still active
+func (s *Service) lockActiveHold(holdID string) (*types.Hold, func(), error) {
+	hold, ok := s.holds.find(holdID)
+	if !ok {
+		return nil, nil, ErrHoldNotFound
+	}
+
+	unlock := s.lockAccount(hold.AccountID)
+
+	// re-read under the lock, the hold could have changed meanwhile
+	hold, _ = s.holds.find(holdID)
+	if status := holdStatus(*hold, s.now()); status != types.HoldStatusActive {
+		unlock()
+		return nil, nil, fmt.Errorf("%w: hold %v is %v", ErrHoldNotActive, holdID, status)
+	}
+	return hold, unlock, nil
+}
+
+// ExpireHolds saves the expiry of the holds that are past it and returns
+// how many there were. Until then such holds are reported as expired and
+// hold nothing already, so it only matters for the dumps.
+func (s *Service) ExpireHolds() (expired int, err error) {
+	s.ready()
+	err = s.audited("ExpireHolds", nil, func(s *Service) error {
+		expired, err = s.expireHolds()
+		return err
+	})
+	return expired, err
+}
+
+func (s *Service) expireHolds() (int, error) {
+	expired := 0
+	for _, v := range s.holds.all() {
+		if !pastExpiry(v, s.now()) {
+			continue
+		}
+
+		err := func() error {
+			unlock := s.lockAccount(v.AccountID)
+			defer unlock()
+
+			// re-read under the lock, the hold could have been captured meanwhile
+			hold, _ := s.holds.find(v.ID)
+			now := s.now()
+			if !pastExpiry(*hold, now) {
+				return nil
+			}
+			s.call.hold(hold.ID)
+			hold.Status = types.HoldStatusExpired
+			hold.UpdatedAt = now
+			expired++
+			return s.save(batch{holds: []*types.Hold{hold}})
+		}()
+		if err != nil {
+			return expired, err
+		}
+	}
+	return expired, nil
+}
+
+// FindHoldByID returns the hold with its status at the moment
+func (s *Service) FindHoldByID(holdID string) (*types.Hold, error) {
+	s.ready()
+	hold, ok := s.holds.find(holdID)
+	if !ok {
+		return nil, ErrHoldNotFound
+	}
+	hold.Status = holdStatus(*hold, s.now())
+	return hold, nil
+}
+
+// FindHoldsByAccountID returns the holds of the account, oldest first, with
+// their statuses at the moment
+func (s *Service) FindHoldsByAccountID(accountID int64) ([]types.Hold, error) {
+	s.ready()
+	_, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	holds := s.holds.findByAccount(accountID)
+	now := s.now()
+	for i := range holds {
+		holds[i].Status = holdStatus(holds[i], now)
+	}
+	sort.SliceStable(holds, func(i, j int) bool {
+		return holds[i].CreatedAt.Before(holds[j].CreatedAt)
+	})
+	return holds, nil
+}
+
+// AccountBalance returns the balance of the account together with the part
+// of it that is available for payments, which is never negative
+func (s *Service) AccountBalance(accountID int64) (*types.AccountBalance, error) {
+	s.ready()
+	unlock := s.lockAccount(accountID)
+	defer unlock()
+
+	account, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	held, err := s.holds.held(accountID, s.now(), "")
+	if err != nil {
+		return nil, err
+	}
+	available, err := availableOf(account.Balance, held)
+	if err != nil {
+		return nil, err
+	}
+	return &types.AccountBalance{
+		AccountID: accountID,
+		Currency:  currencyOrDefault(account.Currency),
+		Balance:   account.Balance,
+		Held:      held,
+		Available: available,
+	}, nil
+}
+
+// holds.dump keeps one hold per line:
+// id;accountID;amount;category;currency;status;captured;paymentID;expiresAt;createdAt;updatedAt
+
+func formatHold(v types.Hold) string {
+	return fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v", escapeField(v.ID), v.AccountID, v.Amount, escapeField(v.Category),
+		escapeField(v.Currency), escapeField(v.Status), v.Captured, escapeField(v.PaymentID), formatTime(v.ExpiresAt),
+		formatTime(v.CreatedAt), formatTime(v.UpdatedAt))
+}
+
+func parseHold(line string, schema int) (types.Hold, error) {
+	rec, err := splitRecord(line, schema)
+	if err != nil {
+		return types.Hold{}, err
+	}
+	if len(rec) != 11 {
+		return types.Hold{}, fmt.Errorf("hold: expected 11 fields, got %v", len(rec))
+	}
+	accountID, err := strconv.ParseInt(rec[1], 10, 64)
+	if err != nil {
+		return types.Hold{}, err
+	}
+	amount, err := strconv.ParseInt(rec[2], 10, 64)
+	if err != nil {
+		return types.Hold{}, err
+	}
+	captured, err := strconv.ParseInt(rec[6], 10, 64)
+	if err != nil {
+		return types.Hold{}, err
+	}
+	expires, err := parseTime(rec[8])
+	if err != nil {
+		return types.Hold{}, err
+	}
+	created, updated, err := parseTimes(rec, 9)
+	if err != nil {
+		return types.Hold{}, err
+	}
+	return types.Hold{
+		ID:        rec[0],
+		AccountID: accountID,
+		Amount:    types.Money(amount),
+		Category:  types.PaymentCategory(rec[3]),
+		Currency:  types.Currency(rec[4]),
+		Status:    types.HoldStatus(rec[5]),
+		Captured:  types.Money(captured),
+		PaymentID: rec[7],
+		ExpiresAt: expires,
+		CreatedAt: created,
+		UpdatedAt: updated,
+	}, nil
+}
+
+func (s *Service) ExportHolds(dir string) error {
+	s.ready()
+	holds := s.holds.all()
+	if len(holds) == 0 {
+		return nil
+	}
+
+	return writeFileAtomicFunc(dir+"/holds.dump", func(w io.Writer) error {
+		return writeHolds(w, holds)
+	})
+}
+
+// ExportHoldsTo writes the holds in the holds.dump format
+func (s *Service) ExportHoldsTo(w io.Writer) error {
+	s.ready()
+	return writeHolds(w, s.holds.all())
+}
+
+func writeHolds(w io.Writer, holds []types.Hold) error {
+	return writeDumpTo(w, len(holds), func(i int) string {
+		return formatHold(holds[i])
+	})
+}
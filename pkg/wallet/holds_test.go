@@ -0,0 +1,420 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// newHoldTestService has an account with 1000.00 and a hold of 300.00 on it
+func newHoldTestService(clock *testClock, options ...Option) (*Service, *types.Hold, error) {
+	s, err := NewService(NewMemoryStorage(), append(options, WithClock(clock.Now), WithHoldExpiry(time.Hour))...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.Deposit(account.ID, 1_000_00)
+	if err != nil {
+		return nil, nil, err
+	}
+	hold, err := s.Authorize(account.ID, 300_00, "auto")
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, hold, nil
+}
+
+func checkAccountBalance(t *testing.T, s *Service, balance types.Money, available types.Money) {
+	t.Helper()
+	result, err := s.AccountBalance(1)
+	if err != nil {
+		t.Errorf("AccountBalance(): error = %v", err)
+		return
+	}
+	if result.Balance != balance || result.Available != available || result.Held != balance-available {
+		t.Errorf("AccountBalance(): %+v, expected balance %v, available %v", result, balance, available)
+	}
+}
+
+func TestService_Authorize(t *testing.T) {
+	s, hold, err := newHoldTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if hold.Status != types.HoldStatusActive || hold.Currency != types.DefaultCurrency {
+		t.Errorf("Authorize(): wrong hold %+v", hold)
+	}
+	checkAccountBalance(t, s, 1_000_00, 700_00)
+	balance, err := s.LedgerBalance(UserLedgerAccount(1))
+	if err != nil || balance[types.DefaultCurrency] != 1_000_00 {
+		t.Errorf("LedgerBalance(): balance %v, error %v", balance, err)
+	}
+
+	_, err = s.Pay(1, 700_01, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay(): must return ErrNotEnoughBalance, returned = %v", err)
+	}
+	_, err = s.Authorize(1, 700_01, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Authorize(): must return ErrNotEnoughBalance, returned = %v", err)
+	}
+	_, err = s.Authorize(1, 0, "auto")
+	if err != ErrAmountMustBePositive {
+		t.Errorf("Authorize(): must return ErrAmountMustBePositive, returned = %v", err)
+	}
+	_, err = s.Authorize(99, 10, "auto")
+	if err != ErrAccountNotFound {
+		t.Errorf("Authorize(): must return ErrAccountNotFound, returned = %v", err)
+	}
+
+	_, err = s.Pay(1, 700_00, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkAccountBalance(t, s, 300_00, 0)
+}
+
+func TestService_Capture(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount types.Money
+	}{
+		{"full", 300_00},
+		{"partial", 120_00},
+	}
+	for _, tt := range tests {
+		s, hold, err := newHoldTestService(newTestClock())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		payment, err := s.Capture(hold.ID, tt.amount)
+		if err != nil {
+			t.Errorf("Capture(): %v: error = %v", tt.name, err)
+			continue
+		}
+		if payment.Amount != tt.amount || payment.Category != "auto" {
+			t.Errorf("Capture(): %v: wrong payment %+v", tt.name, payment)
+		}
+		// the rest of a partial capture is released
+		checkAccountBalance(t, s, 1_000_00-tt.amount, 1_000_00-tt.amount)
+
+		captured, err := s.FindHoldByID(hold.ID)
+		if err != nil || captured.Status != types.HoldStatusCaptured || captured.Captured != tt.amount ||
+			captured.PaymentID != payment.ID {
+			t.Errorf("FindHoldByID(): %v: hold %+v, error %v", tt.name, captured, err)
+		}
+		checkLedger(t, s)
+
+		_, err = s.Capture(hold.ID, 1)
+		if !errors.Is(err, ErrHoldNotActive) {
+			t.Errorf("Capture(): %v: must return ErrHoldNotActive, returned = %v", tt.name, err)
+		}
+	}
+}
+
+func TestService_Capture_errors(t *testing.T) {
+	s, hold, err := newHoldTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Capture(hold.ID, 300_01)
+	if err != ErrCaptureTooLarge {
+		t.Errorf("Capture(): must return ErrCaptureTooLarge, returned = %v", err)
+	}
+	_, err = s.Capture(hold.ID, 0)
+	if err != ErrAmountMustBePositive {
+		t.Errorf("Capture(): must return ErrAmountMustBePositive, returned = %v", err)
+	}
+	_, err = s.Capture("unknown", 10)
+	if err != ErrHoldNotFound {
+		t.Errorf("Capture(): must return ErrHoldNotFound, returned = %v", err)
+	}
+
+	// the money of the hold can't be taken by a payment, only by the capture
+	_, err = s.Pay(1, 700_00, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s.Capture(hold.ID, 300_00)
+	if err != nil {
+		t.Errorf("Capture(): error = %v", err)
+	}
+	checkAccountBalance(t, s, 0, 0)
+}
+
+func TestService_Void(t *testing.T) {
+	s, hold, err := newHoldTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Void(hold.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkAccountBalance(t, s, 1_000_00, 1_000_00)
+
+	err = s.Void(hold.ID)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Void(): must return ErrHoldNotActive, returned = %v", err)
+	}
+	_, err = s.Capture(hold.ID, 10)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Capture(): must return ErrHoldNotActive, returned = %v", err)
+	}
+	err = s.Void("unknown")
+	if err != ErrHoldNotFound {
+		t.Errorf("Void(): must return ErrHoldNotFound, returned = %v", err)
+	}
+
+	report := checkLedger(t, s)
+	if report != nil && report.Entries != 1 {
+		t.Errorf("CheckLedger(): entries %v, a hold must not post", report.Entries)
+	}
+}
+
+func TestService_holdExpiry(t *testing.T) {
+	clock := newTestClock()
+	s, hold, err := newHoldTestService(clock)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	clock.Advance(30 * time.Minute)
+	later, err := s.Authorize(1, 100_00, "food")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.Advance(29 * time.Minute)
+	checkAccountBalance(t, s, 1_000_00, 600_00)
+
+	// the first hold expires by itself, the dump still has it active
+	clock.Advance(time.Minute)
+	checkAccountBalance(t, s, 1_000_00, 900_00)
+	expired, err := s.FindHoldByID(hold.ID)
+	if err != nil || expired.Status != types.HoldStatusExpired {
+		t.Errorf("FindHoldByID(): hold %+v, error %v", expired, err)
+	}
+	_, err = s.Capture(hold.ID, 10)
+	if !errors.Is(err, ErrHoldNotActive) {
+		t.Errorf("Capture(): must return ErrHoldNotActive, returned = %v", err)
+	}
+	if found, _ := s.holds.find(hold.ID); found.Status != types.HoldStatusActive {
+		t.Errorf("holds: status %v before ExpireHolds", found.Status)
+	}
+
+	count, err := s.ExpireHolds()
+	if err != nil || count != 1 {
+		t.Errorf("ExpireHolds(): expired %v, error %v", count, err)
+	}
+	if found, _ := s.holds.find(hold.ID); found.Status != types.HoldStatusExpired || !found.UpdatedAt.Equal(clock.Now()) {
+		t.Errorf("ExpireHolds(): hold %+v", found)
+	}
+	count, err = s.ExpireHolds()
+	if err != nil || count != 0 {
+		t.Errorf("ExpireHolds(): expired %v again, error %v", count, err)
+	}
+
+	holds, err := s.FindHoldsByAccountID(1)
+	if err != nil || len(holds) != 2 || holds[0].ID != hold.ID || holds[1].ID != later.ID ||
+		holds[1].Status != types.HoldStatusActive {
+		t.Errorf("FindHoldsByAccountID(): holds %+v, error %v", holds, err)
+	}
+	_, err = s.FindHoldsByAccountID(99)
+	if err != ErrAccountNotFound {
+		t.Errorf("FindHoldsByAccountID(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestService_holdsOverBalance(t *testing.T) {
+	s, hold, err := newHoldTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// an import may leave holds over the balance
+	over := *hold
+	over.ID = "over"
+	over.Amount = 900_00
+	s.holds.add([]*types.Hold{&over})
+	result, err := s.AccountBalance(1)
+	if err != nil || result.Held != 1_200_00 || result.Available != 0 {
+		t.Errorf("AccountBalance(): %+v, error %v", result, err)
+	}
+	_, err = s.Pay(1, 1, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay(): must return ErrNotEnoughBalance, returned = %v", err)
+	}
+
+	over.Amount = math.MaxInt64
+	s.holds.add([]*types.Hold{&over})
+	_, err = s.AccountBalance(1)
+	if !errors.Is(err, types.ErrOverflow) {
+		t.Errorf("AccountBalance(): must return ErrOverflow, returned = %v", err)
+	}
+	_, err = s.Pay(1, 1, "auto")
+	if !errors.Is(err, types.ErrOverflow) {
+		t.Errorf("Pay(): must return ErrOverflow, returned = %v", err)
+	}
+}
+
+func TestWithHoldExpiry_notPositive(t *testing.T) {
+	for _, expiry := range []time.Duration{0, -time.Hour} {
+		_, err := NewService(NewMemoryStorage(), WithHoldExpiry(expiry))
+		if !errors.Is(err, ErrInvalidOption) {
+			t.Errorf("NewService(): expiry %v must return ErrInvalidOption, returned = %v", expiry, err)
+		}
+	}
+}
+
+func TestService_holds_exports(t *testing.T) {
+	s1, hold, err := newHoldTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.Capture(hold.ID, 100_00)
+	if err == nil {
+		_, err = s1.Authorize(1, 50_00, "food")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dir := t.TempDir()
+
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2 := newTestService()
+	report, err := s2.ValidateImport(dir)
+	if err != nil || len(report.Problems) != 0 || report.Holds != 2 {
+		t.Errorf("ValidateImport(): report %+v, error %v", report, err)
+	}
+	summary, err := s2.ImportWithPolicy(dir, ConflictFail)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Holds.Inserted != 2 {
+		t.Errorf("ImportWithPolicy(): holds %+v", summary.Holds)
+	}
+	compareServices(t, s1, s2.Service)
+
+	summary, err = s2.ImportWithPolicy(dir, ConflictFail)
+	if err != nil || summary.Holds.Skipped != 2 {
+		t.Errorf("ImportWithPolicy(): again, holds %+v, error %v", summary, err)
+	}
+}
+
+func TestService_WithLog_holds(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	s1, hold, err := newHoldTestService(clock, WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := s1.Authorize(1, 100_00, "food")
+	if err == nil {
+		_, err = s1.Capture(hold.ID, 10_00)
+	}
+	if err == nil {
+		err = s1.Void(other.ID)
+	}
+	if err == nil {
+		err = s1.Close()
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithLog(dir, 0), WithClock(clock.Now))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s2.Close()
+	compareServices(t, s1, s2)
+	compareLedgers(t, s1, s2)
+	checkAccountBalance(t, s2, 990_00, 990_00)
+}
+
+func TestService_FileStorage_holds(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s1, err := NewService(storage, WithClock(clock.Now))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s1.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Deposit(account.ID, 1000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	hold, err := s1.Authorize(account.ID, 900, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a new service over the same directory keeps the money held
+	storage, err = NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2, err := NewService(storage, WithClock(clock.Now))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := s2.FindHoldByID(hold.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(got, hold) {
+		t.Errorf("FindHoldByID(): expected %+v, actual %+v", hold, got)
+	}
+	_, err = s2.Pay(account.ID, 900, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("Pay(): err expected:%v, actual:%v", ErrNotEnoughBalance, err)
+	}
+	checkAccountBalance(t, s2, 1000, 100)
+}
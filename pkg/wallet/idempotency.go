@@ -0,0 +1,398 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrIdempotencyKeyReused = errors.New("idempotency key already used for another request")
+
+// DefaultIdempotencyRetention is how long a key is remembered unless
+// WithIdempotencyRetention says otherwise.
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// WithIdempotencyRetention sets how long idempotency keys are remembered
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(s *Service) {
+		s.retention = retention
+	}
+}
+
+type idempotencyEntry struct {
+	key       string
+	request   string // operation and arguments, a key can't be reused for another request
+	paymentID string
+	err       error
+	createdAt time.Time
+	done      chan struct{} // closed once the result is known
+}
+
+type idempotencyTable struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	order   []*idempotencyEntry // oldest first, to expire them cheaply
+}
+
+// acquire returns the entry of the key and whether the caller is the first
+// one and has to run the request
+func (t *idempotencyTable) acquire(key string, request string, now time.Time, retention time.Duration) (*idempotencyEntry, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire(now.Add(-retention))
+
+	entry, ok := t.entries[key]
+	if ok {
+		if entry.request != request {
+			return nil, false, ErrIdempotencyKeyReused
+		}
+		return entry, false, nil
+	}
+
+	entry = &idempotencyEntry{
+		key:       key,
+		request:   request,
+		createdAt: now,
+		done:      make(chan struct{}),
+	}
+	t.add(entry)
+	return entry, true, nil
+}
+
+func (t *idempotencyTable) finish(entry *idempotencyEntry, payment *types.Payment, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if payment != nil {
+		entry.paymentID = payment.ID
+	}
+	entry.err = err
+	close(entry.done)
+}
+
+// add must be called with t.mu held
+func (t *idempotencyTable) add(entry *idempotencyEntry) {
+	if t.entries == nil {
+		t.entries = make(map[string]*idempotencyEntry)
+	}
+	t.entries[entry.key] = entry
+	t.order = append(t.order, entry)
+}
+
+// expire forgets the finished entries created before the deadline,
+// it must be called with t.mu held
+func (t *idempotencyTable) expire(deadline time.Time) {
+	for len(t.order) > 0 && t.order[0].createdAt.Before(deadline) {
+		entry := t.order[0]
+		select {
+		case <-entry.done:
+		default:
+			return // still running
+		}
+		if t.entries[entry.key] == entry {
+			delete(t.entries, entry.key)
+		}
+		t.order[0] = nil
+		t.order = t.order[1:]
+	}
+}
+
+// finished returns copies of the entries that have a result
+func (t *idempotencyTable) finished() []idempotencyEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := []idempotencyEntry{}
+	for _, entry := range t.order {
+		if t.entries[entry.key] != entry {
+			continue
+		}
+		select {
+		case <-entry.done:
+			entries = append(entries, *entry)
+		default:
+		}
+	}
+	return entries
+}
+
+// restore adds finished entries, keeping the ones the table already has
+func (t *idempotencyTable) restore(entries []*idempotencyEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, entry := range entries {
+		if _, ok := t.entries[entry.key]; ok {
+			continue
+		}
+		entry.done = make(chan struct{})
+		close(entry.done)
+		t.add(entry)
+	}
+
+	sort.SliceStable(t.order, func(i, j int) bool {
+		return t.order[i].createdAt.Before(t.order[j].createdAt)
+	})
+}
+
+// pendingKey is the idempotency key of a running request, the first batch
+// the request saves carries it so that the key is saved together with the
+// payment or can't be lost without it
+type pendingKey struct {
+	entry idempotencyEntry
+	saved bool
+}
+
+// attach adds the key to the first batch of the request, with the last
+// payment of the batch as its result
+func (k *pendingKey) attach(b batch) batch {
+	if k == nil || k.saved {
+		return b
+	}
+	entry := k.entry
+	if len(b.payments) > 0 {
+		entry.paymentID = b.payments[len(b.payments)-1].ID
+	}
+	b.keys = append(b.keys[:len(b.keys):len(b.keys)], &entry)
+	return b
+}
+
+// done marks the key saved once its batch is
+func (k *pendingKey) done() {
+	if k != nil {
+		k.saved = true
+	}
+}
+
+// idempotent runs the request once per key, repeated calls with the same
+// key get the payment or the error of the first call while the key is
+// retained. An empty key turns idempotency off.
+//
+// The key is saved in the same batch as the changes of the request. A
+// request that fails before saving anything gets its key saved on its own,
+// the error is remembered too.
+func (s *Service) idempotent(key string, request string, run func(s *Service) (*types.Payment, error)) (*types.Payment, error) {
+	if key == "" {
+		return run(s)
+	}
+
+	entry, first, err := s.idempotency.acquire(key, request, s.now(), s.retention)
+	if err != nil {
+		return nil, err
+	}
+
+	if !first {
+		<-entry.done
+		if entry.err != nil {
+			return nil, entry.err
+		}
+		if entry.paymentID == "" {
+			return nil, nil
+		}
+		return s.FindPaymentByID(entry.paymentID)
+	}
+
+	pending := &pendingKey{entry: idempotencyEntry{key: entry.key, request: entry.request, createdAt: entry.createdAt}}
+	payment, err := run(&Service{state: s.state, actor: s.actor, source: s.source, call: s.call, key: pending})
+	if !pending.saved {
+		pending.entry.err = err
+		saveErr := s.save(batch{keys: []*idempotencyEntry{&pending.entry}})
+		if saveErr != nil && err == nil {
+			payment, err = nil, saveErr
+		} else if saveErr != nil {
+			err = fmt.Errorf("%w, the idempotency key was not saved: %v", err, saveErr)
+		}
+	}
+	s.idempotency.finish(entry, payment, err)
+	return payment, err
+}
+
+// PayIdempotent is Pay that is done only once for the key
+func (s *Service) PayIdempotent(key string, accountID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	s.ready()
+	request := fmt.Sprint("pay;", accountID, ";", amount, ";", category)
+	return s.idempotent(key, request, func(s *Service) (*types.Payment, error) {
+		return s.Pay(accountID, amount, category)
+	})
+}
+
+// DepositIdempotent is Deposit that is done only once for the key
+func (s *Service) DepositIdempotent(key string, accountID int64, amount types.Money) error {
+	s.ready()
+	request := fmt.Sprint("deposit;", accountID, ";", amount)
+	_, err := s.idempotent(key, request, func(s *Service) (*types.Payment, error) {
+		return nil, s.Deposit(accountID, amount)
+	})
+	return err
+}
+
+// PayFromFavoriteIdempotent is PayFromFavorite that is done only once for the key
+func (s *Service) PayFromFavoriteIdempotent(key string, favoriteID string) (*types.Payment, error) {
+	s.ready()
+	request := fmt.Sprint("favorite;", favoriteID)
+	return s.idempotent(key, request, func(s *Service) (*types.Payment, error) {
+		return s.PayFromFavorite(favoriteID)
+	})
+}
+
+// TransferIdempotent is Transfer that is done only once for the key
+func (s *Service) TransferIdempotent(key string, fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	s.ready()
+	request := fmt.Sprint("transfer;", fromID, ";", toID, ";", amount)
+	return s.idempotent(key, request, func(s *Service) (*types.Payment, error) {
+		return s.Transfer(fromID, toID, amount)
+	})
+}
+
+// RefundIdempotent is Refund that is done only once for the key
+func (s *Service) RefundIdempotent(key string, paymentID string, amount types.Money) (*types.Payment, error) {
+	s.ready()
+	request := fmt.Sprint("refund;", paymentID, ";", amount)
+	return s.idempotent(key, request, func(s *Service) (*types.Payment, error) {
+		return s.Refund(paymentID, amount)
+	})
+}
+
+// knownErrors turns the messages of the remembered errors back into the
+// package's error variables after an import
+var knownErrors = []error{
+	ErrPhoneRegistered,
+	ErrAmountMustBePositive,
+	ErrAccountNotFound,
+	ErrNotEnoughBalance,
+	ErrPaymentNotFound,
+	ErrFavoriteNotFound,
+	ErrTransferToSameAccount,
+	ErrIllegalTransition,
+	ErrIdempotencyKeyReused,
+	ErrUnknownCurrency,
+	ErrCurrencyMismatch,
+	ErrNoRate,
+	ErrAmountTooLarge,
+	ErrUnknownRounding,
+	ErrNotRefundable,
+	ErrRefundTooLarge,
+	ErrRefundPayment,
+	ErrHoldNotFound,
+	ErrHoldNotActive,
+	ErrCaptureTooLarge,
+	types.ErrOverflow,
+}
+
+func errorFromMessage(message string) error {
+	if message == "" {
+		return nil
+	}
+	for _, err := range knownErrors {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return errors.New(message)
+}
+
+// idempotency.dump keeps key;request;paymentID;error;createdAt, the
+// free-form fields are query-escaped so they can't break the line
+
+func formatIdempotencyEntry(v idempotencyEntry) string {
+	message := ""
+	if v.err != nil {
+		message = v.err.Error()
+	}
+	return fmt.Sprintf("%v;%v;%v;%v;%v", url.QueryEscape(v.key), url.QueryEscape(v.request), url.QueryEscape(v.paymentID),
+		url.QueryEscape(message), formatTime(v.createdAt))
+}
+
+func parseIdempotencyEntry(line string) (*idempotencyEntry, error) {
+	rec := strings.Split(line, ";")
+	if len(rec) != 5 {
+		return nil, fmt.Errorf("idempotency key: expected 5 fields, got %v", len(rec))
+	}
+
+	key, err := url.QueryUnescape(rec[0])
+	if err != nil {
+		return nil, err
+	}
+	request, err := url.QueryUnescape(rec[1])
+	if err != nil {
+		return nil, err
+	}
+	// payment IDs were written as they are, they have no '%' or '+'
+	paymentID, err := url.QueryUnescape(rec[2])
+	if err != nil {
+		return nil, err
+	}
+	message, err := url.QueryUnescape(rec[3])
+	if err != nil {
+		return nil, err
+	}
+	createdAt, err := parseTime(rec[4])
+	if err != nil {
+		return nil, err
+	}
+
+	return &idempotencyEntry{
+		key:       key,
+		request:   request,
+		paymentID: paymentID,
+		err:       errorFromMessage(message),
+		createdAt: createdAt,
+	}, nil
+}
+
+func (s *Service) ExportIdempotencyKeys(dir string) error {
+	s.ready()
+	entries := s.idempotency.finished()
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return writeFileAtomicFunc(dir+"/idempotency.dump", func(w io.Writer) error {
+		return writeIdempotencyEntries(w, entries)
+	})
+}
+
+func (s *Service) exportIdempotencyKeysTo(w io.Writer) error {
+	return writeIdempotencyEntries(w, s.idempotency.finished())
+}
+
+func writeIdempotencyEntries(w io.Writer, entries []idempotencyEntry) error {
+	return writeDumpTo(w, len(entries), func(i int) string {
+		return formatIdempotencyEntry(entries[i])
+	})
+}
+
+// ImportIdempotencyKeys skips the keys that are already expired
+// and the ones the service already knows
+func (s *Service) ImportIdempotencyKeys(dir string) error {
+	s.ready()
+	return s.audited("ImportIdempotencyKeys", auditParams("dir", dir), func(s *Service) error {
+		lines, _, err := readDump(dir + "/idempotency.dump")
+		if err != nil {
+			return err
+		}
+
+		deadline := s.now().Add(-s.retention)
+		entries := []*idempotencyEntry{}
+		for _, v := range lines {
+			entry, err := parseIdempotencyEntry(v)
+			if err != nil {
+				return err
+			}
+			if entry.createdAt.Before(deadline) {
+				continue
+			}
+			entries = append(entries, entry)
+		}
+
+		return s.save(batch{keys: entries})
+	})
+}
@@ -0,0 +1,366 @@
+package wallet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func newIdempotencyTestService(clock *testClock) (*Service, *types.Account, error) {
+	s, err := NewService(NewMemoryStorage(), WithClock(clock.Now), WithIdempotencyRetention(time.Hour))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.Deposit(account.ID, 100)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, account, nil
+}
+
+func TestService_PayIdempotent_repeated(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := s.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	second, err := s.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if first.ID != second.ID {
+		t.Errorf("PayIdempotent(): new payment %v for a repeated key, original %v", second.ID, first.ID)
+	}
+
+	got, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 90 {
+		t.Errorf("PayIdempotent(): balance expected:%v, actual:%v", 90, got.Balance)
+	}
+}
+
+func TestService_PayIdempotent_originalError(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayIdempotent("key", account.ID, 1_000, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayIdempotent(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+
+	err = s.Deposit(account.ID, 1_000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayIdempotent("key", account.ID, 1_000, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayIdempotent(): must repeat ErrNotEnoughBalance, returned = %v", err)
+	}
+}
+
+func TestService_PayIdempotent_keyReused(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.PayIdempotent("key", account.ID, 20, "auto")
+	if err != ErrIdempotencyKeyReused {
+		t.Errorf("PayIdempotent(): must return ErrIdempotencyKeyReused, returned = %v", err)
+	}
+
+	err = s.DepositIdempotent("key", account.ID, 10)
+	if err != ErrIdempotencyKeyReused {
+		t.Errorf("DepositIdempotent(): must return ErrIdempotencyKeyReused, returned = %v", err)
+	}
+}
+
+func TestService_PayIdempotent_retention(t *testing.T) {
+	clock := newTestClock()
+	s, account, err := newIdempotencyTestService(clock)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := s.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.Advance(2 * time.Hour)
+
+	second, err := s.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first.ID == second.ID {
+		t.Errorf("PayIdempotent(): expired key must make a new payment")
+	}
+}
+
+func TestService_DepositIdempotent(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		err = s.DepositIdempotent("key", account.ID, 50)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	got, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 150 {
+		t.Errorf("DepositIdempotent(): balance expected:%v, actual:%v", 150, got.Balance)
+	}
+}
+
+func TestService_PayFromFavoriteIdempotent(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	favorite, err := s.FavoritePayment(payment.ID, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := s.PayFromFavoriteIdempotent("key", favorite.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := s.PayFromFavoriteIdempotent("key", favorite.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first.ID != second.ID {
+		t.Errorf("PayFromFavoriteIdempotent(): new payment %v for a repeated key, original %v", second.ID, first.ID)
+	}
+}
+
+func TestService_PayIdempotent_concurrent(t *testing.T) {
+	s, account, err := newIdempotencyTestService(newTestClock())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	ids := make([]string, 50)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			payment, err := s.PayIdempotent("key", account.ID, 1, "auto")
+			if err != nil {
+				t.Errorf("PayIdempotent(): error = %v", err)
+				return
+			}
+			ids[i] = payment.ID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("PayIdempotent(): concurrent calls made different payments %v and %v", ids[0], id)
+			return
+		}
+	}
+
+	history, err := s.ExportAccountHistory(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(history) != 1 {
+		t.Errorf("PayIdempotent(): payments expected:%v, actual:%v", 1, len(history))
+	}
+}
+
+func TestService_IdempotencyKeys_exportImport(t *testing.T) {
+	clock := newTestClock()
+	s1, account, err := newIdempotencyTestService(clock)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s1.PayIdempotent("key;with separators\n", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.PayIdempotent("failed", account.ID, 1_000, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayIdempotent(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithClock(clock.Now), WithIdempotencyRetention(time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s2.PayIdempotent("key;with separators\n", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.ID != payment.ID {
+		t.Errorf("PayIdempotent(): imported key made a new payment %v, original %v", got.ID, payment.ID)
+	}
+
+	_, err = s2.PayIdempotent("failed", account.ID, 1_000, "auto")
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayIdempotent(): must repeat ErrNotEnoughBalance after import, returned = %v", err)
+	}
+
+	// expired keys are not imported
+	clock.Advance(2 * time.Hour)
+	s3, err := NewService(NewMemoryStorage(), WithClock(clock.Now), WithIdempotencyRetention(time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s3.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(s3.idempotency.finished()) != 0 {
+		t.Errorf("ImportIdempotencyKeys(): expired keys were imported")
+	}
+}
+
+func TestService_FileStorage_idempotencyKeys(t *testing.T) {
+	dir := t.TempDir()
+	clock := newTestClock()
+	open := func() (*Service, error) {
+		storage, err := NewFileStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return NewService(storage, WithClock(clock.Now), WithIdempotencyRetention(time.Hour))
+	}
+
+	s1, err := open()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s1.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s1.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s1.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the retry after a restart gets the first payment and is not charged again
+	s2, err := open()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := s2.PayIdempotent("key", account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.ID != payment.ID {
+		t.Errorf("PayIdempotent(): new payment %v after a restart, original %v", got.ID, payment.ID)
+	}
+	balance, err := s2.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if balance.Balance != 90 {
+		t.Errorf("PayIdempotent(): balance expected:%v, actual:%v", 90, balance.Balance)
+	}
+
+	// expired keys are not loaded
+	clock.Advance(2 * time.Hour)
+	s3, err := open()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(s3.idempotency.finished()) != 0 {
+		t.Errorf("NewService(): expired keys were loaded")
+	}
+}
@@ -0,0 +1,344 @@
+package wallet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// jsonDocument is the file written by ExportToJSON
+type jsonDocument struct {
+	Accounts  []types.Account  `json:"accounts"`
+	Payments  []types.Payment  `json:"payments"`
+	Favorites []types.Favorite `json:"favorites"`
+}
+
+// jsonRecord is one line of the file written by ExportToJSONLines,
+// exactly one of the fields is set
+//
+//	{"account":{"id":1,...}}
+//	{"payment":{"id":"...",...}}
+//	{"favorite":{"id":"...",...}}
+type jsonRecord struct {
+	Account  *types.Account  `json:"account,omitempty"`
+	Payment  *types.Payment  `json:"payment,omitempty"`
+	Favorite *types.Favorite `json:"favorite,omitempty"`
+}
+
+// jsonImport collects the records of a JSON file, numbers are their
+// positions in the file and stand for the lines in the problems
+type jsonImport struct {
+	path            string
+	accounts        []types.Account
+	accountNumbers  []int
+	payments        []types.Payment
+	paymentNumbers  []int
+	favorites       []types.Favorite
+	favoriteNumbers []int
+}
+
+// files written before currencies have none
+func (im *jsonImport) account(number int, account types.Account) {
+	account.Currency = currencyOrDefault(account.Currency)
+	im.accounts = append(im.accounts, account)
+	im.accountNumbers = append(im.accountNumbers, number)
+}
+
+func (im *jsonImport) payment(number int, payment types.Payment) {
+	payment.Currency = currencyOrDefault(payment.Currency)
+	im.payments = append(im.payments, payment)
+	im.paymentNumbers = append(im.paymentNumbers, number)
+}
+
+func (im *jsonImport) favorite(number int, favorite types.Favorite) {
+	favorite.Currency = currencyOrDefault(favorite.Currency)
+	im.favorites = append(im.favorites, favorite)
+	im.favoriteNumbers = append(im.favoriteNumbers, number)
+}
+
+// save checks the records like the lines of the dumps and saves all of them
+// as one batch under the locks of their accounts, so a bad record or a
+// failed save imports nothing. Imported balances get opening entries like
+// with Import.
+func (im *jsonImport) save(s *Service) error {
+	v := s.newImportValidator(ConflictOverwrite)
+	for i, account := range im.accounts {
+		v.checkAccountRecord(im.path, im.accountNumbers[i], account)
+	}
+	v.checkPhonesOfService(im.path)
+	for i, payment := range im.payments {
+		v.checkPaymentRecord(im.path, im.paymentNumbers[i], payment)
+	}
+	for i, favorite := range im.favorites {
+		v.checkFavoriteRecord(im.path, im.favoriteNumbers[i], favorite)
+	}
+	err := v.report.Err()
+	if err != nil {
+		return err
+	}
+	if len(im.accounts)+len(im.payments)+len(im.favorites) == 0 {
+		return nil
+	}
+
+	ids := []int64{}
+	for _, account := range im.accounts {
+		ids = append(ids, account.ID)
+	}
+	for _, payment := range im.payments {
+		ids = append(ids, payment.AccountID)
+		if payment.ToAccountID != 0 {
+			ids = append(ids, payment.ToAccountID)
+		}
+	}
+	for _, favorite := range im.favorites {
+		ids = append(ids, favorite.AccountID)
+	}
+	unlock := s.lockAll(ids)
+	defer unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := batch{}
+	nextAccountID := s.nextAccountID
+	for i := range im.accounts {
+		account := &im.accounts[i]
+		opening, err := s.opening(account)
+		if err != nil {
+			return fmt.Errorf("account %v: %w", account.ID, err)
+		}
+		b.accounts = append(b.accounts, account)
+		b.postings = append(b.postings, opening...)
+		// RegisterAccount goes on after the largest ID
+		if account.ID > nextAccountID {
+			nextAccountID = account.ID
+		}
+	}
+	for i := range im.payments {
+		b.payments = append(b.payments, &im.payments[i])
+	}
+	for i := range im.favorites {
+		b.favorites = append(b.favorites, &im.favorites[i])
+	}
+
+	err = s.save(b)
+	if err != nil {
+		return err
+	}
+	s.nextAccountID = nextAccountID
+	return nil
+}
+
+// ExportToJSON writes accounts, payments and favorites to one JSON document
+func (s *Service) ExportToJSON(path string) error {
+	s.ready()
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return err
+	}
+	payments, err := s.payments.All()
+	if err != nil {
+		return err
+	}
+	favorites, err := s.favorites.All()
+	if err != nil {
+		return err
+	}
+
+	document := jsonDocument{
+		Accounts:  accounts,
+		Payments:  payments,
+		Favorites: favorites,
+	}
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(document)
+	})
+}
+
+// ImportFromJSON reads a document written by ExportToJSON. Like Import,
+// records with a known ID replace the existing ones. The whole document is
+// decoded and checked before anything is imported, so a malformed or
+// invalid file changes nothing. The problems name the records by their
+// positions in the document, the accounts first.
+func (s *Service) ImportFromJSON(path string) error {
+	s.ready()
+	return s.audited("ImportFromJSON", auditParams("path", path), func(s *Service) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer closeFile(file)
+
+		document := jsonDocument{}
+		err = json.NewDecoder(file).Decode(&document)
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+
+		im := &jsonImport{path: path}
+		number := 0
+		for _, account := range document.Accounts {
+			number++
+			im.account(number, account)
+		}
+		for _, payment := range document.Payments {
+			number++
+			im.payment(number, payment)
+		}
+		for _, favorite := range document.Favorites {
+			number++
+			im.favorite(number, favorite)
+		}
+		return im.save(s)
+	})
+}
+
+// ExportToJSONLines writes one JSON record per line: the accounts first,
+// then the payments and the favorites
+func (s *Service) ExportToJSONLines(path string) error {
+	s.ready()
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return err
+	}
+	payments, err := s.payments.All()
+	if err != nil {
+		return err
+	}
+	favorites, err := s.favorites.All()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomicFunc(path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i := range accounts {
+			err := encoder.Encode(jsonRecord{Account: &accounts[i]})
+			if err != nil {
+				return err
+			}
+		}
+		for i := range payments {
+			err := encoder.Encode(jsonRecord{Payment: &payments[i]})
+			if err != nil {
+				return err
+			}
+		}
+		for i := range favorites {
+			err := encoder.Encode(jsonRecord{Favorite: &favorites[i]})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportFromJSONLines reads a file written by ExportToJSONLines. Records
+// with a known ID replace the existing ones. The file is read record by
+// record in passes, so it never has to fit in memory: the first ones check
+// all the records like ImportFromJSON does, a malformed or invalid record
+// imports nothing and the problems name the records by their lines; the
+// last ones import the records one at a time like ImportPaymentsFrom.
+// The accounts go first wherever they are in the file, the other records
+// refer to them.
+func (s *Service) ImportFromJSONLines(path string) error {
+	s.ready()
+	return s.audited("ImportFromJSONLines", auditParams("path", path), func(s *Service) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer closeFile(file)
+
+		pass := func(accounts bool, fn func(n int, record jsonRecord) error) error {
+			_, err := file.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			return readJSONLines(path, file, func(n int, record jsonRecord) error {
+				if (record.Account != nil) != accounts {
+					return nil
+				}
+				return fn(n, record)
+			})
+		}
+
+		v := s.newImportValidator(ConflictOverwrite)
+		err = pass(true, func(n int, record jsonRecord) error {
+			v.checkAccountRecord(path, n, *record.Account)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.checkPhonesOfService(path)
+		err = pass(false, func(n int, record jsonRecord) error {
+			if record.Payment != nil {
+				v.checkPaymentRecord(path, n, *record.Payment)
+			} else {
+				v.checkFavoriteRecord(path, n, *record.Favorite)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = v.report.Err()
+		if err != nil {
+			return err
+		}
+
+		im := s.newImporter(ConflictOverwrite)
+		err = pass(true, func(n int, record jsonRecord) error {
+			return im.account(*record.Account)
+		})
+		if err != nil {
+			return err
+		}
+		return pass(false, func(n int, record jsonRecord) error {
+			if record.Payment != nil {
+				return im.payment(*record.Payment)
+			}
+			return im.favorite(*record.Favorite)
+		})
+	})
+}
+
+// readJSONLines decodes the records one by one and gives them to fn with
+// their line numbers, the records of files written before currencies get
+// the default one
+func readJSONLines(path string, r io.Reader, fn func(n int, record jsonRecord) error) error {
+	decoder := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		record := jsonRecord{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%v: record %v: %w", path, n, err)
+		}
+
+		switch {
+		case record.Account != nil && record.Payment == nil && record.Favorite == nil:
+			record.Account.Currency = currencyOrDefault(record.Account.Currency)
+		case record.Payment != nil && record.Account == nil && record.Favorite == nil:
+			record.Payment.Currency = currencyOrDefault(record.Payment.Currency)
+		case record.Favorite != nil && record.Account == nil && record.Payment == nil:
+			record.Favorite.Currency = currencyOrDefault(record.Favorite.Currency)
+		default:
+			return fmt.Errorf("%v: record %v: must hold exactly one account, payment or favorite", path, n)
+		}
+
+		err = fn(n, record)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newSeparatorsTestService has a favorite and a payment whose text fields
+// break the .dump and ExportToFile formats
+func newSeparatorsTestService() (*Service, error) {
+	s, err := NewService(NewMemoryStorage())
+	if err != nil {
+		return nil, err
+	}
+
+	err = fillLoggedService(s)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		return nil, err
+	}
+	payment, err := s.Pay(account.ID, 1, "food;\"drinks\"|misc")
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.FavoritePayment(payment.ID, "lunch;\nwith \"friends\"")
+	return s, err
+}
+
+func TestService_ExportToJSON_ImportFromJSON(t *testing.T) {
+	s1, err := newSeparatorsTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/wallet.json"
+	err = s1.ExportToJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	err = s2.ImportFromJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2.Service)
+}
+
+func TestService_ExportToJSON_Export(t *testing.T) {
+	s1, err := NewService(NewMemoryStorage())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	path := dir + "/wallet.json"
+	err = s1.ExportToJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// JSON -> Export -> Import -> JSON gives the same document
+	s2 := newTestService()
+	err = s2.ImportFromJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s3 := newTestService()
+	err = s3.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s3.ExportToJSON(dir + "/wallet2.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content1, _ := os.ReadFile(path)
+	content3, _ := os.ReadFile(dir + "/wallet2.json")
+	if string(content1) != string(content3) {
+		t.Errorf("ExportToJSON(): documents differ after Export and Import:\n%s\n%s", content1, content3)
+	}
+}
+
+func TestService_ExportToJSONLines_ImportFromJSONLines(t *testing.T) {
+	s1, err := newSeparatorsTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/wallet.jsonl"
+	err = s1.ExportToJSONLines(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	accounts, _ := s1.accounts.All()
+	payments, _ := s1.payments.All()
+	favorites, _ := s1.favorites.All()
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != len(accounts)+len(payments)+len(favorites) {
+		t.Errorf("ExportToJSONLines(): must write one line per record, got %v lines", len(lines))
+	}
+
+	s2 := newTestService()
+	err = s2.ImportFromJSONLines(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2.Service)
+}
+
+func TestService_ImportFromJSON_merge(t *testing.T) {
+	s1, err := newSeparatorsTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/wallet.json"
+	err = s1.ExportToJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// s2 has the same records, but one of them was changed since the export
+	s2 := newTestService()
+	err = s2.ImportFromJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.Deposit(1, 1_000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s2.ImportFromJSON(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2.Service)
+}
+
+func TestService_ImportFromJSONLines_malformed(t *testing.T) {
+	path := t.TempDir() + "/wallet.jsonl"
+	content := `{"account":{"id":1,"phone":"+992000000001","balance":10}}
+{"account":{"id":2,"phone":"+992000000002","balance":10},"payment":{"id":"x"}}
+`
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.ImportFromJSONLines(path)
+	if err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("ImportFromJSONLines(): must report the bad record, error = %v", err)
+	}
+
+	_, err = s.FindAccountByID(1)
+	if err != ErrAccountNotFound {
+		t.Errorf("ImportFromJSONLines(): the records before the bad one must not be imported, error = %v", err)
+	}
+}
+
+func TestService_ImportFromJSON_invalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		err     error
+		message string
+	}{
+		{"unknown account", `{"accounts":[{"id":1,"phone":"+992000000001","balance":10}],` +
+			`"payments":[{"id":"x","account_id":2,"amount":5,"status":"OK"}]}`, ErrAccountNotFound, ":2: unknown account 2"},
+		{"duplicate", `{"accounts":[{"id":1,"phone":"+992000000001","balance":10}],` +
+			`"payments":[{"id":"x","account_id":1,"amount":5,"status":"OK"},{"id":"x","account_id":1,"amount":5,"status":"OK"}]}`,
+			ErrInvalidImport, ":3: duplicate payment ID x, first on line 2"},
+		{"not positive", `{"accounts":[{"id":1,"phone":"+992000000001","balance":10}],` +
+			`"favorites":[{"id":"f","account_id":1,"amount":-5}]}`, ErrAmountMustBePositive, ":2: amount -5 must be positive"},
+		{"unknown status", `{"accounts":[{"id":1,"phone":"+992000000001","balance":10}],` +
+			`"payments":[{"id":"x","account_id":1,"amount":5,"status":"PAID"}]}`, ErrInvalidImport, `:2: unknown status "PAID"`},
+	}
+	for _, tt := range tests {
+		path := dir + "/wallet.json"
+		err := os.WriteFile(path, []byte(tt.content), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		s := newTestService()
+		err = s.ImportFromJSON(path)
+		if !errors.Is(err, tt.err) || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("ImportFromJSON(): %v: error = %v", tt.name, err)
+		}
+		_, err = s.FindAccountByID(1)
+		if err != ErrAccountNotFound {
+			t.Errorf("ImportFromJSON(): %v: invalid document must not be imported, error = %v", tt.name, err)
+		}
+	}
+}
+
+func TestService_ImportFromJSONLines_invalid(t *testing.T) {
+	path := t.TempDir() + "/wallet.jsonl"
+	content := `{"account":{"id":1,"phone":"+992000000001","balance":10}}
+{"payment":{"id":"x","account_id":1,"amount":5,"status":"OK"}}
+{"favorite":{"id":"f","account_id":2,"amount":5}}
+`
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the bad last record is found before the first one is imported
+	s := newTestService()
+	err = s.ImportFromJSONLines(path)
+	if !errors.Is(err, ErrAccountNotFound) || !strings.Contains(err.Error(), "wallet.jsonl:3: unknown account 2") {
+		t.Errorf("ImportFromJSONLines(): must report the bad record, error = %v", err)
+	}
+	_, err = s.FindAccountByID(1)
+	if err != ErrAccountNotFound {
+		t.Errorf("ImportFromJSONLines(): invalid file must not be imported, error = %v", err)
+	}
+}
+
+func TestService_ImportFromJSONLines_ledger(t *testing.T) {
+	path := t.TempDir() + "/wallet.jsonl"
+	content := `{"payment":{"id":"x","account_id":1,"amount":5,"status":"OK"}}
+{"account":{"id":1,"phone":"+992000000001","balance":10}}
+`
+	err := os.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the accounts are checked first wherever they are in the file
+	s := newTestService()
+	err = s.ImportFromJSONLines(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	report := checkLedger(t, s.Service)
+	if report != nil && report.Entries != 1 {
+		t.Errorf("CheckLedger(): entries %v, the balance must be opened", report.Entries)
+	}
+	account, err := s.RegisterAccount("+992000000002")
+	if err != nil || account.ID != 2 {
+		t.Errorf("RegisterAccount(): account %v, error %v", account, err)
+	}
+}
+
+func TestService_ImportFromJSON_malformed(t *testing.T) {
+	path := t.TempDir() + "/wallet.json"
+	err := os.WriteFile(path, []byte(`{"accounts":[{"id":1,"phone":"+992000000001"}],"payments":[{"id":`), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.ImportFromJSON(path)
+	if err == nil {
+		t.Errorf("ImportFromJSON(): must fail on a malformed document")
+	}
+
+	_, err = s.FindAccountByID(1)
+	if err != ErrAccountNotFound {
+		t.Errorf("ImportFromJSON(): malformed document must not be imported, error = %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/google/uuid"
+)
+
+var ErrLedgerUnbalanced = errors.New("ledger out of balance")
+
+// Every money movement is also written to the ledger as an entry of postings
+// that sum to zero in every currency, the double entry. A posting credits a
+// ledger account with a positive amount and debits it with a negative one:
+//
+//	user:<id>            the wallet account with the ID
+//	funding              where the deposits come from
+//	merchant:<category>  where the payments of the category go
+//	opening              balances imported without their postings
+//
+// The accounts keep their balances, CheckLedger reconciles them with their
+// ledger accounts and checks that the books sum to zero.
+
+const (
+	FundingLedgerAccount types.LedgerAccount = "funding"
+	OpeningLedgerAccount types.LedgerAccount = "opening"
+)
+
+// UserLedgerAccount is the ledger account of the wallet account
+func UserLedgerAccount(accountID int64) types.LedgerAccount {
+	return types.LedgerAccount("user:" + strconv.FormatInt(accountID, 10))
+}
+
+// MerchantLedgerAccount is where the payments of the category go
+func MerchantLedgerAccount(category types.PaymentCategory) types.LedgerAccount {
+	return types.LedgerAccount("merchant:" + string(category))
+}
+
+// The operations of the ledger entries
+const (
+	LedgerDeposit  = "deposit"
+	LedgerPayment  = "payment"
+	LedgerTransfer = "transfer"
+	LedgerReject   = "reject"
+	LedgerOpening  = "opening"
+)
+
+// ledger keeps the postings in the order they were made
+type ledger struct {
+	mu        sync.RWMutex
+	postings  []types.Posting
+	entries   map[string]bool
+	byAccount map[types.LedgerAccount][]int // indexes in postings
+}
+
+// add appends the postings of the entries it doesn't know yet and returns
+// how many it appended, so a log replayed over a newer snapshot or a dump
+// imported twice doesn't count an entry twice
+func (l *ledger) add(postings []types.Posting) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.entries == nil {
+		l.entries = make(map[string]bool)
+		l.byAccount = make(map[types.LedgerAccount][]int)
+	}
+
+	known := map[string]bool{}
+	for _, posting := range postings {
+		if l.entries[posting.EntryID] {
+			known[posting.EntryID] = true
+		}
+	}
+
+	added := 0
+	for _, posting := range postings {
+		if known[posting.EntryID] {
+			continue
+		}
+		l.entries[posting.EntryID] = true
+		l.byAccount[posting.Account] = append(l.byAccount[posting.Account], len(l.postings))
+		l.postings = append(l.postings, posting)
+		added++
+	}
+	return added
+}
+
+func (l *ledger) has(entryID string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.entries[entryID]
+}
+
+func (l *ledger) all() []types.Posting {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := make([]types.Posting, len(l.postings))
+	copy(postings, l.postings)
+	return postings
+}
+
+func (l *ledger) find(account types.LedgerAccount) []types.Posting {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	postings := make([]types.Posting, len(l.byAccount[account]))
+	for i, index := range l.byAccount[account] {
+		postings[i] = l.postings[index]
+	}
+	return postings
+}
+
+// balance sums the postings of the account by currency
+func (l *ledger) balance(account types.LedgerAccount) (Totals, error) {
+	balance := Totals{}
+	for _, posting := range l.find(account) {
+		err := balance.add(posting.Currency, posting.Amount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return balance, nil
+}
+
+// entry moves the amount from one ledger account to another
+func (s *Service) entry(operation string, paymentID string, from types.LedgerAccount, to types.LedgerAccount,
+	amount types.Money, currency types.Currency, at time.Time) []types.Posting {
+	id := uuid.New().String()
+	currency = currencyOrDefault(currency)
+	return []types.Posting{
+		{EntryID: id, Operation: operation, Account: from, Amount: -amount, Currency: currency, PaymentID: paymentID, CreatedAt: at},
+		{EntryID: id, Operation: operation, Account: to, Amount: amount, Currency: currency, PaymentID: paymentID, CreatedAt: at},
+	}
+}
+
+// opening is the entry that makes the ledger account of an imported account
+// match its balance, nil if it already does; it must be called with the
+// account locked
+func (s *Service) opening(account *types.Account) ([]types.Posting, error) {
+	balance, err := s.ledger.balance(UserLedgerAccount(account.ID))
+	if err != nil {
+		return nil, err
+	}
+	difference, err := account.Balance.Sub(balance[currencyOrDefault(account.Currency)])
+	if err != nil {
+		return nil, err
+	}
+	if difference == 0 {
+		return nil, nil
+	}
+	return s.entry(LedgerOpening, "", OpeningLedgerAccount, UserLedgerAccount(account.ID), difference, account.Currency, s.now()), nil
+}
+
+// LedgerPostings returns the postings of the ledger account, oldest first
+func (s *Service) LedgerPostings(account types.LedgerAccount) []types.Posting {
+	s.ready()
+	return s.ledger.find(account)
+}
+
+// LedgerBalance sums the postings of the ledger account by currency
+func (s *Service) LedgerBalance(account types.LedgerAccount) (Totals, error) {
+	s.ready()
+	return s.ledger.balance(account)
+}
+
+// LedgerReport is the result of CheckLedger
+type LedgerReport struct {
+	Entries  int
+	Postings int
+	Problems []string
+}
+
+// Err returns nil if the books are right and an error that wraps
+// ErrLedgerUnbalanced and lists the problems otherwise
+func (r *LedgerReport) Err() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrLedgerUnbalanced, strings.Join(r.Problems, "; "))
+}
+
+// CheckLedger checks that every entry and the whole ledger sum to zero in
+// every currency and that the balance of every account matches its ledger
+// account. The accounts are checked one by one under their locks, so the
+// check can run next to other operations. The error is only for failures to
+// read the accounts.
+func (s *Service) CheckLedger() (*LedgerReport, error) {
+	s.ready()
+	report := &LedgerReport{}
+	postings := s.ledger.all()
+	report.Postings = len(postings)
+
+	entries := map[string]Totals{}
+	order := []string{}
+	books := Totals{}
+	for _, posting := range postings {
+		sum, ok := entries[posting.EntryID]
+		if !ok {
+			sum = Totals{}
+			entries[posting.EntryID] = sum
+			order = append(order, posting.EntryID)
+		}
+		err := sum.add(posting.Currency, posting.Amount)
+		if err == nil {
+			err = books.add(posting.Currency, posting.Amount)
+		}
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("entry %v: %v", posting.EntryID, err))
+		}
+	}
+	report.Entries = len(entries)
+	for _, id := range order {
+		for _, currency := range entries[id].currencies() {
+			if amount := entries[id][currency]; amount != 0 {
+				report.Problems = append(report.Problems, fmt.Sprintf("entry %v is off by %v", id, amount.Format(currency)))
+			}
+		}
+	}
+	for _, currency := range books.currencies() {
+		if amount := books[currency]; amount != 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("books are off by %v", amount.Format(currency)))
+		}
+	}
+
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range accounts {
+		problems, err := s.checkAccountLedger(v.ID)
+		if err != nil {
+			return nil, err
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+	return report, nil
+}
+
+// checkAccountLedger compares the balance of the account with its ledger account
+func (s *Service) checkAccountLedger(accountID int64) ([]string, error) {
+	unlock := s.lockAccount(accountID)
+	defer unlock()
+
+	account, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	currency := currencyOrDefault(account.Currency)
+	balance, err := s.ledger.balance(UserLedgerAccount(accountID))
+	if err != nil {
+		return []string{fmt.Sprintf("account %v: %v", accountID, err)}, nil
+	}
+
+	problems := []string{}
+	if balance[currency] != account.Balance {
+		problems = append(problems, fmt.Sprintf("account %v has %v, its ledger account %v",
+			accountID, account.Balance.Format(currency), balance[currency].Format(currency)))
+	}
+	for _, other := range balance.currencies() {
+		if other != currency && balance[other] != 0 {
+			problems = append(problems, fmt.Sprintf("account %v in %v has %v in the ledger", accountID, currency, balance[other].Format(other)))
+		}
+	}
+	return problems, nil
+}
+
+// currencies returns the currencies of the totals in order
+func (t Totals) currencies() []types.Currency {
+	currencies := make([]types.Currency, 0, len(t))
+	for currency := range t {
+		currencies = append(currencies, currency)
+	}
+	sort.Slice(currencies, func(i, j int) bool {
+		return currencies[i] < currencies[j]
+	})
+	return currencies
+}
+
+// ledger.dump keeps one posting per line:
+// entryID;operation;account;amount;currency;paymentID;createdAt
+
+func formatPosting(v types.Posting) string {
+	return fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v", escapeField(v.EntryID), escapeField(v.Operation), escapeField(v.Account),
+		v.Amount, escapeField(v.Currency), escapeField(v.PaymentID), formatTime(v.CreatedAt))
+}
+
+func parsePosting(line string, schema int) (types.Posting, error) {
+	rec, err := splitRecord(line, schema)
+	if err != nil {
+		return types.Posting{}, err
+	}
+	if len(rec) != 7 {
+		return types.Posting{}, fmt.Errorf("posting: expected 7 fields, got %v", len(rec))
+	}
+	amount, err := strconv.ParseInt(rec[3], 10, 64)
+	if err != nil {
+		return types.Posting{}, err
+	}
+	created, err := parseTime(rec[6])
+	if err != nil {
+		return types.Posting{}, err
+	}
+	return types.Posting{
+		EntryID:   rec[0],
+		Operation: rec[1],
+		Account:   types.LedgerAccount(rec[2]),
+		Amount:    types.Money(amount),
+		Currency:  types.Currency(rec[4]),
+		PaymentID: rec[5],
+		CreatedAt: created,
+	}, nil
+}
+
+func (s *Service) ExportLedger(dir string) error {
+	s.ready()
+	postings := s.ledger.all()
+	if len(postings) == 0 {
+		return nil
+	}
+
+	return writeFileAtomicFunc(dir+"/ledger.dump", func(w io.Writer) error {
+		return writePostings(w, postings)
+	})
+}
+
+// ExportLedgerTo writes the postings in the ledger.dump format
+func (s *Service) ExportLedgerTo(w io.Writer) error {
+	s.ready()
+	return writePostings(w, s.ledger.all())
+}
+
+func writePostings(w io.Writer, postings []types.Posting) error {
+	return writeDumpTo(w, len(postings), func(i int) string {
+		return formatPosting(postings[i])
+	})
+}
@@ -0,0 +1,293 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// compareLedgers reports the difference between the postings of two services
+func compareLedgers(t *testing.T, s1 *Service, s2 *Service) {
+	postings1 := s1.ledger.all()
+	postings2 := s2.ledger.all()
+	if !reflect.DeepEqual(postings1, postings2) {
+		t.Errorf("ledgers differ: %v and %v", postings1, postings2)
+	}
+}
+
+func checkLedger(t *testing.T, s *Service) *LedgerReport {
+	report, err := s.CheckLedger()
+	if err != nil {
+		t.Errorf("CheckLedger(): error = %v", err)
+		return nil
+	}
+	if report.Err() != nil {
+		t.Errorf("CheckLedger(): %v", report.Err())
+	}
+	return report
+}
+
+func TestService_ledger_postings(t *testing.T) {
+	s := newTestService()
+	err := fillLoggedService(s.Service)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// deposit, payment, transfer, reject and one more payment
+	report := checkLedger(t, s.Service)
+	if report == nil {
+		return
+	}
+	if report.Entries != 5 || report.Postings != 10 {
+		t.Errorf("CheckLedger(): entries %v, postings %v", report.Entries, report.Postings)
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	balances := []struct {
+		account  types.LedgerAccount
+		expected types.Money
+	}{
+		{UserLedgerAccount(1), account.Balance},
+		{UserLedgerAccount(2), 100},
+		{FundingLedgerAccount, -10_000_00},
+		{MerchantLedgerAccount("auto"), 10},
+	}
+	for _, tt := range balances {
+		balance, err := s.LedgerBalance(tt.account)
+		if err != nil || balance[types.DefaultCurrency] != tt.expected {
+			t.Errorf("LedgerBalance(%v): expected %v, actual %v, error %v", tt.account, tt.expected, balance, err)
+		}
+	}
+
+	postings := s.LedgerPostings(UserLedgerAccount(2))
+	if len(postings) != 1 || postings[0].Operation != LedgerTransfer || postings[0].PaymentID == "" {
+		t.Errorf("LedgerPostings(): wrong postings %v", postings)
+	}
+}
+
+func TestService_CheckLedger_drift(t *testing.T) {
+	s := newTestService()
+	_, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a balance changed without a ledger entry
+	account.Balance += 1_00
+	err = s.accounts.Save(account)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report, err := s.CheckLedger()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !errors.Is(report.Err(), ErrLedgerUnbalanced) {
+		t.Errorf("CheckLedger(): must return ErrLedgerUnbalanced, returned = %v", report.Err())
+	}
+	expected := []string{"account 1 has 9001.00 TJS, its ledger account 9000.00 TJS"}
+	if !reflect.DeepEqual(report.Problems, expected) {
+		t.Errorf("CheckLedger(): problems %v, expected %v", report.Problems, expected)
+	}
+}
+
+func TestService_ledger_exportImport(t *testing.T) {
+	s1 := newTestService()
+	err := fillLoggedService(s1.Service)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	summary, err := s2.ImportWithPolicy(dir, ConflictOverwrite)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Postings.Inserted != 10 {
+		t.Errorf("ImportWithPolicy(): postings inserted %v", summary.Postings.Inserted)
+	}
+	compareLedgers(t, s1.Service, s2.Service)
+	checkLedger(t, s2.Service)
+
+	// the entries are known, the ledger doesn't change
+	summary, err = s2.ImportWithPolicy(dir, ConflictOverwrite)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Postings.Inserted != 0 || summary.Postings.Skipped != 10 {
+		t.Errorf("ImportWithPolicy(): postings %+v", summary.Postings)
+	}
+	compareLedgers(t, s1.Service, s2.Service)
+}
+
+func TestService_Import_legacyLedger(t *testing.T) {
+	s1 := newTestService()
+	err := fillLoggedService(s1.Service)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err == nil {
+		err = os.Remove(dir + "/ledger.dump")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	checkLedger(t, s2.Service)
+
+	account, err := s2.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	postings := s2.LedgerPostings(UserLedgerAccount(1))
+	if len(postings) != 1 || postings[0].Operation != LedgerOpening || postings[0].Amount != account.Balance {
+		t.Errorf("Import(): opening expected for %v, postings %v", account.Balance, postings)
+	}
+}
+
+func TestService_WithLog_ledger(t *testing.T) {
+	for _, snapshotEvery := range []int{0, 3} {
+		dir := t.TempDir()
+
+		s1, err := NewService(NewMemoryStorage(), WithLog(dir, snapshotEvery))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = fillLoggedService(s1)
+		if err == nil {
+			err = s1.Close()
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		s2, err := NewService(NewMemoryStorage(), WithLog(dir, snapshotEvery))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		compareLedgers(t, s1, s2)
+		checkLedger(t, s2)
+		s2.Close()
+	}
+}
+
+func TestService_FileStorage_ledger(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s1, err := NewService(storage)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	storage, err = NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2, err := NewService(storage)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareLedgers(t, s1, s2)
+	report := checkLedger(t, s2)
+	if report != nil && (report.Entries != 5 || report.Postings != 10) {
+		t.Errorf("CheckLedger(): entries %v, postings %v", report.Entries, report.Postings)
+	}
+}
+
+func TestService_ValidateImport_ledger(t *testing.T) {
+	dir := t.TempDir()
+	lines := []string{
+		"e1;deposit;funding;-100;TJS;;2024-01-01T00:00:00Z",
+		"e1;deposit;user:1;100;TJS;;2024-01-01T00:00:00Z",
+		"e2;payment;user:1;-50;TJS;p1;2024-01-01T00:00:00Z",
+		"e2;payment;merchant:auto;40;TJS;p1;2024-01-01T00:00:00Z",
+		"e3;payment;user:1;-50;XYZ;p2;2024-01-01T00:00:00Z",
+		"e4;deposit;user:1",
+	}
+	err := os.WriteFile(dir+"/ledger.dump", []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	report, err := s.ValidateImport(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got := []string{}
+	for _, problem := range report.Problems {
+		got = append(got, strings.TrimPrefix(problem.String(), dir+"/"))
+	}
+	expected := []string{
+		`ledger.dump:5: unknown currency "XYZ"`,
+		"ledger.dump:6: posting: expected 7 fields, got 3",
+		"ledger.dump:3: entry e2 is off by -0.10 TJS",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ValidateImport(): problems\n%v\nexpected\n%v", got, expected)
+	}
+	if report.Postings != 6 {
+		t.Errorf("ValidateImport(): postings %v", report.Postings)
+	}
+	if !errors.Is(report.Err(), ErrLedgerUnbalanced) || !errors.Is(report.Err(), ErrUnknownCurrency) {
+		t.Errorf("ValidateImport(): wrong causes %v", report.Err())
+	}
+}
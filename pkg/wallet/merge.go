@@ -0,0 +1,383 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrImportConflict = errors.New("imported record conflicts with an existing one")
+
+// ConflictPolicy decides what happens when an imported record has the ID of
+// an existing one that differs from it. Identical records are always skipped.
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing record
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictKeep keeps the existing record
+	ConflictKeep
+	// ConflictFail imports nothing if there is any conflict
+	ConflictFail
+	// ConflictNewest keeps the record updated last, the existing one on a tie
+	ConflictNewest
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictOverwrite:
+		return "overwrite"
+	case ConflictKeep:
+		return "keep"
+	case ConflictFail:
+		return "fail"
+	case ConflictNewest:
+		return "newest"
+	}
+	return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+}
+
+// ImportCounts says what happened to the imported records of one kind
+type ImportCounts struct {
+	Inserted int
+	Updated  int
+	Skipped  int
+}
+
+// ImportSummary says what happened to the imported records
+type ImportSummary struct {
+	Accounts  ImportCounts
+	Payments  ImportCounts
+	Favorites ImportCounts
+	Postings  ImportCounts
+	Holds     ImportCounts
+}
+
+type importAction int
+
+const (
+	importInsert importAction = iota
+	importUpdate
+	importSkip
+)
+
+func (c *ImportCounts) add(action importAction) {
+	switch action {
+	case importInsert:
+		c.Inserted++
+	case importUpdate:
+		c.Updated++
+	case importSkip:
+		c.Skipped++
+	}
+}
+
+// decide what to do with an imported record, existing and imported are the
+// records in the dump format, existing is empty if there is no such record
+func (p ConflictPolicy) decide(existing string, imported string, existingUpdated time.Time, importedUpdated time.Time) (importAction, error) {
+	switch {
+	case existing == "":
+		return importInsert, nil
+	case existing == imported:
+		return importSkip, nil
+	}
+
+	switch p {
+	case ConflictKeep:
+		return importSkip, nil
+	case ConflictFail:
+		return importSkip, ErrImportConflict
+	case ConflictNewest:
+		if importedUpdated.After(existingUpdated) {
+			return importUpdate, nil
+		}
+		return importSkip, nil
+	}
+	return importUpdate, nil
+}
+
+// ImportWithPolicy is Import with a choice of what to do with the records
+// that already exist. Like Import it checks the dumps first and imports
+// nothing if there is a problem; with ConflictFail a record that differs from
+// the existing one is a problem too. The summary counts the records of the
+// dumps that were inserted, updated and skipped.
+//
+// The ledger is imported before the accounts. Dumps written before there was
+// a ledger have no ledger.dump, then every imported balance gets an opening
+// entry so that the books still match the accounts.
+func (s *Service) ImportWithPolicy(dir string, policy ConflictPolicy) (summary *ImportSummary, err error) {
+	s.ready()
+	err = s.audited("ImportWithPolicy", auditParams("dir", dir, "policy", policy), func(s *Service) error {
+		summary, err = s.importWithPolicy(dir, policy)
+		return err
+	})
+	return summary, err
+}
+
+func (s *Service) importWithPolicy(dir string, policy ConflictPolicy) (*ImportSummary, error) {
+	report, err := s.validateImport(dir, policy, "ledger.dump", "accounts.dump", "payments.dump", "favorites.dump", "holds.dump")
+	if err != nil {
+		return nil, err
+	}
+	err = report.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	im := s.newImporter(policy)
+	_, err = os.Stat(dir + "/ledger.dump")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	im.openBalances = os.IsNotExist(err)
+
+	err = importDump(dir+"/ledger.dump", im.postingsFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = importDump(dir+"/accounts.dump", im.accountsFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = importDump(dir+"/payments.dump", im.paymentsFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = importDump(dir+"/favorites.dump", im.favoritesFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = importDump(dir+"/holds.dump", im.holdsFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.ImportIdempotencyKeys(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &im.summary, nil
+}
+
+// importer saves the imported records according to the policy
+type importer struct {
+	s            *Service
+	policy       ConflictPolicy
+	openBalances bool // the imported balances have no postings yet
+	summary      ImportSummary
+}
+
+func (s *Service) newImporter(policy ConflictPolicy) *importer {
+	return &importer{s: s, policy: policy, openBalances: true}
+}
+
+func (im *importer) accountsFrom(name string, r io.Reader) error {
+	return scanDump(name, r, func(schema int, _ int, line string) error {
+		account, err := parseAccount(line, schema)
+		if err != nil {
+			return err
+		}
+		return im.account(account)
+	})
+}
+
+// postingsFrom saves the postings as one batch, an entry is either
+// imported whole or skipped if the ledger already has it
+func (im *importer) postingsFrom(name string, r io.Reader) error {
+	postings := []types.Posting{}
+	err := scanDump(name, r, func(schema int, _ int, line string) error {
+		posting, err := parsePosting(line, schema)
+		if err != nil {
+			return err
+		}
+		postings = append(postings, posting)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(postings) == 0 {
+		return nil
+	}
+
+	s := im.s
+	inserted := 0
+	for _, posting := range postings {
+		if !s.ledger.has(posting.EntryID) {
+			inserted++
+		}
+	}
+	err = s.save(batch{postings: postings})
+	if err != nil {
+		return err
+	}
+	im.summary.Postings.Inserted += inserted
+	im.summary.Postings.Skipped += len(postings) - inserted
+	return nil
+}
+
+func (im *importer) paymentsFrom(name string, r io.Reader) error {
+	return scanDump(name, r, func(schema int, _ int, line string) error {
+		payment, err := parsePayment(line, schema)
+		if err != nil {
+			return err
+		}
+		return im.payment(payment)
+	})
+}
+
+func (im *importer) favoritesFrom(name string, r io.Reader) error {
+	return scanDump(name, r, func(schema int, _ int, line string) error {
+		favorite, err := parseFavorite(line, schema)
+		if err != nil {
+			return err
+		}
+		return im.favorite(favorite)
+	})
+}
+
+func (im *importer) holdsFrom(name string, r io.Reader) error {
+	return scanDump(name, r, func(schema int, _ int, line string) error {
+		hold, err := parseHold(line, schema)
+		if err != nil {
+			return err
+		}
+		return im.hold(hold)
+	})
+}
+
+// account may overwrite the balance, so it takes the account lock like any
+// other balance change
+func (im *importer) account(account types.Account) error {
+	s := im.s
+	unlock := s.lockAccount(account.ID)
+	defer unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, existingUpdated := "", time.Time{}
+	found, err := s.accounts.FindByID(account.ID)
+	if err != nil && err != ErrAccountNotFound {
+		return err
+	}
+	if err == nil {
+		existing, existingUpdated = formatAccount(*found), found.UpdatedAt
+	}
+
+	action, err := im.policy.decide(existing, formatAccount(account), existingUpdated, account.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("account %v: %w", account.ID, err)
+	}
+	if action != importSkip {
+		b := batch{accounts: []*types.Account{&account}}
+		if im.openBalances {
+			b.postings, err = s.opening(&account)
+			if err != nil {
+				return fmt.Errorf("account %v: %w", account.ID, err)
+			}
+		}
+		err = s.save(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	// RegisterAccount goes on after the largest ID
+	if account.ID > s.nextAccountID {
+		s.nextAccountID = account.ID
+	}
+	im.summary.Accounts.add(action)
+	return nil
+}
+
+// payment locks the account so that the payment doesn't change status between
+// the decision and the save
+func (im *importer) payment(payment types.Payment) error {
+	s := im.s
+	unlock := s.lockAccount(payment.AccountID)
+	defer unlock()
+
+	existing, existingUpdated := "", time.Time{}
+	found, err := s.payments.FindByID(payment.ID)
+	if err != nil && err != ErrPaymentNotFound {
+		return err
+	}
+	if err == nil {
+		existing, existingUpdated = formatPayment(*found), found.UpdatedAt
+	}
+
+	action, err := im.policy.decide(existing, formatPayment(payment), existingUpdated, payment.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("payment %v: %w", payment.ID, err)
+	}
+	if action != importSkip {
+		err = s.save(batch{payments: []*types.Payment{&payment}})
+		if err != nil {
+			return err
+		}
+	}
+	im.summary.Payments.add(action)
+	return nil
+}
+
+func (im *importer) favorite(favorite types.Favorite) error {
+	s := im.s
+	unlock := s.lockAccount(favorite.AccountID)
+	defer unlock()
+
+	existing, existingUpdated := "", time.Time{}
+	found, err := s.favorites.FindByID(favorite.ID)
+	if err != nil && err != ErrFavoriteNotFound {
+		return err
+	}
+	if err == nil {
+		existing, existingUpdated = formatFavorite(*found), found.UpdatedAt
+	}
+
+	action, err := im.policy.decide(existing, formatFavorite(favorite), existingUpdated, favorite.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("favorite %v: %w", favorite.ID, err)
+	}
+	if action != importSkip {
+		err = s.save(batch{favorites: []*types.Favorite{&favorite}})
+		if err != nil {
+			return err
+		}
+	}
+	im.summary.Favorites.add(action)
+	return nil
+}
+
+// hold locks the account like payment, a hold takes money off its balance
+func (im *importer) hold(hold types.Hold) error {
+	s := im.s
+	unlock := s.lockAccount(hold.AccountID)
+	defer unlock()
+
+	existing, existingUpdated := "", time.Time{}
+	if found, ok := s.holds.find(hold.ID); ok {
+		existing, existingUpdated = formatHold(*found), found.UpdatedAt
+	}
+
+	action, err := im.policy.decide(existing, formatHold(hold), existingUpdated, hold.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("hold %v: %w", hold.ID, err)
+	}
+	if action != importSkip {
+		err = s.save(batch{holds: []*types.Hold{&hold}})
+		if err != nil {
+			return err
+		}
+	}
+	im.summary.Holds.add(action)
+	return nil
+}
@@ -0,0 +1,186 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// newConflictTestServices exports a service with an account and a payment,
+// imports it into a second service and changes the account there an hour later
+func newConflictTestServices(t *testing.T) (*Service, *Service, string, error) {
+	clock := newTestClock()
+	s1, err := NewService(NewMemoryStorage(), WithClock(clock.Now))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	account, err := s1.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	err = s1.Deposit(account.ID, 100)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	_, err = s1.Pay(account.ID, 10, "auto")
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithClock(clock.Now))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	err = s2.Import(dir)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	clock.Advance(time.Hour)
+	err = s2.Deposit(account.ID, 1_000)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return s1, s2, dir, nil
+}
+
+func TestService_ImportWithPolicy(t *testing.T) {
+	tests := []struct {
+		policy  ConflictPolicy
+		balance types.Money
+		summary ImportCounts
+	}{
+		{ConflictOverwrite, 90, ImportCounts{Updated: 1}},
+		{ConflictKeep, 1_090, ImportCounts{Skipped: 1}},
+		{ConflictNewest, 1_090, ImportCounts{Skipped: 1}},
+	}
+	for _, tt := range tests {
+		_, s2, dir, err := newConflictTestServices(t)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		summary, err := s2.ImportWithPolicy(dir, tt.policy)
+		if err != nil {
+			t.Errorf("ImportWithPolicy(%v): error = %v", tt.policy, err)
+			continue
+		}
+
+		account, err := s2.FindAccountByID(1)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if account.Balance != tt.balance {
+			t.Errorf("ImportWithPolicy(%v): balance expected:%v, actual:%v", tt.policy, tt.balance, account.Balance)
+		}
+		if summary.Accounts != tt.summary {
+			t.Errorf("ImportWithPolicy(%v): accounts summary expected:%v, actual:%v", tt.policy, tt.summary, summary.Accounts)
+		}
+		// the payment is the same on both sides
+		if summary.Payments != (ImportCounts{Skipped: 1}) {
+			t.Errorf("ImportWithPolicy(%v): payments summary = %v", tt.policy, summary.Payments)
+		}
+	}
+}
+
+func TestService_ImportWithPolicy_fail(t *testing.T) {
+	_, s2, dir, err := newConflictTestServices(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s2.ImportWithPolicy(dir, ConflictFail)
+	if !errors.Is(err, ErrImportConflict) || !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("ImportWithPolicy(): must return ErrImportConflict, returned = %v", err)
+	}
+
+	account, err := s2.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Balance != 1_090 {
+		t.Errorf("ImportWithPolicy(): balance must not change, actual:%v", account.Balance)
+	}
+}
+
+func TestService_ImportWithPolicy_newest(t *testing.T) {
+	s1, s2, dir, err := newConflictTestServices(t)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payment is rejected in s1 after the deposit in s2,
+	// that makes the exported payment and account newer
+	s1.clock = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	history, err := s1.ExportAccountHistory(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Reject(history[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	summary, err := s2.ImportWithPolicy(dir, ConflictNewest)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if summary.Payments != (ImportCounts{Updated: 1}) || summary.Accounts != (ImportCounts{Updated: 1}) {
+		t.Errorf("ImportWithPolicy(): summary = %v", summary)
+	}
+	compareServices(t, s1, s2)
+}
+
+func TestService_Import_nextAccountID(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = writeDumps(dir, map[string]string{"accounts.dump": "1;+992000000001;0\n5;+992000000005;0"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	summary, err := s.ImportWithPolicy(dir, ConflictOverwrite)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// the dump has no timestamps, so account 1 differs and is updated
+	if summary.Accounts != (ImportCounts{Inserted: 1, Updated: 1}) {
+		t.Errorf("ImportWithPolicy(): accounts summary = %v", summary.Accounts)
+	}
+
+	account, err := s.RegisterAccount("+992000000006")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.ID != 6 {
+		t.Errorf("RegisterAccount(): ID expected:%v, actual:%v", 6, account.ID)
+	}
+}
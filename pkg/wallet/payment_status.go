@@ -0,0 +1,102 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrIllegalTransition = errors.New("illegal payment status transition")
+
+// TransitionError is returned when a payment can't move to the requested
+// status, errors.Is(err, ErrIllegalTransition) reports true for it.
+type TransitionError struct {
+	PaymentID string
+	From      types.PaymentStatus
+	To        types.PaymentStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("payment %v can't change status from %v to %v", e.PaymentID, e.From, e.To)
+}
+
+func (e *TransitionError) Is(target error) bool {
+	return target == ErrIllegalTransition
+}
+
+// paymentTransitions lists the statuses a payment can move to,
+// OK and FAIL are terminal
+//
+//	INPROGRESS -> CONFIRMED -> OK
+//	     |            |
+//	     +----------> FAIL
+var paymentTransitions = map[types.PaymentStatus][]types.PaymentStatus{
+	types.PaymentStatusInProgress: {types.PaymentStatusConfirmed, types.PaymentStatusFail},
+	types.PaymentStatusConfirmed:  {types.PaymentStatusOk, types.PaymentStatusFail},
+}
+
+// validPaymentStatus reports whether the status is one of the known ones
+func validPaymentStatus(status types.PaymentStatus) bool {
+	switch status {
+	case types.PaymentStatusInProgress, types.PaymentStatusConfirmed, types.PaymentStatusOk, types.PaymentStatusFail:
+		return true
+	}
+	return false
+}
+
+func checkTransition(payment *types.Payment, to types.PaymentStatus) error {
+	for _, status := range paymentTransitions[payment.Status] {
+		if status == to {
+			return nil
+		}
+	}
+	return &TransitionError{PaymentID: payment.ID, From: payment.Status, To: to}
+}
+
+// Confirm moves an in-progress payment to CONFIRMED
+func (s *Service) Confirm(paymentID string) error {
+	s.ready()
+	return s.audited("Confirm", auditParams("payment", paymentID), func(s *Service) error {
+		s.call.payment(paymentID)
+
+		return s.changeStatus(paymentID, types.PaymentStatusConfirmed)
+	})
+}
+
+// Complete moves a confirmed payment to OK, after that it can't be rejected
+func (s *Service) Complete(paymentID string) error {
+	s.ready()
+	return s.audited("Complete", auditParams("payment", paymentID), func(s *Service) error {
+		s.call.payment(paymentID)
+
+		return s.changeStatus(paymentID, types.PaymentStatusOk)
+	})
+}
+
+// changeStatus is for the transitions that don't move money,
+// Reject has its own because it refunds the payment
+func (s *Service) changeStatus(paymentID string, to types.PaymentStatus) error {
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+
+	// the account lock serializes the status changes with Reject
+	unlock := s.lockAccount(payment.AccountID)
+	defer unlock()
+
+	payment, err = s.FindPaymentByID(paymentID)
+	if err != nil {
+		return err
+	}
+
+	err = checkTransition(payment, to)
+	if err != nil {
+		return err
+	}
+
+	payment.Status = to
+	payment.UpdatedAt = s.now()
+	return s.save(batch{payments: []*types.Payment{payment}})
+}
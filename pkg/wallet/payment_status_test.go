@@ -0,0 +1,147 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func TestService_paymentTransitions(t *testing.T) {
+	// operations that bring a new payment to the given status
+	setups := map[types.PaymentStatus][]string{
+		types.PaymentStatusInProgress: {},
+		types.PaymentStatusConfirmed:  {"confirm"},
+		types.PaymentStatusOk:         {"confirm", "complete"},
+		types.PaymentStatusFail:       {"reject"},
+	}
+
+	tests := []struct {
+		from      types.PaymentStatus
+		operation string
+		to        types.PaymentStatus
+		ok        bool
+	}{
+		{types.PaymentStatusInProgress, "confirm", types.PaymentStatusConfirmed, true},
+		{types.PaymentStatusInProgress, "complete", types.PaymentStatusOk, false},
+		{types.PaymentStatusInProgress, "reject", types.PaymentStatusFail, true},
+		{types.PaymentStatusConfirmed, "confirm", types.PaymentStatusConfirmed, false},
+		{types.PaymentStatusConfirmed, "complete", types.PaymentStatusOk, true},
+		{types.PaymentStatusConfirmed, "reject", types.PaymentStatusFail, true},
+		{types.PaymentStatusOk, "confirm", types.PaymentStatusConfirmed, false},
+		{types.PaymentStatusOk, "complete", types.PaymentStatusOk, false},
+		{types.PaymentStatusOk, "reject", types.PaymentStatusFail, false},
+		{types.PaymentStatusFail, "confirm", types.PaymentStatusConfirmed, false},
+		{types.PaymentStatusFail, "complete", types.PaymentStatusOk, false},
+		{types.PaymentStatusFail, "reject", types.PaymentStatusFail, false},
+	}
+
+	for _, tt := range tests {
+		s := newTestService()
+		account, payments, err := s.addAccount(defultTestAccount)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		payment := payments[0]
+
+		operations := map[string]func(string) error{
+			"confirm":  s.Confirm,
+			"complete": s.Complete,
+			"reject":   s.Reject,
+		}
+
+		for _, operation := range setups[tt.from] {
+			err = operations[operation](payment.ID)
+			if err != nil {
+				t.Errorf("%v: error = %v", operation, err)
+				return
+			}
+		}
+
+		before, err := s.FindAccountByID(account.ID)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = operations[tt.operation](payment.ID)
+
+		got, findErr := s.FindPaymentByID(payment.ID)
+		if findErr != nil {
+			t.Error(findErr)
+			return
+		}
+		after, findErr := s.FindAccountByID(account.ID)
+		if findErr != nil {
+			t.Error(findErr)
+			return
+		}
+
+		if tt.ok {
+			if err != nil {
+				t.Errorf("%v from %v: error = %v", tt.operation, tt.from, err)
+			}
+			if got.Status != tt.to {
+				t.Errorf("%v from %v: status expected:%v, actual:%v", tt.operation, tt.from, tt.to, got.Status)
+			}
+			continue
+		}
+
+		if !errors.Is(err, ErrIllegalTransition) {
+			t.Errorf("%v from %v: must return ErrIllegalTransition, returned = %v", tt.operation, tt.from, err)
+		}
+		transitionErr := &TransitionError{}
+		if !errors.As(err, &transitionErr) || transitionErr.From != tt.from || transitionErr.To != tt.to {
+			t.Errorf("%v from %v: wrong error = %#v", tt.operation, tt.from, err)
+		}
+		if got.Status != tt.from {
+			t.Errorf("%v from %v: status changed to %v", tt.operation, tt.from, got.Status)
+		}
+		if after.Balance != before.Balance {
+			t.Errorf("%v from %v: balance changed from %v to %v", tt.operation, tt.from, before.Balance, after.Balance)
+		}
+	}
+}
+
+func TestService_Reject_transferTwice(t *testing.T) {
+	s := newTestService()
+
+	from, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	to, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	transfer, err := s.Transfer(from.ID, to.ID, 1_000_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(transfer.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(transfer.ID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Reject(): must return ErrIllegalTransition, returned = %v", err)
+	}
+}
+
+func TestService_Confirm_notFound(t *testing.T) {
+	s := newTestService()
+
+	err := s.Confirm("unknown")
+	if err != ErrPaymentNotFound {
+		t.Errorf("Confirm(): must return ErrPaymentNotFound, returned = %v", err)
+	}
+}
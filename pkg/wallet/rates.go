@@ -0,0 +1,431 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrNoRate = errors.New("no exchange rate")
+var ErrAmountTooLarge = errors.New("amount too large")
+var ErrUnknownRounding = errors.New("unknown rounding")
+
+// Rate is an exchange rate: how many units of one currency are paid for a
+// unit of another, e.g. 10.95 TJS for 1 USD. It is kept exactly as written.
+type Rate struct {
+	value *big.Rat
+	text  string
+}
+
+// ParseRate reads a positive decimal rate like "10.95"
+func ParseRate(s string) (Rate, error) {
+	if !isDecimal(s) {
+		return Rate{}, fmt.Errorf("bad rate %q", s)
+	}
+	value, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return Rate{}, fmt.Errorf("bad rate %q", s)
+	}
+	if value.Sign() <= 0 {
+		return Rate{}, fmt.Errorf("rate %q must be positive", s)
+	}
+	return Rate{value: value, text: s}, nil
+}
+
+// isDecimal accepts digits with at most one point between them, big.Rat
+// alone would take fractions and exponents too
+func isDecimal(s string) bool {
+	digits, point := 0, -1
+	for i, c := range s {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '.' && point == -1 && digits > 0:
+			point = i
+		default:
+			return false
+		}
+	}
+	return digits > 0 && point != len(s)-1
+}
+
+func (r Rate) String() string {
+	return r.text
+}
+
+// one is the rate of a currency to itself
+var one = Rate{value: big.NewRat(1, 1), text: "1"}
+
+// RateProvider gives the rate to pay in currency to for a unit of currency from
+type RateProvider interface {
+	Rate(from types.Currency, to types.Currency) (Rate, error)
+}
+
+// Rounding says what to do with a converted amount that falls between two
+// minor units. The amounts are positive, so down is toward zero.
+type Rounding int
+
+const (
+	// RoundHalfUp rounds to the nearest unit, halves up
+	RoundHalfUp Rounding = iota
+	// RoundHalfEven rounds to the nearest unit, halves to the even one
+	RoundHalfEven
+	// RoundDown drops the fraction
+	RoundDown
+	// RoundUp takes any fraction as a whole unit
+	RoundUp
+)
+
+// DefaultRounding is used where no rounding is given, like in Repeat
+const DefaultRounding = RoundHalfUp
+
+func (r Rounding) String() string {
+	switch r {
+	case RoundHalfUp:
+		return "half-up"
+	case RoundHalfEven:
+		return "half-even"
+	case RoundDown:
+		return "down"
+	case RoundUp:
+		return "up"
+	}
+	return fmt.Sprintf("Rounding(%d)", int(r))
+}
+
+// check returns ErrUnknownRounding for a value that is none of the modes
+func (r Rounding) check() error {
+	switch r {
+	case RoundHalfUp, RoundHalfEven, RoundDown, RoundUp:
+		return nil
+	}
+	return ErrUnknownRounding
+}
+
+// round rounds the positive x to an integer
+func (r Rounding) round(x *big.Rat) *big.Int {
+	quotient, remainder := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if remainder.Sign() == 0 {
+		return quotient
+	}
+
+	up := false
+	half := new(big.Int).Lsh(remainder, 1).Cmp(x.Denom()) // 2*remainder vs denominator
+	switch r {
+	case RoundHalfUp:
+		up = half >= 0
+	case RoundHalfEven:
+		up = half > 0 || half == 0 && quotient.Bit(0) == 1
+	case RoundDown:
+		up = false
+	case RoundUp:
+		up = true
+	}
+	if up {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	return quotient
+}
+
+// convert turns the amount in minor units of from into minor units of to
+func convert(amount types.Money, from types.Currency, to types.Currency, rate Rate, rounding Rounding) (types.Money, error) {
+	fromExponent, ok := from.Exponent()
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+	toExponent, ok := to.Exponent()
+	if !ok {
+		return 0, ErrUnknownCurrency
+	}
+
+	x := new(big.Rat).SetInt64(int64(amount))
+	x.Mul(x, rate.value)
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(abs(toExponent-fromExponent))), nil)
+	if toExponent > fromExponent {
+		x.Mul(x, new(big.Rat).SetInt(scale))
+	} else {
+		x.Quo(x, new(big.Rat).SetInt(scale))
+	}
+
+	converted := rounding.round(x)
+	if !converted.IsInt64() {
+		return 0, ErrAmountTooLarge
+	}
+	if converted.Sign() <= 0 {
+		return 0, ErrAmountMustBePositive
+	}
+	return types.Money(converted.Int64()), nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+type currencyPair struct {
+	from types.Currency
+	to   types.Currency
+}
+
+type rateTable map[currencyPair]Rate
+
+func (t rateTable) rate(from types.Currency, to types.Currency) (Rate, error) {
+	if from == to {
+		return one, nil
+	}
+	rate, ok := t[currencyPair{from, to}]
+	if !ok {
+		return Rate{}, fmt.Errorf("%w from %v to %v", ErrNoRate, from, to)
+	}
+	return rate, nil
+}
+
+// MemoryRates is a rate table set up in code, e.g. in tests
+type MemoryRates struct {
+	mu    sync.RWMutex
+	rates rateTable
+}
+
+func NewMemoryRates() *MemoryRates {
+	return &MemoryRates{rates: rateTable{}}
+}
+
+// Set sets the rate from one currency to another, the opposite direction
+// is a separate rate
+func (r *MemoryRates) Set(from types.Currency, to types.Currency, rate Rate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rates[currencyPair{from, to}] = rate
+}
+
+func (r *MemoryRates) Rate(from types.Currency, to types.Currency) (Rate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.rates.rate(from, to)
+}
+
+// FileRates is a rate table loaded from a file with one rate per line,
+// blank lines and lines starting with # are skipped
+//
+//	# from;to;rate
+//	USD;TJS;10.95
+//	TJS;USD;0.0913
+type FileRates struct {
+	path  string
+	mu    sync.RWMutex
+	rates rateTable
+}
+
+// NewFileRates loads the rates from the file
+func NewFileRates(path string) (*FileRates, error) {
+	r := &FileRates{path: path}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the file again, the old rates stay if the file is bad
+func (r *FileRates) Reload() error {
+	content, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+
+	rates := rateTable{}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = parseRateLine(rates, line)
+		if err != nil {
+			return fmt.Errorf("%v: line %v: %w", r.path, i+1, err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rates = rates
+	return nil
+}
+
+func parseRateLine(rates rateTable, line string) error {
+	rec := strings.Split(line, ";")
+	if len(rec) != 3 {
+		return fmt.Errorf("rate: expected 3 fields, got %v", len(rec))
+	}
+	from, to := types.Currency(rec[0]), types.Currency(rec[1])
+	for _, currency := range []types.Currency{from, to} {
+		if checkCurrency(currency) != nil {
+			return fmt.Errorf("unknown currency %q", currency)
+		}
+	}
+	rate, err := ParseRate(rec[2])
+	if err != nil {
+		return err
+	}
+	pair := currencyPair{from, to}
+	if _, ok := rates[pair]; ok {
+		return fmt.Errorf("duplicate rate from %v to %v", from, to)
+	}
+	rates[pair] = rate
+	return nil
+}
+
+func (r *FileRates) Rate(from types.Currency, to types.Currency) (Rate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.rates.rate(from, to)
+}
+
+// WithRates lets the service convert payments and deposits in other currencies
+func WithRates(rates RateProvider) Option {
+	return func(s *Service) {
+		s.rates = rates
+	}
+}
+
+// conversion is a payment in another currency than the account's
+type conversion struct {
+	amount   types.Money
+	currency types.Currency
+	rate     Rate
+}
+
+// convertTo converts the amount in currency into the currency of the account
+func (s *Service) convertTo(account *types.Account, amount types.Money, currency types.Currency, rounding Rounding) (types.Money, *conversion, error) {
+	if s.rates == nil {
+		return 0, nil, ErrNoRate
+	}
+	to := currencyOrDefault(account.Currency)
+	rate, err := s.rates.Rate(currency, to)
+	if err != nil {
+		return 0, nil, err
+	}
+	converted, err := convert(amount, currency, to, rate, rounding)
+	if err != nil {
+		return 0, nil, err
+	}
+	return converted, &conversion{amount: amount, currency: currency, rate: rate}, nil
+}
+
+// PayConverted pays the amount in currency from an account in another
+// currency: the amount is converted at the rate of the provider given with
+// WithRates and rounded to the minor units of the account. The payment
+// records the original amount and currency and the rate. In the currency
+// of the account it is PayIn. A rounding that is none of the modes returns
+// ErrUnknownRounding.
+func (s *Service) PayConverted(accountID int64, amount types.Money, currency types.Currency, category types.PaymentCategory, rounding Rounding) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("PayConverted", auditParams("account", accountID, "amount", amount, "currency", currency, "category", category, "rounding", rounding), func(s *Service) (*types.Payment, error) {
+		s.call.account(accountID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
+		err := checkCurrency(currency)
+		if err != nil {
+			return nil, err
+		}
+		err = rounding.check()
+		if err != nil {
+			return nil, err
+		}
+
+		unlock := s.lockAccount(accountID)
+		defer unlock()
+
+		account, err := s.accounts.FindByID(accountID)
+		if err != nil {
+			return nil, err
+		}
+		if currency == currencyOrDefault(account.Currency) {
+			return s.pay(account, amount, category, nil, nil)
+		}
+
+		converted, original, err := s.convertTo(account, amount, currency, rounding)
+		if err != nil {
+			return nil, err
+		}
+		return s.pay(account, converted, category, original, nil)
+	})
+}
+
+// DepositConverted is Deposit of an amount in currency, converted like in
+// PayConverted. It returns the amount put on the account.
+func (s *Service) DepositConverted(accountID int64, amount types.Money, currency types.Currency, rounding Rounding) (converted types.Money, err error) {
+	s.ready()
+	params := auditParams("account", accountID, "amount", amount, "currency", currency, "rounding", rounding)
+	err = s.audited("DepositConverted", params, func(s *Service) error {
+		s.call.account(accountID)
+		converted, err = s.depositConverted(accountID, amount, currency, rounding)
+		return err
+	})
+	return converted, err
+}
+
+func (s *Service) depositConverted(accountID int64, amount types.Money, currency types.Currency, rounding Rounding) (types.Money, error) {
+	if amount <= 0 {
+		return 0, ErrAmountMustBePositive
+	}
+	err := checkCurrency(currency)
+	if err != nil {
+		return 0, err
+	}
+	err = rounding.check()
+	if err != nil {
+		return 0, err
+	}
+
+	unlock := s.lockAccount(accountID)
+	defer unlock()
+
+	account, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return 0, err
+	}
+
+	converted := amount
+	if currency != currencyOrDefault(account.Currency) {
+		var conversion *conversion
+		converted, conversion, err = s.convertTo(account, amount, currency, rounding)
+		if err != nil {
+			return 0, err
+		}
+		// the ledger has the deposit in the currency of the account only, the
+		// audit record keeps how it was converted next to the amount and currency
+		s.call.param("rate", conversion.rate)
+		s.call.param("converted", converted)
+	}
+
+	balance, err := account.Balance.Add(converted)
+	if err != nil {
+		return 0, err
+	}
+	now := s.now()
+	account.Balance = balance
+	account.UpdatedAt = now
+
+	// the funding account pays in the currency of the account
+	err = s.save(batch{
+		accounts: []*types.Account{account},
+		postings: s.entry(LedgerDeposit, "", FundingLedgerAccount, UserLedgerAccount(account.ID), converted, currencyOrDefault(account.Currency), now),
+	})
+	if err != nil {
+		return 0, err
+	}
+	return converted, nil
+}
@@ -0,0 +1,408 @@
+package wallet
+
+import (
+	"errors"
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func mustParseRate(s string) Rate {
+	rate, err := ParseRate(s)
+	if err != nil {
+		panic(err)
+	}
+	return rate
+}
+
+func TestParseRate(t *testing.T) {
+	for _, s := range []string{"10.95", "1", "0.0913", "149.50"} {
+		rate, err := ParseRate(s)
+		if err != nil || rate.String() != s {
+			t.Errorf("ParseRate(%q): rate %v, error %v", s, rate, err)
+		}
+	}
+	for _, s := range []string{"", "0", "0.00", "-1", "1/3", "1e3", "0x10", ".5", "5.", "1.2.3", "abc"} {
+		_, err := ParseRate(s)
+		if err == nil {
+			t.Errorf("ParseRate(%q): must fail", s)
+		}
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		amount   types.Money
+		from     types.Currency
+		to       types.Currency
+		rate     string
+		rounding Rounding
+		expected types.Money
+		err      error
+	}{
+		{100, "USD", "TJS", "10.95", RoundHalfUp, 1095, nil},
+		{1, "USD", "TJS", "10.955", RoundHalfUp, 11, nil},
+		{1, "USD", "TJS", "10.955", RoundDown, 10, nil},
+		{1, "USD", "TJS", "10.5", RoundHalfUp, 11, nil},
+		{1, "USD", "TJS", "10.5", RoundHalfEven, 10, nil},
+		{1, "USD", "TJS", "11.5", RoundHalfEven, 12, nil},
+		{1, "USD", "TJS", "10.5", RoundDown, 10, nil},
+		{1, "USD", "TJS", "10.1", RoundUp, 11, nil},
+		{1_000, "USD", "JPY", "149.5", RoundHalfUp, 1495, nil},
+		{1, "USD", "JPY", "149.5", RoundHalfUp, 1, nil},
+		{1, "JPY", "USD", "0.0067", RoundUp, 1, nil},
+		{100, "USD", "KWD", "0.3075", RoundHalfUp, 308, nil},
+		{100, "USD", "KWD", "0.3075", RoundDown, 307, nil},
+		{1, "TJS", "USD", "0.0913", RoundDown, 0, ErrAmountMustBePositive},
+		{math.MaxInt64, "USD", "TJS", "10.95", RoundHalfUp, 0, ErrAmountTooLarge},
+		{100, "USD", "XYZ", "1", RoundHalfUp, 0, ErrUnknownCurrency},
+	}
+	for _, tt := range tests {
+		converted, err := convert(tt.amount, tt.from, tt.to, mustParseRate(tt.rate), tt.rounding)
+		if converted != tt.expected || err != tt.err {
+			t.Errorf("convert(%v %v to %v at %v, %v): expected %v %v, actual %v %v",
+				tt.amount, tt.from, tt.to, tt.rate, tt.rounding, tt.expected, tt.err, converted, err)
+		}
+	}
+}
+
+func TestFileRates(t *testing.T) {
+	path := t.TempDir() + "/rates.txt"
+	err := os.WriteFile(path, []byte("# from;to;rate\n\nUSD;TJS;10.95\nTJS;USD;0.0913\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rates, err := NewFileRates(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	rate, err := rates.Rate("USD", "TJS")
+	if err != nil || rate.String() != "10.95" {
+		t.Errorf("Rate(USD, TJS): rate %v, error %v", rate, err)
+	}
+	rate, err = rates.Rate("JPY", "JPY")
+	if err != nil || rate.String() != "1" {
+		t.Errorf("Rate(JPY, JPY): rate %v, error %v", rate, err)
+	}
+	_, err = rates.Rate("TJS", "JPY")
+	if !errors.Is(err, ErrNoRate) {
+		t.Errorf("Rate(TJS, JPY): must return ErrNoRate, returned = %v", err)
+	}
+
+	err = os.WriteFile(path, []byte("USD;TJS;11\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = rates.Reload()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rate, _ = rates.Rate("USD", "TJS")
+	if rate.String() != "11" {
+		t.Errorf("Reload(): rate expected:%v, actual:%v", "11", rate)
+	}
+	_, err = rates.Rate("TJS", "USD")
+	if !errors.Is(err, ErrNoRate) {
+		t.Errorf("Reload(): the removed rate must be gone, returned = %v", err)
+	}
+
+	// a bad file keeps the old rates
+	err = os.WriteFile(path, []byte("USD;TJS;12\nUSD;TJS;13\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = rates.Reload()
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Reload(): must fail on line 2, returned = %v", err)
+	}
+	rate, _ = rates.Rate("USD", "TJS")
+	if rate.String() != "11" {
+		t.Errorf("Reload(): rate expected:%v, actual:%v", "11", rate)
+	}
+}
+
+func TestFileRates_badLines(t *testing.T) {
+	for _, line := range []string{"USD;TJS", "USD;TJS;10.95;1", "USD;XYZ;1", "USD;TJS;abc", "USD;TJS;0"} {
+		path := t.TempDir() + "/rates.txt"
+		err := os.WriteFile(path, []byte(line), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, err = NewFileRates(path)
+		if err == nil {
+			t.Errorf("NewFileRates(): line %q must fail", line)
+		}
+	}
+}
+
+// newRatesTestService has a TJS account 1 with 1000.00 and a USD account 2
+// with 100.00, USD is 10.95 TJS
+func newRatesTestService(options ...Option) (*Service, *MemoryRates, error) {
+	rates := NewMemoryRates()
+	rates.Set("USD", "TJS", mustParseRate("10.95"))
+	s, err := NewService(NewMemoryStorage(), append(options, WithRates(rates))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = s.RegisterAccount("+992000000001")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = s.RegisterAccountInCurrency("+992000000002", "USD")
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.Deposit(1, 100_000)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = s.Deposit(2, 10_000)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, rates, nil
+}
+
+func TestService_PayConverted(t *testing.T) {
+	s, _, err := newRatesTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment, err := s.PayConverted(1, 1_000, "USD", "shop", RoundHalfUp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if payment.Amount != 10_950 || payment.Currency != "TJS" ||
+		payment.OriginalAmount != 1_000 || payment.OriginalCurrency != "USD" || payment.Rate != "10.95" {
+		t.Errorf("PayConverted(): wrong payment %v", payment)
+	}
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 89_050 {
+		t.Errorf("PayConverted(): balance expected:%v, actual:%v", 89_050, account.Balance)
+	}
+
+	// in the currency of the account nothing is converted
+	payment, err = s.PayConverted(2, 1_000, "USD", "shop", RoundHalfUp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if payment.Amount != 1_000 || payment.OriginalCurrency != "" || payment.Rate != "" {
+		t.Errorf("PayConverted(): wrong payment %v", payment)
+	}
+}
+
+func TestService_PayConverted_fail(t *testing.T) {
+	s, _, err := newRatesTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		accountID int64
+		amount    types.Money
+		currency  types.Currency
+		err       error
+	}{
+		{1, 0, "USD", ErrAmountMustBePositive},
+		{1, 100, "XYZ", ErrUnknownCurrency},
+		{1, 100, "JPY", ErrNoRate},
+		{2, 100, "TJS", ErrNoRate},
+		{3, 100, "USD", ErrAccountNotFound},
+		{1, 10_000, "USD", ErrNotEnoughBalance},
+	}
+	for _, tt := range tests {
+		_, err = s.PayConverted(tt.accountID, tt.amount, tt.currency, "shop", RoundHalfUp)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("PayConverted(%v, %v %v): must return %v, returned = %v", tt.accountID, tt.amount, tt.currency, tt.err, err)
+		}
+	}
+
+	// a rounding is checked even when there is nothing to convert
+	_, err = s.PayConverted(1, 100, "TJS", "shop", Rounding(7))
+	if err != ErrUnknownRounding {
+		t.Errorf("PayConverted(): must return ErrUnknownRounding, returned = %v", err)
+	}
+	_, err = s.DepositConverted(1, 100, "USD", Rounding(-1))
+	if err != ErrUnknownRounding {
+		t.Errorf("DepositConverted(): must return ErrUnknownRounding, returned = %v", err)
+	}
+
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 100_000 {
+		t.Errorf("PayConverted(): balance changed to %v", account.Balance)
+	}
+
+	without := newTestService()
+	_, err = without.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = without.PayConverted(1, 100, "USD", "shop", RoundHalfUp)
+	if err != ErrNoRate {
+		t.Errorf("PayConverted(): without rates must return ErrNoRate, returned = %v", err)
+	}
+}
+
+func TestService_PayConverted_repeat(t *testing.T) {
+	s, rates, err := newRatesTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s.PayConverted(1, 1_000, "USD", "shop", RoundHalfUp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	favorite, err := s.FavoritePayment(payment.ID, "shop")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if favorite.Amount != 1_000 || favorite.Currency != "USD" {
+		t.Errorf("FavoritePayment(): must keep the original amount, favorite %v", favorite)
+	}
+
+	// the rate of the day is used again
+	rates.Set("USD", "TJS", mustParseRate("11"))
+	repeated, err := s.Repeat(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	fromFavorite, err := s.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, v := range []*types.Payment{repeated, fromFavorite} {
+		if v.Amount != 11_000 || v.OriginalAmount != 1_000 || v.OriginalCurrency != "USD" || v.Rate != "11" {
+			t.Errorf("wrong payment %v", v)
+		}
+	}
+}
+
+func TestService_DepositConverted(t *testing.T) {
+	s, _, err := newRatesTestService(WithAudit(t.TempDir() + "/audit.log"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	deposited, err := s.DepositConverted(1, 1, "USD", RoundDown)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if deposited != 10 {
+		t.Errorf("DepositConverted(): amount expected:%v, actual:%v", 10, deposited)
+	}
+	account, _ := s.FindAccountByID(1)
+	if account.Balance != 100_010 {
+		t.Errorf("DepositConverted(): balance expected:%v, actual:%v", 100_010, account.Balance)
+	}
+	records, err := s.AuditByAccount(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	params := records[len(records)-1].Params
+	expected := map[string]string{"account": "1", "amount": "1", "currency": "USD", "rounding": "down", "rate": "10.95", "converted": "10"}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("DepositConverted(): audit params expected:%v, actual:%v", expected, params)
+	}
+
+	_, err = s.DepositConverted(2, 100, "TJS", RoundDown)
+	if !errors.Is(err, ErrNoRate) {
+		t.Errorf("DepositConverted(): must return ErrNoRate, returned = %v", err)
+	}
+}
+
+func TestService_Export_converted(t *testing.T) {
+	s1, _, err := newRatesTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.PayConverted(1, 1_000, "USD", "shop", RoundHalfUp)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2.Service)
+
+	s3, err := exportImportCSV(s1, t.TempDir())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s3)
+}
+
+func TestService_ValidateImport_converted(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = writeDumps(dir, map[string]string{
+		"payments.dump": "p1;1;1095;shop;OK;0;;;TJS;100;USD;10.95\n" +
+			"p2;1;1095;shop;OK;0;;;TJS;0;XYZ;ten",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	report, err := s.ValidateImport(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payments := dir + "/payments.dump"
+	expected := []string{
+		payments + ":2: unknown original currency \"XYZ\"",
+		payments + ":2: original amount 0 must be positive",
+		payments + ":2: bad rate \"ten\"",
+	}
+	got := make([]string, len(report.Problems))
+	for i, problem := range report.Problems {
+		got[i] = problem.String()
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ValidateImport(): problems\n%v\nexpected\n%v", got, expected)
+	}
+}
@@ -0,0 +1,245 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrBalanceMismatch = errors.New("balance doesn't match the records")
+
+// AdjustmentLedgerAccount is where Reconcile books the differences it adjusts
+const AdjustmentLedgerAccount types.LedgerAccount = "adjustment"
+
+// LedgerAdjustment is the operation of the entries written by Reconcile
+const LedgerAdjustment = "adjustment"
+
+// AccountReconciliation is an account whose balance or payments don't match
+// the records
+type AccountReconciliation struct {
+	AccountID int64          `json:"account_id"`
+	Currency  types.Currency `json:"currency"`
+	Balance   types.Money    `json:"balance"`
+	Expected  types.Money    `json:"expected"`
+	// Postings are the records the expected balance is made of
+	Postings []types.Posting `json:"postings"`
+	// Problems are what an adjustment can't fix: the payments that disagree
+	// with their ledger entries and a balance that only the opening of an
+	// import explains
+	Problems     []string `json:"problems,omitempty"`
+	AdjustmentID string   `json:"adjustment_id,omitempty"`
+}
+
+// Difference is what the balance has over the expected one
+func (r *AccountReconciliation) Difference() types.Money {
+	return r.Balance - r.Expected
+}
+
+// resolved says whether nothing is left to look at
+func (r *AccountReconciliation) resolved() bool {
+	return (r.Balance == r.Expected || r.AdjustmentID != "") && len(r.Problems) == 0
+}
+
+// Reconciliation is the result of Reconcile
+type Reconciliation struct {
+	Accounts   int                     `json:"accounts"`
+	Mismatches []AccountReconciliation `json:"mismatches"`
+}
+
+// Err returns nil if every mismatch is resolved and an error that wraps
+// ErrBalanceMismatch and lists the rest otherwise
+func (r *Reconciliation) Err() error {
+	problems := []string{}
+	for _, v := range r.Mismatches {
+		if v.resolved() {
+			continue
+		}
+		if v.Balance != v.Expected && v.AdjustmentID == "" {
+			problems = append(problems, fmt.Sprintf("account %v has %v, expected %v", v.AccountID,
+				v.Balance.Format(v.Currency), v.Expected.Format(v.Currency)))
+		}
+		for _, problem := range v.Problems {
+			problems = append(problems, fmt.Sprintf("account %v: %v", v.AccountID, problem))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrBalanceMismatch, strings.Join(problems, "; "))
+}
+
+// Reconcile recomputes the balance of every account from its records: the
+// deposits, payments, transfers and rejections in the ledger, together with
+// the openings of imported balances and earlier adjustments. It reports the
+// accounts whose balance differs from that, with the records, and the
+// payments whose amount or status disagrees with their entries.
+//
+// An opening makes the ledger match the balance of an account imported
+// without its entries, e.g. from a legacy dump, so the records from before
+// it can't be checked: the account is reported with the part of its balance
+// that only the opening explains.
+//
+// With adjust a differing balance is kept, it is what the owner has seen,
+// and the difference is booked between the account and
+// AdjustmentLedgerAccount so that the books match it again. The payment
+// problems are left for someone to look at.
+//
+// The error is only for failures to read or save the records.
+func (s *Service) Reconcile(adjust bool) (result *Reconciliation, err error) {
+	s.ready()
+	if !adjust {
+		return s.reconcile(false)
+	}
+	err = s.audited("Reconcile", auditParams("adjust", adjust), func(s *Service) error {
+		result, err = s.reconcile(true)
+		return err
+	})
+	return result, err
+}
+
+func (s *Service) reconcile(adjust bool) (*Reconciliation, error) {
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Reconciliation{Accounts: len(accounts), Mismatches: []AccountReconciliation{}}
+	for _, v := range accounts {
+		reconciliation, err := s.reconcileAccount(v.ID, adjust)
+		if err != nil {
+			return nil, err
+		}
+		if reconciliation != nil {
+			result.Mismatches = append(result.Mismatches, *reconciliation)
+		}
+	}
+	return result, nil
+}
+
+// reconcileAccount returns nil if the account is right
+func (s *Service) reconcileAccount(accountID int64, adjust bool) (*AccountReconciliation, error) {
+	unlock := s.lockAccount(accountID)
+	defer unlock()
+
+	account, err := s.accounts.FindByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	payments, err := s.payments.FindByAccountID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	currency := currencyOrDefault(account.Currency)
+	postings := s.ledger.find(UserLedgerAccount(accountID))
+	r := &AccountReconciliation{
+		AccountID: accountID,
+		Currency:  currency,
+		Balance:   account.Balance,
+		Postings:  postings,
+		Problems:  checkPaymentPostings(accountID, payments, postings),
+	}
+
+	opening := types.Money(0)
+	for _, posting := range postings {
+		if posting.Currency != currency {
+			r.Problems = append(r.Problems, fmt.Sprintf("entry %v is in %v", posting.EntryID, posting.Currency))
+			continue
+		}
+		r.Expected, err = r.Expected.Add(posting.Amount)
+		if err != nil {
+			return nil, fmt.Errorf("account %v: %w", accountID, err)
+		}
+		if posting.Operation == LedgerOpening {
+			opening, err = opening.Add(posting.Amount)
+			if err != nil {
+				return nil, fmt.Errorf("account %v: %w", accountID, err)
+			}
+		}
+	}
+	if opening != 0 {
+		r.Problems = append(r.Problems, fmt.Sprintf("%v of the balance is only explained by the opening of an import",
+			opening.Format(currency)))
+	}
+
+	if r.Balance == r.Expected && len(r.Problems) == 0 {
+		return nil, nil
+	}
+
+	if adjust && r.Balance != r.Expected {
+		difference, err := r.Balance.Sub(r.Expected)
+		if err != nil {
+			return nil, fmt.Errorf("account %v: %w", accountID, err)
+		}
+		entry := s.entry(LedgerAdjustment, "", AdjustmentLedgerAccount, UserLedgerAccount(accountID), difference, currency, s.now())
+		err = s.save(batch{postings: entry})
+		if err != nil {
+			return nil, err
+		}
+		r.AdjustmentID = entry[0].EntryID
+	}
+	return r, nil
+}
+
+// checkPaymentPostings compares the payments of the account with their
+// entries. Payments without entries are older than the ledger, their money
+// is in the opening of the account.
+func checkPaymentPostings(accountID int64, payments []types.Payment, postings []types.Posting) []string {
+	made := map[string]types.Posting{}
+	refunded := map[string]bool{}
+	for _, posting := range postings {
+		switch posting.Operation {
+		case LedgerPayment, LedgerTransfer, LedgerRefund:
+			made[posting.PaymentID] = posting
+		case LedgerReject:
+			refunded[posting.PaymentID] = true
+		}
+	}
+
+	refunds := map[string]types.Money{} // refunded payment ID -> sum of its refunds
+	for _, payment := range payments {
+		if payment.RefundOf != "" {
+			refunds[payment.RefundOf] += payment.Amount
+		}
+	}
+
+	known := map[string]bool{}
+	problems := []string{}
+	for _, payment := range payments {
+		known[payment.ID] = true
+		currency := currencyOrDefault(payment.Currency)
+		if payment.RefundOf == "" && payment.Refunded != refunds[payment.ID] {
+			problems = append(problems, fmt.Sprintf("payment %v has %v refunded, its refunds %v", payment.ID,
+				payment.Refunded.Format(currency), refunds[payment.ID].Format(currency)))
+		}
+		posting, ok := made[payment.ID]
+		if !ok && !refunded[payment.ID] {
+			continue
+		}
+
+		// the payer pays, the recipient of a transfer or a refund gets the amount
+		amount := -payment.Amount
+		if payment.AccountID != accountID || payment.RefundOf != "" {
+			amount = payment.Amount
+		}
+		if ok && posting.Amount != amount {
+			problems = append(problems, fmt.Sprintf("payment %v is %v, its entry %v", payment.ID,
+				amount.Format(currency), posting.Amount.Format(currency)))
+		}
+		if ok && payment.Status == types.PaymentStatusFail && !refunded[payment.ID] && payment.Refunded < payment.Amount {
+			problems = append(problems, fmt.Sprintf("payment %v failed without a refund", payment.ID))
+		}
+		if refunded[payment.ID] && payment.Status != types.PaymentStatusFail {
+			problems = append(problems, fmt.Sprintf("payment %v was refunded but is %v", payment.ID, payment.Status))
+		}
+	}
+
+	for _, posting := range postings {
+		if posting.PaymentID != "" && !known[posting.PaymentID] {
+			problems = append(problems, fmt.Sprintf("entry %v refers to unknown payment %v", posting.EntryID, posting.PaymentID))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,211 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func TestService_Reconcile(t *testing.T) {
+	s := newTestService()
+	err := fillLoggedService(s.Service)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.Reconcile(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Accounts != 2 || len(result.Mismatches) != 0 || result.Err() != nil {
+		t.Errorf("Reconcile(): accounts %v, mismatches %v, error %v", result.Accounts, result.Mismatches, result.Err())
+	}
+}
+
+func TestService_Reconcile_adjust(t *testing.T) {
+	s := newTestService()
+	_, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a balance changed without a ledger entry
+	account.Balance += 1_00
+	err = s.accounts.Save(account)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.Reconcile(false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !errors.Is(result.Err(), ErrBalanceMismatch) || len(result.Mismatches) != 1 {
+		t.Errorf("Reconcile(): must return ErrBalanceMismatch, returned = %v", result.Err())
+		return
+	}
+	mismatch := result.Mismatches[0]
+	if mismatch.Balance != 9_001_00 || mismatch.Expected != 9_000_00 || mismatch.Difference() != 1_00 {
+		t.Errorf("Reconcile(): wrong mismatch %+v", mismatch)
+	}
+	operations := []string{}
+	for _, posting := range mismatch.Postings {
+		operations = append(operations, posting.Operation)
+	}
+	if !reflect.DeepEqual(operations, []string{LedgerDeposit, LedgerPayment}) {
+		t.Errorf("Reconcile(): records %v", operations)
+	}
+
+	result, err = s.Reconcile(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Err() != nil || len(result.Mismatches) != 1 || result.Mismatches[0].AdjustmentID == "" {
+		t.Errorf("Reconcile(true): must adjust, mismatches %+v, error %v", result.Mismatches, result.Err())
+	}
+
+	// the balance is kept and the books follow it
+	account, err = s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Balance != 9_001_00 {
+		t.Errorf("Reconcile(true): balance changed to %v", account.Balance)
+	}
+	balance, err := s.LedgerBalance(AdjustmentLedgerAccount)
+	if err != nil || balance[types.DefaultCurrency] != -1_00 {
+		t.Errorf("LedgerBalance(): adjustment account %v, error %v", balance, err)
+	}
+	checkLedger(t, s.Service)
+
+	result, err = s.Reconcile(false)
+	if err != nil || len(result.Mismatches) != 0 {
+		t.Errorf("Reconcile(): mismatches after adjustment %+v, error %v", result, err)
+	}
+}
+
+func TestService_Reconcile_paymentProblems(t *testing.T) {
+	s := newTestService()
+	_, payments, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the status changed without the refund
+	payment := *payments[0]
+	payment.Status = types.PaymentStatusFail
+	err = s.payments.Save(&payment)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := s.Reconcile(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result.Mismatches) != 1 {
+		t.Errorf("Reconcile(): mismatches %+v", result.Mismatches)
+		return
+	}
+	mismatch := result.Mismatches[0]
+	expected := []string{"payment " + payment.ID + " failed without a refund"}
+	if !reflect.DeepEqual(mismatch.Problems, expected) || mismatch.AdjustmentID != "" {
+		t.Errorf("Reconcile(): problems %v, adjustment %q", mismatch.Problems, mismatch.AdjustmentID)
+	}
+	if !errors.Is(result.Err(), ErrBalanceMismatch) {
+		t.Errorf("Reconcile(): must return ErrBalanceMismatch, returned = %v", result.Err())
+	}
+}
+
+func TestService_Reconcile_legacy(t *testing.T) {
+	s1 := newTestService()
+	err := fillLoggedService(s1.Service)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err == nil {
+		err = os.Remove(dir + "/ledger.dump")
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the payments older than the ledger are in the openings, which only
+	// the balances explain
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := s2.Reconcile(false)
+	if err != nil || len(result.Mismatches) != 2 || !errors.Is(result.Err(), ErrBalanceMismatch) {
+		t.Errorf("Reconcile(): mismatches %+v, error %v", result, err)
+		return
+	}
+	for _, mismatch := range result.Mismatches {
+		if mismatch.Balance != mismatch.Expected || len(mismatch.Problems) != 1 ||
+			!strings.Contains(mismatch.Problems[0], "only explained by the opening of an import") {
+			t.Errorf("Reconcile(): wrong mismatch %+v", mismatch)
+		}
+	}
+}
+
+func TestService_Reconcile_legacyDump(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"accounts.dump": "1;+992000000001;100000\n",
+		"payments.dump": "p1;1;50000;auto;INPROGRESS\np2;1;70000;auto;FAIL\n",
+	}
+	for name, content := range files {
+		err := os.WriteFile(dir+"/"+name, []byte(content), 0666)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s := newTestService()
+	err := s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := s.Reconcile(true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(result.Mismatches) != 1 || !errors.Is(result.Err(), ErrBalanceMismatch) ||
+		!strings.Contains(result.Err().Error(), "account 1: 1000.00 TJS of the balance is only explained by the opening of an import") {
+		t.Errorf("Reconcile(): mismatches %+v, error %v", result.Mismatches, result.Err())
+		return
+	}
+	if result.Mismatches[0].AdjustmentID != "" {
+		t.Errorf("Reconcile(true): adjusted %+v", result.Mismatches[0])
+	}
+}
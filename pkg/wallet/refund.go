@@ -0,0 +1,125 @@
+package wallet
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+	"github.com/google/uuid"
+)
+
+var ErrNotRefundable = errors.New("payment can't be refunded")
+var ErrRefundTooLarge = errors.New("refund is more than what is left of the payment")
+var ErrRefundPayment = errors.New("payment is a refund")
+
+// LedgerRefund is the operation of the entries written by Refund
+const LedgerRefund = "refund"
+
+// Refund gives a part of the payment back to the payer, as long as the
+// refunds don't add up to more than the payment. Every refund is a payment
+// of its own, in the history of the account, and the payment keeps the sum
+// of its refunds in Refunded. The amount is in the currency of the account,
+// also for a converted payment.
+//
+// Refunds are for purchases: transfers, failed payments and refunds can't
+// be refunded. A later Reject of the payment refunds what is left of it.
+func (s *Service) Refund(paymentID string, amount types.Money) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("Refund", auditParams("payment", paymentID, "amount", amount), func(s *Service) (*types.Payment, error) {
+		s.call.payment(paymentID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
+
+		payment, err := s.FindPaymentByID(paymentID)
+		if err != nil {
+			return nil, err
+		}
+
+		unlock := s.lockAccount(payment.AccountID)
+		defer unlock()
+
+		// re-read under the lock, the payment could have changed meanwhile
+		payment, err = s.FindPaymentByID(paymentID)
+		if err != nil {
+			return nil, err
+		}
+
+		if payment.ToAccountID != 0 || payment.RefundOf != "" || payment.Status == types.PaymentStatusFail {
+			return nil, ErrNotRefundable
+		}
+		if amount > payment.Amount-payment.Refunded {
+			return nil, ErrRefundTooLarge
+		}
+
+		account, err := s.FindAccountByID(payment.AccountID)
+		if err != nil {
+			return nil, err
+		}
+		balance, err := account.Balance.Add(amount)
+		if err != nil {
+			return nil, err
+		}
+
+		now := s.now()
+		account.Balance = balance
+		account.UpdatedAt = now
+		payment.Refunded += amount
+		payment.UpdatedAt = now
+
+		refund := &types.Payment{
+			ID:        uuid.New().String(),
+			AccountID: account.ID,
+			Amount:    amount,
+			Category:  payment.Category,
+			Status:    types.PaymentStatusOk,
+			Currency:  account.Currency,
+			RefundOf:  payment.ID,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		err = s.save(batch{
+			accounts: []*types.Account{account},
+			payments: []*types.Payment{payment, refund},
+			postings: s.entry(LedgerRefund, refund.ID, MerchantLedgerAccount(payment.Category), UserLedgerAccount(account.ID),
+				amount, account.Currency, now),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return refund, nil
+	})
+}
+
+// Refunds returns the refunds of the payment, oldest first
+func (s *Service) Refunds(paymentID string) ([]types.Payment, error) {
+	s.ready()
+	payment, err := s.FindPaymentByID(paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	payments, err := s.payments.FindByAccountID(payment.AccountID)
+	if err != nil {
+		return nil, err
+	}
+	refunds := []types.Payment{}
+	for _, v := range payments {
+		if v.RefundOf == paymentID {
+			refunds = append(refunds, v)
+		}
+	}
+	return PaymentsBetween(refunds, time.Time{}, time.Time{}), nil
+}
+
+// paidAmount is what the payment took from the account, a refund gives it
+// back
+func paidAmount(payment types.Payment) types.Money {
+	if payment.RefundOf != "" {
+		return -payment.Amount
+	}
+	return payment.Amount
+}
@@ -0,0 +1,260 @@
+package wallet
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// newRefundTestService has a payment of 1000.00 refunded by 100.00 and 250.00
+func newRefundTestService() (*testService, *types.Payment, error) {
+	s := newTestService()
+	_, payments, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, amount := range []types.Money{100_00, 250_00} {
+		_, err = s.Refund(payments[0].ID, amount)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return s, payments[0], nil
+}
+
+func TestService_Refund(t *testing.T) {
+	s, payment, err := newRefundTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Balance != 9_350_00 {
+		t.Errorf("Refund(): balance %v, expected %v", account.Balance, 9_350_00)
+	}
+	refunded, err := s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if refunded.Refunded != 350_00 || refunded.Status != payment.Status {
+		t.Errorf("Refund(): wrong payment %+v", refunded)
+	}
+
+	refunds, err := s.Refunds(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(refunds) != 2 || refunds[0].Amount != 100_00 || refunds[1].Amount != 250_00 ||
+		refunds[0].RefundOf != payment.ID || refunds[0].Status != types.PaymentStatusOk {
+		t.Errorf("Refunds(): wrong refunds %+v", refunds)
+	}
+
+	history, err := s.ExportAccountHistory(1)
+	if err != nil || len(history) != 3 {
+		t.Errorf("ExportAccountHistory(): history %+v, error %v", history, err)
+	}
+	sum, err := s.SumPayments(2)
+	if err != nil || sum[types.DefaultCurrency] != 650_00 {
+		t.Errorf("SumPayments(): sum %v, error %v", sum, err)
+	}
+	balance, err := s.LedgerBalance(MerchantLedgerAccount("auto"))
+	if err != nil || balance[types.DefaultCurrency] != 650_00 {
+		t.Errorf("LedgerBalance(): merchant %v, error %v", balance, err)
+	}
+	checkLedger(t, s.Service)
+	result, err := s.Reconcile(false)
+	if err != nil || len(result.Mismatches) != 0 {
+		t.Errorf("Reconcile(): mismatches %+v, error %v", result, err)
+	}
+}
+
+func TestService_Refund_rest(t *testing.T) {
+	s, payment, err := newRefundTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Refund(payment.ID, 650_01)
+	if err != ErrRefundTooLarge {
+		t.Errorf("Refund(): must return ErrRefundTooLarge, returned = %v", err)
+	}
+
+	// a reject refunds what is left
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil || account.Balance != defultTestAccount.balance {
+		t.Errorf("Reject(): account %+v, error %v", account, err)
+	}
+	checkLedger(t, s.Service)
+
+	_, err = s.Refund(payment.ID, 1)
+	if err != ErrNotRefundable {
+		t.Errorf("Refund(): must return ErrNotRefundable, returned = %v", err)
+	}
+}
+
+func TestService_Refund_full(t *testing.T) {
+	s, payment, err := newRefundTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s.Refund(payment.ID, 650_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// nothing is left to refund, the reject only fails the payment
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	report := checkLedger(t, s.Service)
+	if report != nil && report.Entries != 5 {
+		t.Errorf("CheckLedger(): entries %v", report.Entries)
+	}
+	result, err := s.Reconcile(false)
+	if err != nil || len(result.Mismatches) != 0 {
+		t.Errorf("Reconcile(): mismatches %+v, error %v", result, err)
+	}
+}
+
+func TestService_Refund_notRefundable(t *testing.T) {
+	s, payment, err := newRefundTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	transfer, err := s.Transfer(1, other.ID, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	refunds, err := s.Refunds(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.Refund(transfer.ID, 10)
+	if err != ErrNotRefundable {
+		t.Errorf("Refund(): transfer must return ErrNotRefundable, returned = %v", err)
+	}
+	_, err = s.Refund(refunds[0].ID, 10)
+	if err != ErrNotRefundable {
+		t.Errorf("Refund(): refund must return ErrNotRefundable, returned = %v", err)
+	}
+	_, err = s.Refund(payment.ID, 0)
+	if err != ErrAmountMustBePositive {
+		t.Errorf("Refund(): must return ErrAmountMustBePositive, returned = %v", err)
+	}
+	_, err = s.Repeat(refunds[0].ID)
+	if err != ErrRefundPayment {
+		t.Errorf("Repeat(): must return ErrRefundPayment, returned = %v", err)
+	}
+	_, err = s.FavoritePayment(refunds[0].ID, "refund")
+	if err != ErrRefundPayment {
+		t.Errorf("FavoritePayment(): must return ErrRefundPayment, returned = %v", err)
+	}
+	err = s.Reject(refunds[0].ID)
+	if !errors.Is(err, ErrIllegalTransition) {
+		t.Errorf("Reject(): must return ErrIllegalTransition, returned = %v", err)
+	}
+}
+
+func TestService_Refund_exports(t *testing.T) {
+	s1, _, err := newRefundTestService()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	dir := t.TempDir()
+
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2 := newTestService()
+	err = s2.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1.Service, s2.Service)
+
+	s3, err := exportImportCSV(s1.Service, dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1.Service, s3)
+
+	err = s1.ExportToJSON(dir + "/wallet.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s4 := newTestService()
+	err = s4.ImportFromJSON(dir + "/wallet.json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1.Service, s4.Service)
+
+	report, err := s4.ValidateImport(dir)
+	if err != nil || len(report.Problems) != 0 {
+		t.Errorf("ValidateImport(): report %+v, error %v", report, err)
+	}
+}
+
+func TestService_WithLog_refund(t *testing.T) {
+	dir := t.TempDir()
+	s1, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	ts := &testService{Service: s1}
+	_, payments, err := ts.addAccount(defultTestAccount)
+	if err == nil {
+		_, err = s1.Refund(payments[0].ID, 100)
+	}
+	if err == nil {
+		err = s1.Close()
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s2.Close()
+	compareServices(t, s1, s2)
+	compareLedgers(t, s1, s2)
+}
@@ -0,0 +1,306 @@
+package wallet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+// AccountRepository stores accounts. Implementations must be safe for
+// concurrent use and must not share records with callers: FindByID and
+// All return copies and Save stores a copy.
+type AccountRepository interface {
+	// FindByID returns ErrAccountNotFound if there is no such account
+	FindByID(id int64) (*types.Account, error)
+	// FindByPhone returns ErrAccountNotFound if there is no such account
+	FindByPhone(phone types.Phone) (*types.Account, error)
+	// Save inserts the account or replaces the one with the same ID
+	Save(account *types.Account) error
+	All() ([]types.Account, error)
+}
+
+// PaymentRepository stores payments, see AccountRepository for the contract.
+type PaymentRepository interface {
+	// FindByID returns ErrPaymentNotFound if there is no such payment
+	FindByID(id string) (*types.Payment, error)
+	// FindByAccountID returns the payments of the account in insertion order,
+	// including transfers the account received
+	FindByAccountID(accountID int64) ([]types.Payment, error)
+	// Save inserts the payment or replaces the one with the same ID
+	Save(payment *types.Payment) error
+	All() ([]types.Payment, error)
+}
+
+// FavoriteRepository stores favorites, see AccountRepository for the contract.
+type FavoriteRepository interface {
+	// FindByID returns ErrFavoriteNotFound if there is no such favorite
+	FindByID(id string) (*types.Favorite, error)
+	// Save inserts the favorite or replaces the one with the same ID
+	Save(favorite *types.Favorite) error
+	All() ([]types.Favorite, error)
+}
+
+// HoldRepository stores holds, see AccountRepository for the contract.
+type HoldRepository interface {
+	// Save inserts the hold or replaces the one with the same ID
+	Save(hold *types.Hold) error
+	All() ([]types.Hold, error)
+}
+
+// PostingRepository stores the postings of the ledger, which are never
+// changed once they are made.
+type PostingRepository interface {
+	// Add appends the postings of the entries it doesn't have yet, the ones
+	// of known entry IDs are skipped
+	Add(postings []types.Posting) error
+	All() ([]types.Posting, error)
+}
+
+// keyRepository stores the finished idempotency keys, their entries are
+// internal to the package so only NewFileStorage makes one
+type keyRepository interface {
+	// Save adds the entries of the keys it doesn't have yet and drops the
+	// ones created before the deadline
+	Save(entries []*idempotencyEntry, deadline time.Time) error
+	All() ([]idempotencyEntry, error)
+}
+
+// Storage groups the repositories the Service depends on. Holds and Postings
+// may be nil, the service then keeps them in memory only, like the
+// idempotency keys of any storage but NewFileStorage.
+type Storage struct {
+	Accounts  AccountRepository
+	Payments  PaymentRepository
+	Favorites FavoriteRepository
+	Holds     HoldRepository
+	Postings  PostingRepository
+	keys      keyRepository
+}
+
+// NewMemoryStorage returns a storage that keeps everything in memory.
+func NewMemoryStorage() Storage {
+	return Storage{
+		Accounts:  &MemoryAccountRepository{},
+		Payments:  &MemoryPaymentRepository{},
+		Favorites: &MemoryFavoriteRepository{},
+	}
+}
+
+// MemoryAccountRepository keeps accounts in insertion order and indexes them
+// by ID and phone. The zero value is ready to use.
+type MemoryAccountRepository struct {
+	mu       sync.RWMutex
+	accounts []*types.Account
+	byID     map[int64]*types.Account
+	byPhone  map[types.Phone]*types.Account
+}
+
+func (r *MemoryAccountRepository) FindByID(id int64) (*types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	account, ok := r.byID[id]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copied := *account
+	return &copied, nil
+}
+
+func (r *MemoryAccountRepository) FindByPhone(phone types.Phone) (*types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	account, ok := r.byPhone[phone]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	copied := *account
+	return &copied, nil
+}
+
+func (r *MemoryAccountRepository) Save(account *types.Account) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byID == nil {
+		r.byID = make(map[int64]*types.Account)
+		r.byPhone = make(map[types.Phone]*types.Account)
+	}
+
+	existing, ok := r.byID[account.ID]
+	if !ok {
+		copied := *account
+		r.accounts = append(r.accounts, &copied)
+		r.byID[copied.ID] = &copied
+		r.byPhone[copied.Phone] = &copied
+		return nil
+	}
+
+	if existing.Phone != account.Phone {
+		// the old phone may already belong to another account
+		if r.byPhone[existing.Phone] == existing {
+			delete(r.byPhone, existing.Phone)
+		}
+		r.byPhone[account.Phone] = existing
+	}
+	*existing = *account
+	return nil
+}
+
+func (r *MemoryAccountRepository) All() ([]types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	accounts := make([]types.Account, len(r.accounts))
+	for i, v := range r.accounts {
+		accounts[i] = *v
+	}
+	return accounts, nil
+}
+
+// MemoryPaymentRepository keeps payments in insertion order and indexes them
+// by ID and by account. The zero value is ready to use.
+type MemoryPaymentRepository struct {
+	mu        sync.RWMutex
+	payments  []*types.Payment
+	byID      map[string]*types.Payment
+	byAccount map[int64][]*types.Payment
+}
+
+func (r *MemoryPaymentRepository) FindByID(id string) (*types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payment, ok := r.byID[id]
+	if !ok {
+		return nil, ErrPaymentNotFound
+	}
+	copied := *payment
+	return &copied, nil
+}
+
+func (r *MemoryPaymentRepository) FindByAccountID(accountID int64) ([]types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payments := make([]types.Payment, len(r.byAccount[accountID]))
+	for i, v := range r.byAccount[accountID] {
+		payments[i] = *v
+	}
+	return payments, nil
+}
+
+func (r *MemoryPaymentRepository) Save(payment *types.Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byID == nil {
+		r.byID = make(map[string]*types.Payment)
+		r.byAccount = make(map[int64][]*types.Payment)
+	}
+
+	existing, ok := r.byID[payment.ID]
+	if !ok {
+		copied := *payment
+		r.payments = append(r.payments, &copied)
+		r.byID[copied.ID] = &copied
+		r.index(&copied)
+		return nil
+	}
+
+	if existing.AccountID != payment.AccountID || existing.ToAccountID != payment.ToAccountID {
+		r.unindex(existing)
+		*existing = *payment
+		r.index(existing)
+		return nil
+	}
+	*existing = *payment
+	return nil
+}
+
+// index adds the payment to the history of the payer and, for transfers, of the recipient
+func (r *MemoryPaymentRepository) index(payment *types.Payment) {
+	r.byAccount[payment.AccountID] = append(r.byAccount[payment.AccountID], payment)
+	if payment.ToAccountID != 0 && payment.ToAccountID != payment.AccountID {
+		r.byAccount[payment.ToAccountID] = append(r.byAccount[payment.ToAccountID], payment)
+	}
+}
+
+func (r *MemoryPaymentRepository) unindex(payment *types.Payment) {
+	r.byAccount[payment.AccountID] = removePayment(r.byAccount[payment.AccountID], payment)
+	if payment.ToAccountID != 0 {
+		r.byAccount[payment.ToAccountID] = removePayment(r.byAccount[payment.ToAccountID], payment)
+	}
+}
+
+func removePayment(payments []*types.Payment, payment *types.Payment) []*types.Payment {
+	for i, v := range payments {
+		if v == payment {
+			return append(payments[:i], payments[i+1:]...)
+		}
+	}
+	return payments
+}
+
+func (r *MemoryPaymentRepository) All() ([]types.Payment, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	payments := make([]types.Payment, len(r.payments))
+	for i, v := range r.payments {
+		payments[i] = *v
+	}
+	return payments, nil
+}
+
+// MemoryFavoriteRepository keeps favorites in insertion order and indexes
+// them by ID. The zero value is ready to use.
+type MemoryFavoriteRepository struct {
+	mu        sync.RWMutex
+	favorites []*types.Favorite
+	byID      map[string]*types.Favorite
+}
+
+func (r *MemoryFavoriteRepository) FindByID(id string) (*types.Favorite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	favorite, ok := r.byID[id]
+	if !ok {
+		return nil, ErrFavoriteNotFound
+	}
+	copied := *favorite
+	return &copied, nil
+}
+
+func (r *MemoryFavoriteRepository) Save(favorite *types.Favorite) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.byID == nil {
+		r.byID = make(map[string]*types.Favorite)
+	}
+
+	existing, ok := r.byID[favorite.ID]
+	if !ok {
+		copied := *favorite
+		r.favorites = append(r.favorites, &copied)
+		r.byID[copied.ID] = &copied
+		return nil
+	}
+	*existing = *favorite
+	return nil
+}
+
+func (r *MemoryFavoriteRepository) All() ([]types.Favorite, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	favorites := make([]types.Favorite, len(r.favorites))
+	for i, v := range r.favorites {
+		favorites[i] = *v
+	}
+	return favorites, nil
+}
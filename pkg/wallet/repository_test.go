@@ -0,0 +1,339 @@
+package wallet
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func TestMemoryAccountRepository_Save_copies(t *testing.T) {
+	r := &MemoryAccountRepository{}
+
+	account := &types.Account{ID: 1, Phone: "+992000000001", Balance: 100}
+	err := r.Save(account)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account.Balance = 0
+	got, err := r.FindByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 100 {
+		t.Errorf("Save(): stored account changed through the caller's pointer, got %v", got)
+		return
+	}
+
+	got.Balance = 0
+	got, err = r.FindByPhone("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Balance != 100 {
+		t.Errorf("FindByID(): stored account changed through the returned pointer, got %v", got)
+	}
+}
+
+func TestMemoryPaymentRepository_Save_replaces(t *testing.T) {
+	r := &MemoryPaymentRepository{}
+
+	payment := &types.Payment{ID: "1", AccountID: 1, Amount: 10, Status: types.PaymentStatusInProgress}
+	err := r.Save(payment)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	payment.Status = types.PaymentStatusFail
+	err = r.Save(payment)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	all, err := r.All()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !reflect.DeepEqual(all, []types.Payment{*payment}) {
+		t.Errorf("Save(): got %v want %v", all, []types.Payment{*payment})
+	}
+
+	_, err = r.FindByID("2")
+	if err != ErrPaymentNotFound {
+		t.Errorf("FindByID(): must return ErrPaymentNotFound, returned = %v", err)
+	}
+}
+
+func TestFileStorage_persists(t *testing.T) {
+	dir := t.TempDir()
+
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s1, err := NewService(storage)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ts := &testService{Service: s1}
+	account, payments, err := ts.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	favorite, err := s1.FavoritePayment(payments[0].ID, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s1.Reject(payments[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a new service over the same directory must see everything
+	storage, err = NewFileStorage(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s2, err := NewService(storage)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	gotAccount, err := s2.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotAccount.Balance != defultTestAccount.balance {
+		t.Errorf("FindAccountByID(): balance expected:%v, actual:%v", defultTestAccount.balance, gotAccount.Balance)
+	}
+
+	gotPayment, err := s2.FindPaymentByID(payments[0].ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotPayment.Status != types.PaymentStatusFail {
+		t.Errorf("FindPaymentByID(): status expected:%v, actual:%v", types.PaymentStatusFail, gotPayment.Status)
+	}
+
+	_, err = s2.PayFromFavorite(favorite.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// ID generation continues after the loaded accounts
+	next, err := s2.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if next.ID != account.ID+1 {
+		t.Errorf("RegisterAccount(): ID expected:%v, actual:%v", account.ID+1, next.ID)
+	}
+}
+
+func TestFileAccountRepository_Save_failedWrite(t *testing.T) {
+	dir := t.TempDir()
+	r, err := NewFileAccountRepository(dir + "/accounts.dump")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = r.Save(&types.Account{ID: 1, Phone: "+992000000001", Balance: 100})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// with the directory gone the dump can't be written
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = r.Save(&types.Account{ID: 1, Phone: "+992000000001", Balance: 500})
+	if err == nil {
+		t.Error("Save(): error expected for a missing directory")
+		return
+	}
+	err = r.Save(&types.Account{ID: 2, Phone: "+992000000002"})
+	if err == nil {
+		t.Error("Save(): error expected for a missing directory")
+		return
+	}
+
+	account, err := r.FindByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Balance != 100 {
+		t.Errorf("FindByID(): balance expected:%v, actual:%v", 100, account.Balance)
+	}
+	_, err = r.FindByID(2)
+	if err != ErrAccountNotFound {
+		t.Errorf("FindByID(): err expected:%v, actual:%v", ErrAccountNotFound, err)
+	}
+}
+
+func TestMemoryPaymentRepository_FindByAccountID(t *testing.T) {
+	r := &MemoryPaymentRepository{}
+
+	for i, accountID := range []int64{1, 2, 1} {
+		err := r.Save(&types.Payment{ID: fmt.Sprint(i), AccountID: accountID, Amount: 1})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// moving a payment to another account must update the index
+	err := r.Save(&types.Payment{ID: "1", AccountID: 1, Amount: 1})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := r.FindByAccountID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 3 {
+		t.Errorf("FindByAccountID(): payments expected:%v, actual:%v", 3, len(got))
+	}
+
+	got, err = r.FindByAccountID(2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 0 {
+		t.Errorf("FindByAccountID(): payments expected:%v, actual:%v", 0, len(got))
+	}
+}
+
+const benchmarkAccounts = 100
+const benchmarkPayments = 100_000
+
+func newBenchmarkRepositories() (*MemoryAccountRepository, *MemoryPaymentRepository) {
+	accounts := &MemoryAccountRepository{}
+	payments := &MemoryPaymentRepository{}
+	for i := 1; i <= benchmarkAccounts; i++ {
+		_ = accounts.Save(&types.Account{ID: int64(i), Phone: types.Phone(fmt.Sprint(i))})
+	}
+	for i := 0; i < benchmarkPayments; i++ {
+		_ = payments.Save(&types.Payment{
+			ID:        fmt.Sprint(i),
+			AccountID: int64(i%benchmarkAccounts + 1),
+			Amount:    1,
+		})
+	}
+	return accounts, payments
+}
+
+// the *_scan benchmarks repeat the linear scans the service used before the indexes
+
+func BenchmarkFindAccountByPhone_scan(b *testing.B) {
+	accounts, _ := newBenchmarkRepositories()
+	phone := types.Phone(fmt.Sprint(benchmarkAccounts))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, account := range accounts.accounts {
+			if account.Phone == phone {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkFindAccountByPhone_index(b *testing.B) {
+	accounts, _ := newBenchmarkRepositories()
+	phone := types.Phone(fmt.Sprint(benchmarkAccounts))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := accounts.FindByPhone(phone)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+func BenchmarkFindPaymentByID_scan(b *testing.B) {
+	_, payments := newBenchmarkRepositories()
+	id := fmt.Sprint(benchmarkPayments - 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, payment := range payments.payments {
+			if payment.ID == id {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkFindPaymentByID_index(b *testing.B) {
+	_, payments := newBenchmarkRepositories()
+	id := fmt.Sprint(benchmarkPayments - 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := payments.FindByID(id)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
+
+func BenchmarkFindPaymentsByAccountID_scan(b *testing.B) {
+	_, payments := newBenchmarkRepositories()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found := []types.Payment{}
+		for _, payment := range payments.payments {
+			if payment.AccountID == 1 {
+				found = append(found, *payment)
+			}
+		}
+	}
+}
+
+func BenchmarkFindPaymentsByAccountID_index(b *testing.B) {
+	_, payments := newBenchmarkRepositories()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := payments.FindByAccountID(1)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package wallet
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Tursunkhuja/wallet/pkg/types"
 	"github.com/google/uuid"
@@ -21,12 +24,180 @@ var ErrAccountNotFound = errors.New("account not found")
 var ErrNotEnoughBalance = errors.New("not enough balance")
 var ErrPaymentNotFound = errors.New("payment not found")
 var ErrFavoriteNotFound = errors.New("favorite not found")
-
+var ErrTransferToSameAccount = errors.New("can't transfer to the same account")
+var ErrInvalidOption = errors.New("invalid option")
+
+// Service is safe for concurrent use. Balance changes are serialized per
+// account with lockAccount; mu guards registration and nextAccountID.
+//
+// The zero value is ready to use and keeps its data in memory, like a
+// Service made with NewService(NewMemoryStorage()).
+//
+// The services returned by As and From share the state and differ in the
+// actor and the source that the audit log names.
 type Service struct {
-	nextAccountID int64 // to generate a unique account number
-	accounts      []*types.Account
-	payments      []*types.Payment
-	favorites     []*types.Favorite
+	*state
+	actor  string
+	source string
+	call   *auditCall  // the audited call the service runs, nil outside of one
+	key    *pendingKey // the idempotency key of the request the service runs
+	once   sync.Once   // gives the zero value its state
+}
+
+type state struct {
+	mu                sync.Mutex
+	nextAccountID     int64 // to generate a unique account number
+	accounts          AccountRepository
+	payments          PaymentRepository
+	favorites         FavoriteRepository
+	clock             func() time.Time
+	idempotency       idempotencyTable
+	retention         time.Duration // of the idempotency keys
+	log               *writeAheadLog
+	rates             RateProvider // nil if there is no conversion
+	ledger            ledger
+	holds             holdTable
+	holdExpiry        time.Duration
+	holdRepository    HoldRepository    // nil keeps the holds in memory only
+	postingRepository PostingRepository // nil keeps the ledger in memory only
+	keyRepository     keyRepository     // nil keeps the idempotency keys in memory only
+	audit             *auditLog         // nil if there is no audit log
+	optionErr         error             // the first invalid option, NewService returns it
+
+	locksMu sync.Mutex
+	locks   map[int64]*sync.Mutex // per-account locks
+}
+
+// invalidOption makes NewService fail, the options can't return errors
+func (s *Service) invalidOption(format string, args ...interface{}) {
+	if s.optionErr == nil {
+		s.optionErr = fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidOption}, args...)...)
+	}
+}
+
+// Option configures a Service created by NewService.
+type Option func(s *Service)
+
+// WithClock replaces time.Now as the source of the timestamps
+func WithClock(clock func() time.Time) Option {
+	return func(s *Service) {
+		s.clock = clock
+	}
+}
+
+// NewService creates a service on top of the given storage,
+// e.g. NewMemoryStorage() or NewFileStorage(dir).
+func NewService(storage Storage, options ...Option) (*Service, error) {
+	s := &Service{state: newState(storage)}
+	for _, option := range options {
+		option(s)
+	}
+	if s.optionErr != nil {
+		return nil, s.optionErr
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// the restore is not a call of the service, the audit starts after it
+	audit := s.audit
+	s.audit = nil
+	if s.log != nil {
+		err := s.openLog()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if audit != nil {
+		err := audit.open()
+		if err != nil {
+			return nil, err
+		}
+		s.audit = audit
+	}
+
+	accounts, err := s.accounts.All()
+	if err != nil {
+		return nil, err
+	}
+	s.nextAccountID = 0
+	for _, account := range accounts {
+		if account.ID > s.nextAccountID {
+			s.nextAccountID = account.ID
+		}
+	}
+
+	return s, nil
+}
+
+// load fills the tables of the repositories that the storage may leave
+// out, keys past the retention are dropped
+func (s *Service) load() error {
+	if s.postingRepository != nil {
+		postings, err := s.postingRepository.All()
+		if err != nil {
+			return err
+		}
+		s.ledger.add(postings)
+	}
+	if s.keyRepository != nil {
+		entries, err := s.keyRepository.All()
+		if err != nil {
+			return err
+		}
+		deadline := s.now().Add(-s.retention)
+		kept := []*idempotencyEntry{}
+		for i := range entries {
+			if !entries[i].createdAt.Before(deadline) {
+				kept = append(kept, &entries[i])
+			}
+		}
+		s.idempotency.restore(kept)
+	}
+	if s.holdRepository != nil {
+		holds, err := s.holdRepository.All()
+		if err != nil {
+			return err
+		}
+		loaded := make([]*types.Hold, len(holds))
+		for i := range holds {
+			loaded[i] = &holds[i]
+		}
+		s.holds.add(loaded)
+	}
+	return nil
+}
+
+func newState(storage Storage) *state {
+	return &state{
+		accounts:          storage.Accounts,
+		payments:          storage.Payments,
+		favorites:         storage.Favorites,
+		holdRepository:    storage.Holds,
+		postingRepository: storage.Postings,
+		keyRepository:     storage.keys,
+		clock:             time.Now,
+		retention:         DefaultIdempotencyRetention,
+		holdExpiry:        DefaultHoldExpiry,
+	}
+}
+
+// ready gives the zero value a memory storage with the default options on
+// its first use
+func (s *Service) ready() {
+	s.once.Do(func() {
+		if s.state == nil {
+			s.state = newState(NewMemoryStorage())
+		}
+	})
+}
+
+// now returns the clock's time in UTC without the monotonic reading,
+// so that timestamps survive export and import unchanged
+func (s *Service) now() time.Time {
+	return s.clock().UTC().Round(0)
 }
 
 type Error string
@@ -35,200 +206,635 @@ func (e Error) Error() string {
 	return string(e)
 }
 
-func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
-	for _, account := range s.accounts {
-		if account.Phone == phone {
-			return nil, ErrPhoneRegistered // if there is such a phone, then just leave
-		}
+// lockAccount serializes balance changes of one account and returns the
+// unlock function
+func (s *Service) lockAccount(accountID int64) func() {
+	s.locksMu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[int64]*sync.Mutex)
 	}
-	s.nextAccountID++
-
-	account := &types.Account{
-		ID:      s.nextAccountID,
-		Phone:   phone,
-		Balance: 0,
+	lock, ok := s.locks[accountID]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[accountID] = lock
 	}
+	s.locksMu.Unlock()
 
-	s.accounts = append(s.accounts, account)
-	return account, nil
+	lock.Lock()
+	return lock.Unlock
 }
 
-func (s *Service) Deposit(accontID int64, amount types.Money) error {
-	if amount <= 0 {
-		return ErrAmountMustBePositive
+// lockAccounts locks two different accounts, always in the same order so
+// that opposite transfers can't deadlock
+func (s *Service) lockAccounts(first, second int64) func() {
+	if first > second {
+		first, second = second, first
+	}
+	unlockFirst := s.lockAccount(first)
+	unlockSecond := s.lockAccount(second)
+	return func() {
+		unlockSecond()
+		unlockFirst()
 	}
+}
 
-	var account *types.Account
+// lockAll locks the accounts in the order of their IDs, like lockAccounts,
+// an ID may be given more than once
+func (s *Service) lockAll(ids []int64) func() {
+	sorted := append([]int64(nil), ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
 
-	for _, acc := range s.accounts {
-		if acc.ID == accontID {
-			account = acc
-			break
+	unlocks := []func(){}
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
 		}
+		unlocks = append(unlocks, s.lockAccount(id))
 	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
 
-	if account == nil {
-		return ErrAccountNotFound
+// batch holds the records changed by one operation, the payment the
+// operation makes or returns is the last one in payments
+type batch struct {
+	accounts  []*types.Account
+	payments  []*types.Payment
+	favorites []*types.Favorite
+	keys      []*idempotencyEntry
+	postings  []types.Posting
+	holds     []*types.Hold
+}
+
+// save is the only place where changes reach the storage: with a log
+// they are written there first, as one entry, and only then applied
+func (s *Service) save(b batch) error {
+	err := s.call.saving(s.accounts, b)
+	if err != nil {
+		return err
+	}
+	b = s.key.attach(b)
+
+	if s.log == nil {
+		err = s.apply(b)
+		if err != nil {
+			return err
+		}
+		s.call.saved(b)
+		s.key.done()
+		return nil
 	}
 
-	account.Balance += amount
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	err = s.log.append(b)
+	if err != nil {
+		return err
+	}
+
+	err = s.apply(b)
+	if err != nil {
+		return err
+	}
+	s.call.saved(b)
+	s.key.done()
 
+	s.log.entries++
+	if s.log.snapshotEvery > 0 && s.log.entries >= s.log.snapshotEvery {
+		// the change is already durable in the log, so a failed snapshot
+		// doesn't fail the operation
+		err = s.snapshot()
+		if err != nil {
+			log.Println(err)
+		}
+	}
 	return nil
 }
 
-func (s *Service) Pay(accontID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
-	if amount <= 0 {
-		return nil, ErrAmountMustBePositive
+func (s *Service) apply(b batch) error {
+	for _, account := range b.accounts {
+		err := s.accounts.Save(account)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, payment := range b.payments {
+		err := s.payments.Save(payment)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, favorite := range b.favorites {
+		err := s.favorites.Save(favorite)
+		if err != nil {
+			return err
+		}
 	}
 
-	var account *types.Account
+	if s.postingRepository != nil && len(b.postings) > 0 {
+		err := s.postingRepository.Add(b.postings)
+		if err != nil {
+			return err
+		}
+	}
 
-	for _, acc := range s.accounts {
-		if acc.ID == accontID {
-			account = acc
-			break
+	if s.keyRepository != nil && len(b.keys) > 0 {
+		err := s.keyRepository.Save(b.keys, s.now().Add(-s.retention))
+		if err != nil {
+			return err
 		}
 	}
 
-	if account == nil {
-		return nil, ErrAccountNotFound
+	if s.holdRepository != nil {
+		for _, hold := range b.holds {
+			err := s.holdRepository.Save(hold)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	if account.Balance < amount {
+	if len(b.keys) > 0 {
+		s.idempotency.restore(b.keys)
+	}
+
+	if len(b.postings) > 0 {
+		s.ledger.add(b.postings)
+	}
+
+	if len(b.holds) > 0 {
+		s.holds.add(b.holds)
+	}
+	return nil
+}
+
+// RegisterAccount opens an account in types.DefaultCurrency
+func (s *Service) RegisterAccount(phone types.Phone) (*types.Account, error) {
+	s.ready()
+	return s.RegisterAccountInCurrency(phone, types.DefaultCurrency)
+}
+
+func (s *Service) Deposit(accontID int64, amount types.Money) error {
+	s.ready()
+	return s.audited("Deposit", auditParams("account", accontID, "amount", amount), func(s *Service) error {
+		s.call.account(accontID)
+
+		if amount <= 0 {
+			return ErrAmountMustBePositive
+		}
+
+		unlock := s.lockAccount(accontID)
+		defer unlock()
+
+		account, err := s.accounts.FindByID(accontID)
+		if err != nil {
+			return err
+		}
+
+		balance, err := account.Balance.Add(amount)
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		account.Balance = balance
+		account.UpdatedAt = now
+
+		return s.save(batch{
+			accounts: []*types.Account{account},
+			postings: s.entry(LedgerDeposit, "", FundingLedgerAccount, UserLedgerAccount(account.ID), amount, account.Currency, now),
+		})
+	})
+}
+
+// Pay pays the amount in the currency of the account
+func (s *Service) Pay(accontID int64, amount types.Money, category types.PaymentCategory) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("Pay", auditParams("account", accontID, "amount", amount, "category", category), func(s *Service) (*types.Payment, error) {
+		s.call.account(accontID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
+
+		unlock := s.lockAccount(accontID)
+		defer unlock()
+
+		account, err := s.accounts.FindByID(accontID)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.pay(account, amount, category, nil, nil)
+	})
+}
+
+// pay must be called with the account locked, the amount is in the currency
+// of the account and original is set if it was converted. hold is set if the
+// payment captures it, its money is available to the payment and it is saved
+// together with it.
+func (s *Service) pay(account *types.Account, amount types.Money, category types.PaymentCategory, original *conversion,
+	hold *types.Hold) (*types.Payment, error) {
+	captured := ""
+	if hold != nil {
+		captured = hold.ID
+	}
+	available, err := s.available(account, captured)
+	if err != nil {
+		return nil, err
+	}
+	if available < amount {
 		return nil, ErrNotEnoughBalance
 	}
+	balance, err := account.Balance.Sub(amount)
+	if err != nil {
+		return nil, err
+	}
 
-	account.Balance -= amount
+	now := s.now()
+	account.Balance = balance
+	account.UpdatedAt = now
 
 	paymentID := uuid.New().String()
 
 	payment := &types.Payment{
 		ID:        paymentID,
-		AccountID: accontID,
+		AccountID: account.ID,
 		Amount:    amount,
 		Category:  category,
 		Status:    types.PaymentStatusInProgress,
+		Currency:  account.Currency,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if original != nil {
+		payment.OriginalAmount = original.amount
+		payment.OriginalCurrency = original.currency
+		payment.Rate = original.rate.String()
 	}
 
-	s.payments = append(s.payments, payment)
+	b := batch{
+		accounts: []*types.Account{account},
+		payments: []*types.Payment{payment},
+		postings: s.entry(LedgerPayment, paymentID, UserLedgerAccount(account.ID), MerchantLedgerAccount(category), amount,
+			account.Currency, now),
+	}
+	if hold != nil {
+		hold.PaymentID = paymentID
+		hold.UpdatedAt = now
+		b.holds = []*types.Hold{hold}
+	}
+	err = s.save(b)
+	if err != nil {
+		return nil, err
+	}
 
 	return payment, nil
 }
 
-func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
-	var account *types.Account
+// moves money from one account to another, the transfer is recorded
+// as a payment that shows up in the history of both accounts.
+// Both accounts must be in the same currency.
+func (s *Service) Transfer(fromID int64, toID int64, amount types.Money) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("Transfer", auditParams("from", fromID, "to", toID, "amount", amount), func(s *Service) (*types.Payment, error) {
+		s.call.account(fromID)
+		s.call.account(toID)
+
+		if amount <= 0 {
+			return nil, ErrAmountMustBePositive
+		}
 
-	for _, acc := range s.accounts {
-		if acc.ID == accountID {
-			account = acc
-			break
+		if fromID == toID {
+			return nil, ErrTransferToSameAccount
 		}
-	}
 
-	if account == nil {
-		return nil, ErrAccountNotFound
-	}
+		unlock := s.lockAccounts(fromID, toID)
+		defer unlock()
+
+		from, err := s.accounts.FindByID(fromID)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := s.accounts.FindByID(toID)
+		if err != nil {
+			return nil, err
+		}
+
+		if currencyOrDefault(from.Currency) != currencyOrDefault(to.Currency) {
+			return nil, ErrCurrencyMismatch
+		}
 
-	return account, nil
+		available, err := s.available(from, "")
+		if err != nil {
+			return nil, err
+		}
+		if available < amount {
+			return nil, ErrNotEnoughBalance
+		}
+		fromBalance, err := from.Balance.Sub(amount)
+		if err != nil {
+			return nil, err
+		}
+		toBalance, err := to.Balance.Add(amount)
+		if err != nil {
+			return nil, err
+		}
+
+		now := s.now()
+		from.Balance = fromBalance
+		from.UpdatedAt = now
+		to.Balance = toBalance
+		to.UpdatedAt = now
+
+		payment := &types.Payment{
+			ID:          uuid.New().String(),
+			AccountID:   fromID,
+			Amount:      amount,
+			Category:    types.PaymentCategoryTransfer,
+			Status:      types.PaymentStatusInProgress,
+			Currency:    from.Currency,
+			ToAccountID: toID,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+
+		err = s.save(batch{
+			accounts: []*types.Account{from, to},
+			payments: []*types.Payment{payment},
+			postings: s.entry(LedgerTransfer, payment.ID, UserLedgerAccount(fromID), UserLedgerAccount(toID), amount, from.Currency, now),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return payment, nil
+	})
+}
+
+func (s *Service) FindAccountByID(accountID int64) (*types.Account, error) {
+	s.ready()
+	return s.accounts.FindByID(accountID)
 }
 
 func (s *Service) FindPaymentByID(paymentID string) (*types.Payment, error) {
+	s.ready()
+	return s.payments.FindByID(paymentID)
+}
 
-	for _, payment := range s.payments {
-		if paymentID == payment.ID {
-			return payment, nil
+func (s *Service) Reject(paymentID string) error {
+	s.ready()
+	return s.audited("Reject", auditParams("payment", paymentID), func(s *Service) error {
+		s.call.payment(paymentID)
+
+		targetPayment, err := s.FindPaymentByID(paymentID)
+		if err != nil {
+			return err
 		}
-	}
-	return nil, ErrPaymentNotFound
+
+		if targetPayment.ToAccountID != 0 {
+			return s.rejectTransfer(targetPayment)
+		}
+
+		unlock := s.lockAccount(targetPayment.AccountID)
+		defer unlock()
+
+		// re-read under the lock, the payment could have changed meanwhile
+		targetPayment, err = s.FindPaymentByID(paymentID)
+		if err != nil {
+			return err
+		}
+
+		err = checkTransition(targetPayment, types.PaymentStatusFail)
+		if err != nil {
+			return err
+		}
+
+		targetAccount, err := s.FindAccountByID(targetPayment.AccountID)
+		if err != nil {
+			return err
+		}
+		// the partial refunds are back already
+		rest := targetPayment.Amount - targetPayment.Refunded
+		balance, err := targetAccount.Balance.Add(rest)
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		targetPayment.Status = types.PaymentStatusFail
+		targetPayment.UpdatedAt = now
+		targetAccount.Balance = balance
+		targetAccount.UpdatedAt = now
+
+		var postings []types.Posting
+		if rest > 0 {
+			postings = s.entry(LedgerReject, targetPayment.ID, MerchantLedgerAccount(targetPayment.Category),
+				UserLedgerAccount(targetAccount.ID), rest, targetAccount.Currency, now)
+		}
+		return s.save(batch{
+			accounts: []*types.Account{targetAccount},
+			payments: []*types.Payment{targetPayment},
+			postings: postings,
+		})
+	})
 }
 
-func (s *Service) Reject(paymentID string) error {
-	targetPayment, err := s.FindPaymentByID(paymentID)
+// takes the money back from the recipient, the recipient must still have it
+func (s *Service) rejectTransfer(transfer *types.Payment) error {
+	unlock := s.lockAccounts(transfer.AccountID, transfer.ToAccountID)
+	defer unlock()
+
+	transfer, err := s.FindPaymentByID(transfer.ID)
 	if err != nil {
 		return err
 	}
 
-	targetAccount, err := s.FindAccountByID(targetPayment.AccountID)
+	err = checkTransition(transfer, types.PaymentStatusFail)
 	if err != nil {
 		return err
 	}
-	targetPayment.Status = types.PaymentStatusFail
-	targetAccount.Balance += targetPayment.Amount
 
-	return nil
-}
-
-func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
-
-	existingPayment, err := s.FindPaymentByID(paymentID)
+	from, err := s.FindAccountByID(transfer.AccountID)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// account, err := s.FindAccountByID(existingPayment.AccountID)
-	// if err != nil{
-	// 	return nil, err
-	// }
+	to, err := s.FindAccountByID(transfer.ToAccountID)
+	if err != nil {
+		return err
+	}
 
-	repeatedPayment, err := s.Pay(existingPayment.AccountID, existingPayment.Amount, existingPayment.Category)
+	available, err := s.available(to, "")
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if available < transfer.Amount {
+		return ErrNotEnoughBalance
 	}
+	toBalance, err := to.Balance.Sub(transfer.Amount)
+	if err != nil {
+		return err
+	}
+	fromBalance, err := from.Balance.Add(transfer.Amount)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	transfer.Status = types.PaymentStatusFail
+	transfer.UpdatedAt = now
+	to.Balance = toBalance
+	to.UpdatedAt = now
+	from.Balance = fromBalance
+	from.UpdatedAt = now
+
+	return s.save(batch{
+		accounts: []*types.Account{to, from},
+		payments: []*types.Payment{transfer},
+		postings: s.entry(LedgerReject, transfer.ID, UserLedgerAccount(to.ID), UserLedgerAccount(from.ID), transfer.Amount,
+			from.Currency, now),
+	})
+}
+
+func (s *Service) Repeat(paymentID string) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("Repeat", auditParams("payment", paymentID), func(s *Service) (*types.Payment, error) {
+		s.call.payment(paymentID)
+
+		existingPayment, err := s.FindPaymentByID(paymentID)
+		if err != nil {
+			return nil, err
+		}
+
+		if existingPayment.RefundOf != "" {
+			return nil, ErrRefundPayment
+		}
+
+		if existingPayment.ToAccountID != 0 {
+			return s.Transfer(existingPayment.AccountID, existingPayment.ToAccountID, existingPayment.Amount)
+		}
 
-	return repeatedPayment, nil
+		// a converted payment is converted again at the current rate
+		if existingPayment.OriginalCurrency != "" {
+			return s.PayConverted(existingPayment.AccountID, existingPayment.OriginalAmount, existingPayment.OriginalCurrency,
+				existingPayment.Category, DefaultRounding)
+		}
+
+		repeatedPayment, err := s.PayIn(existingPayment.AccountID, existingPayment.Amount, existingPayment.Currency, existingPayment.Category)
+		if err != nil {
+			return nil, err
+		}
+
+		return repeatedPayment, nil
+	})
 }
 
 // creates favorites from a specific payment
-func (s *Service) FavoritePayment(paymentID string, name string) (*types.Favorite, error) {
-	//var favorite *types.Favorite
+func (s *Service) FavoritePayment(paymentID string, name string) (favorite *types.Favorite, err error) {
+	s.ready()
+	err = s.audited("FavoritePayment", auditParams("payment", paymentID, "name", name), func(s *Service) error {
+		s.call.payment(paymentID)
+		favorite, err = s.favoritePayment(paymentID, name)
+		return err
+	})
+	return favorite, err
+}
 
+func (s *Service) favoritePayment(paymentID string, name string) (*types.Favorite, error) {
 	payment, err := s.FindPaymentByID(paymentID)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if payment.RefundOf != "" {
+		return nil, ErrRefundPayment
+	}
+
+	// the favorite of a converted payment keeps the original amount
+	if payment.OriginalCurrency != "" {
+		payment.Amount, payment.Currency = payment.OriginalAmount, payment.OriginalCurrency
+	}
+
 	id := uuid.New().String()
+	now := s.now()
 	favorite := &types.Favorite{
 		ID:        id,
 		AccountID: payment.AccountID,
 		Name:      name,
 		Amount:    payment.Amount,
 		Category:  payment.Category,
+		Currency:  payment.Currency,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = s.save(batch{favorites: []*types.Favorite{favorite}})
+	if err != nil {
+		return nil, err
+	}
+
+	return favorite, nil
+}
+
+func (s *Service) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
+	s.ready()
+	return s.favorites.FindByID(favoriteID)
+}
+
+// FindFavoritesByAccountID returns the favorites of the account in the order they were added
+func (s *Service) FindFavoritesByAccountID(accountID int64) ([]types.Favorite, error) {
+	s.ready()
+	_, err := s.FindAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	favorites, err := s.favorites.All()
+	if err != nil {
+		return nil, err
 	}
-	s.favorites = append(s.favorites, favorite)
-
-	return favorite, nil
-}
 
-func (s *Service) FindFavoriteByID(favoriteID string) (*types.Favorite, error) {
-	for _, favorite := range s.favorites {
-		if favoriteID == favorite.ID {
-			return favorite, nil
+	found := []types.Favorite{}
+	for _, favorite := range favorites {
+		if favorite.AccountID == accountID {
+			found = append(found, favorite)
 		}
 	}
-	return nil, ErrFavoriteNotFound
+	return found, nil
 }
 
-// makes a payment from a specific favorite
+// makes a payment from a specific favorite, a favorite in another currency
+// than the account's is converted like in PayConverted with DefaultRounding
 func (s *Service) PayFromFavorite(favoriteID string) (*types.Payment, error) {
+	s.ready()
+	return s.auditedPayment("PayFromFavorite", auditParams("favorite", favoriteID), func(s *Service) (*types.Payment, error) {
+		s.call.favorite(favoriteID)
 
-	favorite, err := s.FindFavoriteByID(favoriteID)
+		favorite, err := s.FindFavoriteByID(favoriteID)
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	payment, err := s.Pay(favorite.AccountID, favorite.Amount, favorite.Category)
+		payment, err := s.PayConverted(favorite.AccountID, favorite.Amount, currencyOrDefault(favorite.Currency), favorite.Category, DefaultRounding)
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	return payment, nil
+		return payment, nil
+	})
 }
 
 func (s *Service) ExportToFile(path string) error {
+	s.ready()
 
 	file, err := os.Create(path)
 	if err != nil {
@@ -237,17 +843,29 @@ func (s *Service) ExportToFile(path string) error {
 	}
 	defer closeFile(file)
 
-	content := make([]byte, 0)
+	accounts, err := s.accounts.All()
+	if err != nil {
+		log.Println(err)
+		return err
+	}
 
-	for _, accInfo := range s.accounts {
-		accString := fmt.Sprintf("%v;%v;%v", accInfo.ID, accInfo.Phone, accInfo.Balance)
-		if len(content) > 0 {
-			content = append(content, []byte("|")...)
+	writer := bufio.NewWriter(file)
+	for i, accInfo := range accounts {
+		if i > 0 {
+			_, err = writer.WriteString("|")
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+		}
+		_, err = fmt.Fprintf(writer, "%v;%v;%v;%v", accInfo.ID, accInfo.Phone, accInfo.Balance, currencyOrDefault(accInfo.Currency))
+		if err != nil {
+			log.Println(err)
+			return err
 		}
-		content = append(content, []byte(accString)...)
 	}
 
-	_, err = file.Write(content)
+	err = writer.Flush()
 	if err != nil {
 		log.Println(err)
 		return err
@@ -264,60 +882,75 @@ func closeFile(file *os.File) {
 
 }
 
+// ImportFromFile reads the accounts one by one, the file is never held in memory
 func (s *Service) ImportFromFile(path string) error {
-	file, err := os.Open(path)
-	if err != nil {
-		log.Println(err)
-		return err
-	}
-
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Println(err)
-		}
-	}()
-
-	content := make([]byte, 0)
-	buf := make([]byte, 4)
-	for {
-		read, err := file.Read(buf)
-		if err == io.EOF {
-			content = append(content, buf[:read]...)
-			break
-		}
-
+	s.ready()
+	return s.audited("ImportFromFile", auditParams("path", path), func(s *Service) error {
+		file, err := os.Open(path)
 		if err != nil {
 			log.Println(err)
 			return err
 		}
-		content = append(content, buf[:read]...)
-	}
-	data := string(content)
 
-	for _, v := range strings.Split(data, "|") {
-		accS := strings.Split(v, ";")
-		id, err := strconv.ParseInt(accS[0], 10, 64)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		phone := accS[1]
-		balance, err := strconv.ParseInt(accS[2], 10, 64)
-		if err != nil {
-			log.Println(err)
-			return err
-		}
-		account := types.Account{
-			ID:      id,
-			Phone:   types.Phone(phone),
-			Balance: types.Money(balance),
+		defer func() {
+			if err = file.Close(); err != nil {
+				log.Println(err)
+			}
+		}()
+
+		reader := bufio.NewReader(file)
+		for {
+			v, err := reader.ReadString('|')
+			if err != nil && err != io.EOF {
+				log.Println(err)
+				return err
+			}
+			eof := err == io.EOF
+			v = strings.TrimSuffix(v, "|")
+
+			accS := strings.Split(v, ";")
+			if len(accS) < 3 {
+				err = fmt.Errorf("%v: bad account %q", path, v)
+				log.Println(err)
+				return err
+			}
+			id, err := strconv.ParseInt(accS[0], 10, 64)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+			phone := accS[1]
+			balance, err := strconv.ParseInt(accS[2], 10, 64)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+			// the file has no schema, accounts written before currencies have none
+			currency := types.DefaultCurrency
+			if len(accS) > 3 {
+				currency = currencyOrDefault(types.Currency(accS[3]))
+			}
+			account := types.Account{
+				ID:       id,
+				Phone:    types.Phone(phone),
+				Balance:  types.Money(balance),
+				Currency: currency,
+			}
+			err = s.importAccount(account)
+			if err != nil {
+				log.Println(err)
+				return err
+			}
+
+			if eof {
+				return nil
+			}
 		}
-		s.accounts = append(s.accounts, &account)
-	}
-	return nil
+	})
 }
 
 func (s *Service) Export(dir string) error {
+	s.ready()
 
 	err := s.ExportAccounts(dir)
 	if err != nil {
@@ -333,252 +966,256 @@ func (s *Service) Export(dir string) error {
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s *Service) ExportAccounts(dir string) error {
-
-	if len(s.accounts) == 0 {
-		return nil
-	}
 
-	content := make([]byte, 0)
-	for _, v := range s.accounts {
-		accString := fmt.Sprintf("%v;%v;%v", v.ID, v.Phone, v.Balance)
-		if len(content) > 0 {
-			content = append(content, []byte("\n")...)
-		}
-		content = append(content, []byte(accString)...)
-	}
-	err := os.WriteFile(dir+"/accounts.dump", content, 0666)
+	err = s.ExportIdempotencyKeys(dir)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func (s *Service) ExportPayments(dir string) error {
 
-	if len(s.payments) == 0 {
-		return nil
+	err = s.ExportLedger(dir)
+	if err != nil {
+		return err
 	}
 
-	content := make([]byte, 0)
-	for _, v := range s.payments {
-		payString := fmt.Sprintf("%v;%v;%v;%v;%v", v.ID, v.AccountID, v.Amount, v.Category, v.Status)
-		if len(content) > 0 {
-			content = append(content, []byte("\n")...)
-		}
-		content = append(content, []byte(payString)...)
-	}
-	err := os.WriteFile(dir+"/payments.dump", content, 0666)
+	err = s.ExportHolds(dir)
 	if err != nil {
 		return err
 	}
-
 	return nil
 }
 
-func (s *Service) ExportFavorites(dir string) error {
-
-	if len(s.favorites) == 0 {
-		return nil
-	}
-
-	content := make([]byte, 0)
-	for _, v := range s.favorites {
-		favString := fmt.Sprintf("%v;%v;%v;%v;%v", v.ID, v.AccountID, v.Name, v.Amount, v.Category)
-		if len(content) > 0 {
-			content = append(content, []byte("\n")...)
-		}
-		content = append(content, []byte(favString)...)
-	}
-	err := os.WriteFile(dir+"/favorites.dump", content, 0666)
+func (s *Service) ExportAccounts(dir string) error {
+	s.ready()
+	accounts, err := s.accounts.All()
 	if err != nil {
 		return err
 	}
+	if len(accounts) == 0 {
+		return nil
+	}
 
-	return nil
+	return writeFileAtomicFunc(dir+"/accounts.dump", func(w io.Writer) error {
+		return writeAccounts(w, accounts)
+	})
 }
 
-func (s *Service) Import(dir string) error {
-	err := s.ImportAccounts(dir)
+// ExportAccountsTo writes the accounts in the accounts.dump format
+func (s *Service) ExportAccountsTo(w io.Writer) error {
+	s.ready()
+	accounts, err := s.accounts.All()
 	if err != nil {
 		return err
 	}
+	return writeAccounts(w, accounts)
+}
+
+func writeAccounts(w io.Writer, accounts []types.Account) error {
+	return writeDumpTo(w, len(accounts), func(i int) string {
+		return formatAccount(accounts[i])
+	})
+}
 
-	err = s.ImportPayments(dir)
+func (s *Service) ExportPayments(dir string) error {
+	s.ready()
+	payments, err := s.payments.All()
 	if err != nil {
 		return err
 	}
+	if len(payments) == 0 {
+		return nil
+	}
 
-	err = s.ImportFavorites(dir)
+	return writeFileAtomicFunc(dir+"/payments.dump", func(w io.Writer) error {
+		return writePayments(w, payments)
+	})
+}
+
+// ExportPaymentsTo writes the payments in the payments.dump format
+func (s *Service) ExportPaymentsTo(w io.Writer) error {
+	s.ready()
+	payments, err := s.payments.All()
 	if err != nil {
 		return err
 	}
-	return nil
-
+	return writePayments(w, payments)
 }
 
-func (s *Service) ImportAccounts(dir string) error {
+func writePayments(w io.Writer, payments []types.Payment) error {
+	return writeDumpTo(w, len(payments), func(i int) string {
+		return formatPayment(payments[i])
+	})
+}
 
-	content, err := os.ReadFile(dir + "/accounts.dump")
-	if os.IsNotExist(err) {
-		return nil
-	}
+func (s *Service) ExportFavorites(dir string) error {
+	s.ready()
+	favorites, err := s.favorites.All()
 	if err != nil {
 		return err
 	}
-
-	for _, v := range strings.Split(string(content), "\n") {
-		rec := strings.Split(v, ";")
-		id, err := strconv.ParseInt(rec[0], 10, 64)
-		if err != nil {
-			return err
-		}
-		phone := rec[1]
-		balance, err := strconv.ParseInt(rec[2], 10, 34)
-		if err != nil {
-			return err
-		}
-		acc, err := s.FindAccountByID(id)
-		if err != nil {
-			account := types.Account{
-				ID:      id,
-				Phone:   types.Phone(phone),
-				Balance: types.Money(balance),
-			}
-			s.accounts = append(s.accounts, &account)
-			s.nextAccountID++
-			continue
-		}
-		acc.Phone = types.Phone(phone)
-		acc.Balance = types.Money(balance)
-
+	if len(favorites) == 0 {
+		return nil
 	}
 
-	return nil
+	return writeFileAtomicFunc(dir+"/favorites.dump", func(w io.Writer) error {
+		return writeFavorites(w, favorites)
+	})
 }
 
-func (s *Service) ImportPayments(dir string) error {
-
-	content, err := os.ReadFile(dir + "/payments.dump")
-	if os.IsNotExist(err) {
-		return nil
-	}
+// ExportFavoritesTo writes the favorites in the favorites.dump format
+func (s *Service) ExportFavoritesTo(w io.Writer) error {
+	s.ready()
+	favorites, err := s.favorites.All()
 	if err != nil {
 		return err
 	}
+	return writeFavorites(w, favorites)
+}
 
-	for _, v := range strings.Split(string(content), "\n") {
-		rec := strings.Split(v, ";")
-		id := rec[0]
-
-		accid, err := strconv.ParseInt(rec[1], 10, 64)
-		if err != nil {
-			return err
-		}
+func writeFavorites(w io.Writer, favorites []types.Favorite) error {
+	return writeDumpTo(w, len(favorites), func(i int) string {
+		return formatFavorite(favorites[i])
+	})
+}
 
-		amount, err := strconv.ParseInt(rec[2], 10, 64)
-		if err != nil {
-			return err
-		}
+// Import is ImportWithPolicy with ConflictOverwrite: records with a known ID
+// replace the existing ones
+func (s *Service) Import(dir string) error {
+	s.ready()
+	_, err := s.ImportWithPolicy(dir, ConflictOverwrite)
+	return err
+}
 
-		category := rec[3]
-		status := rec[4]
+// ImportAccounts checks the file like Import does and imports nothing if there is a problem
+func (s *Service) ImportAccounts(dir string) error {
+	s.ready()
+	return s.audited("ImportAccounts", auditParams("dir", dir), func(s *Service) error {
+		return s.importChecked(dir, "accounts.dump", s.newImporter(ConflictOverwrite).accountsFrom)
+	})
+}
 
-		pay, err := s.FindPaymentByID(id)
-		if err != nil {
-			payment := types.Payment{
-				ID:        id,
-				AccountID: accid,
-				Amount:    types.Money(amount),
-				Category:  types.PaymentCategory(category),
-				Status:    types.PaymentStatus(status),
-			}
-			s.payments = append(s.payments, &payment)
-			continue
+// ImportAccountsFrom reads accounts in the accounts.dump format line by line.
+// The checksum is known only at the end, so the accounts read before a
+// corruption is found stay imported; ImportAccounts checks the file first.
+func (s *Service) ImportAccountsFrom(r io.Reader) error {
+	s.ready()
+	return s.audited("ImportAccountsFrom", nil, func(s *Service) error {
+		return s.newImporter(ConflictOverwrite).accountsFrom("accounts.dump", r)
+	})
+}
 
-		}
-		pay.AccountID = accid
-		pay.Amount = types.Money(amount)
-		pay.Category = types.PaymentCategory(category)
-		pay.Status = types.PaymentStatus(status)
+// importAccount saves an account read in any format over the existing one
+func (s *Service) importAccount(account types.Account) error {
+	return s.newImporter(ConflictOverwrite).account(account)
+}
 
-	}
+// ImportPayments checks the file like Import does and imports nothing if
+// there is a problem, the payments must refer to accounts of the service
+func (s *Service) ImportPayments(dir string) error {
+	s.ready()
+	return s.audited("ImportPayments", auditParams("dir", dir), func(s *Service) error {
+		return s.importChecked(dir, "payments.dump", s.newImporter(ConflictOverwrite).paymentsFrom)
+	})
+}
 
-	return nil
+// ImportPaymentsFrom reads payments in the payments.dump format line by line.
+// The checksum is known only at the end, so the payments read before a
+// corruption is found stay imported; ImportPayments checks the file first.
+func (s *Service) ImportPaymentsFrom(r io.Reader) error {
+	s.ready()
+	return s.audited("ImportPaymentsFrom", nil, func(s *Service) error {
+		return s.newImporter(ConflictOverwrite).paymentsFrom("payments.dump", r)
+	})
 }
 
+// ImportFavorites checks the file like Import does and imports nothing if
+// there is a problem, the favorites must refer to accounts of the service
 func (s *Service) ImportFavorites(dir string) error {
+	s.ready()
+	return s.audited("ImportFavorites", auditParams("dir", dir), func(s *Service) error {
+		return s.importChecked(dir, "favorites.dump", s.newImporter(ConflictOverwrite).favoritesFrom)
+	})
+}
 
-	content, err := os.ReadFile(dir + "/favorites.dump")
-	if os.IsNotExist(err) {
-		return nil
+// ImportFavoritesFrom reads favorites in the favorites.dump format line by line.
+// The checksum is known only at the end, so the favorites read before a
+// corruption is found stay imported; ImportFavorites checks the file first.
+func (s *Service) ImportFavoritesFrom(r io.Reader) error {
+	s.ready()
+	return s.audited("ImportFavoritesFrom", nil, func(s *Service) error {
+		return s.newImporter(ConflictOverwrite).favoritesFrom("favorites.dump", r)
+	})
+}
+
+func (s *Service) importChecked(dir string, file string, from func(name string, r io.Reader) error) error {
+	report, err := s.validateImport(dir, ConflictOverwrite, file)
+	if err != nil {
+		return err
 	}
+	err = report.Err()
 	if err != nil {
 		return err
 	}
+	return importDump(dir+"/"+file, from)
+}
 
-	for _, v := range strings.Split(string(content), "\n") {
-		rec := strings.Split(v, ";")
-		id := rec[0]
-		accid, err := strconv.ParseInt(rec[1], 10, 64)
-		if err != nil {
-			return err
-		}
-
-		name := rec[2]
-
-		amount, err := strconv.ParseInt(rec[3], 10, 64)
-		if err != nil {
-			return err
-		}
-
-		category := rec[4]
-
-		fav, err := s.FindFavoriteByID(id)
-		if err != nil {
-			favorite := types.Favorite{
-				ID:        id,
-				AccountID: accid,
-				Name:      name,
-				Amount:    types.Money(amount),
-				Category:  types.PaymentCategory(category),
-			}
-			s.favorites = append(s.favorites, &favorite)
-			continue
-		}
-		fav.AccountID = accid
-		fav.Amount = types.Money(amount)
-		fav.Name = name
-		fav.Category = types.PaymentCategory(category)
-
+// importDump imports a file that has been checked, a missing file has no records
+func importDump(path string, from func(name string, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
+	defer closeFile(file)
 
-	return nil
+	return from(path, file)
 }
 
 func (s *Service) ExportAccountHistory(accountID int64) ([]types.Payment, error) {
+	s.ready()
 
 	_, err := s.FindAccountByID(accountID)
 	if err != nil {
 		return nil, err
 	}
 
-	payments := []types.Payment{}
+	return s.payments.FindByAccountID(accountID)
+}
+
+// history of the account created in [from, to), oldest first
+func (s *Service) ExportAccountHistoryBetween(accountID int64, from time.Time, to time.Time) ([]types.Payment, error) {
+	s.ready()
+	payments, err := s.ExportAccountHistory(accountID)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, pay := range s.payments {
-		if accountID == pay.AccountID {
+	return PaymentsBetween(payments, from, to), nil
+}
 
-			payments = append(payments, *pay)
+// PaymentsBetween keeps the payments created in [from, to) and sorts them by
+// creation time, a zero from or to leaves that side of the range open
+func PaymentsBetween(payments []types.Payment, from time.Time, to time.Time) []types.Payment {
+	result := []types.Payment{}
+	for _, v := range payments {
+		if !from.IsZero() && v.CreatedAt.Before(from) {
+			continue
 		}
+		if !to.IsZero() && !v.CreatedAt.Before(to) {
+			continue
+		}
+		result = append(result, v)
 	}
 
-	return payments, nil
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
 }
 
 func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records int) error {
+	s.ready()
 
 	if len(payments) == 0 {
 		return nil
@@ -616,35 +1253,57 @@ func (s *Service) HistoryToFiles(payments []types.Payment, dir string, records i
 	return nil
 }
 
-func (s *Service) SumPayments(goroutines int) types.Money {
+// paymentsSnapshot returns all payments or nil if the storage fails,
+// for the aggregations that have no way to report an error
+func (s *Service) paymentsSnapshot() []types.Payment {
+	payments, err := s.payments.All()
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return payments
+}
+
+// SumPayments adds up the amounts of all payments by currency less their
+// refunds, it fails with types.ErrOverflow if a sum doesn't fit in types.Money
+func (s *Service) SumPayments(goroutines int) (Totals, error) {
+	s.ready()
 	if goroutines <= 1 {
 		return s.SumPaymentsRegular()
 	}
 
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
-	sum := types.Money(0)
+	sum := Totals{}
+	var sumErr error
+	data := s.paymentsSnapshot()
 
 	numElem := int(
 		math.Ceil(
-			float64(len(s.payments)) / float64(goroutines)))
+			float64(len(data)) / float64(goroutines)))
 
 	indexStart := 0
-	for i := 0; i < goroutines; i++ {
+	for i := 0; i < goroutines && indexStart < len(data); i++ {
 		wg.Add(1)
 
 		go func(index, num int) {
 			defer wg.Done()
-			tmpSum := types.Money(0)
-			for _, v := range s.payments[index:] {
-				if num == 0 {
+			tmpSum := Totals{}
+			var err error
+			for _, v := range data[index:] {
+				if num == 0 || err != nil {
 					break
 				}
 				num--
-				tmpSum += v.Amount
+				err = tmpSum.add(v.Currency, paidAmount(v))
 			}
 			mu.Lock()
-			sum += tmpSum
+			if err == nil {
+				err = sum.merge(tmpSum)
+			}
+			if sumErr == nil {
+				sumErr = err
+			}
 			mu.Unlock()
 
 		}(indexStart, numElem)
@@ -653,92 +1312,49 @@ func (s *Service) SumPayments(goroutines int) types.Money {
 	}
 
 	wg.Wait()
-	return sum
+	if sumErr != nil {
+		return nil, sumErr
+	}
+	return sum, nil
 }
 
-func (s *Service) SumPaymentsRegular() types.Money {
-	sum := types.Money(0)
+func (s *Service) SumPaymentsRegular() (Totals, error) {
+	s.ready()
+	sum := Totals{}
 
-	for _, v := range s.payments {
-		sum += v.Amount
+	for _, v := range s.paymentsSnapshot() {
+		err := sum.add(v.Currency, paidAmount(v))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return sum
+	return sum, nil
 }
 
+// FilterPayments returns the payments of the account. The payments are
+// indexed by account, so goroutines are no longer needed and the argument
+// is kept for compatibility.
 func (s *Service) FilterPayments(accountID int64, goroutines int) ([]types.Payment, error) {
-	if goroutines <= 1 {
-		return s.FilterPaymentsRegular(accountID)
-	}
-
-	acc, err := s.FindAccountByID(accountID)
-	if err != nil {
-		return nil, err
-	}
-
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	payments := []types.Payment{}
-	numElem := int(math.Ceil(float64(len(s.payments)) / float64(goroutines)))
-
-	indexStart := 0
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-
-		go func(index, num int) {
-			defer wg.Done()
-			tmpPays := []types.Payment{}
-			for _, v := range s.payments[index:] {
-				if num == 0 {
-					break
-				}
-				num--
-
-				if acc.ID == v.AccountID {
-					tmpPays = append(tmpPays, *v)
-				}
-			}
-
-			mu.Lock()
-			payments = append(payments, tmpPays...)
-			mu.Unlock()
-		}(indexStart, numElem)
-
-		indexStart += numElem
-	}
-
-	wg.Wait()
-
-	return payments, nil
+	s.ready()
+	return s.FilterPaymentsRegular(accountID)
 }
 
 func (s *Service) FilterPaymentsRegular(accountID int64) ([]types.Payment, error) {
+	s.ready()
 	acc, err := s.FindAccountByID(accountID)
 	if err != nil {
 		return nil, err
 	}
 
-	payments := []types.Payment{}
-
-	for _, v := range s.payments {
-		if acc.ID == v.AccountID {
-			payment := types.Payment{
-				ID:        v.ID,
-				AccountID: v.AccountID,
-				Category:  v.Category,
-				Amount:    v.Amount,
-				Status:    v.Status,
-			}
-			payments = append(payments, payment)
-		}
-	}
-	return payments, nil
+	return s.payments.FindByAccountID(acc.ID)
 }
 
 func (s *Service) FilterPaymentsByFn(
 	filter func(payment types.Payment) bool,
 	goroutines int,
 ) ([]types.Payment, error) {
+	s.ready()
 	if goroutines <= 1 {
 		return s.FilterPaymentsByFnRegular(filter)
 	}
@@ -746,22 +1362,23 @@ func (s *Service) FilterPaymentsByFn(
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
 	payments := []types.Payment{}
-	numElem := int(math.Ceil(float64(len(s.payments)) / float64(goroutines)))
+	data := s.paymentsSnapshot()
+	numElem := int(math.Ceil(float64(len(data)) / float64(goroutines)))
 
 	indexStart := 0
-	for i := 0; i < goroutines; i++ {
+	for i := 0; i < goroutines && indexStart < len(data); i++ {
 		wg.Add(1)
 		go func(index, num int) {
 			defer wg.Done()
 			tmpPays := []types.Payment{}
-			for _, v := range s.payments[index:] {
+			for _, v := range data[index:] {
 				if num == 0 {
 					break
 				}
 				num--
 
-				if filter(*v) {
-					tmpPays = append(tmpPays, *v)
+				if filter(v) {
+					tmpPays = append(tmpPays, v)
 				}
 			}
 			mu.Lock()
@@ -778,27 +1395,50 @@ func (s *Service) FilterPaymentsByFn(
 
 func (s *Service) FilterPaymentsByFnRegular(
 	filter func(payment types.Payment) bool) ([]types.Payment, error) {
+	s.ready()
 
 	payments := []types.Payment{}
-	for _, v := range s.payments {
-		if filter(*v) {
-			payments = append(payments, *v)
+	for _, v := range s.paymentsSnapshot() {
+		if filter(v) {
+			payments = append(payments, v)
 		}
 	}
 	return payments, nil
 }
 
+// FilterPaymentsByFnBetween is FilterPaymentsByFn for the payments
+// created in [from, to), oldest first
+func (s *Service) FilterPaymentsByFnBetween(
+	filter func(payment types.Payment) bool,
+	from time.Time,
+	to time.Time,
+	goroutines int,
+) ([]types.Payment, error) {
+	s.ready()
+	payments, err := s.FilterPaymentsByFn(filter, goroutines)
+	if err != nil {
+		return nil, err
+	}
+
+	return PaymentsBetween(payments, from, to), nil
+}
+
+// Progress is the sum of one part of the payments by currency, Err is
+// set instead if the sum overflows
 type Progress struct {
 	Part   int
-	Result types.Money
+	Result Totals
+	Err    error
 }
 
 func (s *Service) SumPaymentsWithProgress() <-chan Progress {
+	s.ready()
 	ch := make(chan Progress)
 	size := 100_000
+	data := s.paymentsSnapshot()
 	parts := int(
 		math.Ceil(
-			float64(len(s.payments)) / float64(size)))
+			float64(len(data)) / float64(size)))
 
 	wg := sync.WaitGroup{}
 	wg.Add(parts)
@@ -808,20 +1448,23 @@ func (s *Service) SumPaymentsWithProgress() <-chan Progress {
 		close(ch)
 	}(ch, &wg)
 
-	data := s.payments
 	for i := 0; i < parts; i++ {
-		go func(data []*types.Payment, part, size int) {
+		go func(data []types.Payment, part, size int) {
 			defer wg.Done()
-			tmpSum := types.Money(0)
+			tmpSum := Totals{}
+			var err error
 			for _, v := range data {
-				if size == 0 {
+				if size == 0 || err != nil {
 					break
 				}
 				size--
-				tmpSum += v.Amount
+				err = tmpSum.add(v.Currency, paidAmount(v))
+			}
+			if err != nil {
+				tmpSum = nil
 			}
 			mu.Lock()
-			ch <- Progress{part, tmpSum}
+			ch <- Progress{Part: part, Result: tmpSum, Err: err}
 			mu.Unlock()
 		}(data[i*size:], parts, size)
 
@@ -1,9 +1,14 @@
 package wallet
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Tursunkhuja/wallet/pkg/types"
 	"github.com/google/uuid"
@@ -23,6 +28,43 @@ func TestService_RegisterAccount(t *testing.T) {
 	}
 }
 
+func TestService_zeroValue(t *testing.T) {
+	s := &Service{}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(account.ID, 1000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s.As("cashier").Pay(account.ID, 300, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.Amount != 300 {
+		t.Errorf("FindPaymentByID(): amount expected:%v, actual:%v", 300, got.Amount)
+	}
+	account, err = s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if account.Balance != 700 {
+		t.Errorf("FindAccountByID(): balance expected:%v, actual:%v", 700, account.Balance)
+	}
+}
+
 func TestService_RegisterAccount_fail(t *testing.T) {
 	s, err := generateTestData(10)
 	if err != nil {
@@ -202,7 +244,11 @@ func TestService_Deposit(t *testing.T) {
 		return
 	}
 
-	accTest := s.accounts[0]
+	accTest, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 	err = s.Deposit(accTest.ID, 50_000)
 	if err != nil {
 		t.Error(err)
@@ -210,6 +256,82 @@ func TestService_Deposit(t *testing.T) {
 	}
 }
 
+func TestService_Deposit_overflow(t *testing.T) {
+	s := newTestService()
+	for _, phone := range []types.Phone{"+992000000001", "+992000000002"} {
+		_, err := s.RegisterAccount(phone)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	err := s.Deposit(1, math.MaxInt64)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(2, 1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Deposit(1, 1)
+	if err != types.ErrOverflow {
+		t.Errorf("Deposit(): must return types.ErrOverflow, returned = %v", err)
+	}
+	_, err = s.Transfer(2, 1, 1)
+	if err != types.ErrOverflow {
+		t.Errorf("Transfer(): must return types.ErrOverflow, returned = %v", err)
+	}
+	for id, balance := range map[int64]types.Money{1: math.MaxInt64, 2: 1} {
+		account, _ := s.FindAccountByID(id)
+		if account.Balance != balance {
+			t.Errorf("balance of account %v expected:%v, actual:%v", id, balance, account.Balance)
+		}
+	}
+}
+
+func TestService_SumPayments_overflow(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(1, math.MaxInt64)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, amount := range []types.Money{math.MaxInt64 - 1, 1} {
+		payment, err := s.Pay(1, amount, "auto")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = s.Reject(payment.ID)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	_, err = s.Pay(1, 1, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = s.SumPaymentsRegular()
+	if !errors.Is(err, types.ErrOverflow) {
+		t.Errorf("SumPaymentsRegular(): must return types.ErrOverflow, returned = %v", err)
+	}
+	_, err = s.SumPayments(2)
+	if !errors.Is(err, types.ErrOverflow) {
+		t.Errorf("SumPayments(): must return types.ErrOverflow, returned = %v", err)
+	}
+}
+
 func TestService_Pay(t *testing.T) {
 	s, err := generateTestData(10)
 	if err != nil {
@@ -217,7 +339,11 @@ func TestService_Pay(t *testing.T) {
 		return
 	}
 
-	accTest := s.accounts[0]
+	accTest, err := s.FindAccountByID(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 	_, err = s.Pay(accTest.ID, 5_000, "Sport")
 	if err != nil {
 		t.Error(err)
@@ -253,6 +379,50 @@ func TestService_FindFavoriteByID_fail(t *testing.T) {
 	}
 }
 
+func TestService_FindFavoritesByAccountID(t *testing.T) {
+	s := newTestService()
+
+	account, payments, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	favorite, err := s.FavoritePayment(payments[0].ID, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.FindFavoritesByAccountID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 1 || got[0].ID != favorite.ID {
+		t.Errorf("FindFavoritesByAccountID(): got %v, want %v", got, favorite)
+	}
+
+	got, err = s.FindFavoritesByAccountID(other.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 0 {
+		t.Errorf("FindFavoritesByAccountID(): favorites of another account %v", got)
+	}
+
+	_, err = s.FindFavoritesByAccountID(100)
+	if err != ErrAccountNotFound {
+		t.Errorf("FindFavoritesByAccountID(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
 func TestService_FavoritePayment_success(t *testing.T) {
 	s := newTestService()
 
@@ -343,7 +513,11 @@ type testService struct {
 }
 
 func newTestService() *testService {
-	return &testService{Service: &Service{}}
+	s, err := NewService(NewMemoryStorage())
+	if err != nil {
+		panic(err)
+	}
+	return &testService{Service: s}
 }
 
 type testAccount struct {
@@ -395,9 +569,14 @@ func TestService_SumPayments(t *testing.T) {
 		return
 	}
 
-	sum := s.SumPayments(5)
-	if sum != types.Money(len(s.payments)) {
-		t.Errorf("sum expected:%v, actual:%v", len(s.payments), sum)
+	sum, err := s.SumPayments(5)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := Totals{types.DefaultCurrency: types.Money(len(s.paymentsSnapshot()))}
+	if !reflect.DeepEqual(sum, expected) {
+		t.Errorf("sum expected:%v, actual:%v", expected, sum)
 	}
 
 }
@@ -408,9 +587,14 @@ func TestService_SumPaymentsRegular(t *testing.T) {
 		return
 	}
 
-	sum := s.SumPaymentsRegular()
-	if sum != types.Money(len(s.payments)) {
-		t.Errorf("sum expected:%v, actual:%v", len(s.payments), sum)
+	sum, err := s.SumPaymentsRegular()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := Totals{types.DefaultCurrency: types.Money(len(s.paymentsSnapshot()))}
+	if !reflect.DeepEqual(sum, expected) {
+		t.Errorf("sum expected:%v, actual:%v", expected, sum)
 	}
 }
 
@@ -423,10 +607,13 @@ func BenchmarkService_SumPayments(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		sum := s.SumPayments(5)
+		sum, err := s.SumPayments(5)
 		b.StopTimer()
-		if sum != types.Money(len(s.payments)) {
-			b.Errorf("sum expected:%v, actual:%v", len(s.payments), sum)
+		if err != nil {
+			b.Error(err)
+		}
+		if sum[types.DefaultCurrency] != types.Money(len(s.paymentsSnapshot())) {
+			b.Errorf("sum expected:%v, actual:%v", len(s.paymentsSnapshot()), sum)
 		}
 		b.StartTimer()
 	}
@@ -443,10 +630,13 @@ func BenchmarkService_SumPaymentsRegular(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		sum := s.SumPaymentsRegular()
+		sum, err := s.SumPaymentsRegular()
 		b.StopTimer()
-		if sum != types.Money(len(s.payments)) {
-			b.Errorf("sum expected:%v, actual:%v", len(s.payments), sum)
+		if err != nil {
+			b.Error(err)
+		}
+		if sum[types.DefaultCurrency] != types.Money(len(s.paymentsSnapshot())) {
+			b.Errorf("sum expected:%v, actual:%v", len(s.paymentsSnapshot()), sum)
 		}
 		b.StartTimer()
 	}
@@ -454,7 +644,10 @@ func BenchmarkService_SumPaymentsRegular(b *testing.B) {
 }
 
 func generateTestData(num int) (*Service, error) {
-	s := &Service{}
+	s, err := NewService(NewMemoryStorage())
+	if err != nil {
+		return nil, err
+	}
 
 	acc, err := s.RegisterAccount("+992-92-833-37-83")
 	if err != nil {
@@ -490,7 +683,7 @@ func TestService_Export(t *testing.T) {
 		return
 	}
 
-	err = s.Export(".")
+	err = s.Export(t.TempDir())
 	if err != nil {
 		t.Error(err)
 		return
@@ -504,28 +697,39 @@ func TestService_Import(t *testing.T) {
 		return
 	}
 
-	err = s1.Export(".")
+	dir := t.TempDir()
+	err = s1.Export(dir)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	s2 := &Service{}
-	err = s2.Import(".")
+	s2, err := NewService(NewMemoryStorage())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.Import(dir)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if !reflect.DeepEqual(s1.accounts, s2.accounts) {
+	accounts1, _ := s1.accounts.All()
+	accounts2, _ := s2.accounts.All()
+	if !reflect.DeepEqual(accounts1, accounts2) {
 		t.Error("s1.accounts and s2.accounts must equals")
 	}
 
-	if !reflect.DeepEqual(s1.payments, s2.payments) {
+	payments1, _ := s1.payments.All()
+	payments2, _ := s2.payments.All()
+	if !reflect.DeepEqual(payments1, payments2) {
 		t.Error("s1.payments and s2.payments must equals")
 	}
 
-	if !reflect.DeepEqual(s1.favorites, s2.favorites) {
+	favorites1, _ := s1.favorites.All()
+	favorites2, _ := s2.favorites.All()
+	if !reflect.DeepEqual(favorites1, favorites2) {
 		t.Error("s1.favorites and s2.favorites must equals")
 	}
 }
@@ -543,10 +747,539 @@ func TestService_HistoryToFiles(t *testing.T) {
 		return
 	}
 
-	err = s.HistoryToFiles(pays, ".", 10)
+	err = s.HistoryToFiles(pays, t.TempDir(), 10)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+}
+
+func TestService_Pay_concurrent(t *testing.T) {
+	s := newTestService()
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Deposit(account.ID, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+	succeeded := 0
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Pay(account.ID, 1, "auto")
+			if err == ErrNotEnoughBalance {
+				return
+			}
+			if err != nil {
+				t.Errorf("Pay(): error = %v", err)
+				return
+			}
+			mu.Lock()
+			succeeded++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != 100 {
+		t.Errorf("Pay(): succeeded expected:%v, actual:%v", 100, succeeded)
+	}
+
+	got, err := s.FindAccountByID(account.ID)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	if got.Balance != 0 {
+		t.Errorf("Pay(): balance expected:%v, actual:%v", 0, got.Balance)
+	}
+}
+
+func TestService_concurrent_moneyConserved(t *testing.T) {
+	s := newTestService()
 
+	const accounts = 5
+	const workers = 20
+	const operations = 100
+
+	ids := make([]int64, accounts)
+	for i := range ids {
+		account, err := s.RegisterAccount(types.Phone(fmt.Sprintf("+99200000000%v", i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ids[i] = account.ID
+	}
+
+	deposited := types.Money(0)
+	depositedMu := sync.Mutex{}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < operations; i++ {
+				accountID := ids[(w+i)%accounts]
+				switch i % 5 {
+				case 0:
+					err := s.Deposit(accountID, 10)
+					if err != nil {
+						t.Errorf("Deposit(): error = %v", err)
+						return
+					}
+					depositedMu.Lock()
+					deposited += 10
+					depositedMu.Unlock()
+				case 1, 2:
+					payment, err := s.Pay(accountID, 7, "auto")
+					if err == ErrNotEnoughBalance {
+						continue
+					}
+					if err != nil {
+						t.Errorf("Pay(): error = %v", err)
+						return
+					}
+					if i%2 == 0 {
+						err = s.Reject(payment.ID)
+						if err != nil {
+							t.Errorf("Reject(): error = %v", err)
+							return
+						}
+					}
+				case 3:
+					_, _ = s.SumPayments(3)
+					_, err := s.FilterPayments(accountID, 3)
+					if err != nil {
+						t.Errorf("FilterPayments(): error = %v", err)
+						return
+					}
+				case 4:
+					_, err := s.ExportAccountHistory(accountID)
+					if err != nil {
+						t.Errorf("ExportAccountHistory(): error = %v", err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := types.Money(0)
+	for _, id := range ids {
+		account, err := s.FindAccountByID(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if account.Balance < 0 {
+			t.Errorf("balance must not be negative, account = %v", account)
+		}
+		total += account.Balance
+	}
+
+	paid, err := s.FilterPaymentsByFn(func(payment types.Payment) bool {
+		return payment.Status != types.PaymentStatusFail
+	}, 4)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, payment := range paid {
+		total += payment.Amount
+	}
+
+	if total != deposited {
+		t.Errorf("money is not conserved, expected:%v, actual:%v", deposited, total)
+	}
+}
+
+func TestService_Transfer_success(t *testing.T) {
+	s := newTestService()
+
+	from, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	to, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	transfer, err := s.Transfer(from.ID, to.ID, 1_000_00)
+	if err != nil {
+		t.Errorf("Transfer(): error = %v", err)
+		return
+	}
+
+	gotFrom, err := s.FindAccountByID(from.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotFrom.Balance != 8_000_00 {
+		t.Errorf("Transfer(): sender balance expected:%v, actual:%v", 8_000_00, gotFrom.Balance)
+	}
+
+	gotTo, err := s.FindAccountByID(to.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotTo.Balance != 1_000_00 {
+		t.Errorf("Transfer(): recipient balance expected:%v, actual:%v", 1_000_00, gotTo.Balance)
+	}
+
+	for _, id := range []int64{from.ID, to.ID} {
+		history, err := s.ExportAccountHistory(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !reflect.DeepEqual(history[len(history)-1], *transfer) {
+			t.Errorf("Transfer(): transfer is not in the history of account %v", id)
+		}
+	}
+}
+
+func TestService_Transfer_fail(t *testing.T) {
+	s := newTestService()
+
+	from, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	to, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tests := []struct {
+		name   string
+		fromID int64
+		toID   int64
+		amount types.Money
+		err    error
+	}{
+		{"zero amount", from.ID, to.ID, 0, ErrAmountMustBePositive},
+		{"same account", from.ID, from.ID, 1, ErrTransferToSameAccount},
+		{"unknown sender", 100, to.ID, 1, ErrAccountNotFound},
+		{"unknown recipient", from.ID, 100, 1, ErrAccountNotFound},
+		{"not enough balance", to.ID, from.ID, 1, ErrNotEnoughBalance},
+	}
+	for _, tt := range tests {
+		_, err := s.Transfer(tt.fromID, tt.toID, tt.amount)
+		if err != tt.err {
+			t.Errorf("Transfer(): %v: err expected:%v, actual:%v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestService_Reject_transfer(t *testing.T) {
+	s := newTestService()
+
+	from, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	to, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	transfer, err := s.Transfer(from.ID, to.ID, 1_000_00)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Reject(transfer.ID)
+	if err != nil {
+		t.Errorf("Reject(): error = %v", err)
+		return
+	}
+
+	gotFrom, err := s.FindAccountByID(from.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotFrom.Balance != 9_000_00 {
+		t.Errorf("Reject(): sender balance expected:%v, actual:%v", 9_000_00, gotFrom.Balance)
+	}
+
+	gotTo, err := s.FindAccountByID(to.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gotTo.Balance != 0 {
+		t.Errorf("Reject(): recipient balance expected:%v, actual:%v", 0, gotTo.Balance)
+	}
+
+	saved, err := s.FindPaymentByID(transfer.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if saved.Status != types.PaymentStatusFail {
+		t.Errorf("Reject(): status didn't change, payment = %v", saved)
+	}
+}
+
+func TestService_Transfer_concurrent(t *testing.T) {
+	s := newTestService()
+
+	first, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, id := range []int64{first.ID, second.ID} {
+		err = s.Deposit(id, 1_000)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// opposite transfers must neither deadlock nor lose money
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _ = s.Transfer(first.ID, second.ID, 3)
+		}()
+		go func() {
+			defer wg.Done()
+			_, _ = s.Transfer(second.ID, first.ID, 5)
+		}()
+	}
+	wg.Wait()
+
+	total := types.Money(0)
+	for _, id := range []int64{first.ID, second.ID} {
+		account, err := s.FindAccountByID(id)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		total += account.Balance
+	}
+	if total != 2_000 {
+		t.Errorf("money is not conserved, expected:%v, actual:%v", 2_000, total)
+	}
+}
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestService_timestamps(t *testing.T) {
+	clock := newTestClock()
+	s, err := NewService(NewMemoryStorage(), WithClock(clock.Now))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	created := clock.Now()
+	if !account.CreatedAt.Equal(created) || !account.UpdatedAt.Equal(created) {
+		t.Errorf("RegisterAccount(): wrong timestamps, account = %v", account)
+	}
+
+	clock.Advance(time.Hour)
+	err = s.Deposit(account.ID, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	clock.Advance(time.Hour)
+	payment, err := s.Pay(account.ID, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	paid := clock.Now()
+
+	clock.Advance(time.Hour)
+	err = s.Reject(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rejected := clock.Now()
+
+	got, err := s.FindPaymentByID(payment.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !got.CreatedAt.Equal(paid) || !got.UpdatedAt.Equal(rejected) {
+		t.Errorf("Reject(): wrong timestamps, payment = %v", got)
+	}
+
+	gotAccount, err := s.FindAccountByID(account.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !gotAccount.CreatedAt.Equal(created) || !gotAccount.UpdatedAt.Equal(rejected) {
+		t.Errorf("Reject(): wrong timestamps, account = %v", gotAccount)
+	}
+}
+
+func TestService_ExportAccountHistoryBetween(t *testing.T) {
+	clock := newTestClock()
+	s, err := NewService(NewMemoryStorage(), WithClock(clock.Now))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Deposit(account.ID, 100)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	start := clock.Now()
+	payments := []*types.Payment{}
+	for i := 0; i < 5; i++ {
+		payment, err := s.Pay(account.ID, 1, "auto")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		payments = append(payments, payment)
+		clock.Advance(24 * time.Hour)
+	}
+
+	got, err := s.ExportAccountHistoryBetween(account.ID, start.Add(24*time.Hour), start.Add(3*24*time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want := []types.Payment{*payments[1], *payments[2]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExportAccountHistoryBetween(): got %v want %v", got, want)
+	}
+
+	got, err = s.ExportAccountHistoryBetween(account.ID, start.Add(3*24*time.Hour), time.Time{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	want = []types.Payment{*payments[3], *payments[4]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ExportAccountHistoryBetween(): got %v want %v", got, want)
+	}
+
+	_, err = s.ExportAccountHistoryBetween(100, time.Time{}, time.Time{})
+	if err != ErrAccountNotFound {
+		t.Errorf("ExportAccountHistoryBetween(): must return ErrAccountNotFound, returned = %v", err)
+	}
+}
+
+func TestPaymentsBetween_sorts(t *testing.T) {
+	base := time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC)
+	payments := []types.Payment{
+		{ID: "3", CreatedAt: base.Add(3 * time.Hour)},
+		{ID: "1", CreatedAt: base.Add(1 * time.Hour)},
+		{ID: "2", CreatedAt: base.Add(2 * time.Hour)},
+	}
+
+	got := PaymentsBetween(payments, time.Time{}, time.Time{})
+	for i, v := range got {
+		if v.ID != fmt.Sprint(i+1) {
+			t.Errorf("PaymentsBetween(): wrong order, got %v", got)
+			return
+		}
+	}
+}
+
+func TestService_Import_legacyDump(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(dir+"/accounts.dump", []byte("1;+992000000001;100"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = os.WriteFile(dir+"/payments.dump", []byte("p1;1;10;auto;INPROGRESS"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	err = s.Import(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := s.FindPaymentByID("p1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !got.CreatedAt.IsZero() || got.ToAccountID != 0 {
+		t.Errorf("Import(): legacy payment = %v", got)
+	}
 }
@@ -0,0 +1,336 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+func TestService_ExportTo_ImportFrom(t *testing.T) {
+	s1, err := NewService(NewMemoryStorage())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	accounts, payments, favorites := bytes.Buffer{}, bytes.Buffer{}, bytes.Buffer{}
+	err = s1.ExportAccountsTo(&accounts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.ExportPaymentsTo(&payments)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.ExportFavoritesTo(&favorites)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the readers may return any number of bytes at a time
+	s2 := newTestService()
+	err = s2.ImportAccountsFrom(iotest.OneByteReader(&accounts))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.ImportPaymentsFrom(iotest.HalfReader(&payments))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.ImportFavoritesFrom(&favorites)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2.Service)
+}
+
+func TestService_ExportTo_sameAsExport(t *testing.T) {
+	s, err := generateTestData(10)
+	if err != nil {
+		t.Errorf("Error generate TEST data: %v", err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s.ExportPayments(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	file, err := os.ReadFile(dir + "/payments.dump")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	err = s.ExportPaymentsTo(&buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if buf.String() != string(file) {
+		t.Errorf("ExportPaymentsTo(): differs from ExportPayments():\n%v\n%v", buf.String(), string(file))
+	}
+}
+
+func TestService_ImportPaymentsFrom_corrupted(t *testing.T) {
+	s1, err := generateTestData(10)
+	if err != nil {
+		t.Errorf("Error generate TEST data: %v", err)
+		return
+	}
+
+	buf := bytes.Buffer{}
+	err = s1.ExportPaymentsTo(&buf)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the last payment is lost, the rest of the dump is fine
+	truncated := buf.String()[:strings.LastIndex(buf.String(), "\n")]
+	s2 := newTestService()
+	err = s2.ImportPaymentsFrom(strings.NewReader(truncated))
+	if !errors.Is(err, ErrCorruptedDump) {
+		t.Errorf("ImportPaymentsFrom(): must return ErrCorruptedDump, returned = %v", err)
+	}
+}
+
+func TestService_ImportFromFile_streaming(t *testing.T) {
+	s1, err := generateTestData(1)
+	if err != nil {
+		t.Errorf("Error generate TEST data: %v", err)
+		return
+	}
+	_, err = s1.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	path := t.TempDir() + "/export.txt"
+	err = s1.ExportToFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	err = s2.ImportFromFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	accounts1, _ := s1.accounts.All()
+	accounts2, _ := s2.accounts.All()
+	if len(accounts1) != len(accounts2) {
+		t.Errorf("ImportFromFile(): accounts expected:%v, actual:%v", len(accounts1), len(accounts2))
+		return
+	}
+	for i := range accounts1 {
+		if accounts1[i].Balance != accounts2[i].Balance || accounts1[i].Phone != accounts2[i].Phone {
+			t.Errorf("ImportFromFile(): account expected:%v, actual:%v", accounts1[i], accounts2[i])
+		}
+	}
+}
+
+// benchmarkDumpDir writes the dumps of a service with n payments
+func benchmarkDumpDir(b *testing.B, n int) string {
+	s, err := NewService(NewMemoryStorage())
+	if err != nil {
+		b.Fatal(err)
+	}
+	account, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		b.Fatal(err)
+	}
+	// payments are written straight to the storage, Pay would take too long
+	for i := 0; i < n; i++ {
+		payment := types.Payment{
+			ID:        strconv.Itoa(i),
+			AccountID: account.ID,
+			Amount:    1,
+			Category:  "auto",
+			Status:    types.PaymentStatusOk,
+		}
+		err = s.payments.Save(&payment)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	dir := b.TempDir()
+	err = s.Export(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	err = s.ExportToFile(dir + "/export.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return dir
+}
+
+func BenchmarkService_ImportPayments(b *testing.B) {
+	dir := benchmarkDumpDir(b, 100_000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newTestService()
+		err := s.ImportPayments(dir)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkService_ImportPayments_readFile is the import as it was
+// before streaming: the whole file is read and split in memory
+func BenchmarkService_ImportPayments_readFile(b *testing.B) {
+	dir := benchmarkDumpDir(b, 100_000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newTestService()
+		content, err := os.ReadFile(dir + "/payments.dump")
+		if err != nil {
+			b.Fatal(err)
+		}
+		lines := strings.Split(string(content), "\n")
+		for _, line := range lines[1:] {
+			payment, err := parsePayment(line, dumpSchema)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = s.save(batch{payments: []*types.Payment{&payment}})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkService_ExportPaymentsTo(b *testing.B) {
+	dir := benchmarkDumpDir(b, 100_000)
+	s := newTestService()
+	err := s.ImportPayments(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = s.ExportPaymentsTo(io.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkService_ExportPayments_lines is the export as it was before
+// streaming: every line is kept until the file is written
+func BenchmarkService_ExportPayments_lines(b *testing.B) {
+	dir := benchmarkDumpDir(b, 100_000)
+	s := newTestService()
+	err := s.ImportPayments(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		payments, err := s.payments.All()
+		if err != nil {
+			b.Fatal(err)
+		}
+		lines := make([]string, len(payments))
+		for i, v := range payments {
+			lines[i] = formatPayment(v)
+		}
+		_, err = io.WriteString(io.Discard, strings.Join(lines, "\n"))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkService_ImportFromFile(b *testing.B) {
+	dir := benchmarkDumpDir(b, 0)
+	content := strings.Repeat("|1;+992000000001;100", 100_000)[1:]
+	err := os.WriteFile(dir+"/export.txt", []byte(content), 0666)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newTestService()
+		err := s.ImportFromFile(dir + "/export.txt")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkService_ImportFromFile_fourBytes reads the file like ImportFromFile
+// did before streaming, 4 bytes at a time into one growing buffer
+func BenchmarkService_ImportFromFile_fourBytes(b *testing.B) {
+	dir := benchmarkDumpDir(b, 0)
+	content := strings.Repeat("|1;+992000000001;100", 100_000)[1:]
+	err := os.WriteFile(dir+"/export.txt", []byte(content), 0666)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(dir + "/export.txt")
+		if err != nil {
+			b.Fatal(err)
+		}
+		data := make([]byte, 0)
+		buf := make([]byte, 4)
+		for {
+			read, err := file.Read(buf)
+			data = append(data, buf[:read]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		closeFile(file)
+
+		s := newTestService()
+		for _, v := range strings.Split(string(data), "|") {
+			rec := strings.Split(v, ";")
+			id, _ := strconv.ParseInt(rec[0], 10, 64)
+			balance, _ := strconv.ParseInt(rec[2], 10, 64)
+			err = s.importAccount(types.Account{ID: id, Phone: types.Phone(rec[1]), Balance: types.Money(balance)})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,465 @@
+package wallet
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Tursunkhuja/wallet/pkg/types"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportProblem is one thing wrong with a dump file
+type ImportProblem struct {
+	File    string
+	Line    int // 0 when the problem is with the whole file
+	Message string
+
+	err error // the cause, so that ImportError matches it with errors.Is
+}
+
+func (p ImportProblem) String() string {
+	if p.File == "" {
+		return p.Message
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("%v: %v", p.File, p.Message)
+	}
+	return fmt.Sprintf("%v:%v: %v", p.File, p.Line, p.Message)
+}
+
+// ImportReport is the result of checking the dumps of a directory
+type ImportReport struct {
+	Accounts  int // records read
+	Payments  int
+	Favorites int
+	Postings  int
+	Holds     int
+	Problems  []ImportProblem
+}
+
+// Err returns nil if there are no problems and an *ImportError otherwise
+func (r *ImportReport) Err() error {
+	if len(r.Problems) == 0 {
+		return nil
+	}
+	return &ImportError{Problems: r.Problems}
+}
+
+// ImportError lists every problem that stopped an import. errors.Is reports
+// true for ErrInvalidImport and for the causes of the problems, e.g.
+// ErrCorruptedDump or ErrAccountNotFound.
+type ImportError struct {
+	Problems []ImportProblem
+}
+
+func (e *ImportError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = problem.String()
+	}
+	return fmt.Sprintf("%v: %v problems: %v", ErrInvalidImport, len(problems), strings.Join(problems, "; "))
+}
+
+func (e *ImportError) Is(target error) bool {
+	if target == ErrInvalidImport {
+		return true
+	}
+	for _, problem := range e.Problems {
+		if problem.err != nil && errors.Is(problem.err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateImport is a dry run of Import: it reads the dumps of dir and
+// reports every problem with them, without changing the service. The dumps
+// are checked together and against the accounts the service already has.
+// The error is only for failures to read the files.
+func (s *Service) ValidateImport(dir string) (*ImportReport, error) {
+	s.ready()
+	return s.validateImport(dir, ConflictOverwrite, "ledger.dump", "accounts.dump", "payments.dump", "favorites.dump", "holds.dump")
+}
+
+// importValidator collects the problems of the dump files, the records seen
+// so far are kept by ID to find duplicates and dangling references
+type importValidator struct {
+	s          *Service
+	policy     ConflictPolicy // ConflictFail makes the existing records that differ a problem
+	report     *ImportReport
+	accounts   map[int64]int // ID -> line
+	currencies map[int64]types.Currency
+	phones     map[types.Phone]int64
+	newPhones  []types.Phone // in the order of the file
+	payments   map[string]int
+	favorites  map[string]int
+	holds      map[string]int
+	entries    map[string]*entryCheck
+	entryOrder []string
+}
+
+// entryCheck sums the postings of a ledger entry by currency
+type entryCheck struct {
+	line int // of the first posting
+	sum  Totals
+}
+
+func (s *Service) newImportValidator(policy ConflictPolicy) *importValidator {
+	return &importValidator{
+		s:          s,
+		policy:     policy,
+		report:     &ImportReport{},
+		accounts:   map[int64]int{},
+		currencies: map[int64]types.Currency{},
+		phones:     map[types.Phone]int64{},
+		payments:   map[string]int{},
+		favorites:  map[string]int{},
+		holds:      map[string]int{},
+		entries:    map[string]*entryCheck{},
+	}
+}
+
+func (s *Service) validateImport(dir string, policy ConflictPolicy, files ...string) (*ImportReport, error) {
+	v := s.newImportValidator(policy)
+
+	// accounts go first, the other files refer to them
+	checks := []struct {
+		file  string
+		check func(path string, schema int, number int, line string)
+	}{
+		{"accounts.dump", v.checkAccount},
+		{"payments.dump", v.checkPayment},
+		{"favorites.dump", v.checkFavorite},
+		{"holds.dump", v.checkHold},
+		{"ledger.dump", v.checkPosting},
+	}
+	for _, check := range checks {
+		if !contains(files, check.file) {
+			continue
+		}
+
+		path := dir + "/" + check.file
+		err := v.checkFile(path, check.check)
+		if err != nil {
+			return nil, err
+		}
+		if check.file == "accounts.dump" {
+			v.checkPhonesOfService(path)
+		}
+		if check.file == "ledger.dump" {
+			v.checkEntries(path)
+		}
+	}
+	return v.report, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *importValidator) problem(path string, number int, err error, format string, args ...interface{}) {
+	v.report.Problems = append(v.report.Problems, ImportProblem{
+		File:    path,
+		Line:    number,
+		Message: fmt.Sprintf(format, args...),
+		err:     err,
+	})
+}
+
+// checkFile reads the file line by line, a problem with the dump itself,
+// like a checksum mismatch, is reported for the whole file
+func (v *importValidator) checkFile(path string, check func(path string, schema int, number int, line string)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeFile(file)
+
+	err = scanDump(path, file, func(schema int, number int, line string) error {
+		check(path, schema, number, line)
+		return nil
+	})
+	if err != nil {
+		v.problem(path, 0, err, "%v", strings.TrimPrefix(err.Error(), path+": "))
+	}
+	return nil
+}
+
+// accountCurrency returns the currency of the account of the dump or of the service
+func (v *importValidator) accountCurrency(id int64) (types.Currency, bool) {
+	if currency, ok := v.currencies[id]; ok {
+		return currency, true
+	}
+	account, err := v.s.accounts.FindByID(id)
+	if err != nil {
+		return "", false
+	}
+	return currencyOrDefault(account.Currency), true
+}
+
+func (v *importValidator) checkAccount(path string, schema int, number int, line string) {
+	account, err := parseAccount(line, schema)
+	if err != nil {
+		v.report.Accounts++
+		v.problem(path, number, err, "%v", err)
+		return
+	}
+	v.checkAccountRecord(path, number, account)
+}
+
+// checkAccountRecord checks an account read from any format, path and number
+// say where it is
+func (v *importValidator) checkAccountRecord(path string, number int, account types.Account) {
+	v.report.Accounts++
+
+	if account.ID <= 0 {
+		v.problem(path, number, nil, "account ID %v must be positive", account.ID)
+	}
+	if first, ok := v.accounts[account.ID]; ok {
+		v.problem(path, number, nil, "duplicate account ID %v, first on line %v", account.ID, first)
+	} else {
+		v.accounts[account.ID] = number
+		v.currencies[account.ID] = account.Currency
+	}
+	if checkCurrency(account.Currency) != nil {
+		v.problem(path, number, ErrUnknownCurrency, "unknown currency %q", account.Currency)
+	}
+	// the payments of an account are in its currency, so it never changes
+	existing, err := v.s.accounts.FindByID(account.ID)
+	if err == nil && currencyOrDefault(existing.Currency) != account.Currency {
+		v.problem(path, number, ErrCurrencyMismatch, "account %v is in %v, not %v", account.ID, currencyOrDefault(existing.Currency), account.Currency)
+	}
+	if id, ok := v.phones[account.Phone]; ok && id != account.ID {
+		v.problem(path, number, ErrPhoneRegistered, "phone %v is already used by account %v", account.Phone, id)
+	} else if !ok {
+		v.phones[account.Phone] = account.ID
+		v.newPhones = append(v.newPhones, account.Phone)
+	}
+	if account.Balance < 0 {
+		v.problem(path, number, nil, "negative balance %v", account.Balance)
+	}
+	if v.policy == ConflictFail {
+		existing, err := v.s.accounts.FindByID(account.ID)
+		if err == nil && formatAccount(*existing) != formatAccount(account) {
+			v.problem(path, number, ErrImportConflict, "account %v differs from the existing one", account.ID)
+		}
+	}
+}
+
+// checkPhonesOfService finds the phones of the dump that belong to other
+// accounts of the service, unless the dump gives those accounts new phones
+func (v *importValidator) checkPhonesOfService(path string) {
+	for _, phone := range v.newPhones {
+		id := v.phones[phone]
+		account, err := v.s.accounts.FindByPhone(phone)
+		if err != nil || account.ID == id {
+			continue
+		}
+		if _, ok := v.accounts[account.ID]; ok {
+			continue
+		}
+		v.problem(path, v.accounts[id], ErrPhoneRegistered, "phone %v is already used by account %v", phone, account.ID)
+	}
+}
+
+func (v *importValidator) checkPayment(path string, schema int, number int, line string) {
+	payment, err := parsePayment(line, schema)
+	if err != nil {
+		v.report.Payments++
+		v.problem(path, number, err, "%v", err)
+		return
+	}
+	v.checkPaymentRecord(path, number, payment)
+}
+
+func (v *importValidator) checkPaymentRecord(path string, number int, payment types.Payment) {
+	v.report.Payments++
+
+	if payment.ID == "" {
+		v.problem(path, number, nil, "payment without ID")
+	} else if first, ok := v.payments[payment.ID]; ok {
+		v.problem(path, number, nil, "duplicate payment ID %v, first on line %v", payment.ID, first)
+	} else {
+		v.payments[payment.ID] = number
+	}
+	if !validPaymentStatus(payment.Status) {
+		v.problem(path, number, nil, "unknown status %q", payment.Status)
+	}
+	if payment.Amount <= 0 {
+		v.problem(path, number, ErrAmountMustBePositive, "amount %v must be positive", payment.Amount)
+	}
+	if currency, ok := v.accountCurrency(payment.AccountID); !ok {
+		v.problem(path, number, ErrAccountNotFound, "unknown account %v", payment.AccountID)
+	} else if currency != payment.Currency {
+		v.problem(path, number, ErrCurrencyMismatch, "payment in %v from account %v in %v", payment.Currency, payment.AccountID, currency)
+	}
+	if payment.ToAccountID != 0 {
+		if payment.ToAccountID == payment.AccountID {
+			v.problem(path, number, ErrTransferToSameAccount, "transfer to the same account %v", payment.AccountID)
+		} else if currency, ok := v.accountCurrency(payment.ToAccountID); !ok {
+			v.problem(path, number, ErrAccountNotFound, "unknown recipient account %v", payment.ToAccountID)
+		} else if currency != payment.Currency {
+			v.problem(path, number, ErrCurrencyMismatch, "transfer in %v to account %v in %v", payment.Currency, payment.ToAccountID, currency)
+		}
+	}
+	if payment.OriginalCurrency != "" {
+		v.checkConversion(path, number, payment)
+	}
+	if payment.Refunded < 0 || payment.Refunded > payment.Amount {
+		v.problem(path, number, ErrRefundTooLarge, "refunded %v of a payment of %v", payment.Refunded, payment.Amount)
+	}
+	if payment.RefundOf != "" && (payment.Refunded != 0 || payment.ToAccountID != 0) {
+		v.problem(path, number, nil, "refund of %v can't be refunded or a transfer", payment.RefundOf)
+	}
+	if v.policy == ConflictFail {
+		existing, err := v.s.payments.FindByID(payment.ID)
+		if err == nil && formatPayment(*existing) != formatPayment(payment) {
+			v.problem(path, number, ErrImportConflict, "payment %v differs from the existing one", payment.ID)
+		}
+	}
+}
+
+// checkConversion checks the original amount, currency and rate of a converted payment
+func (v *importValidator) checkConversion(path string, number int, payment types.Payment) {
+	if checkCurrency(payment.OriginalCurrency) != nil {
+		v.problem(path, number, ErrUnknownCurrency, "unknown original currency %q", payment.OriginalCurrency)
+	}
+	if payment.OriginalAmount <= 0 {
+		v.problem(path, number, ErrAmountMustBePositive, "original amount %v must be positive", payment.OriginalAmount)
+	}
+	if _, err := ParseRate(payment.Rate); err != nil {
+		v.problem(path, number, nil, "%v", err)
+	}
+}
+
+func (v *importValidator) checkFavorite(path string, schema int, number int, line string) {
+	favorite, err := parseFavorite(line, schema)
+	if err != nil {
+		v.report.Favorites++
+		v.problem(path, number, err, "%v", err)
+		return
+	}
+	v.checkFavoriteRecord(path, number, favorite)
+}
+
+func (v *importValidator) checkFavoriteRecord(path string, number int, favorite types.Favorite) {
+	v.report.Favorites++
+
+	if favorite.ID == "" {
+		v.problem(path, number, nil, "favorite without ID")
+	} else if first, ok := v.favorites[favorite.ID]; ok {
+		v.problem(path, number, nil, "duplicate favorite ID %v, first on line %v", favorite.ID, first)
+	} else {
+		v.favorites[favorite.ID] = number
+	}
+	if favorite.Amount <= 0 {
+		v.problem(path, number, ErrAmountMustBePositive, "amount %v must be positive", favorite.Amount)
+	}
+	if _, ok := v.accountCurrency(favorite.AccountID); !ok {
+		v.problem(path, number, ErrAccountNotFound, "unknown account %v", favorite.AccountID)
+	}
+	// a favorite of a converted payment is in another currency than the account
+	if checkCurrency(favorite.Currency) != nil {
+		v.problem(path, number, ErrUnknownCurrency, "unknown currency %q", favorite.Currency)
+	}
+	if v.policy == ConflictFail {
+		existing, err := v.s.favorites.FindByID(favorite.ID)
+		if err == nil && formatFavorite(*existing) != formatFavorite(favorite) {
+			v.problem(path, number, ErrImportConflict, "favorite %v differs from the existing one", favorite.ID)
+		}
+	}
+}
+
+func (v *importValidator) checkHold(path string, schema int, number int, line string) {
+	v.report.Holds++
+
+	hold, err := parseHold(line, schema)
+	if err != nil {
+		v.problem(path, number, err, "%v", err)
+		return
+	}
+
+	if hold.ID == "" {
+		v.problem(path, number, nil, "hold without ID")
+	} else if first, ok := v.holds[hold.ID]; ok {
+		v.problem(path, number, nil, "duplicate hold ID %v, first on line %v", hold.ID, first)
+	} else {
+		v.holds[hold.ID] = number
+	}
+	if !validHoldStatus(hold.Status) {
+		v.problem(path, number, nil, "unknown status %q", hold.Status)
+	}
+	if hold.Amount <= 0 {
+		v.problem(path, number, ErrAmountMustBePositive, "amount %v must be positive", hold.Amount)
+	}
+	if hold.Captured < 0 || hold.Captured > hold.Amount {
+		v.problem(path, number, ErrCaptureTooLarge, "captured %v of a hold of %v", hold.Captured, hold.Amount)
+	}
+	if currency, ok := v.accountCurrency(hold.AccountID); !ok {
+		v.problem(path, number, ErrAccountNotFound, "unknown account %v", hold.AccountID)
+	} else if currency != hold.Currency {
+		v.problem(path, number, ErrCurrencyMismatch, "hold in %v on account %v in %v", hold.Currency, hold.AccountID, currency)
+	}
+	if v.policy == ConflictFail {
+		existing, ok := v.s.holds.find(hold.ID)
+		if ok && formatHold(*existing) != formatHold(hold) {
+			v.problem(path, number, ErrImportConflict, "hold %v differs from the existing one", hold.ID)
+		}
+	}
+}
+
+func (v *importValidator) checkPosting(path string, schema int, number int, line string) {
+	v.report.Postings++
+
+	posting, err := parsePosting(line, schema)
+	if err != nil {
+		v.problem(path, number, err, "%v", err)
+		return
+	}
+
+	if posting.EntryID == "" {
+		v.problem(path, number, nil, "posting without entry ID")
+		return
+	}
+	if posting.Account == "" {
+		v.problem(path, number, nil, "posting without account")
+	}
+	if checkCurrency(posting.Currency) != nil {
+		v.problem(path, number, ErrUnknownCurrency, "unknown currency %q", posting.Currency)
+		return
+	}
+
+	entry, ok := v.entries[posting.EntryID]
+	if !ok {
+		entry = &entryCheck{line: number, sum: Totals{}}
+		v.entries[posting.EntryID] = entry
+		v.entryOrder = append(v.entryOrder, posting.EntryID)
+	}
+	err = entry.sum.add(posting.Currency, posting.Amount)
+	if err != nil {
+		v.problem(path, number, err, "entry %v: %v", posting.EntryID, err)
+	}
+}
+
+// checkEntries reports the entries whose postings don't sum to zero
+func (v *importValidator) checkEntries(path string) {
+	for _, id := range v.entryOrder {
+		entry := v.entries[id]
+		for _, currency := range entry.sum.currencies() {
+			if amount := entry.sum[currency]; amount != 0 {
+				v.problem(path, entry.line, ErrLedgerUnbalanced, "entry %v is off by %v", id, amount.Format(currency))
+			}
+		}
+	}
+}
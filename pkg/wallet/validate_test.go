@@ -0,0 +1,207 @@
+package wallet
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func writeDumps(dir string, dumps map[string]string) error {
+	for name, content := range dumps {
+		err := os.WriteFile(dir+"/"+name, []byte(content), 0666)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestService_ValidateImport_problems(t *testing.T) {
+	dir := t.TempDir()
+	err := writeDumps(dir, map[string]string{
+		"accounts.dump": "1;+992000000001;100\n" +
+			"1;+992000000002;100\n" +
+			"2;+992000000001;-5\n" +
+			"3;+992000000003",
+		"payments.dump": "p1;1;10;auto;OK\n" +
+			"p1;1;10;auto;OK\n" +
+			"p2;7;10;auto;DONE\n" +
+			"p3;1;10;transfer;OK;1\n" +
+			"p4;1",
+		"favorites.dump": "f1;8;lunch;10;food\n" +
+			"f2;1;lunch;0;food",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := newTestService()
+	report, err := s.ValidateImport(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	accounts, payments, favorites := dir+"/accounts.dump", dir+"/payments.dump", dir+"/favorites.dump"
+	expected := []string{
+		accounts + ":2: duplicate account ID 1, first on line 1",
+		accounts + ":3: phone +992000000001 is already used by account 1",
+		accounts + ":3: negative balance -5",
+		accounts + ":4: account: expected 3, 5 or 6 fields in schema 1, got 2",
+		payments + ":2: duplicate payment ID p1, first on line 1",
+		payments + ":3: unknown status \"DONE\"",
+		payments + ":3: unknown account 7",
+		payments + ":4: transfer to the same account 1",
+		payments + ":5: payment: expected 5, 6, 8, 9, 12 or 14 fields in schema 1, got 2",
+		favorites + ":1: unknown account 8",
+		favorites + ":2: amount 0 must be positive",
+	}
+	got := make([]string, len(report.Problems))
+	for i, problem := range report.Problems {
+		got[i] = problem.String()
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ValidateImport(): problems\n%v\nexpected\n%v", got, expected)
+	}
+	if report.Accounts != 4 || report.Payments != 5 || report.Favorites != 2 {
+		t.Errorf("ValidateImport(): wrong counts %v %v %v", report.Accounts, report.Payments, report.Favorites)
+	}
+
+	// nothing of it is imported
+	err = s.Import(dir)
+	if !errors.Is(err, ErrInvalidImport) || !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Import(): must return ErrInvalidImport, returned = %v", err)
+	}
+	if _, err := s.FindAccountByID(1); err != ErrAccountNotFound {
+		t.Errorf("Import(): invalid dumps must not be imported, error = %v", err)
+	}
+}
+
+func TestService_ValidateImport_valid(t *testing.T) {
+	s1, err := NewService(NewMemoryStorage())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = s1.Export(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2 := newTestService()
+	report, err := s2.ValidateImport(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if report.Err() != nil {
+		t.Errorf("ValidateImport(): problems in a valid export: %v", report.Err())
+	}
+
+	accounts, _ := s1.accounts.All()
+	payments, _ := s1.payments.All()
+	if report.Accounts != len(accounts) || report.Payments != len(payments) {
+		t.Errorf("ValidateImport(): wrong counts %v %v", report.Accounts, report.Payments)
+	}
+
+	// a dry run changes nothing
+	got, _ := s2.accounts.All()
+	if len(got) != 0 {
+		t.Errorf("ValidateImport(): accounts were imported")
+	}
+}
+
+func TestService_ImportPayments_checked(t *testing.T) {
+	s := newTestService()
+	account, _, err := s.addAccount(defultTestAccount)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = writeDumps(dir, map[string]string{"payments.dump": "p1;1;10;auto;OK\np2;1"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a short line used to panic
+	err = s.ImportPayments(dir)
+	if !errors.Is(err, ErrInvalidImport) {
+		t.Errorf("ImportPayments(): must return ErrInvalidImport, returned = %v", err)
+	}
+	if _, err := s.FindPaymentByID("p1"); err != ErrPaymentNotFound {
+		t.Errorf("ImportPayments(): the payments before the bad line must not be imported, error = %v", err)
+	}
+
+	// the accounts of the service count for the references
+	err = writeDumps(dir, map[string]string{"payments.dump": "p1;1;10;auto;OK"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportPayments(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := s.FindPaymentByID("p1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.AccountID != account.ID {
+		t.Errorf("ImportPayments(): wrong payment %v", got)
+	}
+}
+
+func TestService_ImportAccounts_phoneOfService(t *testing.T) {
+	s := newTestService()
+	_, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dir := t.TempDir()
+	err = writeDumps(dir, map[string]string{"accounts.dump": "2;+992000000001;0"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportAccounts(dir)
+	if !errors.Is(err, ErrPhoneRegistered) {
+		t.Errorf("ImportAccounts(): must return ErrPhoneRegistered, returned = %v", err)
+	}
+
+	// unless the dump moves the service account to another phone
+	err = writeDumps(dir, map[string]string{"accounts.dump": "2;+992000000001;0\n1;+992000000002;0"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.ImportAccounts(dir)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	got, err := s.accounts.FindByPhone("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.ID != 2 {
+		t.Errorf("ImportAccounts(): phone belongs to account %v, expected 2", got.ID)
+	}
+}
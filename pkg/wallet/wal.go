@@ -0,0 +1,334 @@
+package wallet
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The write-ahead log keeps every change made since the last snapshot. Each
+// operation is one entry: its records in the .dump line format,
+// prefixed with the kind of the record, and a commit line at the end
+//
+//	A;<accounts.dump line>
+//	P;<payments.dump line>
+//	F;<favorites.dump line>
+//	K;<idempotency.dump line>
+//	L;<ledger.dump line>
+//	H;<holds.dump line>
+//	C
+//
+// An entry counts only once its commit line is on disk, so a torn tail left
+// by a crash is dropped on replay. The snapshot is the usual dump files.
+//
+// The log starts with a header that names the schema of its records
+//
+//	#wallet-log schema=6
+//
+// logs written before the header have records of schemaRefunds.
+
+const logFileName = "wallet.log"
+
+const logHeaderPrefix = "#wallet-log"
+
+type writeAheadLog struct {
+	mu            sync.Mutex // serializes appends, applies and snapshots
+	dir           string
+	file          *os.File
+	entries       int // since the last snapshot
+	snapshotEvery int
+}
+
+// WithLog makes the service durable: it restores the snapshot and replays the
+// log found in dir, then appends every change to the log before applying it.
+// After snapshotEvery entries the state is written to a new snapshot and the
+// log starts over, zero or less turns the automatic snapshots off.
+func WithLog(dir string, snapshotEvery int) Option {
+	return func(s *Service) {
+		s.log = &writeAheadLog{dir: dir, snapshotEvery: snapshotEvery}
+	}
+}
+
+func (l *writeAheadLog) path() string {
+	return l.dir + "/" + logFileName
+}
+
+// append writes the entry and waits until it is on disk
+func (l *writeAheadLog) append(b batch) error {
+	buf := bytes.Buffer{}
+	for _, v := range b.accounts {
+		buf.WriteString("A;" + formatAccount(*v) + "\n")
+	}
+	for _, v := range b.payments {
+		buf.WriteString("P;" + formatPayment(*v) + "\n")
+	}
+	for _, v := range b.favorites {
+		buf.WriteString("F;" + formatFavorite(*v) + "\n")
+	}
+	for _, v := range b.keys {
+		buf.WriteString("K;" + formatIdempotencyEntry(*v) + "\n")
+	}
+	for _, v := range b.postings {
+		buf.WriteString("L;" + formatPosting(v) + "\n")
+	}
+	for _, v := range b.holds {
+		buf.WriteString("H;" + formatHold(*v) + "\n")
+	}
+	buf.WriteString("C\n")
+
+	_, err := l.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// openLog restores the service from dir and opens the log for appending,
+// it runs before the service is used so nothing is logged meanwhile
+func (s *Service) openLog() error {
+	l := s.log
+	s.log = nil
+
+	err := s.Import(l.dir)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(l.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	valid, schema, err := s.replayLog(content)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(l.path(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	// cut the torn tail off so that new entries follow the last complete one
+	err = file.Truncate(int64(valid))
+	if err == nil {
+		_, err = file.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		closeFile(file)
+		return err
+	}
+
+	l.file = file
+	s.log = l
+
+	// new entries must not follow records of another schema, the ones of an
+	// older log go to a snapshot first
+	if schema == dumpSchema {
+		return nil
+	}
+	if valid > 0 {
+		return s.snapshot()
+	}
+	return l.restart()
+}
+
+// restart empties the log and writes its header
+func (l *writeAheadLog) restart() error {
+	err := l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(l.file, "%v schema=%v\n", logHeaderPrefix, dumpSchema)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// logSchema reads the header of the log, it returns the schema, zero for a
+// log without a header, and the length of the header
+func logSchema(content []byte) (int, int, error) {
+	if !bytes.HasPrefix(content, []byte(logHeaderPrefix)) {
+		return 0, 0, nil
+	}
+	end := bytes.IndexByte(content, '\n')
+	if end < 0 {
+		return 0, 0, nil // a torn header, nothing follows it
+	}
+	schema := 0
+	_, err := fmt.Sscanf(string(content[:end]), logHeaderPrefix+" schema=%d", &schema)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%v: bad header %q", logFileName, content[:end])
+	}
+	if schema > dumpSchema {
+		return 0, 0, fmt.Errorf("%v: schema %v is newer than the supported %v", logFileName, schema, dumpSchema)
+	}
+	return schema, end + 1, nil
+}
+
+// replayLog applies the complete entries and returns the length they take
+// with the header and the schema of the log
+func (s *Service) replayLog(content []byte) (int, int, error) {
+	schema, valid, err := logSchema(content)
+	if err != nil {
+		return 0, 0, err
+	}
+	recordSchema := schema
+	if schema == 0 {
+		recordSchema = schemaRefunds
+	}
+
+	offset := valid
+	records := []string{}
+	for offset < len(content) {
+		end := bytes.IndexByte(content[offset:], '\n')
+		if end < 0 {
+			break // the last line was not written completely
+		}
+		line := string(content[offset : offset+end])
+		offset += end + 1
+
+		if line != "C" {
+			records = append(records, line)
+			continue
+		}
+
+		b, err := parseLogEntry(records, recordSchema)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%v at byte %v: %w", logFileName, valid, err)
+		}
+		err = s.apply(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		records = records[:0]
+		valid = offset
+	}
+	return valid, schema, nil
+}
+
+func parseLogEntry(records []string, schema int) (batch, error) {
+	b := batch{}
+	for _, record := range records {
+		kind, line := record, ""
+		if i := strings.IndexByte(record, ';'); i >= 0 {
+			kind, line = record[:i], record[i+1:]
+		}
+
+		switch kind {
+		case "A":
+			account, err := parseAccount(line, schema)
+			if err != nil {
+				return batch{}, err
+			}
+			b.accounts = append(b.accounts, &account)
+		case "P":
+			payment, err := parsePayment(line, schema)
+			if err != nil {
+				return batch{}, err
+			}
+			b.payments = append(b.payments, &payment)
+		case "F":
+			favorite, err := parseFavorite(line, schema)
+			if err != nil {
+				return batch{}, err
+			}
+			b.favorites = append(b.favorites, &favorite)
+		case "K":
+			entry, err := parseIdempotencyEntry(line)
+			if err != nil {
+				return batch{}, err
+			}
+			b.keys = append(b.keys, entry)
+		case "L":
+			posting, err := parsePosting(line, schema)
+			if err != nil {
+				return batch{}, err
+			}
+			b.postings = append(b.postings, posting)
+		case "H":
+			hold, err := parseHold(line, schema)
+			if err != nil {
+				return batch{}, err
+			}
+			b.holds = append(b.holds, &hold)
+		default:
+			return batch{}, fmt.Errorf("unknown record %q", record)
+		}
+	}
+	return b, nil
+}
+
+// Snapshot writes the current state to the dump files in the log directory
+// and empties the log
+func (s *Service) Snapshot() error {
+	s.ready()
+	if s.log == nil {
+		return nil
+	}
+
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	return s.snapshot()
+}
+
+// snapshot must be called with s.log.mu held. Every dump file is replaced
+// atomically, and the log is emptied only after all of them are written:
+// replaying the whole log over any mix of old and new dumps gives the same state.
+func (s *Service) snapshot() error {
+	dumps := []struct {
+		name  string
+		write func(w io.Writer) error
+	}{
+		{"ledger.dump", s.ExportLedgerTo},
+		{"accounts.dump", s.ExportAccountsTo},
+		{"payments.dump", s.ExportPaymentsTo},
+		{"favorites.dump", s.ExportFavoritesTo},
+		{"idempotency.dump", s.exportIdempotencyKeysTo},
+		{"holds.dump", s.ExportHoldsTo},
+	}
+	for _, dump := range dumps {
+		err := writeFileAtomicFunc(s.log.dir+"/"+dump.name, dump.write)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.log.restart()
+	if err != nil {
+		return err
+	}
+
+	s.log.entries = 0
+	return nil
+}
+
+// Close closes the log and the audit log, the service must not be changed
+// afterwards
+func (s *Service) Close() error {
+	s.ready()
+	if s.audit != nil {
+		err := s.audit.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.log == nil {
+		return nil
+	}
+
+	s.log.mu.Lock()
+	defer s.log.mu.Unlock()
+
+	return s.log.file.Close()
+}
@@ -0,0 +1,407 @@
+package wallet
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// compareServices reports the difference between the records of two services
+func compareServices(t *testing.T, s1 *Service, s2 *Service) {
+	accounts1, _ := s1.accounts.All()
+	accounts2, _ := s2.accounts.All()
+	if !reflect.DeepEqual(accounts1, accounts2) {
+		t.Errorf("accounts differ: %v and %v", accounts1, accounts2)
+	}
+
+	payments1, _ := s1.payments.All()
+	payments2, _ := s2.payments.All()
+	if !reflect.DeepEqual(payments1, payments2) {
+		t.Errorf("payments differ: %v and %v", payments1, payments2)
+	}
+
+	favorites1, _ := s1.favorites.All()
+	favorites2, _ := s2.favorites.All()
+	if !reflect.DeepEqual(favorites1, favorites2) {
+		t.Errorf("favorites differ: %v and %v", favorites1, favorites2)
+	}
+
+	holds1, holds2 := s1.holds.all(), s2.holds.all()
+	if !reflect.DeepEqual(holds1, holds2) {
+		t.Errorf("holds differ: %v and %v", holds1, holds2)
+	}
+}
+
+// fillLoggedService runs a bit of every kind of operation
+func fillLoggedService(s *Service) error {
+	ts := &testService{Service: s}
+	account, payments, err := ts.addAccount(defultTestAccount)
+	if err != nil {
+		return err
+	}
+
+	other, err := s.RegisterAccount("+992000000001")
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Transfer(account.ID, other.ID, 100)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.FavoritePayment(payments[0].ID, "auto")
+	if err != nil {
+		return err
+	}
+
+	err = s.Reject(payments[0].ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.PayIdempotent("key", account.ID, 10, "auto")
+	return err
+}
+
+func TestService_WithLog_replay(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// nothing but the log is on disk
+	_, err = os.Stat(dir + "/accounts.dump")
+	if !os.IsNotExist(err) {
+		t.Errorf("snapshot must not be written, stat error = %v", err)
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s2.Close()
+
+	compareServices(t, s1, s2)
+
+	// the idempotency keys are replayed as well
+	history1, _ := s1.ExportAccountHistory(1)
+	_, err = s2.PayIdempotent("key", 1, 10, "auto")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	history2, _ := s2.ExportAccountHistory(1)
+	if len(history1) != len(history2) {
+		t.Errorf("PayIdempotent(): replayed key made a new payment")
+	}
+}
+
+func TestService_WithLog_separators(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s1.RegisterAccount("+992000000001")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Deposit(account.ID, 1_000)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s1.Pay(account.ID, 100, "food;drinks\n%2B")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.FavoritePayment(payment.ID, "lunch;with friends\nand more")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = s1.Authorize(account.ID, 100, "hotel; 2 nights")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// replayed from the log and written to a snapshot, then read from it
+	for _, snapshot := range []bool{true, false} {
+		s2, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		compareServices(t, s1, s2)
+		if snapshot {
+			err = s2.Snapshot()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		err = s2.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestService_WithLog_idempotencyKey(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.RegisterAccount("+992000000001")
+	if err == nil {
+		err = s.Deposit(account.ID, 100)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	payment, err := s.PayIdempotent("key", account.ID, 10, "auto")
+	if err == nil {
+		_, err = s.PayIdempotent("failed", account.ID, 1_000, "auto")
+	}
+	if err != ErrNotEnoughBalance {
+		t.Errorf("PayIdempotent(): must return ErrNotEnoughBalance, returned = %v", err)
+		return
+	}
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	content, err := os.ReadFile(dir + "/" + logFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	entries := strings.Split(string(content), "C\n")
+	// the key is committed together with the payment, a failed request has
+	// an entry of its own
+	last := len(entries) - 3
+	if !strings.Contains(entries[last], "P;"+payment.ID) || !strings.Contains(entries[last], "K;key;") ||
+		!strings.HasPrefix(entries[last+1], "K;failed;") {
+		t.Errorf("log entries: %q", entries)
+	}
+}
+
+func TestService_WithLog_tornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a crash in the middle of an entry leaves records without a commit line
+	file, err := os.OpenFile(dir+"/"+logFileName, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = file.WriteString("A;100;+992000000100;500;;\nP;torn;100;5")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = file.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compareServices(t, s1, s2)
+
+	// new entries go after the last complete one
+	_, err = s2.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s2.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s3, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s3.Close()
+	compareServices(t, s2, s3)
+}
+
+func TestService_WithLog_snapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s1, err := NewService(NewMemoryStorage(), WithLog(dir, 3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = fillLoggedService(s1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the automatic snapshots have already compacted most of the log
+	_, err = os.Stat(dir + "/payments.dump")
+	if err != nil {
+		t.Errorf("snapshot must be written, error = %v", err)
+	}
+	entries := s1.log.entries
+	if entries >= 3 {
+		t.Errorf("log must be compacted, entries = %v", entries)
+	}
+
+	err = s1.Snapshot()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	content, err := os.ReadFile(dir + "/" + logFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(content) != "#wallet-log schema=6\n" {
+		t.Errorf("Snapshot(): log must have only the header, content = %q", content)
+	}
+
+	_, err = s1.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s1.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s2, err := NewService(NewMemoryStorage(), WithLog(dir, 3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s2.Close()
+	compareServices(t, s1, s2)
+}
+
+func TestService_WithLog_legacy(t *testing.T) {
+	dir := t.TempDir()
+
+	// a log written before the header, its records are not escaped
+	log := "A;1;+992000000001;100;;;TJS\nC\n"
+	err := os.WriteFile(dir+"/"+logFileName, []byte(log), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, err := NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	account, err := s.FindAccountByID(1)
+	if err != nil || account.Phone != "+992000000001" {
+		t.Errorf("FindAccountByID(): account %v, error %v", account, err)
+	}
+	_, err = s.RegisterAccount("+992000000002")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = s.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// the old records went to a snapshot, the log has only the new ones
+	content, err := os.ReadFile(dir + "/" + logFileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(content), "#wallet-log schema=6\nA;2;%2B992000000002;") {
+		t.Errorf("log content = %q", content)
+	}
+	s, err = NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer s.Close()
+	accounts, _ := s.accounts.All()
+	if len(accounts) != 2 {
+		t.Errorf("reopened service has %v accounts, expected 2", len(accounts))
+	}
+}
+
+func TestService_WithLog_corrupted(t *testing.T) {
+	dir := t.TempDir()
+
+	err := os.WriteFile(dir+"/"+logFileName, []byte("A;x;+992000000001;0;;\nC\n"), 0666)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = NewService(NewMemoryStorage(), WithLog(dir, 0))
+	if err == nil {
+		t.Errorf("NewService(): must fail on a corrupted committed entry")
+	}
+}